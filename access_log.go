@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotationErrors logs the errors of rotating log files to stderr, rather
+// than the proxy's log, which may be the file being rotated
+var rotationErrors = log.New(os.Stderr, "", log.LstdFlags)
+
+// accessLogBackupFormat is the timestamp suffix of rotated access log files,
+// which sorts them from the oldest
+const accessLogBackupFormat = "20060102T150405.000000000"
+
+// accessLog is the request log file, the audit log file or the proxy's own
+// log file, kept apart from each other. It's reopened on SIGUSR1 so
+// logrotate can move it away, or rotated by the proxy itself once it would
+// grow beyond maxSize bytes, keeping the last maxBackups rotated files, or
+// all of them with 0, and only those rotated within maxAge, when set.
+type accessLog struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+	file       *os.File
+	size       int64
+}
+
+func openAccessLog(path string, maxSize int64, maxBackups int, maxAge time.Duration) (*accessLog, error) {
+	l := &accessLog{path: path, maxSize: maxSize, maxBackups: maxBackups, maxAge: maxAge}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	l.removeBackups()
+	return l, nil
+}
+
+func (l *accessLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+func (l *accessLog) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			rotationErrors.Printf("ERROR: rotating log %s - %s", l.path, err)
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	return n, err
+}
+
+// Reopen closes the access log, and opens the file at its path again
+func (l *accessLog) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file.Close()
+	return l.open()
+}
+
+// rotate moves the access log to a backup named after the time, and starts
+// a new one. The current file is kept when it can't be moved.
+func (l *accessLog) rotate() error {
+	backup := l.path + "." + time.Now().UTC().Format(accessLogBackupFormat)
+	if err := os.Rename(l.path, backup); err != nil {
+		return err
+	}
+	l.file.Close()
+	if err := l.open(); err != nil {
+		return err
+	}
+	l.removeBackups()
+	return nil
+}
+
+// removeBackups removes the oldest rotated files beyond maxBackups, and
+// those rotated longer than maxAge ago
+func (l *accessLog) removeBackups() {
+	if l.maxBackups == 0 && l.maxAge == 0 {
+		return
+	}
+	matches, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return
+	}
+	// files rotated by anything else, ie. logrotate, are left alone
+	var backups []string
+	for _, match := range matches {
+		rotated, err := time.Parse(accessLogBackupFormat, strings.TrimPrefix(match, l.path+"."))
+		if err != nil {
+			continue
+		}
+		if l.maxAge > 0 && time.Since(rotated) > l.maxAge {
+			l.removeBackup(match)
+			continue
+		}
+		backups = append(backups, match)
+	}
+	if l.maxBackups == 0 || len(backups) <= l.maxBackups {
+		return
+	}
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-l.maxBackups] {
+		l.removeBackup(backup)
+	}
+}
+
+func (l *accessLog) removeBackup(backup string) {
+	if err := os.Remove(backup); err != nil {
+		rotationErrors.Printf("ERROR: removing log backup %s - %s", backup, err)
+	}
+}
+
+func (l *accessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// reopenAccessLogOn reopens l for each signal received from signals
+func reopenAccessLogOn(signals <-chan os.Signal, l *accessLog) {
+	for range signals {
+		if err := l.Reopen(); err != nil {
+			rotationErrors.Printf("ERROR: reopening log %s - %s", l.path, err)
+			continue
+		}
+		log.Printf("reopened log %s", l.path)
+	}
+}
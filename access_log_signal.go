@@ -0,0 +1,16 @@
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reopenSignals are the signals that reopen the access and audit logs
+func reopenSignals() <-chan os.Signal {
+	reopen := make(chan os.Signal, 1)
+	signal.Notify(reopen, syscall.SIGUSR1)
+	return reopen
+}
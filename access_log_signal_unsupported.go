@@ -0,0 +1,12 @@
+// +build windows plan9
+
+package main
+
+import (
+	"os"
+)
+
+// reopenSignals is never signalled where there is no SIGUSR1
+func reopenSignals() <-chan os.Signal {
+	return nil
+}
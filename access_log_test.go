@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestAccessLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access_log")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	// rotated by logrotate, which is left alone
+	assert.Equal(t, nil, ioutil.WriteFile(path+".1", []byte("old\n"), 0644))
+
+	l, err := openAccessLog(path, 10, 2, 0)
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	for _, line := range []string{"request 1\n", "request 2\n", "request 3\n", "request 4\n"} {
+		_, err := l.Write([]byte(line))
+		assert.Equal(t, nil, err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "request 4\n", string(b))
+	backups, _ := filepath.Glob(path + ".*")
+	sort.Strings(backups)
+	assert.Equal(t, 3, len(backups))
+	assert.Equal(t, path+".1", backups[0])
+	b, _ = ioutil.ReadFile(backups[2])
+	assert.Equal(t, "request 3\n", string(b))
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access_log")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	l, err := openAccessLog(path, 0, 0, 0)
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	l.Write([]byte("request 1\n"))
+	assert.Equal(t, nil, os.Rename(path, path+".1"))
+	l.Write([]byte("request 2\n"))
+	assert.Equal(t, nil, l.Reopen())
+	l.Write([]byte("request 3\n"))
+
+	b, _ := ioutil.ReadFile(path + ".1")
+	assert.Equal(t, "request 1\nrequest 2\n", string(b))
+	b, _ = ioutil.ReadFile(path)
+	assert.Equal(t, "request 3\n", string(b))
+}
+
+func TestAccessLogMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "access_log")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "oauth2_proxy.log")
+	rotated := func(age time.Duration) string {
+		return path + "." + time.Now().Add(-age).UTC().Format(accessLogBackupFormat)
+	}
+	recent := rotated(time.Hour)
+	for _, backup := range []string{rotated(72 * time.Hour), recent, path + ".1"} {
+		assert.Equal(t, nil, ioutil.WriteFile(backup, []byte("old\n"), 0644))
+	}
+
+	// expired files are removed on opening, and on rotating
+	l, err := openAccessLog(path, 10, 0, 48*time.Hour)
+	assert.Equal(t, nil, err)
+	defer l.Close()
+	backups, _ := filepath.Glob(path + ".*")
+	assert.Equal(t, 2, len(backups))
+	assert.Equal(t, nil, os.Rename(recent, rotated(49*time.Hour)))
+	l.Write([]byte("entry 1\n"))
+	l.Write([]byte("entry 2\n"))
+	backups, _ = filepath.Glob(path + ".*")
+	sort.Strings(backups)
+	assert.Equal(t, 2, len(backups))
+	assert.Equal(t, path+".1", backups[0])
+	b, _ := ioutil.ReadFile(backups[1])
+	assert.Equal(t, "entry 1\n", string(b))
+}
+
+func TestAccessLogOptions(t *testing.T) {
+	o := testOptions()
+	o.AccessLogMaxSize = 100
+	assert.Equal(t, errorMsg([]string{
+		"access_log_max_size and access_log_max_backups are only used with access_log_file"}), o.Validate().Error())
+
+	o = testOptions()
+	o.AccessLogFile = "/var/log/oauth2_proxy/access.log"
+	o.AccessLogMaxBackups = -1
+	assert.Equal(t, errorMsg([]string{
+		"access_log_max_size and access_log_max_backups must not be negative"}), o.Validate().Error())
+
+	o = testOptions()
+	o.LoggingMaxAge = 7
+	assert.Equal(t, errorMsg([]string{
+		"logging_max_size, logging_max_backups and logging_max_age are only used with logging_filename"}), o.Validate().Error())
+	o.LoggingFilename = "/var/log/oauth2_proxy/oauth2_proxy.log"
+	o.LoggingMaxSize = -1
+	assert.Equal(t, errorMsg([]string{
+		"logging_max_size, logging_max_backups and logging_max_age must not be negative"}), o.Validate().Error())
+}
+
+func TestSyslogOptions(t *testing.T) {
+	o := testOptions()
+	o.LoggingSyslog = true
+	o.LoggingSyslogFacility = "local9"
+	o.AccessLogFile = "/var/log/oauth2_proxy/access.log"
+	assert.Equal(t, errorMsg([]string{
+		"logging_syslog can't be combined with access_log_file or logging_filename",
+		`invalid logging_syslog_facility "local9", expected daemon, auth, authpriv, local0 to local7 or another syslog facility`}), o.Validate().Error())
+
+	o = testOptions()
+	o.LoggingSyslog = true
+	o.LoggingSyslogFacility = "local3"
+	assert.Equal(t, nil, o.Validate())
+}
@@ -0,0 +1,403 @@
+package api
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const awsTimeFormat = "20060102T150405Z"
+
+// AWSCredentials are the access key an AWS request is signed with
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Expires is when temporary credentials need to be fetched again, or
+	// zero for long lived ones
+	Expires time.Time
+}
+
+// AWSSigner signs requests with AWS Signature Version 4
+// https://docs.aws.amazon.com/general/latest/gr/signature-version-4.html
+type AWSSigner struct {
+	Region      string
+	Service     string
+	Credentials func() (*AWSCredentials, error)
+	now         func() time.Time
+}
+
+// NewAWSSigner signs requests for service in region with the credentials of
+// the default chain
+func NewAWSSigner(region, service string) *AWSSigner {
+	return &AWSSigner{
+		Region:      region,
+		Service:     service,
+		Credentials: defaultAWSCredentials.Get,
+		now:         time.Now,
+	}
+}
+
+// newAWSSignerFromArgs creates the "aws-sigv4:<region>:<service>" signer
+func newAWSSignerFromArgs(args []string) (Signer, error) {
+	if len(args) != 2 || args[0] == "" || args[1] == "" {
+		return nil, errors.New("aws-sigv4 signer needs a region and service: aws-sigv4:<region>:<service>")
+	}
+	return NewAWSSigner(args[0], args[1]), nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// awsURIEncode percent encodes everything but the RFC 3986 unreserved
+// characters, and "/" when encodeSlash is false
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *AWSSigner) canonicalURI(req *http.Request) string {
+	p := req.URL.EscapedPath()
+	if p == "" {
+		return "/"
+	}
+	if s.Service == "s3" {
+		return p
+	}
+	// every service but S3 expects the path to be encoded twice
+	return awsURIEncode(p, false)
+}
+
+func canonicalQuery(req *http.Request) string {
+	var params []string
+	for key, values := range req.URL.Query() {
+		for _, v := range values {
+			params = append(params, awsURIEncode(key, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func (s *AWSSigner) Sign(req *http.Request, body []byte) error {
+	creds, err := s.Credentials()
+	if err != nil {
+		return err
+	}
+	now := s.now().UTC()
+	amzDate := now.Format(awsTimeFormat)
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	if s.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s.canonicalURI(req),
+		canonicalQuery(req),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, s.Region, s.Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+// awsCredentialsChain looks up credentials the same way as the AWS SDKs:
+// environment variables, the shared credentials file, the ECS task role and
+// the EC2 instance role. Temporary credentials are cached until shortly
+// before they expire.
+type awsCredentialsChain struct {
+	mu     sync.Mutex
+	cached *AWSCredentials
+	// endpoints of the ECS and EC2 metadata services, overridden in tests
+	ecsEndpoint string
+	ec2Endpoint string
+}
+
+var defaultAWSCredentials = &awsCredentialsChain{
+	ecsEndpoint: "http://169.254.170.2",
+	ec2Endpoint: "http://169.254.169.254",
+}
+
+// metadataClient is used for the metadata services, which must not go
+// through http.DefaultClient and so the signing transport
+var metadataClient = &http.Client{Timeout: 5 * time.Second}
+
+func (c *awsCredentialsChain) Get() (*AWSCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cached != nil && (c.cached.Expires.IsZero() || time.Now().Add(5*time.Minute).Before(c.cached.Expires)) {
+		return c.cached, nil
+	}
+
+	for _, provider := range []func() (*AWSCredentials, error){
+		awsEnvCredentials,
+		awsSharedCredentials,
+		c.ecsCredentials,
+		c.ec2Credentials,
+	} {
+		creds, err := provider()
+		if err != nil {
+			return nil, err
+		}
+		if creds != nil {
+			c.cached = creds
+			return creds, nil
+		}
+	}
+	return nil, errors.New("no AWS credentials found")
+}
+
+func awsEnvCredentials() (*AWSCredentials, error) {
+	id := os.Getenv("AWS_ACCESS_KEY_ID")
+	secret := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return nil, nil
+	}
+	return &AWSCredentials{
+		AccessKeyID:     id,
+		SecretAccessKey: secret,
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}, nil
+}
+
+func awsSharedCredentials() (*AWSCredentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var creds AWSCredentials
+	var section string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch strings.TrimSpace(kv[0]) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = value
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = value
+		case "aws_session_token":
+			creds.SessionToken = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, nil
+	}
+	return &creds, nil
+}
+
+// awsMetadataCredentials is the credentials document of the ECS and EC2
+// metadata services
+type awsMetadataCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func (m *awsMetadataCredentials) credentials() *AWSCredentials {
+	return &AWSCredentials{
+		AccessKeyID:     m.AccessKeyID,
+		SecretAccessKey: m.SecretAccessKey,
+		SessionToken:    m.Token,
+		Expires:         m.Expiration,
+	}
+}
+
+func metadataRequest(req *http.Request) ([]byte, error) {
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got %d from %q", resp.StatusCode, req.URL.String())
+	}
+	return body, nil
+}
+
+func (c *awsCredentialsChain) ecsCredentials() (*AWSCredentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		endpoint = c.ecsEndpoint + uri
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	body, err := metadataRequest(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching ECS credentials: %s", err)
+	}
+	var m awsMetadataCredentials
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	return m.credentials(), nil
+}
+
+// ec2Credentials fetches the instance role's credentials with IMDSv2. It
+// returns nil when not running on EC2.
+func (c *awsCredentialsChain) ec2Credentials() (*AWSCredentials, error) {
+	if os.Getenv("AWS_EC2_METADATA_DISABLED") == "true" {
+		return nil, nil
+	}
+	req, err := http.NewRequest("PUT", c.ec2Endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	token, err := metadataRequest(req)
+	if err != nil {
+		return nil, nil
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequest("GET", c.ec2Endpoint+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", string(token))
+		return metadataRequest(req)
+	}
+	const rolesPath = "/latest/meta-data/iam/security-credentials/"
+	roles, err := get(rolesPath)
+	if err != nil {
+		return nil, fmt.Errorf("fetching EC2 instance role: %s", err)
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return nil, nil
+	}
+	body, err := get(rolesPath + role)
+	if err != nil {
+		return nil, fmt.Errorf("fetching EC2 credentials: %s", err)
+	}
+	var m awsMetadataCredentials
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, err
+	}
+	return m.credentials(), nil
+}
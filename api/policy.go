@@ -0,0 +1,119 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Redirect policies of provider requests
+const (
+	// RedirectNone follows no redirect, so a misconfigured endpoint fails
+	// rather than answering from wherever it redirects to
+	RedirectNone = "none"
+	// RedirectSameHost follows redirects to the host of the original
+	// request
+	RedirectSameHost = "same-host"
+	// RedirectAny follows redirects to any host
+	RedirectAny = "any"
+
+	// maxRedirects bounds the redirects followed for a request
+	maxRedirects = 10
+)
+
+// DefaultContentTypes are the media types provider endpoints may answer
+// with when no others are configured. Other JSON types, ie.
+// application/jwk-set+json, are allowed along with application/json.
+var DefaultContentTypes = []string{
+	"application/json",
+	"application/jwt",
+	"application/x-www-form-urlencoded",
+	"text/javascript",
+	"text/plain",
+}
+
+// ValidRedirectPolicy tells whether policy is one of the redirect policies
+func ValidRedirectPolicy(policy string) bool {
+	switch policy {
+	case RedirectNone, RedirectSameHost, RedirectAny:
+		return true
+	}
+	return false
+}
+
+// CheckRedirect returns the http.Client CheckRedirect function applying the
+// redirect policy. No policy follows redirects from https to http.
+func CheckRedirect(policy string) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		first := via[0]
+		switch {
+		case policy == RedirectNone:
+			return fmt.Errorf("redirect from %s to %s not followed", first.URL.Host, req.URL.Host)
+		case policy == RedirectSameHost && req.URL.Host != first.URL.Host:
+			return fmt.Errorf("redirect from %s to another host %s not followed", first.URL.Host, req.URL.Host)
+		case req.URL.Scheme != "https" && via[len(via)-1].URL.Scheme == "https":
+			return fmt.Errorf("redirect from https to %s not followed", req.URL)
+		case len(via) >= maxRedirects:
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	}
+}
+
+// ContentTypeError is returned for successful responses whose content type
+// isn't allowed
+type ContentTypeError struct {
+	URL         string
+	ContentType string
+}
+
+func (e *ContentTypeError) Error() string {
+	return fmt.Sprintf("unexpected content type %q from %s", e.ContentType, e.URL)
+}
+
+// ContentTypeTransport rejects the successful responses of provider
+// endpoints whose content type isn't one of Allowed, ie. the HTML login page
+// of a misconfigured endpoint, which would otherwise pass for an answer.
+// Responses without a content type are passed through.
+type ContentTypeTransport struct {
+	Next    http.RoundTripper
+	Allowed []string
+}
+
+func (t *ContentTypeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	resp, err := next.RoundTrip(req)
+	if err != nil || resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" || t.allowed(contentType) {
+		return resp, nil
+	}
+	resp.Body.Close()
+	err = &ContentTypeError{URL: req.URL.Scheme + "://" + req.URL.Host + req.URL.Path, ContentType: contentType}
+	log.Printf("%s %s", req.Method, err)
+	return nil, err
+}
+
+func (t *ContentTypeTransport) allowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range t.Allowed {
+		allowed = strings.ToLower(allowed)
+		if mediaType == allowed {
+			return true
+		}
+		if allowed == "application/json" && strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json") {
+			return true
+		}
+	}
+	return false
+}
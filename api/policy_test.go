@@ -0,0 +1,94 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestCheckRedirect(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"ok":true}`))
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/same":
+			http.Redirect(rw, req, "/target", http.StatusFound)
+		case "/other":
+			http.Redirect(rw, req, target.URL, http.StatusFound)
+		case "/loop":
+			http.Redirect(rw, req, "/loop", http.StatusFound)
+		default:
+			rw.Write([]byte(`{"ok":true}`))
+		}
+	}))
+	defer server.Close()
+
+	get := func(policy, path string) error {
+		client := &http.Client{CheckRedirect: CheckRedirect(policy)}
+		resp, err := client.Get(server.URL + path)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	assert.NotEqual(t, nil, get(RedirectNone, "/same"))
+	assert.Equal(t, nil, get(RedirectNone, "/target"))
+	assert.Equal(t, nil, get(RedirectSameHost, "/same"))
+	assert.NotEqual(t, nil, get(RedirectSameHost, "/other"))
+	assert.Equal(t, nil, get(RedirectAny, "/other"))
+	err := get(RedirectAny, "/loop")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.Contains(err.Error(), "stopped after 10 redirects"))
+
+	assert.Equal(t, true, ValidRedirectPolicy(RedirectSameHost))
+	assert.Equal(t, false, ValidRedirectPolicy("all"))
+}
+
+func TestCheckRedirectDowngrade(t *testing.T) {
+	via := []*http.Request{httptest.NewRequest("GET", "https://provider.example.com/validate", nil)}
+	req := httptest.NewRequest("GET", "http://provider.example.com/validate", nil)
+	assert.NotEqual(t, nil, CheckRedirect(RedirectAny)(req, via))
+	req = httptest.NewRequest("GET", "https://login.example.com/validate", nil)
+	assert.Equal(t, nil, CheckRedirect(RedirectAny)(req, via))
+}
+
+func TestContentTypeTransport(t *testing.T) {
+	var contentType string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if contentType != "" {
+			rw.Header().Set("Content-Type", contentType)
+		} else {
+			rw.Header()["Content-Type"] = nil
+		}
+		rw.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &ContentTypeTransport{Allowed: DefaultContentTypes}}
+	get := func(ct string) error {
+		contentType = ct
+		resp, err := client.Get(server.URL + "/validate")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	assert.Equal(t, nil, get("application/json; charset=utf-8"))
+	assert.Equal(t, nil, get("application/jwk-set+json"))
+	assert.Equal(t, nil, get("text/plain"))
+	assert.Equal(t, nil, get(""))
+	err := get("text/html; charset=utf-8")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.Contains(err.Error(), `unexpected content type "text/html; charset=utf-8" from `+server.URL+"/validate"))
+
+	// only successful responses are checked
+	status = http.StatusUnauthorized
+	assert.Equal(t, nil, get("text/html"))
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// rateLimitMinBackoff is the first backoff after a rate limited response
+	// that doesn't say when to retry, doubled for every further one
+	rateLimitMinBackoff = time.Second
+	// rateLimitMaxBackoff bounds how long requests to a host are held back
+	rateLimitMaxBackoff = 15 * time.Minute
+)
+
+var (
+	rateLimitRemainingGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "provider_rate_limit_remaining",
+		Help: "Requests left in the current rate limit window of a provider API host.",
+	}, []string{"host"})
+	rateLimitLimitGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "provider_rate_limit_limit",
+		Help: "Requests allowed per rate limit window of a provider API host.",
+	}, []string{"host"})
+	rateLimitBackoffCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "provider_rate_limit_backoff_total",
+		Help: "Requests to a provider API host refused while backing off from its rate limit.",
+	}, []string{"host"})
+)
+
+func init() {
+	prometheus.MustRegister(rateLimitRemainingGauge)
+	prometheus.MustRegister(rateLimitLimitGauge)
+	prometheus.MustRegister(rateLimitBackoffCounter)
+}
+
+// RateLimitError is returned for requests to a host that is being backed
+// off from, without sending them
+type RateLimitError struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited by %s until %s", e.Host, e.Until.Format(time.RFC3339))
+}
+
+type rateLimitHost struct {
+	until    time.Time
+	failures int
+}
+
+// RateLimitTransport honors the rate limit headers of provider APIs. Once a
+// host answers 429, or 403 with its quota used up, requests to it fail
+// straight away until the Retry-After or X-RateLimit-Reset time, or an
+// exponential backoff when neither is given, rather than adding to a burst
+// of rejected requests. The remaining quota is exported as a gauge.
+type RateLimitTransport struct {
+	Next http.RoundTripper
+
+	mu    sync.Mutex
+	hosts map[string]*rateLimitHost
+	// now is overridden in tests
+	now func() time.Time
+}
+
+func NewRateLimitTransport(next http.RoundTripper) *RateLimitTransport {
+	return &RateLimitTransport{
+		Next:  next,
+		hosts: make(map[string]*rateLimitHost),
+		now:   time.Now,
+	}
+}
+
+func (t *RateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if until, ok := t.backingOff(host); ok {
+		rateLimitBackoffCounter.WithLabelValues(host).Inc()
+		return nil, &RateLimitError{Host: host, Until: until}
+	}
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	t.observe(host, resp)
+	return resp, nil
+}
+
+func (t *RateLimitTransport) backingOff(host string) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.hosts[host]
+	if !ok || !t.now().Before(h.until) {
+		return time.Time{}, false
+	}
+	return h.until, true
+}
+
+// observe records the quota a response reports, and backs off from host
+// when it was rate limited or used up its quota
+func (t *RateLimitTransport) observe(host string, resp *http.Response) {
+	remaining, hasRemaining := headerInt(resp.Header, "X-RateLimit-Remaining")
+	if hasRemaining {
+		rateLimitRemainingGauge.WithLabelValues(host).Set(float64(remaining))
+	}
+	if limit, ok := headerInt(resp.Header, "X-RateLimit-Limit"); ok {
+		rateLimitLimitGauge.WithLabelValues(host).Set(float64(limit))
+	}
+	exhausted := hasRemaining && remaining == 0
+	limited := resp.StatusCode == http.StatusTooManyRequests ||
+		(resp.StatusCode == http.StatusForbidden && (exhausted || resp.Header.Get("Retry-After") != ""))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	h, ok := t.hosts[host]
+	if !ok {
+		h = &rateLimitHost{}
+		t.hosts[host] = h
+	}
+	if !limited {
+		h.failures = 0
+		if !exhausted {
+			return
+		}
+	} else {
+		h.failures++
+	}
+
+	until, ok := retryAt(resp.Header, now)
+	if !ok && limited {
+		backoff := rateLimitMinBackoff << uint(h.failures-1)
+		if backoff > rateLimitMaxBackoff || backoff <= 0 {
+			backoff = rateLimitMaxBackoff
+		}
+		until = now.Add(backoff)
+	}
+	if !until.After(now) {
+		return
+	}
+	if until.Sub(now) > rateLimitMaxBackoff {
+		until = now.Add(rateLimitMaxBackoff)
+	}
+	h.until = until
+	log.Printf("rate limited by %s (status %d), backing off until %s", host, resp.StatusCode, until.Format(time.RFC3339))
+}
+
+// retryAt reads when a rate limited host accepts requests again, from the
+// Retry-After header in seconds or as a date, or the X-RateLimit-Reset
+// header as a unix timestamp
+func retryAt(header http.Header, now time.Time) (time.Time, bool) {
+	if v := header.Get("Retry-After"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			return now.Add(time.Duration(seconds) * time.Second), true
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return t, true
+		}
+	}
+	if reset, ok := headerInt(header, "X-RateLimit-Reset"); ok {
+		return time.Unix(reset, 0), true
+	}
+	return time.Time{}, false
+}
+
+func headerInt(header http.Header, name string) (int64, bool) {
+	v := header.Get(name)
+	if v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestRateLimitTransport(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	var hits int
+	header := http.Header{}
+	status := 200
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(status)
+	}))
+	defer backend.Close()
+
+	transport := NewRateLimitTransport(nil)
+	transport.now = func() time.Time { return now }
+	client := &http.Client{Transport: transport}
+	get := func() error {
+		resp, err := client.Get(backend.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// Retry-After is honored
+	status = 429
+	header.Set("Retry-After", "30")
+	assert.Equal(t, nil, get())
+	assert.Equal(t, 1, hits)
+	assert.NotEqual(t, nil, get())
+	assert.Equal(t, 1, hits)
+	now = now.Add(31 * time.Second)
+
+	// without a retry time the backoff doubles with every rate limited
+	// response in a row
+	header = http.Header{}
+	assert.Equal(t, nil, get())
+	assert.Equal(t, 2, hits)
+	now = now.Add(1500 * time.Millisecond)
+	assert.NotEqual(t, nil, get())
+	now = now.Add(time.Second)
+	assert.Equal(t, nil, get())
+	assert.Equal(t, 3, hits)
+	now = now.Add(3 * time.Second)
+	assert.NotEqual(t, nil, get())
+	assert.Equal(t, 3, hits)
+	now = now.Add(time.Second)
+
+	// a used up quota holds requests back until it resets
+	status = 200
+	header.Set("X-RateLimit-Limit", "5000")
+	header.Set("X-RateLimit-Remaining", "0")
+	header.Set("X-RateLimit-Reset", strconv.FormatInt(now.Add(time.Minute).Unix(), 10))
+	assert.Equal(t, nil, get())
+	assert.Equal(t, 4, hits)
+	err := get()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 4, hits)
+	now = now.Add(time.Minute)
+	header.Set("X-RateLimit-Remaining", "4999")
+	assert.Equal(t, nil, get())
+	assert.Equal(t, 5, hits)
+}
+
+func TestRetryAt(t *testing.T) {
+	now := time.Unix(1500000000, 0).UTC()
+	h := http.Header{}
+	_, ok := retryAt(h, now)
+	assert.Equal(t, false, ok)
+
+	h.Set("Retry-After", now.Add(time.Hour).Format(http.TimeFormat))
+	at, ok := retryAt(h, now)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, now.Add(time.Hour), at)
+
+	h = http.Header{}
+	h.Set("X-RateLimit-Reset", "1500000060")
+	at, _ = retryAt(h, now)
+	assert.Equal(t, now.Add(time.Minute).Unix(), at.Unix())
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Signer adds authentication to an outbound request, ie. an AWS SigV4
+// signature. body is a copy of the request body, which is left unread.
+type Signer interface {
+	Sign(req *http.Request, body []byte) error
+}
+
+// SignerFactory creates a Signer from the colon separated arguments of a
+// signer specification
+type SignerFactory func(args []string) (Signer, error)
+
+var (
+	signersMu sync.Mutex
+	signers   = map[string]SignerFactory{
+		"aws-sigv4": newAWSSignerFromArgs,
+	}
+)
+
+// RegisterSigner makes a custom signer available as name in signer
+// specifications
+func RegisterSigner(name string, factory SignerFactory) {
+	signersMu.Lock()
+	defer signersMu.Unlock()
+	signers[name] = factory
+}
+
+// NewSigner creates a Signer from a "<name>[:<arg>...]" specification
+func NewSigner(spec string) (Signer, error) {
+	parts := strings.Split(spec, ":")
+	signersMu.Lock()
+	factory, ok := signers[parts[0]]
+	signersMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown request signer %q", parts[0])
+	}
+	return factory(parts[1:])
+}
+
+// SigningRule signs the requests whose URL starts with Prefix
+type SigningRule struct {
+	Prefix string
+	Signer Signer
+}
+
+// SigningTransport signs requests matching one of its rules before passing
+// them to the next RoundTripper
+type SigningTransport struct {
+	Next  http.RoundTripper
+	Rules []SigningRule
+}
+
+func (t *SigningTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	for _, rule := range t.Rules {
+		if !strings.HasPrefix(req.URL.String(), rule.Prefix) {
+			continue
+		}
+		// RoundTrippers must not modify the request they're given
+		signed := req.Clone(req.Context())
+		var body []byte
+		if req.Body != nil {
+			var err error
+			body, err = ioutil.ReadAll(req.Body)
+			req.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			signed.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		if err := rule.Signer.Sign(signed, body); err != nil {
+			return nil, fmt.Errorf("signing request to %s: %s", req.URL.Host, err)
+		}
+		return next.RoundTrip(signed)
+	}
+	return next.RoundTrip(req)
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func testAWSSigner(service string) *AWSSigner {
+	s := NewAWSSigner("us-east-1", service)
+	s.Credentials = func() (*AWSCredentials, error) {
+		return &AWSCredentials{
+			AccessKeyID:     "AKIDEXAMPLE",
+			SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		}, nil
+	}
+	s.now = func() time.Time {
+		t, _ := time.Parse(awsTimeFormat, "20150830T123600Z")
+		return t
+	}
+	return s
+}
+
+// get-vanilla from the AWS Signature Version 4 test suite
+func TestAWSSignerVanilla(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	assert.Equal(t, nil, testAWSSigner("service").Sign(req, nil))
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, "+
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
+
+func TestAWSSignerSessionToken(t *testing.T) {
+	s := testAWSSigner("execute-api")
+	s.Credentials = func() (*AWSCredentials, error) {
+		return &AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}, nil
+	}
+	req, _ := http.NewRequest("POST", "https://example.com/a%20b?z=1&a=2", strings.NewReader("body"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assert.Equal(t, nil, s.Sign(req, []byte("body")))
+	assert.Equal(t, "token", req.Header.Get("X-Amz-Security-Token"))
+	assert.Equal(t, true, strings.Contains(req.Header.Get("Authorization"),
+		"SignedHeaders=content-type;host;x-amz-date;x-amz-security-token,"))
+}
+
+func TestAWSURIEncode(t *testing.T) {
+	assert.Equal(t, "/a%2520b/c~d", awsURIEncode("/a%20b/c~d", false))
+	assert.Equal(t, "a%2Fb%3D", awsURIEncode("a/b=", true))
+}
+
+type testSigner struct{ body []byte }
+
+func (s *testSigner) Sign(req *http.Request, body []byte) error {
+	s.body = body
+	req.Header.Set("X-Signed", "yes")
+	return nil
+}
+
+func TestSigningTransport(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(r.Header.Get("X-Signed") + ":" + string(body)))
+	}))
+	defer backend.Close()
+
+	signer := &testSigner{}
+	client := &http.Client{Transport: &SigningTransport{
+		Rules: []SigningRule{{Prefix: backend.URL + "/validate", Signer: signer}},
+	}}
+
+	for path, expected := range map[string]string{
+		"/validate/user": "yes:payload",
+		"/token":         ":payload",
+	} {
+		resp, err := client.Post(backend.URL+path, "text/plain", strings.NewReader("payload"))
+		assert.Equal(t, nil, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, expected, string(body))
+	}
+	assert.Equal(t, "payload", string(signer.body))
+}
+
+func TestNewSigner(t *testing.T) {
+	s, err := NewSigner("aws-sigv4:eu-west-1:execute-api")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "eu-west-1", s.(*AWSSigner).Region)
+	assert.Equal(t, "execute-api", s.(*AWSSigner).Service)
+
+	_, err = NewSigner("aws-sigv4:eu-west-1")
+	assert.NotEqual(t, nil, err)
+	_, err = NewSigner("unknown")
+	assert.NotEqual(t, nil, err)
+
+	RegisterSigner("test", func(args []string) (Signer, error) { return &testSigner{}, nil })
+	_, err = NewSigner("test")
+	assert.Equal(t, nil, err)
+}
+
+func setenv(env map[string]string) func() {
+	old := make(map[string]*string)
+	for k, v := range env {
+		if prev, ok := os.LookupEnv(k); ok {
+			old[k] = &prev
+		} else {
+			old[k] = nil
+		}
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range old {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+}
+
+func TestAWSCredentialsChain(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "aws")
+	defer os.RemoveAll(dir)
+	credentialsFile := filepath.Join(dir, "credentials")
+	ioutil.WriteFile(credentialsFile, []byte(`[default]
+aws_access_key_id = AKIDDEFAULT
+aws_secret_access_key = default-secret
+
+[staging]
+aws_access_key_id = AKIDSTAGING
+aws_secret_access_key = staging-secret
+aws_session_token = staging-token
+`), 0600)
+
+	ecs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/credentials/task" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{"AccessKeyId":"AKIDECS","SecretAccessKey":"ecs-secret","Token":"ecs-token",
+			"Expiration":"` + time.Now().Add(time.Hour).UTC().Format(time.RFC3339) + `"}`))
+	}))
+	defer ecs.Close()
+
+	restore := setenv(map[string]string{
+		"AWS_ACCESS_KEY_ID":                      "",
+		"AWS_SECRET_ACCESS_KEY":                  "",
+		"AWS_SHARED_CREDENTIALS_FILE":            filepath.Join(dir, "missing"),
+		"AWS_PROFILE":                            "",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "/v2/credentials/task",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     "",
+		"AWS_EC2_METADATA_DISABLED":              "true",
+	})
+	defer restore()
+
+	chain := &awsCredentialsChain{ecsEndpoint: ecs.URL}
+	creds, err := chain.Get()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "AKIDECS", creds.AccessKeyID)
+	assert.Equal(t, "ecs-token", creds.SessionToken)
+
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	os.Setenv("AWS_PROFILE", "staging")
+	creds, err = (&awsCredentialsChain{}).Get()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "AKIDSTAGING", creds.AccessKeyID)
+	assert.Equal(t, "staging-token", creds.SessionToken)
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	creds, err = (&awsCredentialsChain{}).Get()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "AKIDENV", creds.AccessKeyID)
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "")
+	os.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "missing"))
+	os.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	_, err = (&awsCredentialsChain{}).Get()
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/api"
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+var auditEventsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "audit_events_total",
+	Help: "Audit events by what became of them: sent, spilled to disk or dropped.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(auditEventsCounter)
+}
+
+// auditSendTimeout bounds sending a batch, so a hanging sink doesn't hold up
+// the batches after it
+const auditSendTimeout = 10 * time.Second
+
+// auditLogOut is the dedicated audit log, which every session event is
+// written to as a line of JSON, when one is configured. It's shared by every
+// proxy built by reloads, like sessionEvents.
+var auditLogOut io.Writer
+
+// auditEvent is a security relevant event: a sign in, a denied sign in or a
+// sign out
+type auditEvent struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Email      string    `json:"email,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Provider   string    `json:"provider,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	ClientIP   string    `json:"client_ip"`
+	Host       string    `json:"host"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// auditSink delivers batches of audit events
+type auditSink interface {
+	Send(events []auditEvent) error
+}
+
+// webhookSink POSTs batches of audit events as a JSON array. Any answer but
+// a 2xx fails the batch.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookSink(url string, timeout time.Duration) *webhookSink {
+	return &webhookSink{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *webhookSink) Send(events []auditEvent) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got %d from %s", resp.StatusCode, s.url)
+	}
+	return nil
+}
+
+// kafkaSink produces batches of audit events to a Kafka topic through the
+// Kafka REST Proxy, one JSON record per event. Any answer but a 2xx, or a
+// record the proxy couldn't produce, fails the batch.
+// https://docs.confluent.io/platform/current/kafka-rest/api.html#post--topics-(string-topic_name)
+type kafkaSink struct {
+	url    string
+	client *http.Client
+}
+
+func newKafkaSink(url string, timeout time.Duration) *kafkaSink {
+	return &kafkaSink{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+type kafkaRecord struct {
+	Value auditEvent `json:"value"`
+}
+
+func (s *kafkaSink) Send(events []auditEvent) error {
+	records := make([]kafkaRecord, len(events))
+	for i, e := range events {
+		records[i].Value = e
+	}
+	body, err := json.Marshal(map[string][]kafkaRecord{"records": records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got %d from %s", resp.StatusCode, s.url)
+	}
+	var produced struct {
+		Offsets []struct {
+			Error string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&produced); err != nil {
+		return fmt.Errorf("error decoding the answer of %s: %s", s.url, err)
+	}
+	for _, offset := range produced.Offsets {
+		if offset.Error != "" {
+			return fmt.Errorf("error producing to %s: %s", s.url, offset.Error)
+		}
+	}
+	return nil
+}
+
+// bucketSink uploads each batch of audit events to an S3 or GCS bucket, as
+// an object of one JSON event per line. Objects are named after the time of
+// their first event and a hash of their content, so a batch sent again after
+// a failure replaces its object rather than duplicating it.
+type bucketSink struct {
+	// endpoint is the url objects are PUT under, ending with the prefix
+	endpoint string
+	signer   api.Signer
+	client   *http.Client
+}
+
+// newBucketSink uploads to the s3://bucket/prefix or gs://bucket/prefix url
+// bucket. S3 requests are signed with the AWS credentials of the default
+// chain, GCS ones with the Google application default credentials.
+func newBucketSink(bucket *url.URL, region string, timeout time.Duration) *bucketSink {
+	prefix := strings.TrimPrefix(bucket.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	s := &bucketSink{client: &http.Client{Timeout: timeout}}
+	if bucket.Scheme == "gs" {
+		s.endpoint = fmt.Sprintf("https://storage.googleapis.com/%s/%s", bucket.Host, prefix)
+		s.signer = &googleSigner{scope: "https://www.googleapis.com/auth/devstorage.read_write", timeout: timeout}
+	} else {
+		s.endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket.Host, region, prefix)
+		s.signer = api.NewAWSSigner(region, "s3")
+	}
+	return s
+}
+
+func (s *bucketSink) Send(events []auditEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	hash := sha256.Sum256(body.Bytes())
+	name := fmt.Sprintf("%s-%x.json", events[0].Time.UTC().Format("2006/01/02/150405.000000000"), hash[:8])
+	req, err := http.NewRequest("PUT", s.endpoint+name, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if err := s.signer.Sign(req, body.Bytes()); err != nil {
+		return fmt.Errorf("error signing upload of %s: %s", name, err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got %d uploading %s%s", resp.StatusCode, s.endpoint, name)
+	}
+	return nil
+}
+
+// googleSigner authorizes requests with an access token of the Google
+// application default credentials, which are looked up on first use
+type googleSigner struct {
+	scope   string
+	timeout time.Duration
+	tokens  oauth2.TokenSource
+}
+
+func (s *googleSigner) Sign(req *http.Request, body []byte) error {
+	if s.tokens == nil {
+		// tokens mustn't be fetched through http.DefaultClient, which signs
+		// and rate limits provider requests
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Timeout: s.timeout})
+		tokens, err := google.DefaultTokenSource(ctx, s.scope)
+		if err != nil {
+			return err
+		}
+		s.tokens = tokens
+	}
+	token, err := s.tokens.Token()
+	if err != nil {
+		return err
+	}
+	token.SetAuthHeader(req)
+	return nil
+}
+
+// newAuditSink creates the sink of the audit webhook, Kafka topic or bucket
+// that's configured, if any
+func newAuditSink(opts *Options) auditSink {
+	switch {
+	case opts.AuditWebhookURL != "":
+		log.Printf("sending audit events to %s", opts.AuditWebhookURL)
+		return newWebhookSink(opts.AuditWebhookURL, auditSendTimeout)
+	case opts.AuditKafkaURL != "":
+		log.Printf("producing audit events to %s", opts.AuditKafkaURL)
+		return newKafkaSink(opts.AuditKafkaURL, auditSendTimeout)
+	case opts.auditBucket != nil:
+		log.Printf("uploading audit events to %s", opts.AuditBucketURL)
+		return newBucketSink(opts.auditBucket, opts.AuditBucketRegion, auditSendTimeout)
+	}
+	return nil
+}
+
+// auditLog batches audit events to a sink, sending them every interval or
+// once batchSize are pending. Batches that fail are spilled to files in the
+// spool directory, and sent again oldest first before newer ones, so events
+// outlive sink outages and restarts and are delivered at least once. Without
+// a spool directory failed batches are dropped.
+type auditLog struct {
+	sink      auditSink
+	spool     string
+	batchSize int
+	interval  time.Duration
+	events    chan auditEvent
+	done      chan bool
+	stopped   chan bool
+}
+
+func newAuditLog(sink auditSink, spool string, batchSize int, interval time.Duration) *auditLog {
+	a := &auditLog{
+		sink:      sink,
+		spool:     spool,
+		batchSize: batchSize,
+		interval:  interval,
+		events:    make(chan auditEvent, 10*batchSize),
+		done:      make(chan bool),
+		stopped:   make(chan bool),
+	}
+	go a.run()
+	return a
+}
+
+// Close sends the events queued so far, and stops sending them. Events
+// recorded afterwards are dropped.
+func (a *auditLog) Close() {
+	if a == nil {
+		return
+	}
+	close(a.done)
+	<-a.stopped
+}
+
+// Record queues e for the sink. Events are dropped rather than hold up
+// requests when the queue is full.
+func (a *auditLog) Record(e auditEvent) {
+	if a == nil {
+		return
+	}
+	select {
+	case a.events <- e:
+	default:
+		log.Printf("audit queue full, dropping %s event of %s", e.Type, e.Email)
+		auditEventsCounter.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (a *auditLog) run() {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	var batch []auditEvent
+	for {
+		select {
+		case e := <-a.events:
+			batch = append(batch, e)
+			if len(batch) < a.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-a.done:
+			for len(a.events) > 0 {
+				batch = append(batch, <-a.events)
+			}
+			a.flush(batch)
+			close(a.stopped)
+			return
+		}
+		a.flush(batch)
+		batch = nil
+	}
+}
+
+// flush sends the spilled batches, then batch. Once one fails the rest are
+// spilled, to keep them in order.
+func (a *auditLog) flush(batch []auditEvent) {
+	if err := a.sendSpilled(); err != nil {
+		log.Printf("error sending spilled audit events: %s", err)
+		a.spill(batch)
+		return
+	}
+	if len(batch) == 0 {
+		return
+	}
+	if err := a.sink.Send(batch); err != nil {
+		log.Printf("error sending %d audit events: %s", len(batch), err)
+		a.spill(batch)
+		return
+	}
+	auditEventsCounter.WithLabelValues("sent").Add(float64(len(batch)))
+}
+
+func (a *auditLog) spilled() ([]string, error) {
+	if a.spool == "" {
+		return nil, nil
+	}
+	files, err := filepath.Glob(filepath.Join(a.spool, "*.json"))
+	sort.Strings(files)
+	return files, err
+}
+
+func (a *auditLog) sendSpilled() error {
+	files, err := a.spilled()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var batch []auditEvent
+		if err := json.Unmarshal(data, &batch); err != nil {
+			// a partial file can't be sent, so don't let it block the others
+			log.Printf("dropping unreadable audit spool file %s: %s", file, err)
+			os.Remove(file)
+			continue
+		}
+		if err := a.sink.Send(batch); err != nil {
+			return err
+		}
+		os.Remove(file)
+		auditEventsCounter.WithLabelValues("sent").Add(float64(len(batch)))
+	}
+	return nil
+}
+
+// spill writes batch to a new file of the spool directory. The file is
+// named after the time so they sort in order, and only appears once
+// written.
+func (a *auditLog) spill(batch []auditEvent) {
+	if len(batch) == 0 {
+		return
+	}
+	if a.spool == "" {
+		auditEventsCounter.WithLabelValues("dropped").Add(float64(len(batch)))
+		return
+	}
+	err := func() error {
+		data, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		name := filepath.Join(a.spool, fmt.Sprintf("%020d", time.Now().UnixNano()))
+		if err := ioutil.WriteFile(name+".tmp", data, 0600); err != nil {
+			return err
+		}
+		return os.Rename(name+".tmp", name+".json")
+	}()
+	if err != nil {
+		log.Printf("error spilling %d audit events to %s, dropping them: %s", len(batch), a.spool, err)
+		auditEventsCounter.WithLabelValues("dropped").Add(float64(len(batch)))
+		return
+	}
+	auditEventsCounter.WithLabelValues("spilled").Add(float64(len(batch)))
+}
+
+// audit records an event of type eventType for the user of s, which may be
+// nil, and streams it to the session event stream
+func (p *OAuthProxy) audit(req *http.Request, eventType string, s *providers.SessionState, reason string) {
+	e := p.sessionEvent(req, eventType, s, reason)
+	if p.auditLog != nil {
+		p.auditLog.Record(e)
+	}
+}
+
+// streamSessionEvent only streams an event to the session event stream, and
+// the audit log, for events too frequent for the audit webhook
+func (p *OAuthProxy) streamSessionEvent(req *http.Request, eventType string, s *providers.SessionState, reason string) {
+	p.sessionEvent(req, eventType, s, reason)
+}
+
+// sessionEvent publishes an event to the session event stream and writes it
+// to the audit log
+func (p *OAuthProxy) sessionEvent(req *http.Request, eventType string, s *providers.SessionState, reason string) auditEvent {
+	e := newAuditEvent(req, eventType, s, reason)
+	e.Provider = p.auditProvider(s)
+	sessionEvents.Publish(e)
+	writeAuditLog(e)
+	return e
+}
+
+// auditProvider names the provider of s, or of the sign in that didn't get
+// a session. Sessions only naming a user were signed in with a password.
+func (p *OAuthProxy) auditProvider(s *providers.SessionState) string {
+	if s != nil && s.User != "" && s.Email == "" && s.AccessToken == "" {
+		return "htpasswd"
+	}
+	return p.sessionProvider(s).Data().ProviderName
+}
+
+// writeAuditLog writes e to the audit log as one line of JSON
+func writeAuditLog(e auditEvent) {
+	if auditLogOut == nil {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("ERROR: encoding %s audit event - %s", e.Type, err)
+		return
+	}
+	if _, err := auditLogOut.Write(append(line, '\n')); err != nil {
+		log.Printf("ERROR: writing %s audit event of %s to the audit log - %s", e.Type, e.Email, err)
+	}
+}
+
+func newAuditEvent(req *http.Request, eventType string, s *providers.SessionState, reason string) auditEvent {
+	e := auditEvent{
+		Time:       time.Now(),
+		Type:       eventType,
+		RemoteAddr: getRemoteAddr(req),
+		ClientIP:   clientIP(req),
+		Host:       req.Host,
+		Reason:     reason,
+	}
+	if s != nil {
+		e.Email = s.Email
+		e.User = s.User
+	}
+	return e
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/api"
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+type testAuditSink struct {
+	err     error
+	batches [][]auditEvent
+}
+
+func (s *testAuditSink) Send(events []auditEvent) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.batches = append(s.batches, events)
+	return nil
+}
+
+func auditTypes(batches [][]auditEvent) []string {
+	var types []string
+	for _, batch := range batches {
+		for _, e := range batch {
+			types = append(types, e.Type)
+		}
+	}
+	return types
+}
+
+func TestAuditLogSpill(t *testing.T) {
+	spool, err := ioutil.TempDir("", "test_audit_spool_")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(spool)
+
+	sink := &testAuditSink{err: errors.New("webhook down")}
+	a := &auditLog{sink: sink, spool: spool}
+	spilled := func() int {
+		files, _ := filepath.Glob(filepath.Join(spool, "*.json"))
+		return len(files)
+	}
+
+	a.flush([]auditEvent{{Type: "first"}, {Type: "second"}})
+	a.flush([]auditEvent{{Type: "third"}})
+	assert.Equal(t, 2, spilled())
+
+	// once the sink is back, the spilled events are sent first
+	sink.err = nil
+	a.flush([]auditEvent{{Type: "fourth"}})
+	assert.Equal(t, 0, spilled())
+	assert.Equal(t, []string{"first", "second", "third", "fourth"}, auditTypes(sink.batches))
+
+	// an unreadable file doesn't block the others
+	ioutil.WriteFile(filepath.Join(spool, "0.json"), []byte("[{"), 0600)
+	a.flush([]auditEvent{{Type: "fifth"}})
+	assert.Equal(t, 0, spilled())
+	assert.Equal(t, "fifth", sink.batches[len(sink.batches)-1][0].Type)
+
+	// without a spool directory failed batches are dropped
+	sink.err = errors.New("webhook down")
+	a.spool = ""
+	a.flush([]auditEvent{{Type: "sixth"}})
+	sink.err = nil
+	a.flush(nil)
+	assert.Equal(t, "fifth", sink.batches[len(sink.batches)-1][0].Type)
+}
+
+func TestAuditOptions(t *testing.T) {
+	o := testOptions()
+	o.AuditSpoolDir = "/tmp/audit"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"audit_spool_dir requires audit_webhook_url, audit_kafka_url or audit_bucket_url"}), err.Error())
+
+	o = testOptions()
+	o.AuditWebhookURL = "https://audit.example.com/"
+	o.AuditKafkaURL = "http://kafka-rest:8082/audit"
+	o.AuditBucketURL = "s3://audit"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"only one of audit_bucket_url, audit_kafka_url, audit_webhook_url can be set",
+		`audit_kafka_url "http://kafka-rest:8082/audit" must be the http or https url of a Kafka REST Proxy topic, ie. http://kafka-rest:8082/topics/audit`,
+		"audit_bucket_region is required for s3 buckets",
+	}), err.Error())
+
+	o = testOptions()
+	o.AuditBucketURL = "https://audit.s3.amazonaws.com/"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		`audit_bucket_url "https://audit.s3.amazonaws.com/" must be an s3://bucket/prefix or gs://bucket/prefix url`,
+	}), err.Error())
+
+	o = testOptions()
+	o.AuditBucketURL = "gs://audit/proxy"
+	o.AuditBucketRegion = "us-east-1"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"audit_bucket_region is only used with s3 buckets"}), err.Error())
+
+	o = testOptions()
+	o.AuditBucketURL = "s3://audit/proxy"
+	o.AuditBucketRegion = "eu-west-1"
+	assert.Equal(t, nil, o.Validate())
+	sink := newAuditSink(o).(*bucketSink)
+	assert.Equal(t, "https://audit.s3.eu-west-1.amazonaws.com/proxy/", sink.endpoint)
+
+	o = testOptions()
+	o.AuditWebhookURL = "audit.example.com"
+	o.AuditBatchSize = 0
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		`audit_webhook_url "audit.example.com" must be an http or https url`,
+		"audit_batch_size must be positive",
+	}), err.Error())
+}
+
+func TestKafkaSink(t *testing.T) {
+	var produced []json.RawMessage
+	answer := `{"offsets":[{"partition":0,"offset":1,"error_code":null,"error":null}]}`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/topics/audit", r.URL.Path)
+		assert.Equal(t, "application/vnd.kafka.json.v2+json", r.Header.Get("Content-Type"))
+		var body struct {
+			Records []struct {
+				Value json.RawMessage `json:"value"`
+			} `json:"records"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		for _, record := range body.Records {
+			produced = append(produced, record.Value)
+		}
+		w.Write([]byte(answer))
+	}))
+	defer backend.Close()
+
+	sink := newKafkaSink(backend.URL+"/topics/audit", time.Second)
+	assert.Equal(t, nil, sink.Send([]auditEvent{{Type: "sign_in"}, {Type: "sign_out"}}))
+	assert.Equal(t, 2, len(produced))
+	var e auditEvent
+	assert.Equal(t, nil, json.Unmarshal(produced[1], &e))
+	assert.Equal(t, "sign_out", e.Type)
+
+	// a record the REST proxy couldn't produce fails the batch
+	answer = `{"offsets":[{"partition":null,"offset":null,"error_code":50003,"error":"Kafka error: timeout"}]}`
+	err := sink.Send([]auditEvent{{Type: "sign_in"}})
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "error producing to "+backend.URL+"/topics/audit: Kafka error: timeout", err.Error())
+}
+
+func TestBucketSink(t *testing.T) {
+	objects := make(map[string]string)
+	fail := false
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "PUT", r.Method)
+		assert.NotEqual(t, "", r.Header.Get("X-Amz-Content-Sha256"))
+		assert.Equal(t, true, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"))
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		objects[r.URL.Path] = string(body)
+	}))
+	defer backend.Close()
+
+	bucket, _ := url.Parse("s3://audit/proxy")
+	sink := newBucketSink(bucket, "us-east-1", time.Second)
+	assert.Equal(t, "https://audit.s3.us-east-1.amazonaws.com/proxy/", sink.endpoint)
+	sink.endpoint = backend.URL + "/proxy/"
+	sink.signer.(*api.AWSSigner).Credentials = func() (*api.AWSCredentials, error) {
+		return &api.AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, nil
+	}
+
+	first := time.Date(2021, 3, 19, 17, 20, 19, 0, time.UTC)
+	batch := []auditEvent{{Time: first, Type: "sign_in"}, {Time: first.Add(time.Second), Type: "sign_out"}}
+	assert.Equal(t, nil, sink.Send(batch))
+	assert.Equal(t, 1, len(objects))
+	for name, body := range objects {
+		assert.Equal(t, true, strings.HasPrefix(name, "/proxy/2021/03/19/172019.000000000-"))
+		lines := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+		assert.Equal(t, 2, len(lines))
+		var e auditEvent
+		assert.Equal(t, nil, json.Unmarshal([]byte(lines[1]), &e))
+		assert.Equal(t, "sign_out", e.Type)
+	}
+
+	// a batch sent again replaces its object
+	assert.Equal(t, nil, sink.Send(batch))
+	assert.Equal(t, 1, len(objects))
+
+	fail = true
+	assert.NotEqual(t, nil, sink.Send(batch))
+}
+
+func TestAuditEvents(t *testing.T) {
+	batches := make(chan []auditEvent, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []auditEvent
+		json.NewDecoder(r.Body).Decode(&batch)
+		batches <- batch
+	}))
+	defer webhook.Close()
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"my_auth_token"}`))
+	}))
+	defer idp.Close()
+	idpURL, _ := url.Parse(idp.URL)
+
+	opts := testOptions()
+	opts.CookieSecure = false
+	opts.AuditWebhookURL = webhook.URL
+	opts.AuditBatchSize = 1
+	assert.Equal(t, nil, opts.Validate())
+	opts.provider = NewTestProvider(idpURL, "user@example.com")
+	proxy := NewOAuthProxy(opts, func(email string) bool { return email == "user@example.com" })
+
+	next := func() auditEvent {
+		select {
+		case batch := <-batches:
+			assert.Equal(t, 1, len(batch))
+			return batch[0]
+		case <-time.After(5 * time.Second):
+			t.Fatal("no audit event sent")
+		}
+		return auditEvent{}
+	}
+
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	e := next()
+	assert.Equal(t, "sign_in", e.Type)
+	assert.Equal(t, "user@example.com", e.Email)
+
+	signOut, _ := http.NewRequest("GET", "/oauth2/sign_out", nil)
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == proxy.CookieName {
+			signOut.AddCookie(c)
+		}
+	}
+	proxy.ServeHTTP(httptest.NewRecorder(), signOut)
+	e = next()
+	assert.Equal(t, "sign_out", e.Type)
+	assert.Equal(t, "user@example.com", e.Email)
+
+	proxy.provider = NewTestProvider(idpURL, "other@example.com")
+	req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	e = next()
+	assert.Equal(t, "sign_in_denied", e.Type)
+	assert.Equal(t, "other@example.com", e.Email)
+	assert.Equal(t, "unauthorized", e.Reason)
+}
+
+func TestAuditLogFile(t *testing.T) {
+	var out bytes.Buffer
+	auditLogOut = &out
+	defer func() { auditLogOut = nil }()
+
+	// the audit log doesn't need the audit webhook
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	req := httptest.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest("POST", "/oauth2/sign_in", nil)
+	proxy.audit(req, "sign_in", &providers.SessionState{User: "admin"}, "")
+	req = httptest.NewRequest("GET", "/", nil)
+	proxy.streamSessionEvent(req, "session_removed", &providers.SessionState{Email: "user@example.com", AccessToken: "token"}, "invalid token")
+
+	var events []auditEvent
+	lines := bufio.NewScanner(&out)
+	for lines.Scan() {
+		var e auditEvent
+		assert.Equal(t, nil, json.Unmarshal(lines.Bytes(), &e))
+		events = append(events, e)
+	}
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, "sign_in_denied", events[0].Type)
+	assert.Equal(t, "Google", events[0].Provider)
+	assert.Equal(t, "csrf: http: named cookie not present", events[0].Reason)
+	assert.Equal(t, "sign_in", events[1].Type)
+	assert.Equal(t, "admin", events[1].User)
+	assert.Equal(t, "htpasswd", events[1].Provider)
+	assert.Equal(t, "session_removed", events[2].Type)
+	assert.Equal(t, "user@example.com", events[2].Email)
+	assert.Equal(t, "Google", events[2].Provider)
+	assert.Equal(t, "invalid token", events[2].Reason)
+	assert.Equal(t, "192.0.2.1", events[2].ClientIP)
+}
+
+func TestAuditExpiredEmail(t *testing.T) {
+	f, err := ioutil.TempFile("", "test_auth_emails_")
+	assert.Equal(t, nil, err)
+	defer os.Remove(f.Name())
+	f.WriteString("contractor@example.com,expires=2001-01-01\n")
+	f.Close()
+	users := &UserMap{usersFile: f.Name()}
+	users.LoadAuthenticatedEmailsFile()
+
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"my_auth_token"}`))
+	}))
+	defer idp.Close()
+	idpURL, _ := url.Parse(idp.URL)
+
+	opts := testOptions()
+	opts.CookieSecure = false
+	assert.Equal(t, nil, opts.Validate())
+	opts.provider = NewTestProvider(idpURL, "contractor@example.com")
+	proxy := NewOAuthProxy(opts, users.IsValid)
+	proxy.AuthenticatedEmails = users
+	// queued events are read without a sink
+	proxy.auditLog = &auditLog{events: make(chan auditEvent, 10)}
+
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+
+	// existing sessions are removed once their entry expires
+	session := &providers.SessionState{Email: "contractor@example.com", User: "contractor"}
+	value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+	assert.Equal(t, nil, err)
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	close(proxy.auditLog.events)
+	var events []auditEvent
+	for e := range proxy.auditLog.events {
+		assert.Equal(t, "contractor@example.com", e.Email)
+		assert.Equal(t, "expired", e.Reason)
+		events = append(events, e)
+	}
+	assert.Equal(t, []string{"sign_in_denied", "access_denied"}, auditTypes([][]auditEvent{events}))
+}
+
+func TestAuditLogClose(t *testing.T) {
+	sink := &testAuditSink{}
+	a := newAuditLog(sink, "", 10, time.Hour)
+	a.Record(auditEvent{Type: "sign_in"})
+	a.Record(auditEvent{Type: "sign_out"})
+	// the queued events are sent before it stops
+	a.Close()
+	assert.Equal(t, []string{"sign_in", "sign_out"}, auditTypes(sink.batches))
+}
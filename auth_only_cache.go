@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// authOnlyCacheMaxTTL bounds how long a sign out or revocation can take
+	// to apply to the auth endpoint
+	authOnlyCacheMaxTTL = 5 * time.Second
+	// authOnlyCacheMaxEntries bounds the memory used by the auth cache
+	authOnlyCacheMaxEntries = 10000
+)
+
+// authOnlyCachedHeaders are the response headers Authenticate sets, which
+// are replayed with cached results
+var authOnlyCachedHeaders = []string{
+	"X-Auth-Request-User",
+	"X-Auth-Request-Email",
+	"X-Auth-Request-Groups",
+	"X-Auth-Request-Roles",
+	"X-Auth-Request-Experiment-Bucket",
+	"GAP-Auth",
+	"GAP-Session-Expires-In",
+	"GAP-Session-Refresh-URL",
+}
+
+var authOnlyCacheCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "auth_only_cache_total",
+	Help: "Auth endpoint result cache lookups by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(authOnlyCacheCounter)
+}
+
+type authOnlyKey [sha256.Size]byte
+
+type authOnlyEntry struct {
+	header  http.Header
+	expires time.Time
+}
+
+// authOnlyCache remembers the accepted results of the auth endpoint per
+// signed session cookie for a few seconds, as nginx's auth_request calls it
+// for every proxied request
+type authOnlyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[authOnlyKey]authOnlyEntry
+}
+
+func newAuthOnlyCache(ttl time.Duration) *authOnlyCache {
+	return &authOnlyCache{
+		ttl:     ttl,
+		entries: make(map[authOnlyKey]authOnlyEntry),
+	}
+}
+
+func (c *authOnlyCache) Get(key authOnlyKey, now time.Time) (http.Header, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || !now.Before(e.expires) {
+		return nil, false
+	}
+	return e.header, true
+}
+
+func (c *authOnlyCache) Set(key authOnlyKey, header http.Header, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= authOnlyCacheMaxEntries {
+		c.gc(now)
+	}
+	c.entries[key] = authOnlyEntry{header: header, expires: now.Add(c.ttl)}
+}
+
+func (c *authOnlyCache) Invalidate(key authOnlyKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// gc drops the expired entries, or everything when that doesn't make room
+func (c *authOnlyCache) gc(now time.Time) {
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) >= authOnlyCacheMaxEntries {
+		c.entries = make(map[authOnlyKey]authOnlyEntry)
+	}
+}
+
+// authOnlyCacheKey identifies the signed session cookie of req. Requests
+// with several session cookies or an Authorization header aren't cached.
+func (p *OAuthProxy) authOnlyCacheKey(req *http.Request) (authOnlyKey, bool) {
+	cookies := p.sessionCookies(req)
+	if len(cookies) != 1 || req.Header.Get("Authorization") != "" {
+		return authOnlyKey{}, false
+	}
+	return sha256.Sum256([]byte(cookies[0].Value)), true
+}
+
+// authOnlyCacheControl lets nginx cache the accepted results of the auth
+// endpoint itself, keyed by the session cookie
+func (p *OAuthProxy) authOnlyCacheControl(rw http.ResponseWriter) {
+	rw.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(p.authOnlyCache.ttl.Seconds())))
+}
+
+// serveCachedAuthOnly answers the auth endpoint from the cache, returning
+// false on a miss
+func (p *OAuthProxy) serveCachedAuthOnly(rw http.ResponseWriter, key authOnlyKey) bool {
+	header, ok := p.authOnlyCache.Get(key, time.Now())
+	if !ok {
+		authOnlyCacheCounter.WithLabelValues("miss").Inc()
+		return false
+	}
+	authOnlyCacheCounter.WithLabelValues("hit").Inc()
+	for name, values := range header {
+		rw.Header()[name] = values
+	}
+	p.authOnlyCacheControl(rw)
+	rw.WriteHeader(http.StatusAccepted)
+	return true
+}
+
+// cacheAuthOnly remembers an accepted result of the auth endpoint, unless
+// it changed the session cookie
+func (p *OAuthProxy) cacheAuthOnly(rw http.ResponseWriter, key authOnlyKey) {
+	if _, ok := rw.Header()["Set-Cookie"]; ok {
+		return
+	}
+	header := make(http.Header)
+	for _, name := range authOnlyCachedHeaders {
+		if values, ok := rw.Header()[http.CanonicalHeaderKey(name)]; ok {
+			header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	p.authOnlyCache.Set(key, header, time.Now())
+	p.authOnlyCacheControl(rw)
+}
+
+// invalidateAuthOnly drops the cached results for the session cookies of
+// req, on sign out
+func (p *OAuthProxy) invalidateAuthOnly(req *http.Request) {
+	if p.authOnlyCache == nil {
+		return
+	}
+	for _, c := range p.sessionCookies(req) {
+		p.authOnlyCache.Invalidate(sha256.Sum256([]byte(c.Value)))
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestAuthOnlyCacheOptions(t *testing.T) {
+	o := testOptions()
+	o.AuthOnlyCacheTTL = 10 * time.Second
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"auth_only_cache_ttl must be between 0 and 5s"}), err.Error())
+}
+
+func TestAuthOnlyCache(t *testing.T) {
+	opts := testOptions()
+	opts.AuthOnlyCacheTTL = 2 * time.Second
+	opts.SetXAuthRequest = true
+	assert.Equal(t, nil, opts.Validate())
+	validations := 0
+	proxy := NewOAuthProxy(opts, func(string) bool {
+		validations++
+		return true
+	})
+
+	session := &providers.SessionState{Email: "user@example.com", User: "user"}
+	value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+	assert.Equal(t, nil, err)
+	sessionCookie := proxy.MakeSessionCookie(httptest.NewRequest("GET", "/", nil), value, proxy.CookieExpire, time.Now())
+
+	auth := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(sessionCookie)
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := auth("/oauth2/auth")
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, "user@example.com", rw.HeaderMap.Get("X-Auth-Request-Email"))
+	assert.Equal(t, "private, max-age=2", rw.HeaderMap.Get("Cache-Control"))
+	authenticated := validations
+
+	// the cached result is replayed without authenticating again
+	rw = auth("/oauth2/auth")
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, "user@example.com", rw.HeaderMap.Get("X-Auth-Request-Email"))
+	assert.Equal(t, "user", rw.HeaderMap.Get("X-Auth-Request-User"))
+	assert.Equal(t, "user@example.com", rw.HeaderMap.Get("GAP-Auth"))
+	assert.Equal(t, authenticated, validations)
+
+	// requests without the cookie aren't answered from the cache
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/auth", nil))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	// signing out drops the cached result
+	auth("/oauth2/sign_out")
+	rw = auth("/oauth2/auth")
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, 2*authenticated, validations)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// authOutcomes are the outcomes of authentication counted by
+// authOutcomesCounter. Sign ins failing because the provider can't be
+// reached are counted by callback_stage_errors_total instead.
+var authOutcomes = []string{
+	"sign_in",            // a sign in completed, with a provider or htpasswd
+	"validator_rejected", // a user isn't in the authenticated emails, domains or groups
+	"csrf_failed",        // a callback didn't match the sign in it claims to finish
+	"session_expired",    // a session was removed as its token expired
+	"bearer_rejected",    // a bearer token wasn't accepted by the provider
+}
+
+var authOutcomesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "authentication_outcomes_total",
+	Help: "Authentication outcomes: sign_in, validator_rejected, csrf_failed, session_expired or bearer_rejected.",
+}, []string{"outcome"})
+
+func init() {
+	prometheus.MustRegister(authOutcomesCounter)
+	// export every outcome from the start, so alerts on their rates don't
+	// wait for the first of each
+	for _, outcome := range authOutcomes {
+		authOutcomesCounter.WithLabelValues(outcome)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// authOutcomeCounts reads authentication_outcomes_total by outcome
+func authOutcomeCounts(t *testing.T) map[string]float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.Equal(t, nil, err)
+	counts := make(map[string]float64)
+	for _, f := range families {
+		if f.GetName() != "authentication_outcomes_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			counts[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+	}
+	return counts
+}
+
+func TestAuthOutcomes(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	before := authOutcomeCounts(t)
+	// every outcome is exported before it first happens
+	assert.Equal(t, len(authOutcomes), len(before))
+
+	_, err := proxy.CheckBearerAuth("not-a-token")
+	assert.NotEqual(t, nil, err)
+	after := authOutcomeCounts(t)
+	assert.Equal(t, before["bearer_rejected"]+1, after["bearer_rejected"])
+	assert.Equal(t, before["sign_in"], after["sign_in"])
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+// authStateVersion is the version of the auth state bundle format. Proxies
+// import the bundles of their version and older ones.
+const authStateVersion = 1
+
+// The algorithms session cookies are signed and encrypted with, recorded in
+// the bundle so a proxy that changes them refuses it rather than sign
+// everybody out
+const (
+	authStateSignature = "hmac-sha1"
+	authStateCipher    = "aes-cfb"
+)
+
+// authState is what a proxy needs to accept the session cookies of another,
+// exported by -export-auth-state and imported with auth_state_file, so a
+// blue/green cutover keeps users signed in
+type authState struct {
+	Version              int      `json:"version"`
+	Signature            string   `json:"signature"`
+	Cipher               string   `json:"cipher"`
+	CookieName           string   `json:"cookie_name"`
+	CookieNamePrevious   []string `json:"cookie_name_previous,omitempty"`
+	CookieNameAliases    []string `json:"cookie_name_aliases,omitempty"`
+	CookieSecret         string   `json:"cookie_secret"`
+	CookieSecretPrevious string   `json:"cookie_secret_previous,omitempty"`
+	CookieDomain         string   `json:"cookie_domain,omitempty"`
+	CookieExpire         string   `json:"cookie_expire"`
+
+	// the previous cookie format, of a proxy in the middle of a migration
+	CookieMigration             bool   `json:"cookie_migration,omitempty"`
+	CookiePreviousCipher        bool   `json:"cookie_previous_cipher,omitempty"`
+	CookiePreviousSerialization string `json:"cookie_previous_serialization,omitempty"`
+}
+
+// exportAuthState bundles the cookie settings of o
+func exportAuthState(o *Options) ([]byte, error) {
+	return json.MarshalIndent(authState{
+		Version:              authStateVersion,
+		Signature:            authStateSignature,
+		Cipher:               authStateCipher,
+		CookieName:           o.CookieName,
+		CookieNamePrevious:   o.CookieNamePrevious,
+		CookieNameAliases:    o.CookieNameAliases,
+		CookieSecret:         o.CookieSecret,
+		CookieSecretPrevious: o.CookieSecretPrevious,
+		CookieDomain:         o.CookieDomain,
+		CookieExpire:         o.CookieExpire.String(),
+
+		CookieMigration:             o.CookieMigration,
+		CookiePreviousCipher:        o.CookiePreviousCipher,
+		CookiePreviousSerialization: o.CookiePreviousSerialization,
+	}, "", "  ")
+}
+
+// loadAuthState replaces the cookie settings of o with those of the bundle
+// in AuthStateFile. Settings configured with other values than the
+// bundle's are refused rather than silently replaced.
+func loadAuthState(o *Options, msgs []string) []string {
+	if o.AuthStateFile == "" {
+		return msgs
+	}
+	data, err := ioutil.ReadFile(o.AuthStateFile)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error reading auth_state_file: %s", err))
+	}
+	var s authState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return append(msgs, fmt.Sprintf("error parsing auth_state_file %q: %s", o.AuthStateFile, err))
+	}
+	if s.Version < 1 || s.Version > authStateVersion {
+		return append(msgs, fmt.Sprintf("unsupported auth_state_file version %d, expected at most %d", s.Version, authStateVersion))
+	}
+	if s.Signature != authStateSignature || s.Cipher != authStateCipher {
+		return append(msgs, fmt.Sprintf("auth_state_file cookies are signed with %q and encrypted with %q, expected %q and %q",
+			s.Signature, s.Cipher, authStateSignature, authStateCipher))
+	}
+	expire, err := time.ParseDuration(s.CookieExpire)
+	if err != nil || s.CookieName == "" || s.CookieSecret == "" {
+		return append(msgs, fmt.Sprintf("auth_state_file %q is missing the cookie name, secret or expiry", o.AuthStateFile))
+	}
+	if s.CookiePreviousSerialization == "" {
+		s.CookiePreviousSerialization = cookieSerializationSession
+	}
+	defaults := NewOptions()
+	var conflicts []string
+	for _, setting := range []struct {
+		name                     string
+		configured, def, bundled string
+	}{
+		{"cookie_name", o.CookieName, defaults.CookieName, s.CookieName},
+		{"cookie_name_previous", strings.Join(o.CookieNamePrevious, ","), strings.Join(defaults.CookieNamePrevious, ","), strings.Join(s.CookieNamePrevious, ",")},
+		{"cookie_name_aliases", strings.Join(o.CookieNameAliases, ","), strings.Join(defaults.CookieNameAliases, ","), strings.Join(s.CookieNameAliases, ",")},
+		{"cookie_secret", o.CookieSecret, defaults.CookieSecret, s.CookieSecret},
+		{"cookie_secret_previous", o.CookieSecretPrevious, defaults.CookieSecretPrevious, s.CookieSecretPrevious},
+		{"cookie_domain", o.CookieDomain, defaults.CookieDomain, s.CookieDomain},
+		{"cookie_expire", o.CookieExpire.String(), defaults.CookieExpire.String(), expire.String()},
+		{"cookie_migration", fmt.Sprint(o.CookieMigration), fmt.Sprint(defaults.CookieMigration), fmt.Sprint(s.CookieMigration)},
+		{"cookie_previous_cipher", fmt.Sprint(o.CookiePreviousCipher), fmt.Sprint(defaults.CookiePreviousCipher), fmt.Sprint(s.CookiePreviousCipher)},
+		{"cookie_previous_serialization", o.CookiePreviousSerialization, defaults.CookiePreviousSerialization, s.CookiePreviousSerialization},
+	} {
+		if setting.configured != setting.def && setting.configured != setting.bundled {
+			conflicts = append(conflicts, setting.name)
+		}
+	}
+	if len(conflicts) > 0 {
+		return append(msgs, fmt.Sprintf("auth_state_file %q replaces the configured %s, leave them unset or set them to the bundle's",
+			o.AuthStateFile, strings.Join(conflicts, ", ")))
+	}
+	log.Printf("using the cookie settings of auth_state_file %q", o.AuthStateFile)
+	o.CookieName = s.CookieName
+	o.CookieNamePrevious = s.CookieNamePrevious
+	o.CookieNameAliases = s.CookieNameAliases
+	o.CookieSecret = s.CookieSecret
+	o.CookieSecretPrevious = s.CookieSecretPrevious
+	o.CookieDomain = s.CookieDomain
+	o.CookieExpire = expire
+	o.CookieMigration = s.CookieMigration
+	o.CookiePreviousCipher = s.CookiePreviousCipher
+	o.CookiePreviousSerialization = s.CookiePreviousSerialization
+	return msgs
+}
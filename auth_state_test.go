@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestAuthStateCutover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_state")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "auth_state.json")
+
+	// the blue proxy exports its cookie settings
+	blue := testOptions()
+	blue.CookieName = "_blue_session"
+	blue.CookieSecret = previousCookieSecret
+	blue.CookieExpire = 12 * time.Hour
+	blue.PassAccessToken = true
+	assert.Equal(t, nil, blue.Validate())
+	data, err := exportAuthState(blue)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, ioutil.WriteFile(bundle, data, 0600))
+	proxy := NewOAuthProxy(blue, func(string) bool { return true })
+	rw := httptest.NewRecorder()
+	err = proxy.SaveSession(rw, httptest.NewRequest("GET", "/", nil), &providers.SessionState{
+		Email: "user@example.com", AccessToken: "my_access_token",
+	})
+	assert.Equal(t, nil, err)
+
+	// and the green one, leaving the cookie settings to the bundle, accepts
+	// its cookies
+	green := testOptions()
+	green.CookieSecret = ""
+	green.PassAccessToken = true
+	green.AuthStateFile = bundle
+	assert.Equal(t, nil, green.Validate())
+	assert.Equal(t, "_blue_session", green.CookieName)
+	assert.Equal(t, 12*time.Hour, green.CookieExpire)
+	proxy = NewOAuthProxy(green, func(string) bool { return true })
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rw.Result().Cookies()[0])
+	session, _, err := proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@example.com", session.Email)
+	assert.Equal(t, "my_access_token", session.AccessToken)
+}
+
+func TestAuthStateFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_state")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "auth_state.json")
+
+	load := func(data string) error {
+		assert.Equal(t, nil, ioutil.WriteFile(bundle, []byte(data), 0600))
+		o := testOptions()
+		o.CookieSecret = "secret"
+		o.AuthStateFile = bundle
+		return o.Validate()
+	}
+	assert.Equal(t, errorMsg([]string{"unsupported auth_state_file version 2, expected at most 1"}),
+		load(`{"version":2}`).Error())
+	assert.Equal(t, errorMsg([]string{`auth_state_file cookies are signed with "hmac-sha256" and encrypted with "aes-cfb", expected "hmac-sha1" and "aes-cfb"`}),
+		load(`{"version":1,"signature":"hmac-sha256","cipher":"aes-cfb"}`).Error())
+	assert.Equal(t, errorMsg([]string{`auth_state_file "` + bundle + `" is missing the cookie name, secret or expiry`}),
+		load(`{"version":1,"signature":"hmac-sha1","cipher":"aes-cfb","cookie_name":"_oauth2_proxy"}`).Error())
+	assert.Equal(t, nil, load(`{"version":1,"signature":"hmac-sha1","cipher":"aes-cfb","cookie_name":"_oauth2_proxy","cookie_secret":"secret","cookie_expire":"168h0m0s"}`))
+}
+
+func TestAuthStateExportRoundTrip(t *testing.T) {
+	o := testOptions()
+	o.CookieNamePrevious = []string{"_old_session"}
+	o.CookieMigration = true
+	o.CookieSecretPrevious = "previous-secret"
+	o.CookieDomain = ".example.com"
+	assert.Equal(t, nil, o.Validate())
+	data, err := exportAuthState(o)
+	assert.Equal(t, nil, err)
+
+	dir, err := ioutil.TempDir("", "auth_state")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "auth_state.json")
+	assert.Equal(t, nil, ioutil.WriteFile(bundle, data, 0600))
+	imported := testOptions()
+	imported.AuthStateFile = bundle
+	assert.Equal(t, nil, imported.Validate())
+	assert.Equal(t, o.CookieSecret, imported.CookieSecret)
+	assert.Equal(t, []string{"_old_session"}, imported.CookieNamePrevious)
+	assert.Equal(t, true, imported.CookieMigration)
+	assert.Equal(t, "previous-secret", imported.CookieSecretPrevious)
+	assert.Equal(t, ".example.com", imported.CookieDomain)
+}
+
+func TestAuthStateFileConflicts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_state")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	bundle := filepath.Join(dir, "auth_state.json")
+	assert.Equal(t, nil, ioutil.WriteFile(bundle, []byte(`{"version":1,"signature":"hmac-sha1","cipher":"aes-cfb",`+
+		`"cookie_name":"_blue_session","cookie_secret":"`+previousCookieSecret+`","cookie_expire":"12h0m0s"}`), 0600))
+
+	// explicitly configured settings aren't silently replaced
+	o := testOptions()
+	o.CookieSecret = currentCookieSecret
+	o.CookieDomain = ".example.com"
+	o.CookieExpire = time.Hour
+	o.AuthStateFile = bundle
+	assert.Equal(t, errorMsg([]string{`auth_state_file "` + bundle +
+		`" replaces the configured cookie_secret, cookie_domain, cookie_expire, leave them unset or set them to the bundle's`}),
+		o.Validate().Error())
+
+	// but may match the bundle
+	o = testOptions()
+	o.CookieName = "_blue_session"
+	o.CookieSecret = previousCookieSecret
+	o.AuthStateFile = bundle
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 12*time.Hour, o.CookieExpire)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// BlockList denies access to emails and user names even when their domain
+// or the authenticated emails file allows them, ie. departed employees or
+// compromised accounts. It holds the blocked emails given as options, and
+// those of the blocked emails file, one per line.
+type BlockList struct {
+	file    string
+	entries []string
+	m       unsafe.Pointer
+}
+
+// NewBlockList blocks entries, and those of file unless it's empty
+func NewBlockList(entries []string, file string) (*BlockList, error) {
+	bl := &BlockList{file: file, entries: entries}
+	if err := bl.load(); err != nil {
+		return nil, err
+	}
+	return bl, nil
+}
+
+// Watch reloads the blocked emails file whenever it changes. A file that
+// can't be read leaves the previous entries in place.
+func (bl *BlockList) Watch(done <-chan bool) {
+	if bl.file == "" {
+		return
+	}
+	log.Printf("using blocked emails file %s", bl.file)
+	WatchForUpdates(bl.file, done, func() {
+		if err := bl.load(); err != nil {
+			log.Printf("error reloading blocked-emails-file=%q, keeping the previous entries: %s", bl.file, err)
+		}
+	})
+}
+
+func (bl *BlockList) load() error {
+	updated := make(map[string]bool)
+	for _, entry := range bl.entries {
+		updated[strings.ToLower(strings.TrimSpace(entry))] = true
+	}
+	if bl.file != "" {
+		r, err := os.Open(bl.file)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			entry := strings.ToLower(strings.TrimSpace(scanner.Text()))
+			if entry != "" && !strings.HasPrefix(entry, "#") {
+				updated[entry] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	atomic.StorePointer(&bl.m, unsafe.Pointer(&updated))
+	return nil
+}
+
+// IsBlocked tells whether the email or the user name of s is blocked
+func (bl *BlockList) IsBlocked(s *providers.SessionState) bool {
+	if bl == nil || s == nil {
+		return false
+	}
+	m := *(*map[string]bool)(atomic.LoadPointer(&bl.m))
+	return (s.Email != "" && m[strings.ToLower(s.Email)]) || (s.User != "" && m[strings.ToLower(s.User)])
+}
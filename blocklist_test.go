@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestBlockList(t *testing.T) {
+	f, err := ioutil.TempFile("", "test_blocked_emails_")
+	assert.Equal(t, nil, err)
+	defer os.Remove(f.Name())
+	f.WriteString("# departed\nLeaver@Example.com\n\n")
+	f.Close()
+
+	bl, err := NewBlockList([]string{"compromised@example.com"}, f.Name())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, bl.IsBlocked(&providers.SessionState{Email: "leaver@example.com"}))
+	assert.Equal(t, true, bl.IsBlocked(&providers.SessionState{Email: "Compromised@example.com"}))
+	assert.Equal(t, false, bl.IsBlocked(&providers.SessionState{Email: "user@example.com"}))
+	assert.Equal(t, false, (*BlockList)(nil).IsBlocked(&providers.SessionState{Email: "leaver@example.com"}))
+
+	// htpasswd users are blocked by name
+	ioutil.WriteFile(f.Name(), []byte("testuser\n"), 0600)
+	assert.Equal(t, nil, bl.load())
+	assert.Equal(t, true, bl.IsBlocked(&providers.SessionState{User: "testuser"}))
+	assert.Equal(t, false, bl.IsBlocked(&providers.SessionState{Email: "leaver@example.com"}))
+	assert.Equal(t, true, bl.IsBlocked(&providers.SessionState{Email: "compromised@example.com"}))
+
+	// a file that can't be read keeps the previous entries
+	os.Remove(f.Name())
+	assert.NotEqual(t, nil, bl.load())
+	assert.Equal(t, true, bl.IsBlocked(&providers.SessionState{User: "testuser"}))
+}
+
+func TestBlockedSessions(t *testing.T) {
+	opts := testOptions()
+	opts.BlockedEmails = []string{"leaver@example.com", "testuser"}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.PassAccessToken = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	proxy.HtpasswdFile, _ = NewHtpasswd(bytes.NewBufferString("testuser:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=\n"))
+
+	authenticate := func(email string) int {
+		session := &providers.SessionState{Email: email, AccessToken: "token"}
+		value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+		assert.Equal(t, nil, err)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+		return proxy.Authenticate(httptest.NewRecorder(), req)
+	}
+	assert.Equal(t, http.StatusAccepted, authenticate("user@example.com"))
+	assert.Equal(t, http.StatusForbidden, authenticate("leaver@example.com"))
+
+	// the right password doesn't let a blocked htpasswd user in
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("testuser", "asdf")
+	assert.Equal(t, http.StatusForbidden, proxy.Authenticate(httptest.NewRecorder(), req))
+
+	form := url.Values{"username": {"testuser"}, "password": {"asdf"}}
+	req = httptest.NewRequest("POST", "/oauth2/sign_in", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, ok := proxy.ManualSignIn(httptest.NewRecorder(), req)
+	assert.Equal(t, false, ok)
+
+	o := testOptions()
+	o.BlockedEmailsFile = "/nonexistent/blocked"
+	assert.Equal(t, errorMsg([]string{`error reading blocked-emails-file="/nonexistent/blocked": open /nonexistent/blocked: no such file or directory`}), o.Validate().Error())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var botsFilteredCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "bot_requests_filtered_total",
+	Help: "Requests that would have started a sign in, answered 401 as bots, by reason: user_agent or cookies.",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(botsFilteredCounter)
+}
+
+// defaultBotUserAgents match the user agents of crawlers, scanners and
+// HTTP libraries, none of which can sign in with a provider
+var defaultBotUserAgents = []string{
+	`(?i)bot\b`, `(?i)crawl`, `(?i)spider`, `(?i)slurp`, `(?i)scanner`,
+	`(?i)^curl/`, `(?i)^wget/`, `(?i)^python-requests/`, `(?i)^go-http-client/`,
+	`(?i)nmap`, `(?i)nikto`, `(?i)masscan`, `(?i)zgrab`,
+}
+
+const (
+	// botCookieWindow is how long a client that started a sign in without
+	// cookies has to come back with the CSRF cookie
+	botCookieWindow = time.Minute
+	// botCookielessStarts is how many sign ins a client may start within
+	// botCookieWindow without ever sending cookies back
+	botCookielessStarts = 3
+)
+
+// botFilter keeps bots from starting sign ins, which sets a CSRF cookie and
+// redirects to the provider for every protected URL they crawl. Bots are
+// told apart by their user agent, or by starting sign in after sign in
+// without sending back the CSRF cookie of the previous ones, which a
+// browser that can sign in keeps.
+type botFilter struct {
+	userAgents []*regexp.Regexp
+
+	mu         sync.Mutex
+	cookieless map[string]*cookielessStarts
+	lastGC     time.Time
+}
+
+type cookielessStarts struct {
+	count int
+	first time.Time
+}
+
+func newBotFilter(userAgents []*regexp.Regexp) *botFilter {
+	return &botFilter{userAgents: userAgents, cookieless: make(map[string]*cookielessStarts)}
+}
+
+// compileBotUserAgents compiles the default bot user agents, and the
+// configured ones
+func compileBotUserAgents(configured []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range append(defaultBotUserAgents, configured...) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Check reports whether req comes from a bot, and why. Only requests
+// starting a sign in count towards the cookieless starts of their client.
+func (f *botFilter) Check(req *http.Request, starting bool, now time.Time) (string, bool) {
+	userAgent := strings.TrimSpace(req.UserAgent())
+	if userAgent == "" {
+		return "user_agent", true
+	}
+	for _, re := range f.userAgents {
+		if re.MatchString(userAgent) {
+			return "user_agent", true
+		}
+	}
+	if !starting || len(req.Cookies()) > 0 {
+		return "", false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gc(now)
+	// clients behind the same address are told apart by their user agent
+	key := clientIP(req) + " " + userAgent
+	s, ok := f.cookieless[key]
+	if !ok || now.Sub(s.first) > botCookieWindow {
+		s = &cookielessStarts{first: now}
+		f.cookieless[key] = s
+	}
+	s.count++
+	return "cookies", s.count > botCookielessStarts
+}
+
+// gc drops the clients whose window has passed, once a minute
+func (f *botFilter) gc(now time.Time) {
+	if now.Sub(f.lastGC) < time.Minute {
+		return
+	}
+	f.lastGC = now
+	for key, s := range f.cookieless {
+		if now.Sub(s.first) > botCookieWindow {
+			delete(f.cookieless, key)
+		}
+	}
+}
+
+// filterBot answers a request that would start a sign in, or be shown the
+// sign in page, with a 401, and no CSRF cookie, when it comes from a bot.
+// It returns whether it did.
+func (p *OAuthProxy) filterBot(rw http.ResponseWriter, req *http.Request, starting bool) bool {
+	if p.botFilter == nil {
+		return false
+	}
+	reason, bot := p.botFilter.Check(req, starting, time.Now())
+	if !bot {
+		return false
+	}
+	log.Printf("%s filtered bot %q by %s", getRemoteAddr(req), req.UserAgent(), reason)
+	botsFilteredCounter.WithLabelValues(reason).Inc()
+	rw.Header().Set("X-Robots-Tag", "noindex, nofollow")
+	http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+	return true
+}
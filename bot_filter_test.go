@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+const browserUserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/115.0"
+
+func TestFilterBots(t *testing.T) {
+	opts := testOptions()
+	opts.FilterBots = true
+	opts.BotUserAgents = []string{"^InternalMonitor/"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	start := func(userAgent, addr string, cookie bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/oauth2/start?rd=/reports", nil)
+		req.RemoteAddr = addr
+		req.Header.Set("User-Agent", userAgent)
+		if cookie {
+			req.AddCookie(&http.Cookie{Name: "_oauth2_proxy_csrf", Value: "nonce"})
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	for _, userAgent := range []string{"", "Googlebot/2.1 (+http://www.google.com/bot.html)", "curl/8.4.0", "InternalMonitor/1.0"} {
+		rw := start(userAgent, "10.0.0.1:1234", false)
+		assert.Equal(t, http.StatusUnauthorized, rw.Code)
+		assert.Equal(t, "noindex, nofollow", rw.Header().Get("X-Robots-Tag"))
+		assert.Equal(t, "", rw.Header().Get("Set-Cookie"))
+	}
+
+	// a client that never sends back the CSRF cookie is filtered after a few
+	// sign ins, one that does never is
+	var codes []int
+	for i := 0; i < botCookielessStarts+1; i++ {
+		codes = append(codes, start(browserUserAgent, "10.0.0.2:1234", false).Code)
+	}
+	assert.Equal(t, []int{302, 302, 302, 401}, codes)
+	assert.Equal(t, http.StatusFound, start(browserUserAgent, "10.0.0.3:1234", false).Code)
+	for i := 0; i < botCookielessStarts+1; i++ {
+		assert.Equal(t, http.StatusFound, start(browserUserAgent, "10.0.0.2:1234", true).Code)
+	}
+}
+
+func TestBotFilterCookielessWindow(t *testing.T) {
+	f := newBotFilter(nil)
+	req := httptest.NewRequest("GET", "/oauth2/start", nil)
+	req.Header.Set("User-Agent", browserUserAgent)
+	now := time.Now()
+	for i := 0; i < botCookielessStarts; i++ {
+		_, bot := f.Check(req, true, now)
+		assert.Equal(t, false, bot)
+	}
+	// visits of the sign in page don't count
+	_, bot := f.Check(req, false, now)
+	assert.Equal(t, false, bot)
+	reason, bot := f.Check(req, true, now)
+	assert.Equal(t, true, bot)
+	assert.Equal(t, "cookies", reason)
+
+	_, bot = f.Check(req, true, now.Add(botCookieWindow+time.Second))
+	assert.Equal(t, false, bot)
+}
+
+func TestBotFilterOptions(t *testing.T) {
+	o := testOptions()
+	o.BotUserAgents = []string{"^InternalMonitor/"}
+	assert.Equal(t, errorMsg([]string{
+		"bot_user_agents is only used with filter_bots"}), o.Validate().Error())
+
+	o = testOptions()
+	o.FilterBots = true
+	o.BotUserAgents = []string{"("}
+	assert.Equal(t, errorMsg([]string{
+		"error compiling bot-user-agent error parsing regexp: missing closing ): `(`"}), o.Validate().Error())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// cacheControlWriter stamps the Cache-Control header on responses whose
+// content type starts with one of contentTypes, or on all of them, replacing
+// the one the upstream set
+type cacheControlWriter struct {
+	http.ResponseWriter
+	policy       string
+	contentTypes []string
+	wroteHeader  bool
+}
+
+func (w *cacheControlWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.stamp(w.Header().Get("Content-Type"))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheControlWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		contentType := w.Header().Get("Content-Type")
+		if contentType == "" {
+			// the type net/http will sniff for the response
+			contentType = http.DetectContentType(b)
+		}
+		w.stamp(contentType)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheControlWriter) stamp(contentType string) {
+	if len(w.contentTypes) > 0 {
+		contentType = strings.ToLower(contentType)
+		matched := false
+		for _, t := range w.contentTypes {
+			matched = matched || strings.HasPrefix(contentType, strings.ToLower(t))
+		}
+		if !matched {
+			return
+		}
+	}
+	w.Header().Set("Cache-Control", w.policy)
+}
+
+func (w *cacheControlWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *cacheControlWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("webserver doesn't support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// cacheControlRoute tells whether the authenticated responses for path get
+// the Cache-Control header
+func (p *OAuthProxy) cacheControlRoute(path string) bool {
+	if p.cacheControl == "" {
+		return false
+	}
+	if len(p.cacheRoutes) == 0 {
+		return true
+	}
+	for _, r := range p.cacheRoutes {
+		if r.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestCacheControl(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		switch r.URL.Path {
+		case "/app/logo.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("\x89PNG"))
+		case "/app/sniffed":
+			w.Write([]byte("<html><body>report</body></html>"))
+		default:
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`{"balance":42}`))
+		}
+	}))
+	defer backend.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{backend.URL}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.CacheControl = "no-store"
+	opts.CacheControlRoutes = []string{"^/app/"}
+	opts.CacheControlContentTypes = []string{"text/html", "application/json"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	session := &providers.SessionState{Email: "user@example.com", User: "user"}
+	value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+	assert.Equal(t, nil, err)
+	cacheControl := func(path string) string {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 200, rw.Code)
+		return rw.HeaderMap.Get("Cache-Control")
+	}
+
+	assert.Equal(t, "no-store", cacheControl("/app/account"))
+	assert.Equal(t, "no-store", cacheControl("/app/sniffed"))
+	assert.Equal(t, "public, max-age=3600", cacheControl("/app/logo.png"))
+	assert.Equal(t, "public, max-age=3600", cacheControl("/public/account"))
+}
+
+func TestCacheControlOptions(t *testing.T) {
+	o := testOptions()
+	o.CacheControlRoutes = []string{"^/app/"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"cache_control_routes and cache_control_content_types require cache_control",
+	}), err.Error())
+
+	o = testOptions()
+	o.CacheControl = "no-store\r\nSet-Cookie: a=b"
+	o.CacheControlRoutes = []string{"("}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		`invalid cache_control "no-store\r\nSet-Cookie: a=b"`,
+		"error compiling cache-control-route=\"(\" error parsing regexp: missing closing ): `(`",
+	}), err.Error())
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	callbackStageErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "callback_stage_errors_total",
+		Help: "OAuth callbacks that failed, by the stage they failed at.",
+	}, []string{"stage"})
+	callbackStageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "callback_stage_duration_seconds",
+		Help:    "Time spent in each stage of OAuth callbacks.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"stage"})
+)
+
+func init() {
+	prometheus.MustRegister(callbackStageErrorsCounter)
+	prometheus.MustRegister(callbackStageDuration)
+}
+
+// callbackTrace follows an OAuth callback through its stages: authorize,
+// state, csrf, redeem, email, validate and save. Each stage is a span under
+// the request's, and is timed. A failed stage is counted, logged and marked
+// as an error on its span, so a broken login flow shows where it breaks.
+type callbackTrace struct {
+	req        *http.Request
+	remoteAddr string
+
+	stage string
+	span  opentracing.Span
+	start time.Time
+}
+
+func newCallbackTrace(req *http.Request) *callbackTrace {
+	return &callbackTrace{req: req, remoteAddr: getRemoteAddr(req)}
+}
+
+// begin ends the current stage, and starts the next one
+func (t *callbackTrace) begin(stage string) {
+	t.end()
+	t.stage = stage
+	t.span, _ = opentracing.StartSpanFromContext(t.req.Context(), "callback."+stage)
+	t.start = time.Now()
+}
+
+// fail records that the current stage failed with err, and ends it
+func (t *callbackTrace) fail(err error) {
+	if t.span == nil {
+		return
+	}
+	log.Printf("%s callback failed at stage %s: %s", t.remoteAddr, t.stage, err)
+	callbackStageErrorsCounter.WithLabelValues(t.stage).Inc()
+	ext.Error.Set(t.span, true)
+	t.span.LogFields(otlog.String("event", "error"), otlog.Error(err))
+	t.end()
+}
+
+// end ends the current stage, if any
+func (t *callbackTrace) end() {
+	if t.span == nil {
+		return
+	}
+	callbackStageDuration.WithLabelValues(t.stage).Observe(time.Since(t.start).Seconds())
+	t.span.Finish()
+	t.span = nil
+}
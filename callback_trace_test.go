@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestOAuthCallbackStages(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"my_auth_token"}`))
+	}))
+	defer idp.Close()
+	idpURL, _ := url.Parse(idp.URL)
+
+	opts := testOptions()
+	opts.CookieSecure = false
+	assert.Equal(t, nil, opts.Validate())
+	opts.provider = NewTestProvider(idpURL, "user@example.com")
+	proxy := NewOAuthProxy(opts, func(email string) bool { return email == "user@example.com" })
+
+	callback := func(state, csrf string) []string {
+		tracer.Reset()
+		req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(state), nil)
+		req.AddCookie(proxy.MakeCSRFCookie(req, csrf, proxy.CookieExpire, time.Now()))
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+		var stages []string
+		for _, span := range tracer.FinishedSpans() {
+			stage := span.OperationName
+			if span.Tag("error") == true {
+				stage += " failed"
+			}
+			stages = append(stages, stage)
+		}
+		return stages
+	}
+
+	assert.Equal(t, []string{
+		"callback.authorize", "callback.state", "callback.csrf", "callback.redeem",
+		"callback.email", "callback.validate", "callback.save",
+	}, callback("nonce:/", "nonce"))
+	assert.Equal(t, []string{
+		"callback.authorize", "callback.state failed",
+	}, callback("nonce", "nonce"))
+	assert.Equal(t, []string{
+		"callback.authorize", "callback.state", "callback.csrf failed",
+	}, callback("nonce:/", "other"))
+
+	opts.provider = NewTestProvider(idpURL, "other@example.com")
+	proxy.provider = opts.provider
+	assert.Equal(t, []string{
+		"callback.authorize", "callback.state", "callback.csrf", "callback.redeem",
+		"callback.email", "callback.validate failed",
+	}, callback("nonce:/", "nonce"))
+}
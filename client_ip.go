@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// realClientIPHeader is the request header the ingress puts the client's
+// address in, ie. X-Forwarded-For or CF-Connecting-IP. It is set once at
+// startup from --real-client-ip-header; without one requests are identified
+// by the address they were received from, and logged with X-Real-IP.
+var realClientIPHeader string
+
+// clientIP is the address of the client: the one in the real client IP
+// header when it is configured and holds one, or else the address the
+// request was received from
+func clientIP(req *http.Request) string {
+	if realClientIPHeader != "" {
+		if ip := headerClientIP(req.Header.Get(realClientIPHeader)); ip != "" {
+			return ip
+		}
+	}
+	return peerIP(req)
+}
+
+// peerIP is the address the request was received from
+func peerIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// headerClientIP reads the address in a client IP header, or "" when it has
+// none. Of a list, ie. X-Forwarded-For, it is the last address, which the
+// load balancer appended, as the ones before it may come from the client.
+func headerClientIP(value string) string {
+	addrs := strings.Split(value, ",")
+	addr := strings.TrimSpace(addrs[len(addrs)-1])
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if net.ParseIP(addr) == nil {
+		return ""
+	}
+	return addr
+}
+
+// clientIPLogHeader is the header the client's address is logged from along
+// with the address the request was received from
+func clientIPLogHeader() string {
+	if realClientIPHeader != "" {
+		return realClientIPHeader
+	}
+	return "X-Real-IP"
+}
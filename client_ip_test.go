@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func() { realClientIPHeader = "" }()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:53214"
+	req.Header.Set("X-Real-IP", "203.0.113.9")
+	assert.Equal(t, "10.0.0.1", clientIP(req))
+
+	realClientIPHeader = "X-Forwarded-For"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7")
+	assert.Equal(t, "203.0.113.7", clientIP(req))
+	assert.Equal(t, "10.0.0.1", peerIP(req))
+	req.Header.Set("X-Forwarded-For", "[2001:db8::1]:443")
+	assert.Equal(t, "2001:db8::1", clientIP(req))
+
+	// without a valid address the peer is used
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, unknown")
+	assert.Equal(t, "10.0.0.1", clientIP(req))
+	req.Header.Del("X-Forwarded-For")
+	assert.Equal(t, "10.0.0.1", clientIP(req))
+}
+
+func TestRealClientIPHeaderUsedConsistently(t *testing.T) {
+	defer func() { realClientIPHeader = "" }()
+	realClientIPHeader = "Cf-Connecting-Ip"
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:53214"
+	req.Header.Set("CF-Connecting-IP", "203.0.113.7")
+	req.Header.Set("X-Real-IP", "198.51.100.1")
+
+	assert.Equal(t, "10.0.0.1:53214 (\"203.0.113.7\")", getRemoteAddr(req))
+	assert.Equal(t, "203.0.113.7", newAuditEvent(req, "sign_in", &providers.SessionState{Email: "user@example.com"}, "").ClientIP)
+
+	// the header is only honored from trusted downstreams
+	opts := testOptions()
+	opts.TrustedDownstreams = []string{"10.0.0.0/24"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	req.RemoteAddr = "192.0.2.1:53214"
+	proxy.stripForwardedHeaders(req)
+	assert.Equal(t, "", req.Header.Get("CF-Connecting-IP"))
+	assert.Equal(t, "192.0.2.1", clientIP(req))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The serializations of session cookies: the fields of the session, with
+// the tokens encrypted by the cipher, or only the email or user, as written
+// without a cipher before sessions carried more
+const (
+	cookieSerializationSession = "session"
+	cookieSerializationEmail   = "email"
+)
+
+var cookieMigrationCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "session_cookie_migrations_total",
+	Help: "Session cookies read in the previous cookie format and re-issued.",
+})
+
+func init() {
+	prometheus.MustRegister(cookieMigrationCounter)
+}
+
+// cookieFormat is how session cookies were signed, whether their tokens
+// were encrypted, and how they were serialized
+type cookieFormat struct {
+	seed          string
+	cipher        *cookie.Cipher
+	serialization string
+}
+
+// newPreviousCookieFormat is the format of the cookies written before the
+// migration, or nil without cookie_migration. The options were validated,
+// so the cipher can be created.
+func newPreviousCookieFormat(opts *Options) *cookieFormat {
+	if !opts.CookieMigration {
+		return nil
+	}
+	f := &cookieFormat{seed: opts.CookieSecretPrevious, serialization: opts.CookiePreviousSerialization}
+	if f.seed == "" {
+		f.seed = opts.CookieSecret
+	}
+	if opts.CookiePreviousCipher {
+		f.cipher, _ = cookie.NewCipher(secretBytes(f.seed))
+	}
+	return f
+}
+
+// decode deserializes a session from a cookie value in format f
+func (f *cookieFormat) decode(provider providers.Provider, v string) (*providers.SessionState, error) {
+	if f.serialization == cookieSerializationEmail {
+		if strings.Contains(v, "|") {
+			return nil, errors.New("cookie doesn't hold only an email")
+		}
+		return providers.DecodeSessionState(v, nil)
+	}
+	return provider.SessionFromCookie(v, f.cipher)
+}
+
+// decodeSessionCookie validates and decodes c in the current format, then
+// in the previous one. migrated is set when c needs re-issuing in the
+// current format.
+func (p *OAuthProxy) decodeSessionCookie(c *http.Cookie) (s *providers.SessionState, timestamp time.Time, migrated bool, err error) {
+	val, timestamp, ok := cookie.Validate(c, p.CookieSeed, p.CookieExpire)
+	if ok {
+		s, err = p.provider.SessionFromCookie(val, p.CookieCipher)
+		if err == nil || p.previousCookie == nil {
+			return s, timestamp, false, err
+		}
+	}
+	if p.previousCookie != nil {
+		val, timestamp, ok = cookie.Validate(c, p.previousCookie.seed, p.CookieExpire)
+		if ok {
+			s, err = p.previousCookie.decode(p.provider, val)
+			return s, timestamp, true, err
+		}
+	}
+	if err != nil {
+		return nil, timestamp, false, err
+	}
+	return nil, timestamp, false, errors.New("Cookie Signature not valid")
+}
+
+// MigrateCookieValue re-issues a session cookie value in the current format,
+// for clients that store their cookie outside a browser
+func (p *OAuthProxy) MigrateCookieValue(value string) (string, error) {
+	s, _, _, err := p.decodeSessionCookie(&http.Cookie{Name: p.CookieName, Value: value})
+	if err != nil {
+		return "", err
+	}
+	v, err := p.sessionProvider(s).CookieForSession(s, p.CookieCipher)
+	if err != nil {
+		return "", err
+	}
+	return cookie.SignedValue(p.CookieSeed, p.CookieName, v, time.Now()), nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+const (
+	previousCookieSecret = "0123456789abcdefabcdefabcdefabcd"
+	currentCookieSecret  = "fedcba9876543210fedcba9876543210"
+)
+
+func newCookieMigrationProxy(secret, previous string) *OAuthProxy {
+	opts := NewOptions()
+	opts.Upstreams = []string{"http://127.0.0.1:8080/"}
+	opts.CookieSecret = secret
+	if previous != "" {
+		opts.CookieMigration = true
+		opts.CookieSecretPrevious = previous
+		opts.CookiePreviousCipher = true
+	}
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.PassAccessToken = true
+	opts.Validate()
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	proxy.provider = &TestProvider{ValidToken: true}
+	return proxy
+}
+
+func previousSessionCookie(t *testing.T) *http.Cookie {
+	old := newCookieMigrationProxy(previousCookieSecret, "")
+	req, _ := http.NewRequest("GET", "/", nil)
+	rw := httptest.NewRecorder()
+	err := old.SaveSession(rw, req, &providers.SessionState{
+		Email: "user@example.com", AccessToken: "my_access_token",
+	})
+	assert.Equal(t, nil, err)
+	return rw.Result().Cookies()[0]
+}
+
+func TestCookieMigrationDualRead(t *testing.T) {
+	c := previousSessionCookie(t)
+
+	proxy := newCookieMigrationProxy(currentCookieSecret, "")
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(c)
+	_, _, err := proxy.LoadCookiedSession(req)
+	assert.NotEqual(t, nil, err)
+
+	proxy = newCookieMigrationProxy(currentCookieSecret, previousCookieSecret)
+	session, _, err := proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@example.com", session.Email)
+	assert.Equal(t, "my_access_token", session.AccessToken)
+
+	// the cookie is re-issued in the current format
+	rw := httptest.NewRecorder()
+	assert.Equal(t, http.StatusAccepted, proxy.Authenticate(rw, req))
+	cookies := rw.Result().Cookies()
+	assert.Equal(t, 1, len(cookies))
+
+	current := newCookieMigrationProxy(currentCookieSecret, "")
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	session, _, err = current.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "my_access_token", session.AccessToken)
+
+	// cookies in the current format aren't re-issued
+	rw = httptest.NewRecorder()
+	assert.Equal(t, http.StatusAccepted, proxy.Authenticate(rw, req))
+	assert.Equal(t, 0, len(rw.Result().Cookies()))
+}
+
+func TestMigrateCookieValue(t *testing.T) {
+	c := previousSessionCookie(t)
+	proxy := newCookieMigrationProxy(currentCookieSecret, previousCookieSecret)
+
+	value, err := proxy.MigrateCookieValue(c.Value)
+	assert.Equal(t, nil, err)
+
+	current := newCookieMigrationProxy(currentCookieSecret, "")
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: current.CookieName, Value: value})
+	session, _, err := current.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "my_access_token", session.AccessToken)
+
+	_, err = proxy.MigrateCookieValue("garbage")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestCookieMigrationToEncrypted(t *testing.T) {
+	// cookies written without a cipher, before tokens were passed upstream
+	opts := testOptions()
+	opts.CookieSecret = previousCookieSecret
+	assert.Equal(t, nil, opts.Validate())
+	old := NewOAuthProxy(opts, func(string) bool { return true })
+	req := httptest.NewRequest("GET", "/", nil)
+	rw := httptest.NewRecorder()
+	assert.Equal(t, nil, old.SaveSession(rw, req, &providers.SessionState{Email: "user@example.com"}))
+	c := rw.Result().Cookies()[0]
+	assert.Equal(t, -1, strings.Index(c.Value, "|my_access_token"))
+
+	// are read by a proxy encrypting them with a new secret
+	opts = testOptions()
+	opts.CookieSecret = currentCookieSecret
+	opts.PassAccessToken = true
+	opts.CookieMigration = true
+	opts.CookieSecretPrevious = previousCookieSecret
+	opts.CookiePreviousSerialization = cookieSerializationEmail
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	proxy.provider = &TestProvider{ValidToken: true}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(c)
+	session, _, migrated, err := proxy.loadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, migrated)
+	assert.Equal(t, "user@example.com", session.Email)
+
+	// and re-issued in the current format
+	rw = httptest.NewRecorder()
+	assert.Equal(t, http.StatusAccepted, proxy.Authenticate(rw, req))
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(rw.Result().Cookies()[0])
+	session, _, migrated, err = proxy.loadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, migrated)
+	assert.Equal(t, "user@example.com", session.Email)
+
+	// cookies with more fields weren't written in the previous format
+	value := cookie.SignedValue(previousCookieSecret, proxy.CookieName, "user@example.com||1600000000|", time.Now())
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: proxy.CookieName, Value: value})
+	_, _, _, err = proxy.loadCookiedSession(req)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestCookieMigrationOptions(t *testing.T) {
+	o := testOptions()
+	o.CookieSecretPrevious = previousCookieSecret
+	assert.Equal(t, errorMsg([]string{
+		"cookie_secret_previous, cookie_previous_cipher and cookie_previous_serialization are only used with cookie_migration"}),
+		o.Validate().Error())
+
+	o = testOptions()
+	o.CookieMigration = true
+	o.CookiePreviousSerialization = "json"
+	assert.Equal(t, errorMsg([]string{
+		`invalid cookie_previous_serialization "json", expected session or email`}),
+		o.Validate().Error())
+
+	// the previous format has to differ from the current one
+	o = testOptions()
+	o.CookieMigration = true
+	assert.Equal(t, errorMsg([]string{
+		"cookie_migration needs a previous format other than the current one: set cookie_secret_previous, cookie_previous_cipher or cookie_previous_serialization"}),
+		o.Validate().Error())
+	o = testOptions()
+	o.CookieSecret = currentCookieSecret
+	o.CookieMigration = true
+	o.CookiePreviousCipher = true
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestCookieNameAliases(t *testing.T) {
+	old := newCookieMigrationProxy(currentCookieSecret, "")
+	old.CookieName = "_legacy_proxy"
+	req, _ := http.NewRequest("GET", "/", nil)
+	rw := httptest.NewRecorder()
+	err := old.SaveSession(rw, req, &providers.SessionState{
+		Email: "user@example.com", AccessToken: "my_access_token",
+	})
+	assert.Equal(t, nil, err)
+	legacy := rw.Result().Cookies()[0]
+
+	proxy := newCookieMigrationProxy(currentCookieSecret, "")
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(legacy)
+	_, _, err = proxy.LoadCookiedSession(req)
+	assert.NotEqual(t, nil, err)
+
+	proxy.cookieNameAliases = []string{"_legacy_proxy"}
+	session, _, err := proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "my_access_token", session.AccessToken)
+
+	// the session is re-issued under the cookie name, and the alias expired
+	rw = httptest.NewRecorder()
+	assert.Equal(t, http.StatusAccepted, proxy.Authenticate(rw, req))
+	var reissued *http.Cookie
+	expired := 0
+	for _, c := range rw.Result().Cookies() {
+		switch {
+		case c.Name == proxy.CookieName && c.Value != "":
+			reissued = c
+		case c.Name == "_legacy_proxy" && c.Value == "":
+			expired++
+		}
+	}
+	assert.NotEqual(t, (*http.Cookie)(nil), reissued)
+	assert.NotEqual(t, 0, expired)
+
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.AddCookie(reissued)
+	session, _, err = proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@example.com", session.Email)
+
+	// an alias cookie left next to a current one is only expired
+	req.AddCookie(legacy)
+	rw = httptest.NewRecorder()
+	assert.Equal(t, http.StatusAccepted, proxy.Authenticate(rw, req))
+	for _, c := range rw.Result().Cookies() {
+		assert.Equal(t, "_legacy_proxy", c.Name)
+	}
+}
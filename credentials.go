@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// credentialRotation is the admin endpoint rotating the client ID and secret
+// of a provider of the running configuration. Unlike a reload, it keeps the
+// state of rate limits, caches and upstream health. Sessions are kept either
+// way, as they're encrypted with the cookie secret.
+type credentialRotation struct {
+	token string
+	proxy atomic.Value
+}
+
+func newCredentialRotation(token string, proxy *OAuthProxy) *credentialRotation {
+	r := &credentialRotation{token: token}
+	r.Store(proxy)
+	return r
+}
+
+// Store makes the rotations apply to proxy, the proxy of the configuration
+// that was just loaded
+func (r *credentialRotation) Store(proxy *OAuthProxy) {
+	r.proxy.Store(proxy)
+}
+
+// ServeHTTP rotates the credentials to the client_id and client_secret form
+// values, either of which keeps its current value when empty, of the
+// provider with the id in the provider form value, or the primary provider
+func (r *credentialRotation) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(r.token)) != 1 {
+		http.Error(rw, "invalid admin token", http.StatusUnauthorized)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clientID, clientSecret := req.PostForm.Get("client_id"), req.PostForm.Get("client_secret")
+	if clientID == "" && clientSecret == "" {
+		http.Error(rw, "missing client_id and client_secret", http.StatusBadRequest)
+		return
+	}
+	id := req.PostForm.Get("provider")
+	provider := r.proxy.Load().(*OAuthProxy).rotatedProvider(id)
+	if provider == nil {
+		http.Error(rw, fmt.Sprintf("unknown provider %q", id), http.StatusNotFound)
+		return
+	}
+
+	data := provider.Data()
+	credentials := data.Credentials()
+	if clientID != "" {
+		credentials.ClientID = clientID
+	}
+	if clientSecret != "" {
+		credentials.ClientSecret = clientSecret
+	}
+	data.SetCredentials(credentials)
+	log.Printf("%s rotated the credentials of %s, client ID %s", getRemoteAddr(req), data.ProviderName, credentials.ClientID)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// rotatedProvider is the provider whose credentials are rotated for id: the
+// extra provider with that id, or the primary provider for an empty id or
+// its own
+func (p *OAuthProxy) rotatedProvider(id string) providers.Provider {
+	if id == "" || id == p.providerID {
+		return p.provider
+	}
+	if e := p.extraProvider(id); e != nil {
+		return e.provider
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+const testAdminToken = "0123456789abcdef"
+
+func TestAdminTokenOptions(t *testing.T) {
+	o := testOptions()
+	o.AdminToken = "short"
+	assert.Equal(t, errorMsg([]string{
+		"admin_token must be at least 16 bytes",
+		"admin_token is only used with admin_address"}), o.Validate().Error())
+}
+
+func TestCredentialRotation(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	rotation := newCredentialRotation(testAdminToken, proxy)
+
+	rotate := func(token string, form url.Values) int {
+		req := httptest.NewRequest("POST", "/credentials", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rw := httptest.NewRecorder()
+		rotation.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, rotate("another token!!!", url.Values{"client_secret": {"rotated"}}))
+	assert.Equal(t, http.StatusBadRequest, rotate(testAdminToken, url.Values{}))
+	assert.Equal(t, http.StatusNotFound, rotate(testAdminToken, url.Values{"client_secret": {"rotated"}, "provider": {"github"}}))
+	assert.Equal(t, opts.ClientSecret, proxy.provider.Data().Credentials().ClientSecret)
+
+	assert.Equal(t, http.StatusNoContent, rotate(testAdminToken, url.Values{"client_secret": {"rotated"}}))
+	credentials := proxy.provider.Data().Credentials()
+	assert.Equal(t, opts.ClientID, credentials.ClientID)
+	assert.Equal(t, "rotated", credentials.ClientSecret)
+
+	// rotations apply to the proxy of the reloaded configuration
+	opts = testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	next := NewOAuthProxy(opts, func(string) bool { return true })
+	rotation.Store(next)
+	assert.Equal(t, http.StatusNoContent, rotate(testAdminToken, url.Values{"client_id": {"rotated-id"}}))
+	assert.Equal(t, "rotated-id", next.provider.Data().Credentials().ClientID)
+	assert.Equal(t, opts.ClientSecret, next.provider.Data().Credentials().ClientSecret)
+	assert.Equal(t, "rotated", proxy.provider.Data().Credentials().ClientSecret)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// csrfStateKey keeps the signatures of states apart from those of
+	// cookies made with the same secret
+	csrfStateKey = "csrf_state"
+	// csrfStateMaxAge is how long a signed state is accepted without the
+	// CSRF cookie, long enough to sign in with the provider
+	csrfStateMaxAge = 5 * time.Minute
+)
+
+var csrfChecksCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "csrf_checks_total",
+	Help: "CSRF checks of OAuth callbacks by result: cookie, state_fallback or failed.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(csrfChecksCounter)
+}
+
+// csrfState is the nonce as sent in the state parameter of a sign in started
+// by req. With the state fallback, the time and a signature of the nonce and
+// the client's address are appended to it, as in
+// "<nonce>|<time>|<signature>". The nonce stays readable, as it tells which
+// provider the sign in is started with.
+func (p *OAuthProxy) csrfState(req *http.Request, nonce string, now time.Time) string {
+	if !p.CSRFStateFallback {
+		return nonce
+	}
+	signed := cookie.SignedValue(p.CookieSeed, csrfStateKey, csrfStateValue(req, nonce), now)
+	return nonce + "|" + strings.SplitN(signed, "|", 2)[1]
+}
+
+// csrfStateValue is what the state of a sign in started by req signs: its
+// nonce and the client's address, so that another client can't complete
+// the sign in without the CSRF cookie
+func csrfStateValue(req *http.Request, nonce string) string {
+	return nonce + " " + clientIP(req)
+}
+
+// checkCSRF checks the nonce in the state of a callback against the CSRF
+// cookie. Safari drops the cookie in some cross-site callbacks, so with the
+// state fallback, a state signed for the same client address less than
+// csrfStateMaxAge ago is accepted once when the cookie is missing. The
+// error is shown to the user.
+func (p *OAuthProxy) checkCSRF(req *http.Request, state string) error {
+	parts := strings.Split(state, "|")
+	nonce := parts[0]
+	c, err := req.Cookie(p.CSRFCookieName)
+	switch {
+	case err == nil && c.Value == nonce:
+		csrfChecksCounter.WithLabelValues("cookie").Inc()
+		return nil
+	case err == nil:
+		err = errors.New("csrf failed")
+	case p.CSRFStateFallback && len(parts) == 3 && p.validCSRFState(req, parts):
+		// a replayed callback must not sign in another browser
+		if p.csrfNonces.Use(nonce, time.Now()) {
+			csrfChecksCounter.WithLabelValues("state_fallback").Inc()
+			return nil
+		}
+		err = errors.New("csrf state already used")
+	}
+	csrfChecksCounter.WithLabelValues("failed").Inc()
+	return err
+}
+
+func (p *OAuthProxy) validCSRFState(req *http.Request, parts []string) bool {
+	value := csrfStateValue(req, parts[0])
+	c := &http.Cookie{
+		Name:  csrfStateKey,
+		Value: base64.URLEncoding.EncodeToString([]byte(value)) + "|" + parts[1] + "|" + parts[2],
+	}
+	_, _, ok := cookie.Validate(c, p.CookieSeed, csrfStateMaxAge)
+	return ok
+}
+
+// csrfNonces remembers the nonces of the states accepted without the CSRF
+// cookie until their states expire, so each is only accepted once
+type csrfNonces struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	lastGC time.Time
+}
+
+func newCSRFNonces() *csrfNonces {
+	return &csrfNonces{seen: make(map[string]time.Time)}
+}
+
+// Use reports whether nonce wasn't used before, and marks it used
+func (n *csrfNonces) Use(nonce string, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.gc(now)
+	if _, ok := n.seen[nonce]; ok {
+		return false
+	}
+	n.seen[nonce] = now
+	return true
+}
+
+// gc drops the nonces whose states expired, once a minute. A state was
+// signed before its nonce was used, so it expired by then too.
+func (n *csrfNonces) gc(now time.Time) {
+	if now.Sub(n.lastGC) < time.Minute {
+		return
+	}
+	n.lastGC = now
+	for nonce, used := range n.seen {
+		if now.Sub(used) > csrfStateMaxAge {
+			delete(n.seen, nonce)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestCSRFStateFallback(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"my_auth_token"}`))
+	}))
+	defer idp.Close()
+	idpURL, _ := url.Parse(idp.URL)
+
+	opts := testOptions()
+	opts.CookieSecure = false
+	opts.CSRFStateFallback = true
+	assert.Equal(t, nil, opts.Validate())
+	opts.provider = NewTestProvider(idpURL, "user@example.com")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	req := httptest.NewRequest("GET", "/oauth2/start?rd=/app", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	loginURL, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	state := loginURL.Query().Get("state")
+	nonce := strings.SplitN(state, "|", 2)[0]
+	assert.Equal(t, 3, len(strings.Split(strings.SplitN(state, ":", 2)[0], "|")))
+
+	callbackFrom := func(addr, state, csrf string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(state), nil)
+		req.RemoteAddr = addr
+		if csrf != "" {
+			req.AddCookie(proxy.MakeCSRFCookie(req, csrf, proxy.CookieExpire, time.Now()))
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	callback := func(state, csrf string) *httptest.ResponseRecorder {
+		return callbackFrom("10.0.0.1:5678", state, csrf)
+	}
+
+	rw = callback(state, nonce)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/app", rw.HeaderMap.Get("Location"))
+	// the signed state stands in for a dropped cookie, once, and only for
+	// the client that started the sign in
+	assert.Equal(t, 403, callbackFrom("10.0.0.2:5678", state, "").Code)
+	rw = callback(state, "")
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/app", rw.HeaderMap.Get("Location"))
+	assert.Equal(t, 403, callback(state, "").Code)
+
+	// but not for one that doesn't match
+	assert.Equal(t, 403, callback(state, "other").Code)
+	assert.Equal(t, 403, callback(nonce+":/app", "").Code)
+	tampered := strings.Replace(state, nonce, "0"+nonce[1:], 1)
+	if tampered == state {
+		tampered = strings.Replace(state, nonce, "1"+nonce[1:], 1)
+	}
+	assert.Equal(t, 403, callback(tampered, "").Code)
+	old := proxy.csrfState(req, nonce, time.Now().Add(-csrfStateMaxAge-time.Minute))
+	assert.Equal(t, 403, callback(old+":/app", "").Code)
+
+	proxy.CSRFStateFallback = false
+	assert.Equal(t, nonce, proxy.csrfState(req, nonce, time.Now()))
+	assert.Equal(t, 403, callback(state, "").Code)
+	assert.Equal(t, 302, callback(state, nonce).Code)
+}
+
+func TestCSRFNonces(t *testing.T) {
+	n := newCSRFNonces()
+	now := time.Now()
+	assert.Equal(t, true, n.Use("nonce", now))
+	assert.Equal(t, false, n.Use("nonce", now.Add(time.Minute)))
+	assert.Equal(t, true, n.Use("other", now.Add(time.Minute)))
+
+	// forgotten once their states expired
+	later := now.Add(csrfStateMaxAge + 2*time.Minute)
+	assert.Equal(t, true, n.Use("nonce", later))
+	assert.Equal(t, 1, len(n.seen))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// accessDecision is the outcome of the per-request authorization checks
+type accessDecision int
+
+const (
+	accessAllowed accessDecision = iota
+	// accessDeniedUser means the session's user is no longer authorized at
+	// all, eg. they were removed from the authenticated emails file
+	accessDeniedUser
+	// accessDeniedRoute means the session may not access the requested path
+	accessDeniedRoute
+)
+
+// decisionCacheMaxSessions bounds the memory used by the decision cache
+const decisionCacheMaxSessions = 10000
+
+type sessionKey [sha256.Size]byte
+
+// decisionSessionKey identifies a session. It covers the access token and
+// expiry, so a refreshed session gets a new key.
+func decisionSessionKey(s *providers.SessionState) sessionKey {
+	return sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%d|%s",
+		s.User, s.Email, s.ExpiresOn.Unix(), s.AccessToken)))
+}
+
+type decisionEntry struct {
+	decision accessDecision
+	expires  time.Time
+}
+
+// decisionCache remembers access decisions per session and path policy for
+// ttl, so requests from the same session don't re-evaluate them
+type decisionCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[sessionKey]map[string]decisionEntry
+}
+
+func newDecisionCache(ttl time.Duration) *decisionCache {
+	return &decisionCache{
+		ttl:      ttl,
+		sessions: make(map[sessionKey]map[string]decisionEntry),
+	}
+}
+
+func (c *decisionCache) Get(session sessionKey, policy string, now time.Time) (accessDecision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.sessions[session][policy]
+	if !ok || now.After(e.expires) {
+		return accessAllowed, false
+	}
+	return e.decision, true
+}
+
+func (c *decisionCache) Set(session sessionKey, policy string, d accessDecision, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	policies, ok := c.sessions[session]
+	if !ok {
+		if len(c.sessions) >= decisionCacheMaxSessions {
+			c.gc(now)
+		}
+		policies = make(map[string]decisionEntry)
+		c.sessions[session] = policies
+	}
+	policies[policy] = decisionEntry{decision: d, expires: now.Add(c.ttl)}
+}
+
+// Invalidate drops every decision made for session
+func (c *decisionCache) Invalidate(session sessionKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sessions, session)
+}
+
+// gc drops the expired decisions, or everything when that doesn't make room
+func (c *decisionCache) gc(now time.Time) {
+	for session, policies := range c.sessions {
+		for policy, e := range policies {
+			if now.After(e.expires) {
+				delete(policies, policy)
+			}
+		}
+		if len(policies) == 0 {
+			delete(c.sessions, session)
+		}
+	}
+	if len(c.sessions) >= decisionCacheMaxSessions {
+		c.sessions = make(map[sessionKey]map[string]decisionEntry)
+	}
+}
+
+// pathPolicy names the route policy that applies to path, so that paths
+// sharing a policy share cached decisions
+func (p *OAuthProxy) pathPolicy(path string) string {
+	for _, r := range p.guestRoutes {
+		if r.MatchString(path) {
+			return "guest:" + r.String()
+		}
+	}
+	if name := p.guestUpstream(path); name != "" {
+		return "guest-upstream:" + name
+	}
+	return ""
+}
+
+// decideAccess runs the authorization checks for a session requesting path
+func (p *OAuthProxy) decideAccess(s *providers.SessionState, path string) accessDecision {
+	if p.blockList.IsBlocked(s) {
+		return accessDeniedUser
+	}
+	if s.Email != "" && !p.Validator(s.Email) {
+		return accessDeniedUser
+	}
+	if isGuestSession(s) && !p.IsGuestRoute(path) {
+		return accessDeniedRoute
+	}
+	return accessAllowed
+}
+
+// authorize is decideAccess, cached when the decision cache is enabled
+func (p *OAuthProxy) authorize(s *providers.SessionState, path string) accessDecision {
+	if p.decisions == nil {
+		return p.decideAccess(s, path)
+	}
+	now := time.Now()
+	key, policy := decisionSessionKey(s), p.pathPolicy(path)
+	if d, ok := p.decisions.Get(key, policy, now); ok {
+		decisionCacheCounter.WithLabelValues("hit").Inc()
+		return d
+	}
+	decisionCacheCounter.WithLabelValues("miss").Inc()
+	d := p.decideAccess(s, path)
+	p.decisions.Set(key, policy, d, now)
+	return d
+}
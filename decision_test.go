@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestDecisionCacheExpiry(t *testing.T) {
+	c := newDecisionCache(time.Minute)
+	key := decisionSessionKey(&providers.SessionState{Email: "user@example.com"})
+	now := time.Now()
+
+	_, ok := c.Get(key, "", now)
+	assert.Equal(t, false, ok)
+
+	c.Set(key, "", accessDeniedRoute, now)
+	d, ok := c.Get(key, "", now.Add(30*time.Second))
+	assert.Equal(t, true, ok)
+	assert.Equal(t, accessDeniedRoute, d)
+
+	_, ok = c.Get(key, "other", now)
+	assert.Equal(t, false, ok)
+	_, ok = c.Get(key, "", now.Add(2*time.Minute))
+	assert.Equal(t, false, ok)
+
+	c.Set(key, "", accessAllowed, now)
+	c.Invalidate(key)
+	_, ok = c.Get(key, "", now)
+	assert.Equal(t, false, ok)
+}
+
+func TestDecisionSessionKeyChangesOnRefresh(t *testing.T) {
+	s := &providers.SessionState{Email: "user@example.com", AccessToken: "a", ExpiresOn: time.Now()}
+	before := decisionSessionKey(s)
+	s.AccessToken = "b"
+	s.ExpiresOn = s.ExpiresOn.Add(time.Hour)
+	assert.NotEqual(t, before, decisionSessionKey(s))
+}
+
+func TestAuthenticateCachesDecisions(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.Upstreams = []string{"http://127.0.0.1:8080/"}
+	opts.AuthDecisionCacheTTL = time.Minute
+	assert.Equal(t, nil, opts.Validate())
+
+	validations := 0
+	proxy := NewOAuthProxy(opts, func(email string) bool {
+		validations++
+		return true
+	})
+	value, _ := proxy.provider.CookieForSession(&providers.SessionState{Email: "user@example.com"}, proxy.CookieCipher)
+
+	for _, path := range []string{"/a", "/b", "/a"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+		assert.Equal(t, http.StatusAccepted, proxy.Authenticate(httptest.NewRecorder(), req))
+	}
+	assert.Equal(t, 1, validations)
+}
+
+func TestPathPolicyGroupsGuestRoutes(t *testing.T) {
+	proxy, upstream := newGuestTestProxy(t)
+	defer upstream.Close()
+
+	assert.Equal(t, proxy.pathPolicy("/review/1"), proxy.pathPolicy("/review/2"))
+	assert.NotEqual(t, proxy.pathPolicy("/review/1"), proxy.pathPolicy("/admin"))
+	assert.Equal(t, proxy.pathPolicy("/admin"), proxy.pathPolicy("/other"))
+}
+
+func TestDecisionCacheTTLNotNegative(t *testing.T) {
+	o := testOptions()
+	o.AuthDecisionCacheTTL = -time.Second
+	assert.NotEqual(t, nil, o.Validate())
+}
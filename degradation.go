@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// errorBudgetBuckets is the resolution of the sliding window
+	errorBudgetBuckets = 10
+	// errorBudgetMinCalls is how many provider calls the window must hold
+	// before their error rate is trusted
+	errorBudgetMinCalls = 10
+)
+
+var (
+	degradedModeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "provider_degraded_mode",
+		Help: "Whether existing sessions are trusted because the provider is failing.",
+	})
+	degradedDecisionsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "degraded_mode_decisions_total",
+		Help: "Sessions kept in degraded mode, by the check that was relaxed.",
+	}, []string{"check"})
+)
+
+func init() {
+	prometheus.MustRegister(degradedModeGauge)
+	prometheus.MustRegister(degradedDecisionsCounter)
+}
+
+type errorBudgetBucket struct {
+	start  time.Time
+	calls  int
+	errors int
+}
+
+// errorBudget tracks the error rate of calls to the provider over a sliding
+// window. While it exceeds threshold the proxy runs in degraded mode, and
+// it returns to strict mode as soon as the rate drops again.
+type errorBudget struct {
+	mu        sync.Mutex
+	threshold float64
+	window    time.Duration
+	buckets   [errorBudgetBuckets]errorBudgetBucket
+	degraded  bool
+}
+
+func newErrorBudget(threshold float64, window time.Duration) *errorBudget {
+	return &errorBudget{threshold: threshold, window: window}
+}
+
+// Record counts a call to the provider, and whether it failed
+func (b *errorBudget) Record(now time.Time, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	width := b.window / errorBudgetBuckets
+	start := now.Truncate(width)
+	bucket := &b.buckets[(start.UnixNano()/int64(width))%errorBudgetBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = errorBudgetBucket{start: start}
+	}
+	bucket.calls++
+	if failed {
+		bucket.errors++
+	}
+	b.update(now)
+}
+
+// Degraded reports whether the error rate over the window exceeds the
+// threshold
+func (b *errorBudget) Degraded(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.update(now)
+	return b.degraded
+}
+
+func (b *errorBudget) update(now time.Time) {
+	var calls, errors int
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) < b.window {
+			calls += bucket.calls
+			errors += bucket.errors
+		}
+	}
+	degraded := calls >= errorBudgetMinCalls && float64(errors)/float64(calls) > b.threshold
+	if degraded == b.degraded {
+		return
+	}
+	b.degraded = degraded
+	if degraded {
+		log.Printf("provider error rate %d/%d over %s exceeds %.2f, entering degraded mode", errors, calls, b.window, b.threshold)
+		degradedModeGauge.Set(1)
+	} else {
+		log.Printf("provider error rate %d/%d over %s is back under %.2f, leaving degraded mode", errors, calls, b.window, b.threshold)
+		degradedModeGauge.Set(0)
+	}
+}
+
+// degraded reports whether checks against the provider are relaxed
+func (p *OAuthProxy) degraded() bool {
+	return p.errorBudget != nil && p.errorBudget.Degraded(time.Now())
+}
+
+// recordProviderCall feeds the outcome of a call to the provider into the
+// error budget
+func (p *OAuthProxy) recordProviderCall(failed bool) {
+	if p.errorBudget != nil {
+		p.errorBudget.Record(time.Now(), failed)
+	}
+}
+
+// trustDegraded reports whether a session failing check may be kept
+// because the proxy is in degraded mode, and its token didn't expire longer
+// than the grace period ago
+func (p *OAuthProxy) trustDegraded(remoteAddr string, s *providers.SessionState, check string) bool {
+	if s == nil || !p.degraded() {
+		return false
+	}
+	if !s.ExpiresOn.IsZero() && providers.Now().Sub(s.ExpiresOn) > p.DegradedSessionGrace {
+		return false
+	}
+	log.Printf("%s degraded mode: keeping session %s despite failed %s", remoteAddr, s, check)
+	degradedDecisionsCounter.WithLabelValues(check).Inc()
+	return true
+}
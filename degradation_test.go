@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestErrorBudget(t *testing.T) {
+	b := newErrorBudget(0.5, time.Minute)
+	now := time.Now()
+
+	// too few calls to judge
+	for i := 0; i < errorBudgetMinCalls-1; i++ {
+		b.Record(now, true)
+	}
+	assert.Equal(t, false, b.Degraded(now))
+	b.Record(now, true)
+	assert.Equal(t, true, b.Degraded(now))
+
+	// successes bring the rate back under the threshold
+	for i := 0; i < errorBudgetMinCalls; i++ {
+		b.Record(now, false)
+	}
+	assert.Equal(t, false, b.Degraded(now))
+
+	for i := 0; i < 2*errorBudgetMinCalls; i++ {
+		b.Record(now, true)
+	}
+	assert.Equal(t, true, b.Degraded(now))
+	// the failures age out of the window
+	assert.Equal(t, false, b.Degraded(now.Add(time.Minute+time.Second)))
+}
+
+func TestDegradationOptions(t *testing.T) {
+	o := testOptions()
+	o.DegradeErrorRate = 1.5
+	o.DegradeWindow = 0
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"degrade_error_rate must be between 0 and 1",
+		"degrade_window must be at least 1s",
+	}), err.Error())
+
+	o = testOptions()
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, (*errorBudget)(nil), o.errorBudget)
+}
+
+func TestDegradedModeTrustsSessions(t *testing.T) {
+	opts := testOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.CookieRefresh = time.Hour
+	opts.DegradeErrorRate = 0.5
+	opts.DegradeSessionGrace = time.Hour
+	assert.Equal(t, nil, opts.Validate())
+	provider := NewTestProvider(&url.URL{Host: "localhost"}, "user@example.com")
+	opts.provider = provider
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	session := &providers.SessionState{Email: "user@example.com", AccessToken: "token"}
+	value, err := provider.CookieForSession(session, proxy.CookieCipher)
+	assert.Equal(t, nil, err)
+	authenticate := func(expiresOn time.Time) int {
+		session.ExpiresOn = expiresOn
+		value, _ = provider.CookieForSession(session, proxy.CookieCipher)
+		req := httptest.NewRequest("GET", "/", nil)
+		// old enough to be validated again
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now().Add(-2*time.Hour)))
+		return proxy.Authenticate(httptest.NewRecorder(), req)
+	}
+
+	// the provider can't be reached for any validation, which removes
+	// sessions until the error rate has been measured
+	provider.ValidateErr = &url.Error{Op: "Get", URL: "https://localhost/validate", Err: errors.New("connection refused")}
+	for i := 0; i < errorBudgetMinCalls-1; i++ {
+		assert.Equal(t, http.StatusForbidden, authenticate(time.Time{}))
+	}
+	assert.Equal(t, http.StatusAccepted, authenticate(time.Time{}))
+	assert.Equal(t, true, proxy.degraded())
+
+	// expired tokens are trusted for the grace period
+	assert.Equal(t, http.StatusAccepted, authenticate(time.Now().Add(-time.Minute)))
+	assert.Equal(t, http.StatusForbidden, authenticate(time.Now().Add(-2*time.Hour)))
+
+	// a token the provider rejects is never trusted
+	provider.ValidateErr = nil
+	assert.Equal(t, http.StatusForbidden, authenticate(time.Time{}))
+	assert.Equal(t, true, proxy.degraded())
+}
+
+func TestRejectedTokensDontDegrade(t *testing.T) {
+	opts := testOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.CookieRefresh = time.Hour
+	opts.DegradeErrorRate = 0.5
+	assert.Equal(t, nil, opts.Validate())
+	provider := NewTestProvider(&url.URL{Host: "localhost"}, "user@example.com")
+	opts.provider = provider
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	// a revoked user retrying can't push the error rate up
+	value, err := provider.CookieForSession(&providers.SessionState{Email: "user@example.com", AccessToken: "revoked"}, proxy.CookieCipher)
+	assert.Equal(t, nil, err)
+	for i := 0; i < 2*errorBudgetMinCalls; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now().Add(-2*time.Hour)))
+		assert.Equal(t, http.StatusForbidden, proxy.Authenticate(httptest.NewRecorder(), req))
+	}
+	assert.Equal(t, false, proxy.degraded())
+}
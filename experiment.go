@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// experimentBucketer assigns each user a stable experiment bucket from a
+// hash of their identity keyed by a salt, so upstreams and analytics bucket
+// authenticated users alike without knowing how
+type experimentBucketer struct {
+	salt    []byte
+	buckets uint64
+}
+
+func newExperimentBucketer(salt string, buckets int) *experimentBucketer {
+	return &experimentBucketer{salt: []byte(salt), buckets: uint64(buckets)}
+}
+
+// Bucket returns the bucket of the user of s, from 0 to the number of
+// buckets - 1, by their email, or their user name when they have none
+func (b *experimentBucketer) Bucket(s *providers.SessionState) string {
+	identity := s.Email
+	if identity == "" {
+		identity = s.User
+	}
+	h := hmac.New(sha256.New, b.salt)
+	h.Write([]byte(strings.ToLower(identity)))
+	return strconv.FormatUint(binary.BigEndian.Uint64(h.Sum(nil))%b.buckets, 10)
+}
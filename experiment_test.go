@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestExperimentBucket(t *testing.T) {
+	b := newExperimentBucketer("salt", 10)
+	bucket := b.Bucket(&providers.SessionState{Email: "user@example.com", User: "user"})
+	assert.Equal(t, bucket, b.Bucket(&providers.SessionState{Email: "User@Example.com"}))
+	assert.Equal(t, bucket, newExperimentBucketer("salt", 10).Bucket(&providers.SessionState{Email: "user@example.com"}))
+
+	// users are spread across all the buckets
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		seen[b.Bucket(&providers.SessionState{User: fmt.Sprintf("user%d", i)})] = true
+	}
+	assert.Equal(t, 10, len(seen))
+	for _, bucket := range []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"} {
+		assert.Equal(t, true, seen[bucket])
+	}
+}
+
+func TestExperimentBucketHeader(t *testing.T) {
+	opts := testOptions()
+	opts.ExperimentSalt = "salt"
+	opts.SetXAuthRequest = true
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.PassAccessToken = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	session := &providers.SessionState{Email: "user@example.com", User: "user", AccessToken: "token"}
+	value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+	assert.Equal(t, nil, err)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Experiment-Bucket", "treatment")
+	req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+	rw := httptest.NewRecorder()
+	assert.Equal(t, http.StatusAccepted, proxy.Authenticate(rw, req))
+
+	bucket := newExperimentBucketer("salt", 100).Bucket(session)
+	assert.Equal(t, []string{bucket}, req.Header["X-Experiment-Bucket"])
+	assert.Equal(t, bucket, rw.HeaderMap.Get("X-Auth-Request-Experiment-Bucket"))
+	assert.Equal(t, "X-Experiment-Bucket", proxy.configuration("").IdentityHeaders["experiment_bucket"])
+
+	o := testOptions()
+	o.ExperimentSalt = "salt"
+	o.ExperimentBuckets = 0
+	assert.Equal(t, errorMsg([]string{"experiment_buckets must be positive"}), o.Validate().Error())
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// sessionProviderPrimary and sessionProviderFailover tag the sessions
+	// issued by each provider when a failover provider is configured
+	sessionProviderPrimary  = "primary"
+	sessionProviderFailover = "failover"
+
+	// failoverNoncePrefix marks the CSRF nonce of logins started with the
+	// failover provider, so the callback redeems the code with it too
+	failoverNoncePrefix = "failover."
+
+	// failoverProbeInterval is how often the primary provider's authorize
+	// endpoint is probed, at most
+	failoverProbeInterval = 10 * time.Second
+	failoverProbeTimeout  = 5 * time.Second
+)
+
+var failoverActiveGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "provider_failover_active",
+	Help: "Whether new sign ins use the failover provider.",
+})
+
+func init() {
+	prometheus.MustRegister(failoverActiveGauge)
+}
+
+// circuitBreaker opens after threshold consecutive failures to reach an
+// endpoint, and stays open for cooldown. Once the cooldown has passed the
+// endpoint is tried again, and a single failure re-opens the breaker.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	name      string
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func (b *circuitBreaker) Open(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return now.Before(b.openUntil)
+}
+
+func (b *circuitBreaker) Failure(now time.Time, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= b.threshold && !now.Before(b.openUntil) {
+		log.Printf("primary provider %s endpoint unreachable, failing over for %s: %s", b.name, b.cooldown, err)
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures >= b.threshold {
+		log.Printf("primary provider %s endpoint reachable again", b.name)
+	}
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+// providerFailover switches new sign ins to the failover provider while the
+// primary provider's authorize or token endpoint is unreachable. The
+// authorize endpoint is visited by browsers, so it is probed in the
+// background; the token endpoint is tracked through code redemptions.
+type providerFailover struct {
+	provider  providers.Provider
+	authorize *circuitBreaker
+	token     *circuitBreaker
+
+	probeURL  string
+	client    *http.Client
+	probing   int32
+	mu        sync.Mutex
+	lastProbe time.Time
+}
+
+func newProviderFailover(primary, failover providers.Provider, threshold int, cooldown time.Duration) *providerFailover {
+	probeURL := *primary.Data().LoginURL
+	probeURL.RawQuery = ""
+	return &providerFailover{
+		provider:  failover,
+		authorize: &circuitBreaker{name: "authorize", threshold: threshold, cooldown: cooldown},
+		token:     &circuitBreaker{name: "token", threshold: threshold, cooldown: cooldown},
+		probeURL:  probeURL.String(),
+		client:    &http.Client{Timeout: failoverProbeTimeout},
+	}
+}
+
+// Active reports whether new sign ins should use the failover provider,
+// probing the primary's authorize endpoint when it is due
+func (f *providerFailover) Active(now time.Time) bool {
+	f.mu.Lock()
+	due := now.Sub(f.lastProbe) >= failoverProbeInterval
+	if due {
+		f.lastProbe = now
+	}
+	f.mu.Unlock()
+	if due && atomic.CompareAndSwapInt32(&f.probing, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&f.probing, 0)
+			f.probe()
+		}()
+	}
+
+	active := f.authorize.Open(now) || f.token.Open(now)
+	if active {
+		failoverActiveGauge.Set(1)
+	} else {
+		failoverActiveGauge.Set(0)
+	}
+	return active
+}
+
+// probe checks the authorize endpoint answers. Any response short of a
+// server error counts, as the endpoint rejects requests without parameters.
+func (f *providerFailover) probe() {
+	resp, err := f.client.Get(f.probeURL)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			err = errors.New(resp.Status)
+		}
+	}
+	if err != nil {
+		f.authorize.Failure(time.Now(), err)
+		return
+	}
+	f.authorize.Success()
+}
+
+// RedeemResult records whether the primary's token endpoint was reachable.
+// Only transport errors count as failures, not rejected codes.
+func (f *providerFailover) RedeemResult(err error) {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		f.token.Failure(time.Now(), err)
+	} else if err == nil {
+		f.token.Success()
+	}
+}
+
+// loginProvider is the provider new sign ins use, and the tag of the
+// sessions it issues
+func (p *OAuthProxy) loginProvider() (providers.Provider, string) {
+	if p.failover == nil {
+		return p.provider, ""
+	}
+	if p.failover.Active(time.Now()) {
+		return p.failover.provider, sessionProviderFailover
+	}
+	return p.provider, sessionProviderPrimary
+}
+
+// loginNonce creates the CSRF nonce of a sign in with the provider tagged
+// tag. Sign ins with the failover or an extra provider prefix it with the tag.
+func loginNonce(tag string) (string, error) {
+	nonce, err := cookie.Nonce()
+	if err != nil {
+		return "", err
+	}
+	if tag != "" && tag != sessionProviderPrimary {
+		nonce = tag + "." + nonce
+	}
+	return nonce, nil
+}
+
+// callbackProvider is the provider a sign in was started with, given its
+// state parameter
+func (p *OAuthProxy) callbackProvider(state string) (providers.Provider, string) {
+	if e := p.extraCallbackProvider(state); e != nil {
+		return e.provider, e.id
+	}
+	if p.failover == nil {
+		return p.provider, ""
+	}
+	if strings.HasPrefix(state, failoverNoncePrefix) {
+		return p.failover.provider, sessionProviderFailover
+	}
+	return p.provider, sessionProviderPrimary
+}
+
+// sessionProvider is the provider that issued s, which refreshes and
+// validates it
+func (p *OAuthProxy) sessionProvider(s *providers.SessionState) providers.Provider {
+	if s != nil {
+		if e := p.extraProvider(s.Provider); e != nil {
+			return e.provider
+		}
+	}
+	if p.failover != nil && s != nil && s.Provider == sessionProviderFailover {
+		return p.failover.provider
+	}
+	if p.testMode != nil && s != nil && s.Provider == sessionProviderTestMode {
+		return p.testMode.provider
+	}
+	return p.provider
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{name: "token", threshold: 2, cooldown: time.Minute}
+	now := time.Now()
+	err := errors.New("connection refused")
+
+	b.Failure(now, err)
+	assert.Equal(t, false, b.Open(now))
+	b.Failure(now, err)
+	assert.Equal(t, true, b.Open(now))
+	assert.Equal(t, true, b.Open(now.Add(59*time.Second)))
+
+	// after the cooldown the endpoint is retried, and a single failure
+	// re-opens the breaker
+	assert.Equal(t, false, b.Open(now.Add(time.Minute)))
+	b.Failure(now.Add(time.Minute), err)
+	assert.Equal(t, true, b.Open(now.Add(time.Minute)))
+
+	b.Success()
+	assert.Equal(t, false, b.Open(now))
+	b.Failure(now, err)
+	assert.Equal(t, false, b.Open(now))
+}
+
+func TestFailoverOptions(t *testing.T) {
+	o := testOptions()
+	o.FailoverProvider = "github"
+	o.FailoverThreshold = 0
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	for _, msg := range []string{
+		"missing setting: failover-client-id",
+		"missing setting: failover-client-secret",
+		"failover_threshold must be at least 1",
+	} {
+		assert.Equal(t, true, strings.Contains(err.Error(), msg))
+	}
+
+	o = testOptions()
+	o.FailoverProvider = "github"
+	o.FailoverClientID = "failover-id"
+	o.FailoverClientSecret = "failover-secret"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "GitHub", o.failoverProvider.Data().ProviderName)
+	assert.Equal(t, "failover-id", o.failoverProvider.Data().ClientID)
+}
+
+func TestProviderFailover(t *testing.T) {
+	// the primary provider is unreachable
+	down := httptest.NewServer(http.NotFoundHandler())
+	downURL, _ := url.Parse(down.URL)
+	down.Close()
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"failover_token"}`))
+	}))
+	defer idp.Close()
+	idpURL, _ := url.Parse(idp.URL)
+
+	opts := NewOptions()
+	opts.Upstreams = []string{"http://127.0.0.1:8080/"}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecure = false
+	opts.EmailDomains = []string{"*"}
+	opts.PassAccessToken = true
+	assert.Equal(t, nil, opts.Validate())
+	primary := NewTestProvider(downURL, "user@example.com")
+	secondary := NewTestProvider(idpURL, "user@example.com")
+	secondary.ValidToken = true
+	opts.provider = primary
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	proxy.failover = newProviderFailover(primary, secondary, 1, time.Minute)
+
+	callback := func(state string) *httptest.ResponseRecorder {
+		nonce := strings.SplitN(state, ":", 2)[0]
+		req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(state), nil)
+		req.AddCookie(proxy.MakeCSRFCookie(req, nonce, proxy.CookieExpire, time.Now()))
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// a failed redemption with the primary trips the breaker
+	rw := callback("nonce:/")
+	assert.Equal(t, 500, rw.Code)
+
+	req, _ := http.NewRequest("GET", "/oauth2/start?rd=/app", nil)
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	loginURL, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	assert.Equal(t, idpURL.Host, loginURL.Host)
+	state := loginURL.Query().Get("state")
+	assert.Equal(t, true, strings.HasPrefix(state, failoverNoncePrefix))
+
+	// the callback redeems the code with the failover provider and tags
+	// the session with it
+	rw = callback(state)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/app", rw.HeaderMap.Get("Location"))
+	req, _ = http.NewRequest("GET", "/", nil)
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == proxy.CookieName {
+			req.AddCookie(c)
+		}
+	}
+	session, _, err := proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "failover_token", session.AccessToken)
+	assert.Equal(t, sessionProviderFailover, session.Provider)
+	assert.Equal(t, providers.Provider(secondary), proxy.sessionProvider(session))
+
+	session.Provider = sessionProviderPrimary
+	assert.Equal(t, providers.Provider(primary), proxy.sessionProvider(session))
+}
@@ -16,11 +16,14 @@ require (
 	github.com/opentracing-contrib/go-stdlib v0.0.0-20181222025249-77df8e8e70b4
 	github.com/opentracing/opentracing-go v1.2.0
 	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/client_model v0.2.0
 	github.com/uber/jaeger-client-go v2.25.0+incompatible
 	github.com/uber/jaeger-lib v2.2.0+incompatible
 	go.uber.org/atomic v1.7.0 // indirect
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
 	golang.org/x/oauth2 v0.0.0-20170928010508-bb50c06baba3
-	golang.org/x/sys v0.0.0-20200922070232-aee5d888a860 // indirect
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1
 	google.golang.org/api v0.0.0-20171005000305-7a7376eff6a5
 	google.golang.org/appengine v1.0.0 // indirect
 	gopkg.in/fsnotify.v1 v1.4.2
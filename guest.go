@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// guestUserPrefix marks the user of a guest session. htpasswd users can't
+// contain a ":" and provider sessions are keyed by email, so it can't
+// collide with a real account.
+const guestUserPrefix = "guest:"
+
+// guestCodeKey is the name guest codes are signed under, keeping them from
+// being replayed as session cookies and vice versa
+const guestCodeKey = "guest_code"
+
+var guestLabelRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// MintGuestCode returns a code that can be redeemed for a guest session
+// labelled label until GuestCodeExpire has passed.
+func (p *OAuthProxy) MintGuestCode(label string, now time.Time) (string, error) {
+	if !guestLabelRegex.MatchString(label) {
+		return "", fmt.Errorf("invalid guest label %q", label)
+	}
+	return cookie.SignedValue(p.CookieSeed, guestCodeKey, label, now), nil
+}
+
+// RedeemGuestCode checks a guest code and returns the session it grants
+func (p *OAuthProxy) RedeemGuestCode(code string, now time.Time) (*providers.SessionState, error) {
+	label, _, ok := cookie.Validate(&http.Cookie{Name: guestCodeKey, Value: code},
+		p.CookieSeed, p.GuestCodeExpire)
+	if !ok || !guestLabelRegex.MatchString(label) {
+		return nil, fmt.Errorf("invalid or expired guest code")
+	}
+	return &providers.SessionState{
+		User:      guestUserPrefix + label,
+		ExpiresOn: now.Add(p.GuestSessionExpire),
+	}, nil
+}
+
+func isGuestSession(s *providers.SessionState) bool {
+	return s.Email == "" && strings.HasPrefix(s.User, guestUserPrefix)
+}
+
+func (p *OAuthProxy) isGuestAdmin(email string) bool {
+	for _, admin := range p.guestAdmins {
+		if strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsGuestRoute reports whether guest sessions may access path
+func (p *OAuthProxy) IsGuestRoute(path string) bool {
+	for _, r := range p.guestRoutes {
+		if r.MatchString(path) {
+			return true
+		}
+	}
+	return p.guestUpstream(path) != ""
+}
+
+// guestUpstream is the name of the upstream serving path when guest
+// sessions may access it
+func (p *OAuthProxy) guestUpstream(path string) string {
+	if len(p.guestUpstreams) == 0 {
+		return ""
+	}
+	if u := p.upstreamFor(path); u != nil && p.guestUpstreams[u.name] {
+		return u.name
+	}
+	return ""
+}
+
+// Guest mints guest codes for admins on POST and redeems them on GET
+func (p *OAuthProxy) Guest(rw http.ResponseWriter, req *http.Request) {
+	if len(p.guestAdmins) == 0 {
+		http.NotFound(rw, req)
+		return
+	}
+	switch req.Method {
+	case "POST":
+		p.GuestMint(rw, req)
+	default:
+		p.GuestRedeem(rw, req)
+	}
+}
+
+// GuestMint issues a guest code to an authenticated guest admin
+func (p *OAuthProxy) GuestMint(rw http.ResponseWriter, req *http.Request) {
+	remoteAddr := getRemoteAddr(req)
+	session, _, err := p.LoadCookiedSession(req)
+	if err != nil || session.IsExpired() || !p.isGuestAdmin(session.Email) {
+		log.Printf("%s Permission Denied: guest code requested by non-admin", remoteAddr)
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	label := req.FormValue("label")
+	code, err := p.MintGuestCode(label, now)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("%s %s minted guest code for %q", remoteAddr, session.Email, label)
+
+	redeemURL := url.URL{
+		Path:     p.GuestPath,
+		RawQuery: url.Values{"code": {code}}.Encode(),
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(struct {
+		Code      string    `json:"code"`
+		URL       string    `json:"url"`
+		ExpiresOn time.Time `json:"expires_on"`
+	}{
+		Code:      code,
+		URL:       redeemURL.String(),
+		ExpiresOn: now.Add(p.GuestCodeExpire).Truncate(time.Second),
+	})
+}
+
+// GuestRedeem exchanges a guest code for a guest session cookie
+func (p *OAuthProxy) GuestRedeem(rw http.ResponseWriter, req *http.Request) {
+	remoteAddr := getRemoteAddr(req)
+	session, err := p.RedeemGuestCode(req.FormValue("code"), time.Now())
+	if err != nil {
+		log.Printf("%s %s", remoteAddr, err)
+		p.ErrorPage(rw, req, 403, "Permission Denied", "Invalid or expired guest code")
+		return
+	}
+
+	redirect := req.FormValue("rd")
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = "/"
+	}
+	log.Printf("%s guest authentication complete %s", remoteAddr, session)
+	if err := p.SaveSession(rw, req, session); err != nil {
+		log.Printf("%s %s", remoteAddr, err)
+		p.ErrorPage(rw, req, 500, "Internal Error", "Internal Error")
+		return
+	}
+	http.Redirect(rw, req, redirect, 302)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func newGuestTestProxy(t *testing.T) (*OAuthProxy, *httptest.Server) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(r.Header.Get("X-Forwarded-User")))
+	}))
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecure = false
+	opts.EmailDomains = []string{"*"}
+	opts.GuestAdmins = []string{"admin@example.com"}
+	opts.GuestRoutes = []string{"^/review/"}
+	assert.Equal(t, nil, opts.Validate())
+
+	upstreamURL, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstreamURL, "")
+	return NewOAuthProxy(opts, func(email string) bool { return true }), upstream
+}
+
+func TestGuestRoutesRequiredWithAdmins(t *testing.T) {
+	o := testOptions()
+	o.GuestAdmins = []string{"admin@example.com"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.Contains(err.Error(), "missing setting: guest-route"))
+}
+
+func TestGuestCodeRoundTrip(t *testing.T) {
+	proxy, upstream := newGuestTestProxy(t)
+	defer upstream.Close()
+
+	now := time.Now()
+	code, err := proxy.MintGuestCode("acme-auditor", now)
+	assert.Equal(t, nil, err)
+
+	session, err := proxy.RedeemGuestCode(code, now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "guest:acme-auditor", session.User)
+	assert.Equal(t, "", session.Email)
+	assert.Equal(t, now.Add(proxy.GuestSessionExpire), session.ExpiresOn)
+}
+
+func TestGuestCodeInvalid(t *testing.T) {
+	proxy, upstream := newGuestTestProxy(t)
+	defer upstream.Close()
+
+	_, err := proxy.MintGuestCode("bad|label", time.Now())
+	assert.NotEqual(t, nil, err)
+
+	code, _ := proxy.MintGuestCode("acme", time.Now().Add(-25*time.Hour))
+	_, err = proxy.RedeemGuestCode(code, time.Now())
+	assert.NotEqual(t, nil, err)
+
+	// a session cookie value is not a guest code
+	sessionValue := proxy.MakeSessionCookie(&http.Request{Host: "localhost"}, "guest:acme", time.Hour, time.Now()).Value
+	_, err = proxy.RedeemGuestCode(sessionValue, time.Now())
+	assert.NotEqual(t, nil, err)
+}
+
+func TestGuestMintRequiresAdmin(t *testing.T) {
+	proxy, upstream := newGuestTestProxy(t)
+	defer upstream.Close()
+
+	for email, code := range map[string]int{
+		"user@example.com":  403,
+		"admin@example.com": 200,
+	} {
+		req, _ := http.NewRequest("POST", "/oauth2/guest", strings.NewReader("label=acme"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		value, _ := proxy.provider.CookieForSession(&providers.SessionState{Email: email}, proxy.CookieCipher)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, code, rw.Code)
+	}
+}
+
+func TestGuestSessionRestrictedToRoutes(t *testing.T) {
+	proxy, upstream := newGuestTestProxy(t)
+	defer upstream.Close()
+
+	// mint
+	req, _ := http.NewRequest("POST", "/oauth2/guest", strings.NewReader("label=acme"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	value, _ := proxy.provider.CookieForSession(&providers.SessionState{Email: "admin@example.com"}, proxy.CookieCipher)
+	req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	var minted struct {
+		URL string `json:"url"`
+	}
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &minted))
+
+	// redeem
+	req, _ = http.NewRequest("GET", minted.URL+"&rd=/review/1", nil)
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/review/1", rw.HeaderMap.Get("Location"))
+	cookies := (&http.Response{Header: rw.HeaderMap}).Cookies()
+	assert.Equal(t, 1, len(cookies))
+
+	// access
+	req, _ = http.NewRequest("GET", "/review/1", nil)
+	req.AddCookie(cookies[0])
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "guest:acme", rw.Body.String())
+
+	req, _ = http.NewRequest("GET", "/admin", nil)
+	req.AddCookie(cookies[0])
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, 0, len(rw.HeaderMap["Set-Cookie"]))
+}
+
+func TestGuestUpstreamRoute(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL + "/billing/?name=billing-api", upstream.URL + "/admin/"}
+	opts.GuestAdmins = []string{"admin@example.com"}
+	opts.GuestRoutes = []string{"upstream:billing-api"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	assert.Equal(t, true, proxy.IsGuestRoute("/billing/invoices"))
+	assert.Equal(t, false, proxy.IsGuestRoute("/admin/"))
+	assert.Equal(t, "guest-upstream:billing-api", proxy.pathPolicy("/billing/invoices"))
+
+	req, _ := http.NewRequest("GET", "/billing/invoices", nil)
+	rw := httptest.NewRecorder()
+	proxy.serveMux.ServeHTTP(rw, req)
+	assert.Equal(t, "billing-api", rw.HeaderMap.Get("GAP-Upstream-Address"))
+
+	req, _ = http.NewRequest("GET", "/admin/", nil)
+	rw = httptest.NewRecorder()
+	proxy.serveMux.ServeHTTP(rw, req)
+	assert.Equal(t, strings.TrimPrefix(upstream.URL, "http://"), rw.HeaderMap.Get("GAP-Upstream-Address"))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// readinessProbeInterval is how often the provider is probed for the
+	// readiness endpoint, at most
+	readinessProbeInterval = 10 * time.Second
+	readinessProbeTimeout  = 5 * time.Second
+)
+
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// readiness checks that the proxy can actually authenticate anyone: the
+// provider sign ins go to answers, and the certificates served are valid.
+// Sessions live in cookies, so there is no session store to check.
+type readiness struct {
+	client       *http.Client
+	certificates []*x509.Certificate
+
+	mu          sync.Mutex
+	lastProbe   time.Time
+	probedURL   string
+	providerErr error
+}
+
+func newReadiness(certificates []*x509.Certificate) *readiness {
+	return &readiness{
+		client:       &http.Client{Timeout: readinessProbeTimeout},
+		certificates: certificates,
+	}
+}
+
+// loadCertificates reads the leaf certificates of the configured key pairs.
+// Pairs that fail to load are skipped, as the HTTPS server refuses to start
+// with them anyway.
+func loadCertificates(certFiles, keyFiles []string) []*x509.Certificate {
+	var certificates []*x509.Certificate
+	for i := range certFiles {
+		if i >= len(keyFiles) {
+			break
+		}
+		pair, err := tls.LoadX509KeyPair(certFiles[i], keyFiles[i])
+		if err != nil || len(pair.Certificate) == 0 {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			log.Printf("can't parse certificate %s for readiness checks: %s", certFiles[i], err)
+			continue
+		}
+		certificates = append(certificates, leaf)
+	}
+	return certificates
+}
+
+// provider checks the authorize endpoint of the provider new sign ins use
+// answers, probing it when the last result is too old or for another
+// provider. Any response short of a server error counts, as the endpoint
+// rejects requests without parameters.
+func (r *readiness) provider(loginURL string, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if loginURL == r.probedURL && now.Sub(r.lastProbe) < readinessProbeInterval {
+		return r.providerErr
+	}
+	resp, err := r.client.Get(loginURL)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			err = errors.New(resp.Status)
+		}
+	}
+	if err != nil && r.providerErr == nil {
+		log.Printf("readiness: provider unreachable: %s", err)
+	}
+	r.lastProbe, r.probedURL, r.providerErr = now, loginURL, err
+	return err
+}
+
+// certificatesValid checks the certificates served are within their
+// validity period
+func (r *readiness) certificatesValid(now time.Time) error {
+	for _, c := range r.certificates {
+		if now.After(c.NotAfter) {
+			return fmt.Errorf("certificate for %q expired at %s", c.Subject.CommonName, c.NotAfter.Format(time.RFC3339))
+		}
+		if now.Before(c.NotBefore) {
+			return fmt.Errorf("certificate for %q is not valid before %s", c.Subject.CommonName, c.NotBefore.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// writeHealth answers a health endpoint with report, as JSON when verbose
+func (p *OAuthProxy) writeHealth(rw http.ResponseWriter, report healthReport) {
+	code := http.StatusOK
+	if report.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	if p.HealthVerbose {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(code)
+		json.NewEncoder(rw).Encode(report)
+		return
+	}
+	rw.WriteHeader(code)
+	if code == http.StatusOK {
+		fmt.Fprintf(rw, "OK")
+	} else {
+		fmt.Fprintf(rw, "Service Unavailable")
+	}
+}
+
+// ReadinessPage reports whether the proxy can authenticate requests, so
+// orchestrators only route traffic to instances that can
+func (p *OAuthProxy) ReadinessPage(rw http.ResponseWriter) {
+	now := time.Now()
+	report := healthReport{Status: "ok", Checks: make(map[string]healthCheck)}
+	check := func(name string, err error) {
+		if err != nil {
+			report.Status = "error"
+			report.Checks[name] = healthCheck{Status: "error", Error: err.Error()}
+		} else {
+			report.Checks[name] = healthCheck{Status: "ok"}
+		}
+	}
+
+	provider, _ := p.loginProvider()
+	if loginURL := provider.Data().LoginURL; loginURL != nil {
+		u := *loginURL
+		u.RawQuery = ""
+		check("provider", p.readiness.provider(u.String(), now))
+	}
+	check("certificates", p.readiness.certificatesValid(now))
+	p.writeHealth(rw, report)
+}
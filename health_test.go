@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestHealthPathOptions(t *testing.T) {
+	o := testOptions()
+	o.LivenessPath = "healthz"
+	o.ReadinessPath = "/oauth2/ready"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		`liveness_path "healthz" must start with /`,
+		`readiness_path "/oauth2/ready" must not be under the proxy prefix "/oauth2"`,
+	}), err.Error())
+
+	o = testOptions()
+	o.ReadinessPath = "/ping"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"liveness_path and readiness_path must differ"}), err.Error())
+}
+
+func TestMetricsAddress(t *testing.T) {
+	opts := testOptions()
+	opts.MetricsAddress = "127.0.0.1:9100"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	serve := func(handler http.Handler, path string) int {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw.Code
+	}
+	// the public listener asks for a sign in, like for any other path
+	assert.Equal(t, http.StatusForbidden, serve(proxy, "/ping"))
+	assert.Equal(t, http.StatusForbidden, serve(proxy, "/oauth2/metrics"))
+
+	health := proxy.HealthHandler()
+	assert.Equal(t, http.StatusOK, serve(health, "/ping"))
+	assert.Equal(t, http.StatusOK, serve(health, "/oauth2/metrics"))
+	assert.Equal(t, http.StatusNotFound, serve(health, "/"))
+	assert.Equal(t, http.StatusNotFound, serve(health, "/oauth2/start"))
+
+	opts = testOptions()
+	opts.AdminAddress = "127.0.0.1:4190"
+	opts.MetricsAddress = "127.0.0.1:4190"
+	assert.Equal(t, errorMsg([]string{"metrics_address must differ from http_address and admin_address"}), opts.Validate().Error())
+}
+
+func TestReadiness(t *testing.T) {
+	status := http.StatusOK
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer idp.Close()
+	idpURL, _ := url.Parse(idp.URL)
+
+	opts := testOptions()
+	opts.LivenessPath = "/healthz"
+	opts.ReadinessPath = "/readyz"
+	assert.Equal(t, nil, opts.Validate())
+	opts.provider = NewTestProvider(idpURL, "user@example.com")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+	report := func(rw *httptest.ResponseRecorder) healthReport {
+		var r healthReport
+		assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &r))
+		return r
+	}
+
+	rw := get("/healthz")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "OK", rw.Body.String())
+	rw = get("/readyz")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "OK", rw.Body.String())
+
+	// the provider answering 400 without parameters is reachable, the
+	// result is cached until it is probed again
+	status = http.StatusBadRequest
+	proxy.readiness.lastProbe = time.Time{}
+	assert.Equal(t, http.StatusOK, get("/readyz").Code)
+	status = http.StatusBadGateway
+	assert.Equal(t, http.StatusOK, get("/readyz").Code)
+	proxy.readiness.lastProbe = time.Time{}
+	rw = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, "Service Unavailable", rw.Body.String())
+
+	// the process is still alive
+	proxy.HealthVerbose = true
+	rw = get("/healthz")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, healthReport{Status: "ok"}, report(rw))
+
+	status = http.StatusOK
+	proxy.readiness.lastProbe = time.Time{}
+	proxy.readiness.certificates = []*x509.Certificate{{
+		Subject:   pkix.Name{CommonName: "proxy.example.com"},
+		NotBefore: time.Now().Add(-48 * time.Hour),
+		NotAfter:  time.Now().Add(-24 * time.Hour),
+	}}
+	rw = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	r := report(rw)
+	assert.Equal(t, "error", r.Status)
+	assert.Equal(t, healthCheck{Status: "ok"}, r.Checks["provider"])
+	assert.Equal(t, "error", r.Checks["certificates"].Status)
+}
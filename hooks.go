@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// Hooks add behavior around authentication and proxying to a build of the
+// proxy, ie. feature flags or entitlement headers, without patching it. The
+// build registers them with RegisterHooks from the init function of an extra
+// file in this package. Every hook is optional.
+type Hooks struct {
+	// OnAuthSuccess is called once a request is authenticated and
+	// authorized, with its session, which is nil for requests authenticated
+	// by a client certificate. An error denies the request.
+	OnAuthSuccess func(rw http.ResponseWriter, req *http.Request, s *providers.SessionState) error
+	// OnAuthFailure is called when a request isn't authenticated or is
+	// denied, with the status Authenticate returns for it: 403 when it
+	// needs to sign in, 401 when it's denied, or 500.
+	OnAuthFailure func(rw http.ResponseWriter, req *http.Request, status int)
+	// ModifyUpstreamRequest is called before an authenticated request is
+	// proxied, after the X-Forwarded-* headers are set
+	ModifyUpstreamRequest func(req *http.Request, s *providers.SessionState)
+	// ModifyResponse is called with the responses of http, https and h2c
+	// upstreams. An error answers 502 instead.
+	ModifyResponse func(resp *http.Response) error
+}
+
+var registeredHooks Hooks
+
+// RegisterHooks sets the hooks of the proxies created after it
+func RegisterHooks(h Hooks) {
+	registeredHooks = h
+}
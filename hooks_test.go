@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestHooks(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Entitlements")))
+	}))
+	defer backend.Close()
+
+	var failures []int
+	RegisterHooks(Hooks{
+		OnAuthSuccess: func(rw http.ResponseWriter, req *http.Request, s *providers.SessionState) error {
+			if s.User == "blocked" {
+				return errors.New("blocked by feature flag")
+			}
+			return nil
+		},
+		OnAuthFailure: func(rw http.ResponseWriter, req *http.Request, status int) {
+			failures = append(failures, status)
+		},
+		ModifyUpstreamRequest: func(req *http.Request, s *providers.SessionState) {
+			req.Header.Set("X-Entitlements", "reports:"+s.User)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Set("X-Hooked", "1")
+			return nil
+		},
+	})
+	defer RegisterHooks(Hooks{})
+
+	opts := testOptions()
+	opts.Upstreams = []string{backend.URL}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	request := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if user != "" {
+			session := &providers.SessionState{Email: user + "@example.com", User: user}
+			value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+			assert.Equal(t, nil, err)
+			req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := request("user")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "reports:user", rw.Body.String())
+	assert.Equal(t, "1", rw.HeaderMap.Get("X-Hooked"))
+	assert.Equal(t, []int(nil), failures)
+
+	rw = request("blocked")
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, "", rw.HeaderMap.Get("X-Hooked"))
+	assert.Equal(t, []int{http.StatusUnauthorized}, failures)
+
+	request("")
+	assert.Equal(t, []int{http.StatusUnauthorized, http.StatusForbidden}, failures)
+}
@@ -7,12 +7,20 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 // lookup passwords in a htpasswd file
-// The entries must have been created with -s for SHA encryption
+// The entries must have been created with -s for SHA encryption, or -B for
+// bcrypt
 
 type HtpasswdFile struct {
+	file string
+
+	mu    sync.RWMutex
 	Users map[string]string
 }
 
@@ -22,7 +30,34 @@ func NewHtpasswdFromFile(path string) (*HtpasswdFile, error) {
 		return nil, err
 	}
 	defer r.Close()
-	return NewHtpasswd(r)
+	h, err := NewHtpasswd(r)
+	if err != nil {
+		return nil, err
+	}
+	h.file = path
+	return h, nil
+}
+
+// Watch reloads the htpasswd file whenever it changes, until done is closed.
+// A file that can't be read leaves the previous users in place.
+func (h *HtpasswdFile) Watch(done <-chan bool) {
+	WatchForUpdates(h.file, done, func() {
+		if err := h.load(); err != nil {
+			log.Printf("error reloading htpasswd-file=%q, keeping the previous users: %s", h.file, err)
+		}
+	})
+}
+
+func (h *HtpasswdFile) load() error {
+	updated, err := NewHtpasswdFromFile(h.file)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	h.Users = updated.Users
+	h.mu.Unlock()
+	log.Printf("loaded %d users from htpasswd file %s", len(updated.Users), h.file)
+	return nil
 }
 
 func NewHtpasswd(file io.Reader) (*HtpasswdFile, error) {
@@ -43,18 +78,23 @@ func NewHtpasswd(file io.Reader) (*HtpasswdFile, error) {
 }
 
 func (h *HtpasswdFile) Validate(user string, password string) bool {
+	h.mu.RLock()
 	realPassword, exists := h.Users[user]
+	h.mu.RUnlock()
 	if !exists {
 		return false
 	}
-	if realPassword[:5] == "{SHA}" {
+	switch {
+	case strings.HasPrefix(realPassword, "{SHA}"):
 		d := sha1.New()
 		d.Write([]byte(password))
 		if realPassword[5:] == base64.StdEncoding.EncodeToString(d.Sum(nil)) {
 			return true
 		}
-	} else {
-		log.Printf("Invalid htpasswd entry for %s. Must be a SHA entry.", user)
+	case strings.HasPrefix(realPassword, "$2a$"), strings.HasPrefix(realPassword, "$2b$"), strings.HasPrefix(realPassword, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(realPassword), []byte(password)) == nil
+	default:
+		log.Printf("Invalid htpasswd entry for %s. Must be a SHA or bcrypt entry.", user)
 	}
 	return false
 }
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -14,3 +16,34 @@ func TestHtpasswd(t *testing.T) {
 	valid := h.Validate("testuser", "asdf")
 	assert.Equal(t, valid, true)
 }
+
+func TestHtpasswdBcrypt(t *testing.T) {
+	file := bytes.NewBuffer([]byte("testuser:$2y$04$XAa.LXUElnAmVesCUGtcH.M4ubhlo3NjzT92SftAyGqCf.mNymBPi\n"))
+	h, err := NewHtpasswd(file)
+	assert.Equal(t, err, nil)
+
+	assert.Equal(t, h.Validate("testuser", "asdf"), true)
+	assert.Equal(t, h.Validate("testuser", "qwer"), false)
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "test_htpasswd_")
+	assert.Equal(t, err, nil)
+	defer os.Remove(f.Name())
+	f.WriteString("testuser:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=\n")
+	f.Close()
+
+	h, err := NewHtpasswdFromFile(f.Name())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, h.Validate("testuser", "asdf"), true)
+	assert.Equal(t, h.Validate("newuser", "asdf"), false)
+
+	ioutil.WriteFile(f.Name(), []byte("testuser:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=\nnewuser:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=\n"), 0600)
+	assert.Equal(t, h.load(), nil)
+	assert.Equal(t, h.Validate("newuser", "asdf"), true)
+
+	// an unreadable file keeps the previous users
+	ioutil.WriteFile(f.Name(), []byte("testuser:\"broken\n"), 0600)
+	assert.NotEqual(t, h.load(), nil)
+	assert.Equal(t, h.Validate("newuser", "asdf"), true)
+}
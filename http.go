@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
 )
 
 type Server struct {
@@ -17,7 +25,7 @@ type Server struct {
 }
 
 func (s *Server) ListenAndServe() {
-	if len(s.Opts.TLSCertFile) != 0 {
+	if len(s.Opts.TLSCertFile) != 0 || s.Opts.TLSACME {
 		s.ServeHTTPS()
 	} else {
 		s.ServeHTTP()
@@ -44,14 +52,14 @@ func (s *Server) ServeHTTP() {
 	slice := strings.SplitN(httpAddress, "//", 2)
 	listenAddr := slice[len(slice)-1]
 
-	listener, err := net.Listen(networkType, listenAddr)
+	listener, err := listen(networkType, listenAddr, s.Opts.ReusePort)
 	if err != nil {
 		log.Fatalf("FATAL: listen (%s, %s) failed - %s", networkType, listenAddr, err)
 	}
-	log.Printf("HTTP: listening on %s", listenAddr)
+	log.Printf("HTTP: listening on %s", listener.Addr())
 
 	server := &http.Server{Handler: s.Handler}
-	err = server.Serve(listener)
+	err = serveUntil(server, listener, shutdownSignals(), s.Opts.ShutdownTimeout)
 	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
 		log.Printf("ERROR: http.Serve() - %s", err)
 	}
@@ -104,15 +112,41 @@ func (s *Server) ServeHTTPS() {
 		}
 	}
 
-	ln, err := net.Listen("tcp", addr)
+	if s.Opts.TLSOCSPStapling {
+		stapler := newOCSPStapler(config.Certificates)
+		stapler.Run()
+		config.Certificates = nil
+		config.GetCertificate = stapler.GetCertificate
+	}
+
+	if !s.Opts.TLSSessionTickets {
+		config.SessionTicketsDisabled = true
+	} else if s.Opts.TLSSessionTicketSecret != "" {
+		rotateSessionTicketKeys(config, s.Opts.TLSSessionTicketSecret, s.Opts.TLSSessionTicketRotation)
+	}
+
+	if s.Opts.TLSACME {
+		m := newACMEManager(s.Opts.TLSACMEDomains, s.Opts.TLSACMECacheDir)
+		config.GetCertificate = m.GetCertificate
+		// answer the tls-alpn-01 challenges on this listener
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	}
+
+	ln, err := listen("tcp", addr, s.Opts.ReusePort)
 	if err != nil {
 		log.Fatalf("FATAL: listen (%s) failed - %s", addr, err)
 	}
 	log.Printf("HTTPS: listening on %s", ln.Addr())
+	if tcpLn, ok := ln.(*net.TCPListener); ok {
+		ln = tcpKeepAliveListener{tcpLn}
+	}
 
-	tlsListener := tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener)}, config)
-	srv := &http.Server{Handler: s.Handler}
-	err = srv.Serve(tlsListener)
+	tlsListener := tls.NewListener(ln, config)
+	srv := &http.Server{Handler: s.Handler, TLSConfig: config}
+	if err := configureHTTP2(srv, s.Opts.HTTP2MaxConcurrentStreams); err != nil {
+		log.Fatalf("FATAL: configuring HTTP/2 failed - %s", err)
+	}
+	err = serveUntil(srv, tlsListener, shutdownSignals(), s.Opts.ShutdownTimeout)
 
 	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
 		log.Printf("ERROR: https.Serve() - %s", err)
@@ -121,6 +155,56 @@ func (s *Server) ServeHTTPS() {
 	log.Printf("HTTPS: closing %s", tlsListener.Addr())
 }
 
+// shutdownSignals are the signals that gracefully stop the server
+func shutdownSignals() <-chan os.Signal {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	return stop
+}
+
+// serveUntil serves srv on listener until a signal is received from stop,
+// then stops accepting connections and waits up to timeout for the requests
+// in flight to finish. Hijacked connections, ie. websockets, aren't waited
+// for.
+func serveUntil(srv *http.Server, listener net.Listener, stop <-chan os.Signal, timeout time.Duration) error {
+	drained := make(chan struct{})
+	go func() {
+		sig := <-stop
+		log.Printf("received %s, waiting up to %s for requests in flight", sig, timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("ERROR: shutdown - %s", err)
+		}
+		close(drained)
+	}()
+	err := srv.Serve(listener)
+	if err == http.ErrServerClosed {
+		<-drained
+		return nil
+	}
+	return err
+}
+
+// newACMEManager obtains certificates for domains from Let's Encrypt, renews
+// them before they expire, and keeps them in cacheDir
+func newACMEManager(domains []string, cacheDir string) *autocert.Manager {
+	log.Printf("HTTPS: obtaining certificates for %s through ACME", strings.Join(domains, ", "))
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}
+}
+
+// configureHTTP2 serves HTTP/2 to the clients of srv that negotiate h2 through
+// ALPN in its TLSConfig, ie. browsers and gRPC-web frontends
+func configureHTTP2(srv *http.Server, maxConcurrentStreams int) error {
+	return http2.ConfigureServer(srv, &http2.Server{
+		MaxConcurrentStreams: uint32(maxConcurrentStreams),
+	})
+}
+
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
 // connections. It's used by ListenAndServe and ListenAndServeTLS so
 // dead TCP connections (e.g. closing laptop mid-download) eventually
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"golang.org/x/net/http2"
+)
+
+func TestConfigureHTTP2(t *testing.T) {
+	// borrow the test certificate of httptest
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := ts.TLS.Certificates[0]
+	ts.Close()
+
+	serve := func(maxConcurrentStreams int) *http2.ClientConn {
+		config := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+		srv := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.Proto))
+			}),
+			TLSConfig: config,
+		}
+		assert.Equal(t, nil, configureHTTP2(srv, maxConcurrentStreams))
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Equal(t, nil, err)
+		go srv.Serve(tls.NewListener(ln, config))
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2"},
+		})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+		cc, err := (&http2.Transport{}).NewClientConn(conn)
+		assert.Equal(t, nil, err)
+
+		// the first response follows the server's settings
+		req, _ := http.NewRequest("GET", "https://"+ln.Addr().String()+"/", nil)
+		resp, err := cc.RoundTrip(req)
+		assert.Equal(t, nil, err)
+		resp.Body.Close()
+		assert.Equal(t, "HTTP/2.0", resp.Proto)
+		return cc
+	}
+
+	assert.Equal(t, uint32(250), serve(250).State().MaxConcurrentStreams)
+	assert.Equal(t, uint32(1), serve(1).State().MaxConcurrentStreams)
+}
+
+func TestACMEManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_acme_cache_")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	m := newACMEManager([]string{"auth.example.com"}, dir)
+	assert.Equal(t, nil, m.HostPolicy(context.Background(), "auth.example.com"))
+	assert.NotEqual(t, nil, m.HostPolicy(context.Background(), "evil.example.com"))
+}
+
+func TestServeUntil(t *testing.T) {
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("finished"))
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	stop := make(chan os.Signal, 1)
+	served := make(chan error)
+	go func() { served <- serveUntil(srv, ln, stop, time.Minute) }()
+
+	resp := make(chan string)
+	go func() {
+		r, err := http.Get("http://" + ln.Addr().String() + "/")
+		assert.Equal(t, nil, err)
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		resp <- string(body)
+	}()
+	<-started
+	stop <- syscall.SIGTERM
+
+	// the request in flight finishes before serveUntil returns
+	assert.Equal(t, "finished", <-resp)
+	assert.Equal(t, nil, <-served)
+	_, err = net.Dial("tcp", ln.Addr().String())
+	assert.NotEqual(t, nil, err)
+}
+
+func TestListenReusePort(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SO_REUSEPORT is not supported on windows")
+	}
+	first, err := listen("tcp", "127.0.0.1:0", true)
+	assert.Equal(t, nil, err)
+	defer first.Close()
+	second, err := listen("tcp", first.Addr().String(), true)
+	assert.Equal(t, nil, err)
+	defer second.Close()
+
+	// without it the address is taken
+	_, err = listen("tcp", first.Addr().String(), false)
+	assert.NotEqual(t, nil, err)
+}
@@ -5,13 +5,26 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"text/template"
 	"time"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-client-go"
+)
+
+// Formats of the request log
+const (
+	loggingFormatText = "text"
+	loggingFormatJSON = "json"
 )
 
 // responseLogger is wrapper of http.ResponseWriter that keeps track of its HTTP status
@@ -21,6 +34,7 @@ type responseLogger struct {
 	status   int
 	size     int
 	upstream string
+	tag      string
 	authInfo string
 }
 
@@ -44,6 +58,11 @@ func (l *responseLogger) ExtractGAPMetadata() {
 		l.upstream = upstream
 		l.w.Header().Del("GAP-Upstream-Address")
 	}
+	tag := l.w.Header().Get("GAP-Upstream-Tag")
+	if tag != "" {
+		l.tag = tag
+		l.w.Header().Del("GAP-Upstream-Tag")
+	}
 	authInfo := l.w.Header().Get("GAP-Auth")
 	if authInfo != "" {
 		l.authInfo = authInfo
@@ -81,10 +100,24 @@ type loggingHandler struct {
 	writer  io.Writer
 	handler http.Handler
 	enabled bool
+	// tagged appends the upstream tag to every log line
+	tagged bool
+	// json logs each request as a JSON object instead of a line of text
+	json bool
+	// template formats the lines of text instead of the default format
+	template *template.Template
+	// excluded are the paths whose requests aren't logged
+	excluded map[string]bool
 }
 
 func LoggingHandler(out io.Writer, h http.Handler, v bool) http.Handler {
-	return loggingHandler{out, h, v}
+	return loggingHandler{writer: out, handler: h, enabled: v}
+}
+
+// TaggedLoggingHandler is LoggingHandler, logging the upstream tag of each
+// request as the last field
+func TaggedLoggingHandler(out io.Writer, h http.Handler, v bool) http.Handler {
+	return loggingHandler{writer: out, handler: h, enabled: v, tagged: true}
 }
 
 func (h loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -92,10 +125,26 @@ func (h loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	url := *req.URL
 	logger := &responseLogger{w: w}
 	h.handler.ServeHTTP(logger, req)
-	if !h.enabled {
+	if !h.enabled || h.excluded[url.Path] {
+		return
+	}
+	if h.json {
+		h.writer.Write(buildLogEntry(logger, req, url, t, h.tagged))
+		return
+	}
+	if h.template != nil {
+		logLine, err := buildTemplateLogLine(h.template, logger, req, url, t)
+		if err != nil {
+			log.Printf("ERROR: formatting the request log - %s", err)
+			return
+		}
+		h.writer.Write(logLine)
 		return
 	}
 	logLine := buildLogLine(logger.authInfo, logger.upstream, req, url, t, logger.Status(), logger.Size())
+	if h.tagged {
+		logLine = appendLogTag(logLine, logger.tag)
+	}
 	h.writer.Write(logLine)
 }
 
@@ -115,19 +164,10 @@ func buildLogLine(username, upstream string, req *http.Request, url url.URL, ts
 		}
 	}
 
-	client := req.Header.Get("X-Real-IP")
-	if client == "" {
-		client = req.RemoteAddr
-	}
-
-	if c, _, err := net.SplitHostPort(client); err == nil {
-		client = c
-	}
-
 	duration := float64(time.Now().Sub(ts)) / float64(time.Second)
 
 	logLine := fmt.Sprintf("%s - %s [%s] %s %s %s %q %s %q %d %d %0.3f\n",
-		client,
+		logClient(req),
 		username,
 		ts.Format("02/Jan/2006:15:04:05 -0700"),
 		req.Host,
@@ -142,3 +182,149 @@ func buildLogLine(username, upstream string, req *http.Request, url url.URL, ts
 	)
 	return []byte(logLine)
 }
+
+// logClient is the address requests are logged with
+func logClient(req *http.Request) string {
+	if realClientIPHeader != "" {
+		return clientIP(req)
+	}
+	client := req.Header.Get("X-Real-IP")
+	if client == "" {
+		client = req.RemoteAddr
+	}
+	if c, _, err := net.SplitHostPort(client); err == nil {
+		client = c
+	}
+	return client
+}
+
+// logTemplateData are the fields of a request available to the request
+// logging format. Those the request had none of are "-".
+type logTemplateData struct {
+	Timestamp       string
+	Client          string
+	Username        string
+	Host            string
+	RequestMethod   string
+	Upstream        string
+	RequestURI      string
+	Protocol        string
+	UserAgent       string
+	StatusCode      int
+	ResponseSize    int
+	RequestDuration string
+	Tag             string
+	TraceID         string
+}
+
+// buildTemplateLogLine is the log line of the request logger answered,
+// formatted with t and ending with a newline
+func buildTemplateLogLine(t *template.Template, logger *responseLogger, req *http.Request, url url.URL, ts time.Time) ([]byte, error) {
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	username := logger.authInfo
+	if url.User != nil && username == "" {
+		username = url.User.Username()
+	}
+	data := logTemplateData{
+		Timestamp:       ts.Format("02/Jan/2006:15:04:05 -0700"),
+		Client:          logClient(req),
+		Username:        orDash(username),
+		Host:            req.Host,
+		RequestMethod:   req.Method,
+		Upstream:        orDash(logger.upstream),
+		RequestURI:      url.RequestURI(),
+		Protocol:        req.Proto,
+		UserAgent:       orDash(req.UserAgent()),
+		StatusCode:      logger.Status(),
+		ResponseSize:    logger.Size(),
+		RequestDuration: fmt.Sprintf("%0.3f", float64(time.Now().Sub(ts))/float64(time.Second)),
+		Tag:             orDash(logger.tag),
+		TraceID:         orDash(traceID(req)),
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	if b.Len() == 0 || b.Bytes()[b.Len()-1] != '\n' {
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+// logEntry is a request logged as JSON. Tag is only set, to "-" when the
+// request had none, for tagged logging.
+type logEntry struct {
+	Time      string  `json:"time"`
+	Client    string  `json:"client"`
+	User      string  `json:"user,omitempty"`
+	Host      string  `json:"host"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Proto     string  `json:"proto"`
+	UserAgent string  `json:"user_agent"`
+	Upstream  string  `json:"upstream,omitempty"`
+	Tag       string  `json:"tag,omitempty"`
+	Status    int     `json:"status"`
+	Size      int     `json:"size"`
+	Duration  float64 `json:"duration"`
+	TraceID   string  `json:"trace_id,omitempty"`
+}
+
+// buildLogEntry is the JSON log entry of the request logger answered, with
+// a trailing newline
+func buildLogEntry(logger *responseLogger, req *http.Request, url url.URL, ts time.Time, tagged bool) []byte {
+	user := logger.authInfo
+	if url.User != nil && user == "" {
+		user = url.User.Username()
+	}
+	e := logEntry{
+		Time:      ts.UTC().Format(time.RFC3339Nano),
+		Client:    logClient(req),
+		User:      user,
+		Host:      req.Host,
+		Method:    req.Method,
+		Path:      url.RequestURI(),
+		Proto:     req.Proto,
+		UserAgent: req.UserAgent(),
+		Upstream:  logger.upstream,
+		Status:    logger.Status(),
+		Size:      logger.Size(),
+		Duration:  float64(time.Now().Sub(ts)) / float64(time.Second),
+		TraceID:   traceID(req),
+	}
+	if tagged {
+		e.Tag = logger.tag
+		if e.Tag == "" {
+			e.Tag = "-"
+		}
+	}
+	b, _ := json.Marshal(e)
+	return append(b, '\n')
+}
+
+// traceID is the id of the trace req is part of, or "" when it isn't traced
+// with Jaeger
+func traceID(req *http.Request) string {
+	span := opentracing.SpanFromContext(req.Context())
+	if span == nil {
+		return ""
+	}
+	if sc, ok := span.Context().(jaeger.SpanContext); ok && sc.IsValid() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// appendLogTag adds tag, or "-" when the request had none, as the last field
+// of logLine
+func appendLogTag(logLine []byte, tag string) []byte {
+	if tag == "" {
+		tag = "-"
+	}
+	return append(append(logLine[:len(logLine)-1], ' '), tag+"\n"...)
+}
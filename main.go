@@ -1,125 +1,271 @@
 package main // import "github.com/bitly/oauth2_proxy"
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"runtime"
 	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/bitly/oauth2_proxy/api"
 	"github.com/mreiferson/go-options"
-	"github.com/opentracing-contrib/go-stdlib/nethttp"
 	opentracing "github.com/opentracing/opentracing-go"
-	"github.com/uber/jaeger-client-go"
-	jaegercfg "github.com/uber/jaeger-client-go/config"
-	jaegerlog "github.com/uber/jaeger-client-go/log"
-	"github.com/uber/jaeger-lib/metrics"
 )
 
 func main() {
-	traceHost := "localhost"
-	tracePort := "6831"
-	if jhost := os.Getenv("JAEGER_AGENT_HOST"); jhost != "" {
-		traceHost = jhost
-	}
-	if jport := os.Getenv("JAEGER_AGENT_PORT"); jport != "" {
-		tracePort = jport
-	}
-	jcfg := jaegercfg.Configuration{
-		Sampler: &jaegercfg.SamplerConfig{
-			Type:  jaeger.SamplerTypeProbabilistic,
-			Param: 1.0 / 100.0,
-		},
-		Reporter: &jaegercfg.ReporterConfig{
-			LogSpans:           false,
-			LocalAgentHostPort: traceHost + ":" + tracePort,
-		},
-	}
-
-	jLogger := jaegerlog.StdLogger
-	jMetricsFactory := metrics.NullFactory
-	closer, err := jcfg.InitGlobalTracer(
-		"oauth2_proxy",
-		jaegercfg.Logger(jLogger),
-		jaegercfg.Metrics(jMetricsFactory),
-	)
-	if err != nil {
-		log.Printf("Could not initialize jaeger tracer: %s", err.Error())
-		return
-	}
-	defer closer.Close()
-
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 	flagSet := flag.NewFlagSet("oauth2_proxy", flag.ExitOnError)
 
 	emailDomains := StringArray{}
 	upstreams := StringArray{}
+	upstreamTags := StringArray{}
+	providerDomains := StringArray{}
+	extraProviders := StringArray{}
+	cookieNamesPrevious := StringArray{}
+	cookieNameAliases := StringArray{}
 	skipAuthRegex := StringArray{}
+	trustedIPs := StringArray{}
+	trustedDownstreams := StringArray{}
 	googleGroups := StringArray{}
+	githubOrgs := StringArray{}
+	githubTeams := StringArray{}
+	githubUsers := StringArray{}
+	azureGroups := StringArray{}
+	gitlabGroups := StringArray{}
+	gitlabProjects := StringArray{}
+	keycloakGroups := StringArray{}
+	keycloakRealmRoles := StringArray{}
+	guestAdmins := StringArray{}
+	guestRoutes := StringArray{}
+	metricsLabels := StringArray{}
+	traceSampleRoutes := StringArray{}
+	otlpHeaders := StringArray{}
+	otlpResourceAttributes := StringArray{}
+	rateLimitRoutes := StringArray{}
+	blockedEmails := StringArray{}
+	signProviderRequests := StringArray{}
+	providerContentTypes := StringArray{}
 	tlsCerts := StringArray{}
 	tlsKeys := StringArray{}
+	acmeDomains := StringArray{}
+	cacheControlRoutes := StringArray{}
+	cacheControlContentTypes := StringArray{}
+	scopeRoutes := StringArray{}
+	sessionAgeRoutes := StringArray{}
+	excludeLoggingPaths := StringArray{}
+	botUserAgents := StringArray{}
 
 	config := flagSet.String("config", "", "path to config file")
 	showVersion := flagSet.Bool("version", false, "print version string")
+	migrateCookie := flagSet.String("migrate-cookie", "", "print this session cookie value re-issued in the current cookie format, and exit")
+	exportState := flagSet.Bool("export-auth-state", false, "print the cookie settings as a bundle another proxy can import with auth-state-file, and exit")
 
 	flagSet.String("http-address", "127.0.0.1:4180", "[http://]<addr>:<port> or unix://<path> to listen on for HTTP clients")
 	flagSet.String("https-address", ":443", "<addr>:<port> to listen on for HTTPS clients")
+	flagSet.String("admin-address", "", "<addr>:<port> to serve the session event stream on, for monitoring systems only; unset to disable")
+	flagSet.String("admin-token", "", "bearer token of the admin endpoint rotating the provider's client ID and secret; unset to disable it")
+	flagSet.String("metrics-address", "", "<addr>:<port> to serve the liveness, readiness and metrics endpoints on instead of the http(s) address, for health checks and monitoring only; unset to serve them with the proxy")
 	flagSet.Var(&tlsCerts, "tls-cert", "path to a certificate file")
 	flagSet.Var(&tlsKeys, "tls-key", "path to  a private key file")
 	flagSet.String("tls-client-ca", "", "path to CA, clients presenting certs matching this CA will bypass auth")
+	flagSet.Bool("tls-acme", false, "obtain and renew the HTTPS certificate from Let's Encrypt instead of tls-cert and tls-key")
+	flagSet.Var(&acmeDomains, "tls-acme-domain", "domain to obtain a certificate for with tls-acme (may be given multiple times)")
+	flagSet.String("tls-acme-cache-dir", "", "directory to keep the certificates obtained with tls-acme in")
+	flagSet.Int("http2-max-concurrent-streams", 250, "maximum concurrent streams of each HTTP/2 connection to the HTTPS listener")
+	flagSet.Bool("tls-session-tickets", true, "let HTTPS clients resume sessions with session tickets")
+	flagSet.String("tls-session-ticket-secret", "", "secret the session ticket keys are derived from, shared by replicas that resume each other's sessions")
+	flagSet.Duration("tls-session-ticket-rotation", time.Duration(12)*time.Hour, "how often the session ticket keys derived from tls-session-ticket-secret are rotated")
+	flagSet.Bool("tls-ocsp-stapling", false, "staple OCSP responses from the issuer to the tls-cert certificates")
+	flagSet.Bool("reuse-port", false, "listen with SO_REUSEPORT, so a new process can take over the address while this one drains")
+	flagSet.Duration("shutdown-timeout", time.Duration(30)*time.Second, "how long SIGTERM waits for requests in flight before exiting")
+	flagSet.String("liveness-path", "/ping", "path of the liveness endpoint, which answers 200 while the process is up")
+	flagSet.String("readiness-path", "/ready", "path of the readiness endpoint, which answers 503 while the provider is unreachable or the TLS certificate is not valid")
+	flagSet.Bool("health-verbose", false, "answer the liveness and readiness endpoints with JSON reports of each check")
 	flagSet.String("redirect-url", "", "the OAuth Redirect URL. ie: \"https://internalapp.yourcompany.com/oauth2/callback\"")
-	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User and X-Auth-Request-Email response headers (useful in Nginx auth_request mode)")
-	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint or file:// paths for static files. Routing is based on the path")
-	flagSet.Bool("pass-basic-auth", true, "pass HTTP Basic Auth, X-Forwarded-User and X-Forwarded-Email information to upstream")
-	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User and X-Forwarded-Email information to upstream")
+	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User, X-Auth-Request-Email and X-Auth-Request-Groups response headers (useful in Nginx auth_request mode)")
+	flagSet.Bool("session-expiry-headers", false, "set GAP-Session-Expires-In and GAP-Session-Refresh-URL response headers telling applications when the session ends and where to renew it")
+	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint, file:// paths for static files, h2c:// HTTP/2 cleartext upstreams, static://<status code> responses or srv://<SRV record name> upstreams discovered through DNS. Routing is based on the path, and requests for a path with several http upstreams are balanced across them")
+	flagSet.String("upstream-health-path", "", "path requested from each upstream sharing a path with others every upstream-health-interval, to take those that fail out of rotation")
+	flagSet.Duration("upstream-health-interval", time.Duration(10)*time.Second, "how often upstreams are health checked, and how long they are taken out of rotation without health checks")
+	flagSet.Int("upstream-max-fails", 3, "take an upstream sharing a path with others out of rotation after this many 502, 503 or 504 responses in a row; 0 to disable")
+	flagSet.Duration("upstream-srv-interval", time.Duration(30)*time.Second, "how often the SRV records of srv:// upstreams are looked up")
+	flagSet.Int("upstream-max-idle-conns-per-host", http.DefaultMaxIdleConnsPerHost, "idle connections kept open to each upstream for reuse")
+	flagSet.Duration("upstream-idle-conn-timeout", time.Duration(90)*time.Second, "how long idle connections to upstreams are kept open; 0 for no limit")
+	flagSet.Duration("upstream-dial-timeout", time.Duration(30)*time.Second, "timeout for connecting to upstreams; 0 for none")
+	flagSet.Duration("upstream-tls-handshake-timeout", time.Duration(10)*time.Second, "timeout for the TLS handshake with https upstreams; 0 for none")
+	flagSet.Duration("upstream-response-header-timeout", time.Duration(0), "timeout for upstreams to send response headers after the request; 0 for none")
+	flagSet.Var(&upstreamTags, "upstream-tag", "attribute the requests to a named upstream to a team or cost center in logs and metrics: <upstream name>=<tag> (may be given multiple times)")
+	flagSet.String("upstream-balance", "round-robin", "how requests are balanced across the upstreams of a path: round-robin, least-conn or sticky")
+	flagSet.Bool("pass-basic-auth", true, "pass HTTP Basic Auth, X-Forwarded-User, X-Forwarded-Email and X-Forwarded-Groups information to upstream")
+	flagSet.Bool("pass-original-request", false, "pass the URL and method of the client's request to upstream as X-Original-URL, X-Forwarded-Uri and X-Original-Method, and return those of the request asked about from the auth endpoint")
+	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User, X-Forwarded-Email and X-Forwarded-Groups information to upstream")
 	flagSet.String("basic-auth-password", "", "the password to set when passing the HTTP Basic Auth header")
 	flagSet.Bool("pass-access-token", false, "pass OAuth access_token to upstream via X-Forwarded-Access-Token header")
 	flagSet.Bool("pass-host-header", true, "pass the request Host Header to upstream")
 	flagSet.Var(&skipAuthRegex, "skip-auth-regex", "bypass authentication for requests path's that match (may be given multiple times)")
+	flagSet.Var(&trustedIPs, "trusted-ip", "bypass authentication for requests from this address or CIDR, ie. 10.0.0.0/8 (may be given multiple times)")
+	flagSet.String("real-client-ip-header", "", "header the ingress sets to the client's address, ie. X-Forwarded-For, CF-Connecting-IP or True-Client-IP, used to log, rate limit and audit clients instead of the address requests are received from")
+	flagSet.Var(&trustedDownstreams, "trusted-downstream-cidr", "honor X-Forwarded-For and X-Real-IP only from proxies at this address or CIDR, stripping them from other clients; all are honored when unset (may be given multiple times)")
 	flagSet.Bool("skip-provider-button", false, "will skip sign-in-page to directly reach the next step: oauth/start")
+	flagSet.Bool("headless", false, "never render HTML: redirect browsers without a session to oauth/start, answer other requests without one with a 401, and report errors as JSON")
+	flagSet.Bool("silent-reauth", false, "enable the /oauth2/silent endpoint that renews sessions in a hidden iframe using prompt=none")
+	flagSet.Duration("silent-reauth-window", time.Duration(10)*time.Minute, "renew sessions via /oauth2/silent when they expire within this duration")
 	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for OPTIONS requests")
+	flagSet.Int("auth-rate-limit", 0, "maximum /oauth2/start and /oauth2/callback requests per minute from a client IP; 0 to disable")
+	flagSet.Int("auth-max-concurrent", 0, "maximum /oauth2/start and /oauth2/callback requests handled at once; 0 to disable")
+	flagSet.Int("sign-in-attempts", 5, "failed htpasswd sign ins allowed per client IP and username before each further failure doubles the wait for the next attempt; 0 to disable")
+	flagSet.Duration("sign-in-lockout", time.Duration(15)*time.Minute, "longest wait imposed after failed htpasswd sign ins, and how long until failures are forgotten")
+	flagSet.Var(&metricsLabels, "metrics-label", "add a label to the request metrics: <name>=header:<header>:<value>,... | host:<host>,... | upstream (may be given multiple times)")
+	flagSet.Float64("trace-sample-rate", 0.01, "fraction of requests traced, other than to the sign in and auth endpoints, which are all traced")
+	flagSet.String("otlp-endpoint", "", "OpenTelemetry collector url to export sampled traces and metrics to with OTLP over HTTP, ie. http://127.0.0.1:4318")
+	flagSet.Var(&otlpHeaders, "otlp-header", "header sent with OTLP exports: <name>=<value> (may be given multiple times)")
+	flagSet.Var(&otlpResourceAttributes, "otlp-resource-attribute", "resource attribute of the exported traces and metrics, in addition to or overriding service.name, service.version, service.instance.id and host.name: <key>=<value> (may be given multiple times)")
+	flagSet.Duration("otlp-metrics-interval", time.Duration(60)*time.Second, "how often metrics are exported with OTLP")
+	flagSet.Var(&traceSampleRoutes, "trace-sample-route", "fraction of the requests for a path (regex) traced, instead of the default: <path regex>=<rate> (may be given multiple times)")
+	flagSet.Int("rate-limit", 0, "maximum proxied requests per minute from a user, or a client IP without a session; 0 to disable")
+	flagSet.Var(&rateLimitRoutes, "rate-limit-route", "maximum proxied requests per minute from a user to the paths starting with a prefix, instead of rate-limit: <path prefix>=<requests per minute>, 0 for no limit (may be given multiple times)")
+	flagSet.Duration("auth-decision-cache-ttl", time.Duration(0), "cache per-session access decisions for this duration; 0 to disable")
+	flagSet.Duration("auth-only-cache-ttl", time.Duration(0), "cache accepted /oauth2/auth results per session cookie for this duration, at most 5s; 0 to disable")
+	flagSet.String("experiment-salt", "", "salt of the hash of the user's email the X-Experiment-Bucket header passed upstream is derived from; unset to disable")
+	flagSet.Int("experiment-buckets", 100, "number of experiment buckets users are split into")
+	flagSet.Bool("unsafe-test-mode", false, "mint sessions from signed X-Test-Identity headers and allow moving the session clock, for integration tests only; never enable in production")
+	flagSet.String("test-mode-secret", "", "secret X-Test-Identity headers and test clock requests are signed with in unsafe-test-mode")
+	flagSet.String("cache-control", "", "Cache-Control header set on authenticated proxied responses, ie. \"no-store\"")
+	flagSet.Var(&cacheControlRoutes, "cache-control-route", "request paths (regex) whose responses get the cache-control header, instead of all (may be given multiple times)")
+	flagSet.Var(&cacheControlContentTypes, "cache-control-content-type", "content type prefix of the responses that get the cache-control header, instead of all (may be given multiple times)")
 	flagSet.String("tls-ca", "", "file containing the CA to use when validating upstream TLS connections")
 	flagSet.Bool("tls-insecure-skip-verify", false, "skip validation of certificates presented when using upstream TLS")
+	flagSet.String("upstream-tls-cert", "", "path to the client certificate presented to upstreams that require mutual TLS")
+	flagSet.String("upstream-tls-key", "", "path to the private key of upstream-tls-cert")
 
-	flagSet.Var(&emailDomains, "email-domain", "authenticate emails with the specified domain (may be given multiple times). Use * to authenticate any email")
+	flagSet.Var(&emailDomains, "email-domain", "authenticate emails with the specified domain, or any subdomain of it with *.<domain> (may be given multiple times). Use * to authenticate any email")
+	flagSet.String("apple-team-id", "", "the apple developer team id the sign in with apple key belongs to")
+	flagSet.String("apple-key-id", "", "the id of the sign in with apple private key")
+	flagSet.String("apple-private-key-file", "", "path to the sign in with apple private key (.p8), used to generate client secrets")
 	flagSet.String("azure-tenant", "common", "go to a tenant-specific or common (tenant-independent) endpoint.")
-	flagSet.String("github-org", "", "restrict logins to members of this organisation")
-	flagSet.String("github-team", "", "restrict logins to members of this team")
+	flagSet.Var(&azureGroups, "azure-group", "restrict logins to members of this azure ad group object id (may be given multiple times).")
+	flagSet.String("bitbucket-team", "", "restrict logins to members of this team")
+	flagSet.String("bitbucket-repository", "", "restrict logins to users with access to this repository")
+	flagSet.String("cognito-domain", "", "the hosted UI domain of the cognito user pool, ie: \"https://yourapp.auth.us-east-1.amazoncognito.com\"")
+	flagSet.Var(&githubOrgs, "github-org", "restrict logins to members of this organisation (may be given multiple times)")
+	flagSet.Var(&githubTeams, "github-team", "restrict logins to members of this team: [<org>:]<team> (may be given multiple times)")
+	flagSet.Var(&githubUsers, "github-user", "allow this GitHub login regardless of github-org, github-team and github-repo (may be given multiple times)")
+	flagSet.String("github-repo", "", "restrict logins to collaborators of this repository: <owner>/<name>")
+	flagSet.String("github-token", "", "the token used to look up the collaborators of github-repo, which must have push access to it")
+	flagSet.String("github-enterprise-url", "", "the base url of a GitHub Enterprise instance, ie: \"https://github.yourcompany.com\"")
+	flagSet.String("gitea-url", "", "the base url of a Gitea or Forgejo instance, ie: \"https://git.yourcompany.com\"")
+	flagSet.String("gitea-org", "", "restrict logins to members of this gitea organisation")
+	flagSet.String("gitea-team", "", "restrict logins to members of any of these gitea teams, separated by a comma")
+	flagSet.String("gitlab-url", "", "the base url of a self-hosted GitLab instance, ie: \"https://gitlab.yourcompany.com\"")
+	flagSet.Var(&gitlabGroups, "gitlab-group", "restrict logins to members of this gitlab group (may be given multiple times).")
+	flagSet.Var(&gitlabProjects, "gitlab-project", "restrict logins to members of this gitlab project: <group/project>[=<access level>] (may be given multiple times).")
+	flagSet.Var(&keycloakGroups, "keycloak-group", "restrict logins to members of this keycloak group (may be given multiple times).")
+	flagSet.Var(&keycloakRealmRoles, "keycloak-realm-role", "restrict logins to tokens granted this keycloak realm role (may be given multiple times).")
 	flagSet.Var(&googleGroups, "google-group", "restrict logins to members of this google group (may be given multiple times).")
 	flagSet.String("google-admin-email", "", "the google admin to impersonate for api calls")
+	flagSet.Duration("google-group-cache-ttl", time.Duration(0), "cache google group memberships for this duration; 0 to disable")
+	flagSet.Duration("google-group-negative-cache-ttl", time.Duration(0), "cache users that are in none of the google groups for this duration, with google-group-cache-ttl")
 	flagSet.String("google-service-account-json", "", "the path to the service account json credentials")
 	flagSet.String("client-id", "", "the OAuth Client ID: ie: \"123456.apps.googleusercontent.com\"")
 	flagSet.String("client-secret", "", "the OAuth Client Secret")
-	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line)")
-	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -s\" for SHA encryption")
+	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line, optionally followed by ,expires=<date>)")
+	flagSet.Var(&blockedEmails, "blocked-email", "deny an email or htpasswd user even when its domain or the authenticated emails file allows it (may be given multiple times)")
+	flagSet.String("blocked-emails-file", "", "deny the emails and htpasswd users listed in a file, one per line, even when their domain or the authenticated emails file allows them; reloaded when it changes")
+	flagSet.String("role-mapping-file", "", "file mapping provider groups to roles, one <group>,<role>[,<role>...] per line; reloaded when it changes")
+	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -s\" for SHA encryption or \"htpasswd -B\" for bcrypt")
 	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file is provided")
 	flagSet.String("custom-templates-dir", "", "path to custom html templates")
 	flagSet.String("footer", "", "custom footer string. Use \"-\" to disable default footer.")
+	flagSet.Var(&guestAdmins, "guest-admin", "email of an admin allowed to mint guest access codes (may be given multiple times)")
+	flagSet.Var(&guestRoutes, "guest-route", "request paths (regex) or upstream:<name> guest sessions may access (may be given multiple times)")
+	flagSet.Duration("guest-code-expire", time.Duration(24)*time.Hour, "how long a guest access code can be redeemed after it is minted")
+	flagSet.Duration("guest-session-expire", time.Duration(1)*time.Hour, "expire timeframe for guest sessions")
 	flagSet.String("proxy-prefix", "/oauth2", "the url root path that this proxy should be nested under (e.g. /<oauth2>/sign_in)")
 
 	flagSet.String("cookie-name", "_oauth2_proxy", "the name of the cookie that the oauth_proxy creates")
+	flagSet.Var(&cookieNamesPrevious, "cookie-name-previous", "a previous cookie-name whose cookies are expired along with the session cookie (may be given multiple times)")
+	flagSet.Var(&cookieNameAliases, "cookie-name-alias", "a previous cookie-name whose session cookies are still accepted and re-issued under cookie-name, then expired (may be given multiple times)")
 	flagSet.String("cookie-secret", "", "the seed string for secure cookies (optionally base64 encoded)")
+	flagSet.String("cookie-secret-previous", "", "with cookie-migration, the cookie-secret cookies in the previous format were signed with (default cookie-secret)")
+	flagSet.Bool("cookie-migration", false, "accept session cookies in the previous format, and re-issue them in the current one")
+	flagSet.Bool("cookie-previous-cipher", false, "with cookie-migration, whether cookies in the previous format had their tokens encrypted")
+	flagSet.String("cookie-previous-serialization", "session", "with cookie-migration, how cookies in the previous format were serialized: session or email")
 	flagSet.String("cookie-domain", "", "an optional cookie domain to force cookies to (ie: .yourcompany.com)*")
 	flagSet.Duration("cookie-expire", time.Duration(168)*time.Hour, "expire timeframe for cookie")
 	flagSet.Duration("cookie-refresh", time.Duration(0), "refresh the cookie after this duration; 0 to disable")
 	flagSet.Bool("cookie-secure", true, "set secure (HTTPS) cookie flag")
 	flagSet.Bool("cookie-httponly", true, "set HttpOnly cookie flag")
+	flagSet.Bool("csrf-state-fallback", false, "sign the CSRF nonce and client address into the OAuth state, and accept callbacks from that address with a recently signed state once when the browser dropped the CSRF cookie, which weakens login CSRF protection")
+	flagSet.String("auth-state-file", "", "use the cookie settings of this bundle, exported by another proxy with -export-auth-state")
+	flagSet.Bool("filter-bots", false, "answer crawlers, scanners and clients that don't keep cookies with a 401 instead of starting sign ins")
+	flagSet.Var(&botUserAgents, "bot-user-agent", "user agent (regex) of bots, in addition to the built in crawlers, scanners and HTTP libraries (may be given multiple times)")
 
 	flagSet.Bool("request-logging", true, "Log requests to stdout")
+	flagSet.String("logging-format", "text", "format of the request log: text, or json for one JSON object per request")
+	flagSet.String("request-logging-format", "", "template of the request log lines, ie. {{.Client}} {{.Host}} {{.RequestMethod}} {{.RequestURI}} {{.StatusCode}}; unset for the default format")
+	flagSet.Var(&excludeLoggingPaths, "exclude-logging-path", "request path left out of the request log, ie. /ping,/oauth2/metrics (may be given multiple times)")
+	flagSet.String("access-log-file", "", "log requests to this file instead of stdout; reopened on SIGUSR1")
+	flagSet.Int("access-log-max-size", 0, "rotate the access log file once it grows beyond this many megabytes; 0 to leave rotation to logrotate")
+	flagSet.Int("access-log-max-backups", 0, "number of rotated access log files to keep; 0 to keep them all")
+	flagSet.String("logging-filename", "", "write the proxy's own log to this file instead of stderr; reopened on SIGUSR1")
+	flagSet.Int("logging-max-size", 0, "rotate the log file once it grows beyond this many megabytes; 0 to leave rotation to logrotate")
+	flagSet.Int("logging-max-backups", 0, "number of rotated log files to keep; 0 to keep them all")
+	flagSet.Int("logging-max-age", 0, "remove rotated log files after this many days; 0 to keep them")
+	flagSet.Bool("logging-syslog", false, "send the request log and the proxy's own log to the local syslog daemon instead of stdout and stderr")
+	flagSet.String("logging-syslog-facility", "daemon", "syslog facility of the logs, ie. daemon, auth or local0")
+	flagSet.String("logging-syslog-tag", "oauth2_proxy", "syslog tag of the logs")
 
 	flagSet.String("provider", "google", "OAuth provider")
+	flagSet.Var(&providerDomains, "provider-domain", "pin an email domain to the provider it must sign in with: <domain>=<provider> (may be given multiple times)")
+	flagSet.Var(&extraProviders, "extra-provider", "offer another provider on the sign in page: <id>=<provider>?client-id=...&client-secret=...[&name=...&login-url=...&redeem-url=...&profile-url=...&validate-url=...&scope=...] (may be given multiple times)")
 	flagSet.String("login-url", "", "Authentication endpoint")
 	flagSet.String("redeem-url", "", "Token redemption endpoint")
 	flagSet.String("profile-url", "", "Profile access endpoint")
 	flagSet.String("resource", "", "The resource that is protected (Azure AD only)")
 	flagSet.String("validate-url", "", "Access token validation endpoint")
 	flagSet.String("scope", "", "OAuth scope specification")
+	flagSet.Var(&scopeRoutes, "scope-route", "request paths (regex) that need scopes beyond -scope, requested when a user first reaches them: <path regex>=<scope>[ <scope>...] (may be given multiple times)")
+	flagSet.Var(&sessionAgeRoutes, "max-session-age-route", "request paths (regex) that need a session issued or refreshed within a duration, refreshed or signed in again otherwise: <path regex>=<duration> (may be given multiple times)")
 	flagSet.String("approval-prompt", "force", "OAuth approval_prompt")
 
+	flagSet.String("failover-provider", "", "OAuth provider new sign ins use while the primary provider is unreachable")
+	flagSet.String("failover-client-id", "", "the OAuth Client ID of the failover provider")
+	flagSet.String("failover-client-secret", "", "the OAuth Client Secret of the failover provider")
+	flagSet.String("failover-login-url", "", "Authentication endpoint of the failover provider")
+	flagSet.String("failover-redeem-url", "", "Token redemption endpoint of the failover provider")
+	flagSet.String("failover-profile-url", "", "Profile access endpoint of the failover provider")
+	flagSet.String("failover-validate-url", "", "Access token validation endpoint of the failover provider")
+	flagSet.String("failover-scope", "", "OAuth scope specification of the failover provider")
+	flagSet.Int("failover-threshold", 3, "consecutive failures to reach the primary provider's authorize or token endpoint before failing over")
+	flagSet.Duration("failover-cooldown", time.Duration(1)*time.Minute, "how long to use the failover provider before trying the primary provider again")
+
+	flagSet.Float64("degrade-error-rate", 0, "trust existing sessions while more than this fraction of calls to the provider fail, ie. 0.5; 0 to disable")
+	flagSet.Duration("degrade-window", time.Duration(1)*time.Minute, "the window the provider error rate is measured over")
+	flagSet.Duration("degrade-session-grace", time.Duration(1)*time.Hour, "how long after its token expired a session is still trusted in degraded mode")
+
+	flagSet.String("opa-url", "", "Open Policy Agent data API url of the decision authorizing authenticated requests, eg. http://127.0.0.1:8181/v1/data/oauth2_proxy/allow")
+	flagSet.Duration("opa-timeout", time.Duration(1)*time.Second, "timeout for Open Policy Agent queries; requests are denied when it is exceeded")
+
+	flagSet.String("audit-webhook-url", "", "POST sign ins, denied sign ins and sign outs as batches of JSON events to this url")
+	flagSet.String("audit-kafka-url", "", "produce sign ins, denied sign ins and sign outs to this Kafka REST Proxy topic url, ie. http://kafka-rest:8082/topics/audit")
+	flagSet.String("audit-bucket-url", "", "upload sign ins, denied sign ins and sign outs as batches of JSON lines to this s3://bucket/prefix or gs://bucket/prefix")
+	flagSet.String("audit-bucket-region", "", "the region of the audit-bucket-url S3 bucket")
+	flagSet.String("audit-spool-dir", "", "directory keeping the audit events that couldn't be sent to the audit webhook, Kafka topic or bucket until they are")
+	flagSet.Int("audit-batch-size", 100, "send audit events once this many are pending")
+	flagSet.Duration("audit-flush-interval", time.Duration(5)*time.Second, "send pending audit events at this interval")
+	flagSet.String("audit-log-file", "", "write every session event as a line of JSON to this file, or to stdout with \"-\"")
+
 	flagSet.String("jwt-keys-url", "", "URL for retrieving the valid JWT keys hash")
+	flagSet.Var(&signProviderRequests, "sign-provider-request", "sign requests to a provider endpoint: <redeem|profile|validate|jwt-keys|url prefix>=<signer>, ie. validate=aws-sigv4:<region>:<service> (may be given multiple times)")
+	flagSet.String("provider-redirects", "none", "redirects followed for requests to the provider: none, same-host or any")
+	flagSet.Var(&providerContentTypes, "provider-content-type", "content type allowed in successful responses from the provider, instead of JSON, JWT, form encoded and plain text (may be given multiple times)")
+	flagSet.Duration("provider-timeout", time.Duration(30)*time.Second, "timeout for requests to the provider; sign ins timing out are retried")
 
 	flagSet.String("signature-key", "", "GAP-Signature request signature key (algorithm:secretkey)")
 
@@ -130,25 +276,174 @@ func main() {
 		return
 	}
 
-	opts := NewOptions()
+	opts, err := loadOptions(flagSet, *config)
+	if err != nil {
+		log.Printf("%s", err)
+		os.Exit(1)
+	}
+	if opts.LoggingFilename != "" {
+		logFile, err := openAccessLog(opts.LoggingFilename, int64(opts.LoggingMaxSize)<<20, opts.LoggingMaxBackups,
+			time.Duration(opts.LoggingMaxAge)*24*time.Hour)
+		if err != nil {
+			log.Fatalf("FATAL: opening log file - %s", err)
+		}
+		go reopenAccessLogOn(reopenSignals(), logFile)
+		log.SetOutput(logFile)
+	}
+	var syslogOut io.Writer
+	if opts.LoggingSyslog {
+		syslogOut, err = openSyslog(opts.LoggingSyslogFacility, opts.LoggingSyslogTag)
+		if err != nil {
+			log.Fatalf("FATAL: connecting to syslog - %s", err)
+		}
+		// syslog timestamps the lines itself
+		log.SetFlags(log.Lshortfile)
+		log.SetOutput(syslogOut)
+	}
+	closer, err := initTracer(opts)
+	if err != nil {
+		log.Printf("Could not initialize jaeger tracer: %s", err.Error())
+		return
+	}
+	defer closer.Close()
+	realClientIPHeader = http.CanonicalHeaderKey(opts.RealClientIPHeader)
+	http.DefaultClient = newProviderClient(opts)
+	done := make(chan bool)
+	oauthproxy, err := newOAuthProxy(opts, done)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err)
+	}
+
+	if *exportState {
+		bundle, err := exportAuthState(opts)
+		if err != nil {
+			log.Fatalf("ERROR: failed to export auth state - %s", err)
+		}
+		fmt.Println(string(bundle))
+		return
+	}
+
+	if *migrateCookie != "" {
+		value, err := oauthproxy.MigrateCookieValue(*migrateCookie)
+		if err != nil {
+			log.Fatalf("ERROR: failed to migrate cookie - %s", err)
+		}
+		fmt.Println(value)
+		return
+	}
+
+	var rotation *credentialRotation
+	if opts.AdminToken != "" {
+		rotation = newCredentialRotation(opts.AdminToken, oauthproxy)
+	}
+	if opts.AdminAddress != "" {
+		go serveAdmin(opts.AdminAddress, rotation)
+	}
+
+	var accessLogOut io.Writer = os.Stdout
+	if opts.AccessLogFile != "" {
+		accessLog, err := openAccessLog(opts.AccessLogFile, int64(opts.AccessLogMaxSize)<<20, opts.AccessLogMaxBackups, 0)
+		if err != nil {
+			log.Fatalf("FATAL: opening access log - %s", err)
+		}
+		go reopenAccessLogOn(reopenSignals(), accessLog)
+		accessLogOut = accessLog
+	} else if syslogOut != nil {
+		accessLogOut = syslogOut
+	}
+
+	if opts.AuditLogFile == "-" {
+		auditLogOut = os.Stdout
+	} else if opts.AuditLogFile != "" {
+		auditLog, err := openAccessLog(opts.AuditLogFile, 0, 0, 0)
+		if err != nil {
+			log.Fatalf("FATAL: opening audit log - %s", err)
+		}
+		go reopenAccessLogOn(reopenSignals(), auditLog)
+		auditLogOut = auditLog
+	}
+
+	handler := &reloadableHandler{}
+	handler.Store(newHandler(opts, oauthproxy, accessLogOut))
+	var health *reloadableHandler
+	if opts.MetricsAddress != "" {
+		health = &reloadableHandler{}
+		health.Store(oauthproxy.HealthHandler())
+		go serveMetrics(opts.MetricsAddress, health)
+	}
+	go reloadOn(reloadSignals(), func() error {
+		next, err := loadOptions(flagSet, *config)
+		if err != nil {
+			return err
+		}
+		if err := checkReloadable(opts, next); err != nil {
+			return err
+		}
+		nextDone := make(chan bool)
+		nextProxy, err := newOAuthProxy(next, nextDone)
+		if err != nil {
+			close(nextDone)
+			nextProxy.Close()
+			return err
+		}
+		// states accepted without the CSRF cookie stay used
+		nextProxy.csrfNonces = oauthproxy.csrfNonces
+		handler.Store(newHandler(next, nextProxy, accessLogOut))
+		if health != nil {
+			health.Store(nextProxy.HealthHandler())
+		}
+		if rotation != nil {
+			rotation.Store(nextProxy)
+		}
+		// requests in flight finish on the replaced proxy
+		previousDone, previous := done, oauthproxy
+		time.AfterFunc(opts.ShutdownTimeout, func() {
+			close(previousDone)
+			previous.Close()
+		})
+		done, oauthproxy = nextDone, nextProxy
+		return nil
+	})
+
+	s := &Server{
+		Handler: handler,
+		Opts:    opts,
+	}
+	s.ListenAndServe()
+}
 
+// loadOptions reads the options from the command line, the environment and
+// config, and validates them
+func loadOptions(flagSet *flag.FlagSet, config string) (*Options, error) {
+	opts := NewOptions()
 	cfg := make(EnvOptions)
-	if *config != "" {
-		_, err := toml.DecodeFile(*config, &cfg)
+	if config != "" {
+		_, err := toml.DecodeFile(config, &cfg)
 		if err != nil {
-			log.Fatalf("ERROR: failed to load config file %s - %s", *config, err)
+			return nil, fmt.Errorf("failed to load config file %s - %s", config, err)
 		}
 	}
 	cfg.LoadEnvForStruct(opts)
 	options.Resolve(opts, flagSet, cfg)
-
-	err = opts.Validate()
-	if err != nil {
-		log.Printf("%s", err)
-		os.Exit(1)
+	if err := opts.Validate(); err != nil {
+		return nil, err
 	}
-	validator := NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile)
+	return opts, nil
+}
+
+// newOAuthProxy builds the proxy for opts, whose authenticated emails, role
+// mapping and blocked emails files are watched until done is closed
+func newOAuthProxy(opts *Options, done <-chan bool) (*OAuthProxy, error) {
+	validator, users := newValidatorImpl(opts.EmailDomains, opts.AuthenticatedEmailsFile, done, func() {})
 	oauthproxy := NewOAuthProxy(opts, validator)
+	oauthproxy.AuthenticatedEmails = users
+
+	if opts.roleMap != nil {
+		opts.roleMap.Watch(done)
+	}
+	if opts.blockList != nil {
+		opts.blockList.Watch(done)
+	}
 
 	if len(opts.EmailDomains) != 0 && opts.AuthenticatedEmailsFile == "" {
 		if len(opts.EmailDomains) > 1 {
@@ -160,19 +455,55 @@ func main() {
 
 	if opts.HtpasswdFile != "" {
 		log.Printf("using htpasswd file %s", opts.HtpasswdFile)
+		var err error
 		oauthproxy.HtpasswdFile, err = NewHtpasswdFromFile(opts.HtpasswdFile)
 		oauthproxy.DisplayHtpasswdForm = opts.DisplayHtpasswdForm
 		if err != nil {
-			log.Fatalf("FATAL: unable to open %s %s", opts.HtpasswdFile, err)
+			return oauthproxy, fmt.Errorf("unable to open %s %s", opts.HtpasswdFile, err)
 		}
+		oauthproxy.HtpasswdFile.Watch(done)
 	}
+	return oauthproxy, nil
+}
 
-	s := &Server{
-		Handler: nethttp.Middleware(
-			opentracing.GlobalTracer(),
-			LoggingHandler(os.Stdout, oauthproxy, opts.RequestLogging),
-		),
-		Opts: opts,
+// newHandler wraps oauthproxy in the request logging opts ask for, written
+// to out, and traces the requests opts sample
+func newHandler(opts *Options, oauthproxy *OAuthProxy, out io.Writer) http.Handler {
+	logging := loggingHandler{
+		writer:   out,
+		handler:  oauthproxy,
+		enabled:  opts.RequestLogging,
+		tagged:   len(opts.upstreamTags) > 0,
+		json:     opts.LoggingFormat == loggingFormatJSON,
+		template: opts.logTemplate,
+		excluded: opts.excludeLogging,
+	}
+	return newTraceHandler(opentracing.GlobalTracer(), newTraceSampler(opts), logging)
+}
+
+// newProviderClient is the client the providers talk to the provider with,
+// as http.DefaultClient. It's only set up once, at start, as reloads can't
+// swap it under the requests in flight.
+func newProviderClient(opts *Options) *http.Client {
+	var transport http.RoundTripper
+	if opts.TLSInsecureSkipVerify {
+		transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+	transport = &api.ContentTypeTransport{
+		Next:    transport,
+		Allowed: opts.providerContentTypes,
+	}
+	if len(opts.signingRules) > 0 {
+		transport = &api.SigningTransport{
+			Next:  transport,
+			Rules: opts.signingRules,
+		}
+	}
+	return &http.Client{
+		CheckRedirect: api.CheckRedirect(opts.ProviderRedirects),
+		Timeout:       opts.ProviderTimeout,
+		Transport:     api.NewRateLimitTransport(transport),
 	}
-	s.ListenAndServe()
 }
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// maxMetricLabels bounds the number of custom metric labels
+	maxMetricLabels = 5
+	// maxMetricLabelValues bounds the allowlist of a header or host label
+	maxMetricLabelValues = 20
+	// maxMetricLabelSeries bounds the combinations of custom label values,
+	// which multiply the number of series of every handler histogram
+	maxMetricLabelSeries = 1000
+
+	// metricLabelOther replaces values that aren't in a label's allowlist
+	metricLabelOther = "other"
+
+	// proxyUpstreamLabel is the label of the handler histograms identifying
+	// the upstream a proxied request matched, for the first
+	// maxMetricLabelValues upstreams. It's empty for the other handlers.
+	proxyUpstreamLabel = "upstream"
+)
+
+var metricLabelNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// metricLabel is an extra label of the request duration histograms and the
+// request attribute its value is read from
+type metricLabel struct {
+	Name   string
+	Source string // "header", "host" or "upstream"
+	Header string
+	Values map[string]bool
+}
+
+// parseMetricLabel parses a "<name>=<source>" specification, where source
+// is one of:
+//
+//	header:<header>:<value>,<value>... the value of a request header
+//	host:<host>,<host>...              the requested host
+//	upstream                           the name, or else the path, of the
+//	                                   matched upstream
+//
+// Header and host values not in the allowlist are recorded as "other".
+func parseMetricLabel(spec string) (*metricLabel, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid metrics-label %q, expected <name>=<source>", spec)
+	}
+	l := &metricLabel{Name: parts[0]}
+	if !metricLabelNameRegex.MatchString(l.Name) || strings.HasPrefix(l.Name, "__") ||
+		l.Name == "code" || l.Name == "handler" || l.Name == proxyUpstreamLabel {
+		return nil, fmt.Errorf("invalid metrics-label name %q", l.Name)
+	}
+
+	var values string
+	source := strings.SplitN(parts[1], ":", 2)
+	l.Source = source[0]
+	switch l.Source {
+	case "header":
+		if len(source) == 2 {
+			header := strings.SplitN(source[1], ":", 2)
+			l.Header = http.CanonicalHeaderKey(header[0])
+			if len(header) == 2 {
+				values = header[1]
+			}
+		}
+		if l.Header == "" {
+			return nil, fmt.Errorf("invalid metrics-label %q, missing header name", spec)
+		}
+	case "host":
+		if len(source) == 2 {
+			values = strings.ToLower(source[1])
+		}
+	case "upstream":
+		if len(source) == 2 {
+			return nil, fmt.Errorf("invalid metrics-label %q, upstream takes no values", spec)
+		}
+		return l, nil
+	default:
+		return nil, fmt.Errorf("invalid metrics-label %q, unknown source %q", spec, l.Source)
+	}
+
+	l.Values = make(map[string]bool)
+	for _, v := range strings.Split(values, ",") {
+		if v != "" {
+			l.Values[v] = true
+		}
+	}
+	if len(l.Values) == 0 {
+		return nil, fmt.Errorf("invalid metrics-label %q, an allowlist of values is required", spec)
+	}
+	if len(l.Values) > maxMetricLabelValues {
+		return nil, fmt.Errorf("invalid metrics-label %q, more than %d values", spec, maxMetricLabelValues)
+	}
+	return l, nil
+}
+
+// cardinality is the number of values l can take, including "" for
+// requests without one and "other"
+func (l *metricLabel) cardinality(upstreams int) int {
+	if l.Source == "upstream" {
+		return upstreams + 1
+	}
+	return len(l.Values) + 2
+}
+
+func (l *metricLabel) value(req *http.Request, mux http.Handler) string {
+	var v string
+	switch l.Source {
+	case "header":
+		v = req.Header.Get(l.Header)
+	case "host":
+		v = strings.ToLower(req.Host)
+	case "upstream":
+		if mux, ok := mux.(*http.ServeMux); ok {
+			var h http.Handler
+			h, v = mux.Handler(req)
+			if u, ok := h.(*UpstreamProxy); ok && u.name != "" {
+				v = u.name
+			}
+		}
+		return v
+	}
+	if v != "" && !l.Values[v] {
+		return metricLabelOther
+	}
+	return v
+}
+
+// upstreamLabelValue identifies the upstream u, registered for pattern: by
+// its name, the host and path of a single HTTP upstream, or else its path
+func upstreamLabelValue(u *UpstreamProxy, pattern string) string {
+	switch {
+	case u.name != "":
+		return u.name
+	case u.pool == nil && (u.upstream.Scheme == "http" || u.upstream.Scheme == "https" || u.upstream.Scheme == "h2c"):
+		return u.upstream.Host + pattern
+	}
+	return pattern
+}
+
+// newUpstreamLabels allows the upstream label values of the upstreams of
+// paths, in order, up to maxMetricLabelValues of them
+func newUpstreamLabels(mux *http.ServeMux, paths []string) map[string]bool {
+	labels := make(map[string]bool)
+	for _, path := range paths {
+		h, pattern := mux.Handler(&http.Request{Method: "GET", URL: &url.URL{Path: path}})
+		u, ok := h.(*UpstreamProxy)
+		if !ok || len(labels) == maxMetricLabelValues {
+			continue
+		}
+		labels[upstreamLabelValue(u, pattern)] = true
+	}
+	return labels
+}
+
+// upstreamLabel is the value of the proxy histogram's upstream label for
+// req: "" when no upstream serves it, and "other" for upstreams past the
+// first maxMetricLabelValues
+func (p *OAuthProxy) upstreamLabel(req *http.Request) string {
+	mux, ok := p.serveMux.(*http.ServeMux)
+	if !ok {
+		return ""
+	}
+	h, pattern := mux.Handler(req)
+	u, ok := h.(*UpstreamProxy)
+	if !ok {
+		return ""
+	}
+	if v := upstreamLabelValue(u, pattern); p.upstreamLabels[v] {
+		return v
+	}
+	return metricLabelOther
+}
+
+func parseMetricLabels(o *Options, msgs []string) []string {
+	if len(o.MetricsLabels) > maxMetricLabels {
+		return append(msgs, fmt.Sprintf("at most %d metrics-label may be set", maxMetricLabels))
+	}
+	names := make(map[string]bool)
+	series := 1
+	for _, spec := range o.MetricsLabels {
+		l, err := parseMetricLabel(spec)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		if names[l.Name] {
+			msgs = append(msgs, fmt.Sprintf("duplicate metrics-label name %q", l.Name))
+			continue
+		}
+		names[l.Name] = true
+		series *= l.cardinality(len(o.Upstreams))
+		o.metricLabels = append(o.metricLabels, l)
+	}
+	if series > maxMetricLabelSeries {
+		msgs = append(msgs, fmt.Sprintf(
+			"metrics-label allows %d combinations of values, more than %d",
+			series, maxMetricLabelSeries))
+	}
+	return msgs
+}
+
+var (
+	// handlerRegistry holds the handler histograms, which are replaced
+	// when their labels change. The default registry can't be used as it
+	// doesn't allow a metric's label names to change once registered.
+	handlerRegistry *prometheus.Registry
+	// handlerMetricLabels are the extra label names of the handler
+	// histograms
+	handlerMetricLabels []string
+	// metricsHandler serves the default and handler metrics
+	metricsHandler http.Handler
+)
+
+// setHandlerMetricLabels re-creates the handler histograms in a new registry
+// when their extra label names change
+func setHandlerMetricLabels(labels []*metricLabel) {
+	var names []string
+	for _, l := range labels {
+		names = append(names, l.Name)
+	}
+	if handlerRegistry != nil && reflect.DeepEqual(names, handlerMetricLabels) {
+		return
+	}
+	newHandlerVecs(names)
+	handlerRegistry = prometheus.NewRegistry()
+	handlerRegistry.MustRegister(handlerVecs()...)
+	handlerMetricLabels = names
+	metricsHandler = promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, handlerRegistry},
+			promhttp.HandlerOpts{}))
+}
+
+// metricLabelValues are the values of the custom metric labels for req
+func (p *OAuthProxy) metricLabelValues(req *http.Request) prometheus.Labels {
+	labels := make(prometheus.Labels, len(p.metricLabels))
+	for _, l := range p.metricLabels {
+		labels[l.Name] = l.value(req, p.serveMux)
+	}
+	return labels
+}
+
+// serveMetrics serves the health and metrics endpoints of the current
+// configuration, from handler, on addr, which should only be reachable by
+// health checks and monitoring
+func serveMetrics(addr string, handler http.Handler) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("FATAL: listen (tcp, %s) failed - %s", addr, err)
+	}
+	log.Printf("metrics: listening on %s", listener.Addr())
+	if err := http.Serve(listener, handler); err != nil {
+		log.Printf("ERROR: metrics http.Serve() - %s", err)
+	}
+}
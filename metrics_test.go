@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseMetricLabel(t *testing.T) {
+	l, err := parseMetricLabel("tenant=header:x-tenant:payments,search")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "tenant", l.Name)
+	assert.Equal(t, "X-Tenant", l.Header)
+	assert.Equal(t, map[string]bool{"payments": true, "search": true}, l.Values)
+
+	l, err = parseMetricLabel("app=upstream")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "upstream", l.Source)
+
+	for _, spec := range []string{
+		"tenant",
+		"code=upstream",
+		"upstream=host:example.com",
+		"bad-name=upstream",
+		"tenant=header:X-Tenant",
+		"tenant=header::payments",
+		"tenant=host",
+		"tenant=cookie:foo",
+		"app=upstream:/api/",
+	} {
+		_, err := parseMetricLabel(spec)
+		assert.NotEqual(t, nil, err)
+	}
+}
+
+func TestMetricLabelsCardinality(t *testing.T) {
+	o := testOptions()
+	o.MetricsLabels = []string{"a=upstream", "a=upstream"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.Contains(err.Error(), "duplicate metrics-label"))
+
+	var values []string
+	for i := 0; i < maxMetricLabelValues; i++ {
+		values = append(values, string(rune('a'+i)))
+	}
+	allowlist := strings.Join(values, ",")
+	o = testOptions()
+	o.MetricsLabels = []string{
+		"a=header:X-A:" + allowlist,
+		"b=header:X-B:" + allowlist,
+		"c=header:X-C:" + allowlist,
+	}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.Contains(err.Error(), "combinations of values"))
+}
+
+func TestMetricLabelValues(t *testing.T) {
+	opts := NewOptions()
+	opts.Upstreams = []string{"http://127.0.0.1:8080/api/", "http://127.0.0.1:8081/billing/?name=billing-api"}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.MetricsLabels = []string{
+		"tenant=header:X-Tenant:payments",
+		"site=host:example.com",
+		"app=upstream",
+	}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	defer setHandlerMetricLabels(nil)
+
+	req, _ := http.NewRequest("GET", "http://EXAMPLE.com/api/users", nil)
+	req.Header.Set("X-Tenant", "payments")
+	assert.Equal(t, prometheus.Labels{"tenant": "payments", "site": "example.com", "app": "/api/"},
+		proxy.metricLabelValues(req))
+
+	req, _ = http.NewRequest("GET", "http://example.com/billing/invoices", nil)
+	assert.Equal(t, "billing-api", proxy.metricLabelValues(req)["app"])
+
+	req, _ = http.NewRequest("GET", "http://other.example.com/", nil)
+	req.Header.Set("X-Tenant", "attacker-chosen")
+	assert.Equal(t, prometheus.Labels{"tenant": "other", "site": "other", "app": ""},
+		proxy.metricLabelValues(req))
+
+	req, _ = http.NewRequest("GET", "http://example.com/ping", nil)
+	req.Header.Set("X-Tenant", "payments")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+
+	families, err := handlerRegistry.Gather()
+	assert.Equal(t, nil, err)
+	found := false
+	for _, f := range families {
+		if f.GetName() != "http_request_duration_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["handler"] == "ping" && labels["tenant"] == "payments" && labels["code"] == "200" {
+				found = true
+			}
+		}
+	}
+	assert.Equal(t, true, found)
+}
+
+func TestProxyUpstreamLabel(t *testing.T) {
+	opts := testOptions()
+	opts.Upstreams = []string{
+		"http://10.0.0.1:8080/",
+		"http://10.0.0.2:8080/api/?name=api",
+		"http://10.0.0.3:8080/bulk/",
+		"http://10.0.0.4:8080/bulk/",
+		"file:///var/www/static/#/static/",
+	}
+	for i := 0; i < maxMetricLabelValues; i++ {
+		opts.Upstreams = append(opts.Upstreams, fmt.Sprintf("http://10.0.1.%d:8080/app%d/", i, i))
+	}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	label := func(path string) string {
+		return proxy.upstreamLabel(httptest.NewRequest("GET", path, nil))
+	}
+	assert.Equal(t, "10.0.0.1:8080/", label("/reports"))
+	assert.Equal(t, "api", label("/api/users"))
+	assert.Equal(t, "/bulk/", label("/bulk/export"))
+	assert.Equal(t, "/static/", label("/static/app.js"))
+	assert.Equal(t, "10.0.1.15:8080/app15/", label("/app15/"))
+	// upstreams past the first 20 are recorded together
+	assert.Equal(t, "other", label("/app16/"))
+	assert.Equal(t, "other", label("/app19/"))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// extraProvider is a provider offered on the sign in page alongside the
+// primary one. Its sessions are tagged with its id, as is the CSRF nonce of
+// the sign ins started with it so the callback redeems the code with it too.
+type extraProvider struct {
+	id       string
+	name     string
+	provider providers.Provider
+}
+
+// signInProvider is a button on the sign in page. An empty ID starts the
+// sign in with the primary provider.
+type signInProvider struct {
+	ID   string
+	Name string
+}
+
+// extraProvider is the extra provider with the given id, or nil
+func (p *OAuthProxy) extraProvider(id string) *extraProvider {
+	for _, e := range p.extraProviders {
+		if e.id == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// chosenProvider is the provider a sign in started from the sign in page
+// uses, given the id of the button that was pressed
+func (p *OAuthProxy) chosenProvider(id string) (providers.Provider, string, bool) {
+	if id == "" || id == p.providerID {
+		provider, tag := p.loginProvider()
+		return provider, tag, true
+	}
+	if e := p.extraProvider(id); e != nil {
+		return e.provider, e.id, true
+	}
+	return nil, "", false
+}
+
+// extraCallbackProvider is the extra provider a sign in was started with,
+// given its state parameter, or nil when it was started with the primary one
+func (p *OAuthProxy) extraCallbackProvider(state string) *extraProvider {
+	nonce := strings.SplitN(state, ":", 2)[0]
+	i := strings.Index(nonce, ".")
+	if i < 0 {
+		return nil
+	}
+	return p.extraProvider(nonce[:i])
+}
+
+// pinnedID is the id provider pinning compares against for sessions tagged
+// tag: the extra provider's id, or the primary provider's name
+func (p *OAuthProxy) pinnedID(tag string) string {
+	if p.extraProvider(tag) != nil {
+		return tag
+	}
+	return p.providerID
+}
+
+// signInProviders are the buttons of the sign in page
+func (p *OAuthProxy) signInProviders() []signInProvider {
+	provider, _ := p.loginProvider()
+	buttons := []signInProvider{{Name: provider.Data().ProviderName}}
+	for _, e := range p.extraProviders {
+		buttons = append(buttons, signInProvider{ID: e.id, Name: e.name})
+	}
+	return buttons
+}
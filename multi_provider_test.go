@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestExtraProviderOptions(t *testing.T) {
+	o := testOptions()
+	o.ExtraProviders = []string{
+		"contractors=github?client-id=gh-id&client-secret=gh-secret&name=Contractors",
+		"google=github?client-id=gh-id&client-secret=gh-secret",
+		"test-mode=github?client-id=gh-id&client-secret=gh-secret",
+		"Bad=github?client-id=gh-id&client-secret=gh-secret",
+		"partners=github?client-id=gh-id&secret=gh-secret",
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	for _, msg := range []string{
+		`extra-provider id "google" is already in use`,
+		`extra-provider id "test-mode" is already in use`,
+		`invalid extra-provider id "Bad"`,
+		`unknown extra-provider "partners" parameter "secret"`,
+		`missing extra-provider "partners" parameter: client-secret`,
+	} {
+		assert.Equal(t, true, strings.Contains(err.Error(), msg))
+	}
+
+	o = testOptions()
+	o.ExtraProviders = []string{"contractors=github?client-id=gh-id&client-secret=gh-secret"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 1, len(o.extraProviders))
+	e := o.extraProviders[0]
+	assert.Equal(t, "contractors", e.id)
+	assert.Equal(t, "GitHub", e.name)
+	assert.Equal(t, "gh-id", e.provider.Data().ClientID)
+}
+
+func TestExtraProviderSignIn(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"contractor_token"}`))
+	}))
+	defer idp.Close()
+	idpURL, _ := url.Parse(idp.URL)
+
+	opts := NewOptions()
+	opts.Upstreams = []string{"http://127.0.0.1:8080/"}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecure = false
+	opts.EmailDomains = []string{"*"}
+	opts.PassAccessToken = true
+	opts.ProviderDomains = []string{"example.com=contractors"}
+	assert.Equal(t, nil, opts.Validate())
+	primary := NewTestProvider(&url.URL{Host: "primary.example.com"}, "user@example.com")
+	contractors := NewTestProvider(idpURL, "user@example.com")
+	contractors.ValidToken = true
+	opts.provider = primary
+	opts.extraProviders = []*extraProvider{{id: "contractors", name: "Contractors", provider: contractors}}
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	// the sign in page has a button per provider
+	req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	body := rw.Body.String()
+	assert.Equal(t, true, strings.Contains(body, "Sign in with a Test Provider Account"))
+	assert.Equal(t, true, strings.Contains(body, `name="provider" value="contractors"`))
+	assert.Equal(t, true, strings.Contains(body, "Sign in with a Contractors Account"))
+
+	req, _ = http.NewRequest("GET", "/oauth2/start?provider=unknown", nil)
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 400, rw.Code)
+
+	req, _ = http.NewRequest("GET", "/oauth2/start?provider=contractors&rd=/app", nil)
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	loginURL, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	assert.Equal(t, idpURL.Host, loginURL.Host)
+	state := loginURL.Query().Get("state")
+	assert.Equal(t, true, strings.HasPrefix(state, "contractors."))
+
+	// the callback redeems the code with the provider the sign in was
+	// started with, which example.com is pinned to
+	nonce := strings.SplitN(state, ":", 2)[0]
+	req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(state), nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, nonce, proxy.CookieExpire, time.Now()))
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/app", rw.HeaderMap.Get("Location"))
+	req, _ = http.NewRequest("GET", "/", nil)
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == proxy.CookieName {
+			req.AddCookie(c)
+		}
+	}
+	session, _, err := proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "contractor_token", session.AccessToken)
+	assert.Equal(t, "contractors", session.Provider)
+	assert.Equal(t, providers.Provider(contractors), proxy.sessionProvider(session))
+}
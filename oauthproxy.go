@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	b64 "encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -12,6 +14,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,21 +26,37 @@ import (
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
 )
 
 var (
 	proxyVec     *prometheus.HistogramVec
 	robotsVec    *prometheus.HistogramVec
 	pingVec      *prometheus.HistogramVec
+	readyVec     *prometheus.HistogramVec
 	whitelistVec *prometheus.HistogramVec
 	signInVec    *prometheus.HistogramVec
 	signOutVec   *prometheus.HistogramVec
 	startVec     *prometheus.HistogramVec
 	callbackVec  *prometheus.HistogramVec
 	authOnlyVec  *prometheus.HistogramVec
+	guestVec     *prometheus.HistogramVec
+	silentVec    *prometheus.HistogramVec
+	configVec    *prometheus.HistogramVec
+
+	duplicateCookiesCounter prometheus.Counter
+	upstreamTagCounter      *prometheus.CounterVec
+	authLimitedCounter      *prometheus.CounterVec
+	proxyLimitedCounter     *prometheus.CounterVec
+	signInFailureCounter    *prometheus.CounterVec
+	decisionCacheCounter    *prometheus.CounterVec
 )
 
-func init() {
+// newHandlerVecs creates the per handler request duration histograms with
+// the "code" label followed by extraLabels, and the "upstream" label, only
+// set by the proxy handler
+func newHandlerVecs(extraLabels []string) {
+	labelNames := append(append([]string{"code"}, extraLabels...), proxyUpstreamLabel)
 	histogramOpts := prometheus.HistogramOpts{
 		Name:        "http_request_duration_seconds",
 		Help:        "A histogram of latencies for requests.",
@@ -46,67 +65,141 @@ func init() {
 	}
 	proxyVec = prometheus.NewHistogramVec(
 		histogramOpts,
-		[]string{"code"},
+		labelNames,
 	)
 
 	histogramOpts.ConstLabels = prometheus.Labels{"handler": "robots"}
 	robotsVec = prometheus.NewHistogramVec(
 		histogramOpts,
-		[]string{"code"},
+		labelNames,
 	)
 
 	histogramOpts.ConstLabels = prometheus.Labels{"handler": "ping"}
 	pingVec = prometheus.NewHistogramVec(
 		histogramOpts,
-		[]string{"code"},
+		labelNames,
+	)
+
+	histogramOpts.ConstLabels = prometheus.Labels{"handler": "ready"}
+	readyVec = prometheus.NewHistogramVec(
+		histogramOpts,
+		labelNames,
 	)
 
 	histogramOpts.ConstLabels = prometheus.Labels{"handler": "whitelist"}
 	whitelistVec = prometheus.NewHistogramVec(
 		histogramOpts,
-		[]string{"code"},
+		labelNames,
 	)
 
 	histogramOpts.ConstLabels = prometheus.Labels{"handler": "signIn"}
 	signInVec = prometheus.NewHistogramVec(
 		histogramOpts,
-		[]string{"code"},
+		labelNames,
 	)
 
 	histogramOpts.ConstLabels = prometheus.Labels{"handler": "signOut"}
 	signOutVec = prometheus.NewHistogramVec(
 		histogramOpts,
-		[]string{"code"},
+		labelNames,
 	)
 
 	histogramOpts.ConstLabels = prometheus.Labels{"handler": "start"}
 	startVec = prometheus.NewHistogramVec(
 		histogramOpts,
-		[]string{"code"},
+		labelNames,
 	)
 
 	histogramOpts.ConstLabels = prometheus.Labels{"handler": "callback"}
 	callbackVec = prometheus.NewHistogramVec(
 		histogramOpts,
-		[]string{"code"},
+		labelNames,
 	)
 
 	histogramOpts.ConstLabels = prometheus.Labels{"handler": "authOnly"}
 	authOnlyVec = prometheus.NewHistogramVec(
 		histogramOpts,
-		[]string{"code"},
+		labelNames,
 	)
 
-	prometheus.MustRegister(
+	histogramOpts.ConstLabels = prometheus.Labels{"handler": "guest"}
+	guestVec = prometheus.NewHistogramVec(
+		histogramOpts,
+		labelNames,
+	)
+
+	histogramOpts.ConstLabels = prometheus.Labels{"handler": "silent"}
+	silentVec = prometheus.NewHistogramVec(
+		histogramOpts,
+		labelNames,
+	)
+
+	histogramOpts.ConstLabels = prometheus.Labels{"handler": "configuration"}
+	configVec = prometheus.NewHistogramVec(
+		histogramOpts,
+		labelNames,
+	)
+}
+
+// handlerVecs are the per handler request duration histograms
+func handlerVecs() []prometheus.Collector {
+	return []prometheus.Collector{
 		proxyVec,
 		robotsVec,
 		pingVec,
+		readyVec,
 		whitelistVec,
 		signInVec,
 		signOutVec,
 		startVec,
 		callbackVec,
 		authOnlyVec,
+		guestVec,
+		silentVec,
+		configVec,
+	}
+}
+
+func init() {
+	setHandlerMetricLabels(nil)
+
+	duplicateCookiesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "duplicate_session_cookies_total",
+		Help: "Requests that carried more than one session cookie.",
+	})
+
+	authLimitedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_requests_limited_total",
+		Help: "Sign in requests rejected by the per-IP rate limit or the concurrency limit.",
+	}, []string{"handler", "limit"})
+
+	proxyLimitedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_requests_limited_total",
+		Help: "Proxied requests rejected by the per-user rate limit, by the path prefix of the limit.",
+	}, []string{"route"})
+
+	signInFailureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "htpasswd_sign_in_failures_total",
+		Help: "Failed htpasswd sign ins, by wrong password or throttled attempt.",
+	}, []string{"reason"})
+
+	decisionCacheCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "access_decision_cache_total",
+		Help: "Access decision cache lookups by result.",
+	}, []string{"result"})
+
+	upstreamTagCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_tag_requests_total",
+		Help: "Requests proxied to tagged upstreams, by team or cost center tag.",
+	}, []string{"tag"})
+
+	prometheus.MustRegister(
+		duplicateCookiesCounter,
+		authLimitedCounter,
+		proxyLimitedCounter,
+		signInFailureCounter,
+		decisionCacheCounter,
+		upstreamTagCounter,
 	)
 }
 
@@ -136,45 +229,153 @@ type OAuthProxy struct {
 	CookieRefresh  time.Duration
 	Validator      func(string) bool
 
+	previousCookieNames []string
+	cookieNameAliases   []string
+
 	RobotsPath        string
 	MetricsPath       string
 	PingPath          string
+	ReadyPath         string
 	SignInPath        string
 	SignOutPath       string
 	OAuthStartPath    string
 	OAuthCallbackPath string
 	AuthOnlyPath      string
+	GuestPath         string
+	SilentPath        string
+	ConfigurationPath string
+	TestClockPath     string
+
+	// metricsAddress serves the health and metrics endpoints on their own
+	// listener, instead of this one, when set
+	metricsAddress string
+
+	SilentReauth       bool
+	SilentReauthWindow time.Duration
+
+	GuestCodeExpire    time.Duration
+	GuestSessionExpire time.Duration
+	guestAdmins        []string
+	guestRoutes        []*regexp.Regexp
+	guestUpstreams     map[string]bool
+
+	authRateLimiter *rateLimiter
+	authConcurrency concurrencyLimiter
+	signInThrottle  *signInThrottle
+	proxyRateLimits proxyRateLimits
+
+	decisions      *decisionCache
+	authOnlyCache  *authOnlyCache
+	errorBudget    *errorBudget
+	failover       *providerFailover
+	extraProviders []*extraProvider
+	opa            *opaAuthorizer
+	roleMap        *RoleMap
+	blockList      *BlockList
+	experiments    *experimentBucketer
+	auditLog       *auditLog
+	botFilter      *botFilter
+	testMode       *testMode
+	hooks          Hooks
+
+	// done stops the upstream health checks and lookups once closed
+	done chan bool
+
+	// signature describes the signature of upstream requests in the proxy
+	// configuration
+	signature *signatureConfiguration
+
+	cacheControl      string
+	cacheRoutes       []*regexp.Regexp
+	cacheContentTypes []string
+
+	scopeRoutes      []scopeRoute
+	sessionAgeRoutes []sessionAgeRoute
+
+	// DegradedSessionGrace is how long after its token expired a session is
+	// still trusted in degraded mode
+	DegradedSessionGrace time.Duration
+
+	metricLabels []*metricLabel
+
+	readiness *readiness
+	// HealthVerbose answers the health endpoints with JSON reports
+	HealthVerbose bool
+
+	// SessionExpiryHeaders tells applications when the session of a request
+	// ends, so they can warn users before it does
+	SessionExpiryHeaders bool
+	// CSRFStateFallback accepts callbacks without the CSRF cookie when
+	// their state is signed
+	CSRFStateFallback bool
+	csrfNonces        *csrfNonces
 
 	redirectURL         *url.URL // the url to receive requests at
 	provider            providers.Provider
+	providerID          string
+	providerDomains     map[string]string
 	ProxyPrefix         string
 	SignInMessage       string
 	HtpasswdFile        *HtpasswdFile
+	AuthenticatedEmails *UserMap
 	DisplayHtpasswdForm bool
 	serveMux            http.Handler
+	upstreamLabels      map[string]bool
 	SetXAuthRequest     bool
 	PassBasicAuth       bool
 	SkipProviderButton  bool
+	Headless            bool
 	PassUserHeaders     bool
+	PassOriginal        bool
 	BasicAuthPassword   string
 	PassAccessToken     bool
 	CookieCipher        *cookie.Cipher
+	previousCookie      *cookieFormat
 	skipAuthRegex       []string
 	skipAuthPreflight   bool
 	compiledRegex       []*regexp.Regexp
+	trustedNets         []*net.IPNet
+	trustedDownstreams  []*net.IPNet
 	templates           *template.Template
 	Footer              string
 }
 
 type UpstreamProxy struct {
 	upstream url.URL
-	handler  http.Handler
-	auth     hmacauth.HmacAuth
-	wsd      *websocket.Dialer
+	// name, when set, identifies the upstream in logs, metrics and guest
+	// routes instead of its host
+	name    string
+	handler http.Handler
+	auth    hmacauth.HmacAuth
+	wsd     *websocket.Dialer
+	// tag, when set, attributes the requests to the upstream to a team or
+	// cost center in logs and metrics
+	tag string
+	// pool, when set, balances requests across several upstreams
+	pool *upstreamPool
+	// hostHeader, when set, is the Host of websocket handshakes instead of
+	// the client's
+	hostHeader string
+}
+
+// Address is the upstream's name, or its host when it isn't named
+func (u *UpstreamProxy) Address() string {
+	if u.name != "" {
+		return u.name
+	}
+	return u.upstream.Host
 }
 
 func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("GAP-Upstream-Address", u.upstream.Host)
+	if u.pool != nil {
+		u.pool.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("GAP-Upstream-Address", u.Address())
+	if u.tag != "" {
+		w.Header().Set("GAP-Upstream-Tag", u.tag)
+		upstreamTagCounter.WithLabelValues(u.tag).Inc()
+	}
 	if u.auth != nil {
 		r.Header.Set("GAP-Auth", w.Header().Get("GAP-Auth"))
 		u.auth.SignRequest(r)
@@ -186,10 +387,21 @@ func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// upstreamFor returns the upstream that serves path, or nil
+func (p *OAuthProxy) upstreamFor(path string) *UpstreamProxy {
+	mux, ok := p.serveMux.(*http.ServeMux)
+	if !ok {
+		return nil
+	}
+	h, _ := mux.Handler(&http.Request{Method: "GET", URL: &url.URL{Path: path}})
+	u, _ := h.(*UpstreamProxy)
+	return u
+}
+
 type traceTransport struct{ next http.RoundTripper }
 
 func (t traceTransport) RoundTrip(r *http.Request) (*http.Response, error) {
-	nt := &nethttp.Transport{t.next}
+	nt := &nethttp.Transport{RoundTripper: t.next}
 	r, ht := nethttp.TraceRequest(opentracing.GlobalTracer(), r)
 	defer ht.Finish()
 	return nt.RoundTrip(r)
@@ -206,6 +418,139 @@ func NewReverseProxy(target *url.URL, tlsconfig *tls.Config) (proxy *httputil.Re
 	return rp
 }
 
+// upstreamOverride holds the per-upstream transport settings given as
+// tls_server_name, dial_address, http_version, alpn and keep_alive query
+// parameters on the upstream URL
+type upstreamOverride struct {
+	TLSServerName string
+	DialAddress   string
+
+	// HTTPVersion pins the protocol to "1.1" or "2" instead of negotiating
+	// it, and ALPN replaces the comma separated protocols offered in the TLS
+	// handshake, or offers none when "none"
+	HTTPVersion       string
+	ALPN              string
+	DisableKeepAlives bool
+}
+
+// upstreamSignature holds the per-upstream request signature settings given
+// as signature_header and signature_headers query parameters on the upstream
+// URL, for upstreams that verify a different HMAC header convention. Unset
+// fields default to SignatureHeader and SignatureHeaders.
+type upstreamSignature struct {
+	Header  string
+	Headers []string
+}
+
+// newUpstreamAuth signs the requests to an upstream with the signature key
+func newUpstreamAuth(sigData *SignatureData, s upstreamSignature) hmacauth.HmacAuth {
+	header, headers := SignatureHeader, SignatureHeaders
+	if s.Header != "" {
+		header = s.Header
+	}
+	if s.Headers != nil {
+		headers = s.Headers
+	}
+	return hmacauth.NewHmacAuth(sigData.hash, []byte(sigData.key), header, headers)
+}
+
+// upstreamConnSettings tune the connection pool and timeouts of the
+// transports to upstreams
+type upstreamConnSettings struct {
+	MaxIdleConnsPerHost   int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+// newUpstreamTransport returns a transport with the connection settings c.
+// It connects to the override's dial address rather than the upstream host,
+// and presents and verifies its TLS server name rather than the upstream
+// host name.
+func newUpstreamTransport(tlsconfig *tls.Config, c upstreamConnSettings, o upstreamOverride) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsconfig != nil {
+		t.TLSClientConfig = tlsconfig.Clone()
+	}
+	t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	if t.MaxIdleConns < c.MaxIdleConnsPerHost {
+		t.MaxIdleConns = c.MaxIdleConnsPerHost
+	}
+	t.IdleConnTimeout = c.IdleConnTimeout
+	t.TLSHandshakeTimeout = c.TLSHandshakeTimeout
+	t.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+	dialer := &net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	t.DialContext = dialer.DialContext
+
+	if o.TLSServerName != "" {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.ServerName = o.TLSServerName
+	}
+	if o.DialAddress != "" {
+		t.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, o.DialAddress)
+		}
+	}
+
+	// connections that aren't kept alive are only used for one request,
+	// which is what HTTP/1.1 is for
+	allowHTTP2 := o.HTTPVersion != "1.1" && !o.DisableKeepAlives
+	if o.ALPN != "" {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.NextProtos = nil
+		allowHTTP2 = false
+		for _, proto := range strings.Split(o.ALPN, ",") {
+			if proto != "none" {
+				t.TLSClientConfig.NextProtos = append(t.TLSClientConfig.NextProtos, proto)
+			}
+			allowHTTP2 = allowHTTP2 || proto == "h2"
+		}
+	}
+	if !allowHTTP2 {
+		// an empty map is how HTTP/2 is turned off
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	t.DisableKeepAlives = o.DisableKeepAlives
+	return t
+}
+
+// newHTTP2Transport speaks only HTTP/2 to https upstreams pinned to it,
+// dialing and verifying them like t, and fails to connect to upstreams that
+// don't negotiate it rather than falling back to HTTP/1.1
+func newHTTP2Transport(t *http.Transport) *http2.Transport {
+	return &http2.Transport{
+		TLSClientConfig: t.TLSClientConfig,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := t.DialContext(context.Background(), network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if t.TLSHandshakeTimeout > 0 {
+				conn.SetDeadline(time.Now().Add(t.TLSHandshakeTimeout))
+			}
+			tlsConn := tls.Client(conn, cfg)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn.SetDeadline(time.Time{})
+			if p := tlsConn.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+				conn.Close()
+				return nil, fmt.Errorf("upstream %s negotiated %q instead of HTTP/2", addr, p)
+			}
+			return tlsConn, nil
+		},
+	}
+}
+
 func setProxyUpstreamHostHeader(proxy *httputil.ReverseProxy, target *url.URL) {
 	director := proxy.Director
 	proxy.Director = func(req *http.Request) {
@@ -229,35 +574,122 @@ func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
 	return http.StripPrefix(path, http.FileServer(http.Dir(filesystemPath)))
 }
 
-func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
-	serveMux := http.NewServeMux()
+// NewStaticResponse answers every request with code and body, for health
+// checks and placeholder routes without a backend
+func NewStaticResponse(code int, body string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		rw.WriteHeader(code)
+		fmt.Fprint(rw, body)
+	})
+}
+
+// newH2CTransport speaks HTTP/2 over cleartext connections, for h2c
+// upstreams such as gRPC services
+func newH2CTransport(c upstreamConnSettings, o upstreamOverride) *http2.Transport {
+	dialer := &net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			if o.DialAddress != "" {
+				addr = o.DialAddress
+			}
+			return dialer.Dial(network, addr)
+		},
+	}
+}
+
+// newHTTPUpstream proxies to the http, https or h2c upstream u, with the
+// settings given to the i-th upstream
+func newHTTPUpstream(opts *Options, i int, u *url.URL) *UpstreamProxy {
+	h2c := u.Scheme == "h2c"
+	if h2c {
+		// h2c upstreams are http ones reached over HTTP/2
+		target := *u
+		target.Scheme = "http"
+		u = &target
+	}
+	proxy := NewReverseProxy(u, opts.tlsclientconfig)
+	if !opts.PassHostHeader {
+		setProxyUpstreamHostHeader(proxy, u)
+	} else {
+		setProxyDirector(proxy)
+	}
+
 	var auth hmacauth.HmacAuth
-	if sigData := opts.signatureData; sigData != nil {
-		auth = hmacauth.NewHmacAuth(sigData.hash, []byte(sigData.key),
-			SignatureHeader, SignatureHeaders)
+	if opts.signatureData != nil {
+		auth = newUpstreamAuth(opts.signatureData, opts.upstreamSigning[i])
+	}
+
+	o := opts.upstreamOverrides[i]
+	transport := newUpstreamTransport(opts.tlsclientconfig, opts.upstreamConns, o)
+	proxy.Transport = &traceTransport{transport}
+	proxy.ModifyResponse = registeredHooks.ModifyResponse
+	if f := opts.upstreamFilters[i]; f.enabled() {
+		proxy.ModifyResponse = f.modifyResponse(proxy.ModifyResponse)
+	}
+	if h2c {
+		proxy.Transport = &traceTransport{newH2CTransport(opts.upstreamConns, o)}
+		// gRPC streams responses, so don't hold them back
+		proxy.FlushInterval = -1
+	}
+	if o.HTTPVersion == "2" {
+		proxy.Transport = &traceTransport{newHTTP2Transport(transport)}
+	}
+	if o.TLSServerName != "" || o.DialAddress != "" {
+		log.Printf("upstream %q dial address:%q tls server name:%q", u, o.DialAddress, o.TLSServerName)
 	}
-	for _, u := range opts.proxyURLs {
+	if o.HTTPVersion != "" || o.ALPN != "" || o.DisableKeepAlives {
+		log.Printf("upstream %q http version:%q alpn:%q keep-alive:%t", u, o.HTTPVersion, o.ALPN, !o.DisableKeepAlives)
+	}
+	// websockets dial like the transport, so wss:// upstreams verify
+	// certificates against --tls-ca and honor the per-upstream overrides
+	wsd := &websocket.Dialer{
+		Proxy:            websocket.DefaultDialer.Proxy,
+		HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+		NetDialContext:   transport.DialContext,
+		TLSClientConfig:  transport.TLSClientConfig,
+	}
+
+	upstream := &UpstreamProxy{
+		upstream: *u,
+		name:     opts.upstreamNames[i],
+		handler:  proxy,
+		auth:     auth,
+		wsd:      wsd,
+		tag:      opts.upstreamTags[opts.upstreamNames[i]],
+	}
+	if !opts.PassHostHeader {
+		upstream.hostHeader = u.Host
+	}
+	return upstream
+}
+
+func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
+	serveMux := http.NewServeMux()
+	done := make(chan bool)
+	pools := newUpstreamPools(opts.UpstreamBalance, upstreamHealth{
+		path:     opts.UpstreamHealthPath,
+		interval: opts.UpstreamHealthInterval,
+		maxFails: opts.UpstreamMaxFails,
+	}, done)
+	var paths []string
+	for i, u := range opts.proxyURLs {
 		path := u.Path
 		switch u.Scheme {
-		case "http", "https":
+		case "http", "https", "h2c":
 			u.Path = ""
 			log.Printf("mapping path %q => upstream %q", path, u)
-			proxy := NewReverseProxy(u, opts.tlsclientconfig)
-			if !opts.PassHostHeader {
-				setProxyUpstreamHostHeader(proxy, u)
-			} else {
-				setProxyDirector(proxy)
-			}
-
-			websocket.DefaultDialer.TLSClientConfig = opts.tlsclientconfig
-
-			serveMux.Handle(path,
-				&UpstreamProxy{
-					upstream: *u,
-					handler:  proxy,
-					auth:     auth,
-					wsd:      websocket.DefaultDialer,
-				})
+			pools.Add(path, newHTTPUpstream(opts, i, u))
+		case "srv":
+			u.Path = ""
+			log.Printf("mapping path %q => upstreams of SRV record %q", path, u.Host)
+			pools.AddSRV(path, newSRVUpstream(u, opts.upstreamNames[i], opts.UpstreamSRVInterval, func(backend *url.URL) *UpstreamProxy {
+				return newHTTPUpstream(opts, i, backend)
+			}))
 		case "file":
 			if u.Fragment != "" {
 				path = u.Fragment
@@ -266,14 +698,29 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 			proxy := NewFileServer(path, u.Path)
 			serveMux.Handle(path, &UpstreamProxy{
 				upstream: *u,
+				name:     opts.upstreamNames[i],
 				handler:  proxy,
 				auth:     nil,
 				wsd:      websocket.DefaultDialer,
+				tag:      opts.upstreamTags[opts.upstreamNames[i]],
+			})
+		case "static":
+			code, _ := strconv.Atoi(u.Host)
+			log.Printf("mapping path %q => static response %d", path, code)
+			serveMux.Handle(path, &UpstreamProxy{
+				upstream: *u,
+				name:     opts.upstreamNames[i],
+				handler:  NewStaticResponse(code, u.Query().Get("body")),
+				auth:     nil,
+				wsd:      websocket.DefaultDialer,
+				tag:      opts.upstreamTags[opts.upstreamNames[i]],
 			})
 		default:
 			panic(fmt.Sprintf("unknown upstream protocol %s", u.Scheme))
 		}
+		paths = append(paths, path)
 	}
+	pools.Register(serveMux)
 	for _, u := range opts.CompiledRegex {
 		log.Printf("compiled skip-auth-regex => %q", u)
 	}
@@ -282,6 +729,9 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 	redirectURL.Path = fmt.Sprintf("%s/callback", opts.ProxyPrefix)
 
 	log.Printf("OAuthProxy configured for %s Client ID: %s", opts.provider.Data().ProviderName, opts.ClientID)
+	for _, e := range opts.extraProviders {
+		log.Printf("OAuthProxy configured for %s (%s) Client ID: %s", e.name, e.id, e.provider.Data().ClientID)
+	}
 	domain := opts.CookieDomain
 	if domain == "" {
 		domain = "<default>"
@@ -302,6 +752,66 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		}
 	}
 
+	var authRateLimiter *rateLimiter
+	if opts.AuthRateLimit > 0 {
+		authRateLimiter = newRateLimiter(opts.AuthRateLimit)
+	}
+	var authConcurrency concurrencyLimiter
+	if opts.AuthMaxConcurrent > 0 {
+		authConcurrency = newConcurrencyLimiter(opts.AuthMaxConcurrent)
+	}
+	var experiments *experimentBucketer
+	if opts.ExperimentSalt != "" {
+		experiments = newExperimentBucketer(opts.ExperimentSalt, opts.ExperimentBuckets)
+	}
+	var signInThrottle *signInThrottle
+	if opts.SignInAttempts > 0 {
+		signInThrottle = newSignInThrottle(opts.SignInAttempts, opts.SignInLockout)
+	}
+	setHandlerMetricLabels(opts.metricLabels)
+
+	var decisions *decisionCache
+	if opts.AuthDecisionCacheTTL > 0 {
+		decisions = newDecisionCache(opts.AuthDecisionCacheTTL)
+	}
+	var authOnly *authOnlyCache
+	if opts.AuthOnlyCacheTTL > 0 {
+		authOnly = newAuthOnlyCache(opts.AuthOnlyCacheTTL)
+	}
+	var opa *opaAuthorizer
+	if opts.OPAURL != "" {
+		log.Printf("authorizing requests with the Open Policy Agent decision at %s", opts.OPAURL)
+		opa = newOPAAuthorizer(opts.OPAURL, opts.OPATimeout)
+	}
+	var bots *botFilter
+	if opts.FilterBots {
+		bots = newBotFilter(opts.botUserAgents)
+	}
+	var audit *auditLog
+	if sink := newAuditSink(opts); sink != nil {
+		audit = newAuditLog(sink, opts.AuditSpoolDir, opts.AuditBatchSize, opts.AuditFlushInterval)
+	}
+	var failover *providerFailover
+	if opts.failoverProvider != nil {
+		log.Printf("failing over to %s after %d failures to reach %s", opts.failoverProvider.Data().ProviderName,
+			opts.FailoverThreshold, opts.provider.Data().ProviderName)
+		failover = newProviderFailover(opts.provider, opts.failoverProvider, opts.FailoverThreshold, opts.FailoverCooldown)
+	}
+
+	var testMode *testMode
+	if opts.UnsafeTestMode {
+		log.Printf("WARNING: unsafe test mode is enabled, sessions are minted from %s headers", testIdentityHeader)
+		testMode = newTestMode(opts.TestModeSecret)
+	} else {
+		// a reload disabling test mode puts the session clock back
+		providers.SetClockOffset(0)
+	}
+
+	providerID := strings.ToLower(opts.Provider)
+	if providerID == "" {
+		providerID = "google"
+	}
+
 	return &OAuthProxy{
 		CookieName:     opts.CookieName,
 		CSRFCookieName: fmt.Sprintf("%v_%v", opts.CookieName, "csrf"),
@@ -313,41 +823,123 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		CookieRefresh:  opts.CookieRefresh,
 		Validator:      validator,
 
+		previousCookieNames: opts.CookieNamePrevious,
+		cookieNameAliases:   opts.CookieNameAliases,
+
 		RobotsPath:        "/robots.txt",
-		PingPath:          "/ping",
+		PingPath:          opts.LivenessPath,
+		ReadyPath:         opts.ReadinessPath,
 		MetricsPath:       fmt.Sprintf("%s/metrics", opts.ProxyPrefix),
 		SignInPath:        fmt.Sprintf("%s/sign_in", opts.ProxyPrefix),
 		SignOutPath:       fmt.Sprintf("%s/sign_out", opts.ProxyPrefix),
 		OAuthStartPath:    fmt.Sprintf("%s/start", opts.ProxyPrefix),
 		OAuthCallbackPath: fmt.Sprintf("%s/callback", opts.ProxyPrefix),
 		AuthOnlyPath:      fmt.Sprintf("%s/auth", opts.ProxyPrefix),
+		GuestPath:         fmt.Sprintf("%s/guest", opts.ProxyPrefix),
+		SilentPath:        fmt.Sprintf("%s/silent", opts.ProxyPrefix),
+		ConfigurationPath: fmt.Sprintf("%s/.well-known/proxy-configuration", opts.ProxyPrefix),
+		TestClockPath:     fmt.Sprintf("%s/test/clock", opts.ProxyPrefix),
+
+		metricsAddress: opts.MetricsAddress,
+
+		SilentReauth:       opts.SilentReauth,
+		SilentReauthWindow: opts.SilentReauthWindow,
+
+		GuestCodeExpire:    opts.GuestCodeExpire,
+		GuestSessionExpire: opts.GuestSessionExpire,
+		guestAdmins:        opts.GuestAdmins,
+		guestRoutes:        opts.guestRoutes,
+		guestUpstreams:     opts.guestUpstreams,
+
+		authRateLimiter: authRateLimiter,
+		authConcurrency: authConcurrency,
+		signInThrottle:  signInThrottle,
+		proxyRateLimits: newProxyRateLimits(opts.RateLimit, opts.rateLimitRoutes),
+
+		decisions:      decisions,
+		authOnlyCache:  authOnly,
+		errorBudget:    opts.errorBudget,
+		failover:       failover,
+		extraProviders: opts.extraProviders,
+		opa:            opa,
+		roleMap:        opts.roleMap,
+		blockList:      opts.blockList,
+		experiments:    experiments,
+		auditLog:       audit,
+		botFilter:      bots,
+		testMode:       testMode,
+		hooks:          registeredHooks,
+
+		done: done,
+
+		signature: newSignatureConfiguration(opts),
+
+		cacheControl:      opts.CacheControl,
+		cacheRoutes:       opts.cacheRoutes,
+		cacheContentTypes: opts.CacheControlContentTypes,
+
+		scopeRoutes:      opts.scopeRoutes,
+		sessionAgeRoutes: opts.sessionAgeRoutes,
+
+		DegradedSessionGrace: opts.DegradeSessionGrace,
+
+		metricLabels: opts.metricLabels,
+
+		readiness:     newReadiness(loadCertificates(opts.TLSCertFile, opts.TLSKeyFile)),
+		HealthVerbose: opts.HealthVerbose,
+
+		SessionExpiryHeaders: opts.SessionExpiryHeaders,
+		CSRFStateFallback:    opts.CSRFStateFallback,
+		csrfNonces:           newCSRFNonces(),
 
 		ProxyPrefix:        opts.ProxyPrefix,
 		provider:           opts.provider,
+		providerID:         providerID,
+		providerDomains:    opts.providerDomains,
 		serveMux:           serveMux,
+		upstreamLabels:     newUpstreamLabels(serveMux, paths),
 		redirectURL:        redirectURL,
 		skipAuthRegex:      opts.SkipAuthRegex,
 		skipAuthPreflight:  opts.SkipAuthPreflight,
 		compiledRegex:      opts.CompiledRegex,
+		trustedNets:        opts.trustedNets,
+		trustedDownstreams: opts.trustedDownstreams,
 		SetXAuthRequest:    opts.SetXAuthRequest,
 		PassBasicAuth:      opts.PassBasicAuth,
 		PassUserHeaders:    opts.PassUserHeaders,
+		PassOriginal:       opts.PassOriginalRequest,
 		BasicAuthPassword:  opts.BasicAuthPassword,
 		PassAccessToken:    opts.PassAccessToken,
 		SkipProviderButton: opts.SkipProviderButton,
+		Headless:           opts.Headless,
 		CookieCipher:       cipher,
+		previousCookie:     newPreviousCookieFormat(opts),
 		templates:          loadTemplates(opts.CustomTemplatesDir),
 		Footer:             opts.Footer,
 	}
 }
 
+// Close stops the background work of the proxy, once it no longer serves
+// requests: upstream health checks and lookups, and the audit log, whose
+// queued events are sent first
+func (p *OAuthProxy) Close() {
+	close(p.done)
+	p.auditLog.Close()
+}
+
 func (p *OAuthProxy) GetRedirectURI(host string) string {
-	// default to the request Host if not set
-	if p.redirectURL.Host != "" {
-		return p.redirectURL.String()
-	}
+	return p.absoluteURL(host, p.redirectURL.Path)
+}
+
+// absoluteURL builds a URL for path on the redirect URL's scheme and host,
+// defaulting to the request host
+func (p *OAuthProxy) absoluteURL(host, path string) string {
 	var u url.URL
 	u = *p.redirectURL
+	u.Path = path
+	if u.Host != "" {
+		return u.String()
+	}
 	if u.Scheme == "" {
 		if p.CookieSecure {
 			u.Scheme = "https"
@@ -363,18 +955,36 @@ func (p *OAuthProxy) displayCustomLoginForm() bool {
 	return p.HtpasswdFile != nil && p.DisplayHtpasswdForm
 }
 
-func (p *OAuthProxy) redeemCode(host, code string) (s *providers.SessionState, err error) {
+func (p *OAuthProxy) redeemCode(provider providers.Provider, host, code string) (s *providers.SessionState, err error) {
 	if code == "" {
 		return nil, errors.New("missing code")
 	}
 	redirectURI := p.GetRedirectURI(host)
-	s, err = p.provider.Redeem(redirectURI, code)
-	if err != nil {
-		return
+	s, err = provider.Redeem(redirectURI, code)
+	if p.failover != nil && provider == p.provider {
+		p.failover.RedeemResult(err)
+	}
+	// only unreachable token endpoints count against the error budget,
+	// not rejected codes
+	var urlErr *url.Error
+	if err == nil || errors.As(err, &urlErr) {
+		p.recordProviderCall(err != nil)
 	}
+	return
+}
 
+// fetchIdentity completes a redeemed session with the email address and
+// groups the token endpoint didn't return
+func (p *OAuthProxy) fetchIdentity(provider providers.Provider, s *providers.SessionState) (err error) {
 	if s.Email == "" {
-		s.Email, err = p.provider.GetEmailAddress(s)
+		s.Email, err = provider.GetEmailAddress(s)
+		if err != nil {
+			return
+		}
+	}
+
+	if s.Groups == nil {
+		s.Groups, err = provider.GetGroups(s)
 	}
 	return
 }
@@ -422,40 +1032,193 @@ func (p *OAuthProxy) ClearCSRFCookie(rw http.ResponseWriter, req *http.Request)
 }
 
 func (p *OAuthProxy) SetCSRFCookie(rw http.ResponseWriter, req *http.Request, val string) {
-	http.SetCookie(rw, p.MakeCSRFCookie(req, val, p.CookieExpire, time.Now()))
+	c := p.MakeCSRFCookie(req, val, p.CookieExpire, time.Now())
+	// the nonce tells which provider the sign in is started with
+	provider, _ := p.callbackProvider(val)
+	if _, ok := provider.(*providers.AppleProvider); ok && p.CookieSecure {
+		// Apple posts the callback cross-site, which browsers only send
+		// SameSite=None cookies with
+		c.SameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(rw, c)
 }
 
+// ClearSessionCookie expires the session cookie, along with the cookies of
+// previous cookie names and aliases and any split chunks of them the request
+// carries, on every domain they may have been set on
 func (p *OAuthProxy) ClearSessionCookie(rw http.ResponseWriter, req *http.Request) {
-	http.SetCookie(rw, p.MakeSessionCookie(req, "", time.Hour*-1, time.Now()))
+	for _, name := range p.sessionCookieNames(req) {
+		p.expireCookie(rw, req, name)
+	}
+}
+
+// ClearSignInCookies expires the CSRF cookies of the current and previous
+// cookie names and aliases on every domain they may have been set on
+func (p *OAuthProxy) ClearSignInCookies(rw http.ResponseWriter, req *http.Request) {
+	p.expireCookie(rw, req, p.CSRFCookieName)
+	for _, name := range p.previousCookieNames {
+		p.expireCookie(rw, req, name+"_csrf")
+	}
+	for _, name := range p.cookieNameAliases {
+		p.expireCookie(rw, req, name+"_csrf")
+	}
+}
+
+// sessionCookieNames are the names of the session cookies to expire: the
+// current and previous cookie names and aliases, and the "<name>_<n>" chunks
+// of cookies that were split to fit the cookie size limit
+func (p *OAuthProxy) sessionCookieNames(req *http.Request) []string {
+	names := append([]string{p.CookieName}, p.previousCookieNames...)
+	names = append(names, p.cookieNameAliases...)
+	for _, c := range req.Cookies() {
+		for _, name := range names {
+			if isCookieChunk(c.Name, name) {
+				names = append(names, c.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// isCookieChunk reports whether cookie is a "<name>_<n>" chunk of name
+func isCookieChunk(cookie, name string) bool {
+	if !strings.HasPrefix(cookie, name+"_") {
+		return false
+	}
+	n := cookie[len(name)+1:]
+	if n == "" {
+		return false
+	}
+	for _, r := range n {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// expireCookie expires the cookie called name on the domain makeCookie uses,
+// and on the request host, the configured cookie domain and host-only
+func (p *OAuthProxy) expireCookie(rw http.ResponseWriter, req *http.Request, name string) {
+	canonical := p.makeCookie(req, name, "", time.Hour*-1, time.Now())
+	http.SetCookie(rw, canonical)
+	for _, domain := range p.otherCookieDomains(req, canonical.Domain) {
+		c := *canonical
+		c.Domain = domain
+		http.SetCookie(rw, &c)
+	}
+}
+
+// otherCookieDomains are the domains other than canonical a cookie may have
+// been set on: none for host-only cookies, the request host, and the
+// configured cookie domain
+func (p *OAuthProxy) otherCookieDomains(req *http.Request, canonical string) []string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	var domains []string
+	seen := map[string]bool{canonical: true}
+	for _, domain := range []string{"", host, p.CookieDomain} {
+		if seen[domain] {
+			continue
+		}
+		seen[domain] = true
+		domains = append(domains, domain)
+	}
+	return domains
 }
 
 func (p *OAuthProxy) SetSessionCookie(rw http.ResponseWriter, req *http.Request, val string) {
 	http.SetCookie(rw, p.MakeSessionCookie(req, val, p.CookieExpire, time.Now()))
 }
 
+// sessionCookies returns every cookie carrying the session cookie name. A
+// browser sends several when both a host cookie and a domain cookie exist.
+func (p *OAuthProxy) sessionCookies(req *http.Request) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, c := range req.Cookies() {
+		if c.Name == p.CookieName {
+			cookies = append(cookies, c)
+		}
+	}
+	return cookies
+}
+
+// aliasCookies returns the cookies carrying an alias of the session cookie
+// name, which are accepted while cookies are renamed
+func (p *OAuthProxy) aliasCookies(req *http.Request) []*http.Cookie {
+	var cookies []*http.Cookie
+	for _, c := range req.Cookies() {
+		for _, name := range p.cookieNameAliases {
+			if c.Name == name {
+				cookies = append(cookies, c)
+			}
+		}
+	}
+	return cookies
+}
+
+// ClearAliasCookies expires the cookies carrying an alias of the session
+// cookie name on every domain they may have been set on
+func (p *OAuthProxy) ClearAliasCookies(rw http.ResponseWriter, req *http.Request) {
+	expired := make(map[string]bool)
+	for _, c := range p.aliasCookies(req) {
+		if !expired[c.Name] {
+			expired[c.Name] = true
+			p.expireCookie(rw, req, c.Name)
+		}
+	}
+}
+
 func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*providers.SessionState, time.Duration, error) {
+	session, age, _, err := p.loadCookiedSession(req)
+	return session, age, err
+}
+
+// loadCookiedSession is LoadCookiedSession, also reporting whether the
+// session was read from a cookie in the previous format
+func (p *OAuthProxy) loadCookiedSession(req *http.Request) (*providers.SessionState, time.Duration, bool, error) {
 	var age time.Duration
-	c, err := req.Cookie(p.CookieName)
-	if err != nil {
-		// always http.ErrNoCookie
-		return nil, age, fmt.Errorf("Cookie %q not present", p.CookieName)
+	cookies := p.sessionCookies(req)
+	if len(cookies) == 0 {
+		cookies = p.aliasCookies(req)
 	}
-	val, timestamp, ok := cookie.Validate(c, p.CookieSeed, p.CookieExpire)
-	if !ok {
-		return nil, age, errors.New("Cookie Signature not valid")
+	if len(cookies) == 0 {
+		return nil, age, false, fmt.Errorf("Cookie %q not present", p.CookieName)
 	}
 
-	session, err := p.provider.SessionFromCookie(val, p.CookieCipher)
-	if err != nil {
-		return nil, age, err
+	// prefer the first cookie that validates when several are present
+	var err error
+	for _, c := range cookies {
+		var session *providers.SessionState
+		var timestamp time.Time
+		var migrated bool
+		session, timestamp, migrated, err = p.decodeSessionCookie(c)
+		if err != nil {
+			continue
+		}
+		age = time.Now().Truncate(time.Second).Sub(timestamp)
+		return session, age, migrated, nil
 	}
+	return nil, age, false, err
+}
 
-	age = time.Now().Truncate(time.Second).Sub(timestamp)
-	return session, age, nil
+// ClearDuplicateSessionCookies expires the session cookie on every domain it
+// may have been set on other than the one MakeSessionCookie uses, so a
+// browser holding several copies is left with at most one.
+func (p *OAuthProxy) ClearDuplicateSessionCookies(rw http.ResponseWriter, req *http.Request) {
+	canonical := p.MakeSessionCookie(req, "", time.Hour*-1, time.Now())
+	for _, domain := range p.otherCookieDomains(req, canonical.Domain) {
+		c := *canonical
+		c.Domain = domain
+		http.SetCookie(rw, &c)
+	}
 }
 
 func (p *OAuthProxy) SaveSession(rw http.ResponseWriter, req *http.Request, s *providers.SessionState) error {
-	value, err := p.provider.CookieForSession(s, p.CookieCipher)
+	value, err := p.sessionProvider(s).CookieForSession(s, p.CookieCipher)
 	if err != nil {
 		return err
 	}
@@ -468,29 +1231,56 @@ func (p *OAuthProxy) RobotsTxt(rw http.ResponseWriter) {
 	fmt.Fprintf(rw, "User-agent: *\nDisallow: /")
 }
 
+// PingPage reports the process is up, whether or not it can authenticate
+// requests
 func (p *OAuthProxy) PingPage(rw http.ResponseWriter) {
-	rw.WriteHeader(http.StatusOK)
-	fmt.Fprintf(rw, "OK")
+	p.writeHealth(rw, healthReport{Status: "ok"})
 }
 
-func (p *OAuthProxy) ErrorPage(rw http.ResponseWriter, code int, title string, message string) {
+func (p *OAuthProxy) ErrorPage(rw http.ResponseWriter, req *http.Request, code int, title string, message string) {
+	p.errorPage(rw, req, code, title, message, "")
+}
+
+// ProviderErrorPage explains the error a provider redirected back with
+func (p *OAuthProxy) ProviderErrorPage(rw http.ResponseWriter, req *http.Request, e providerError) {
+	log.Printf("%s provider error %s: %q", getRemoteAddr(req), e.Code, e.Description)
+	p.errorPage(rw, req, 403, "Permission Denied", e.Message(), e.Code)
+}
+
+// errorPage renders the error page, with the error code of the provider
+// when it's the provider's error
+func (p *OAuthProxy) errorPage(rw http.ResponseWriter, req *http.Request, code int, title string, message string, errorCode string) {
 	log.Printf("ErrorPage %d %s %s", code, title, message)
+	rw.Header().Add("Vary", "Accept, Accept-Language, User-Agent")
+	if p.Headless || wantsJSON(req) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(code)
+		json.NewEncoder(rw).Encode(struct {
+			Code      int    `json:"code"`
+			Title     string `json:"title"`
+			Message   string `json:"message"`
+			ErrorCode string `json:"error,omitempty"`
+		}{code, title, message, errorCode})
+		return
+	}
 	rw.WriteHeader(code)
 	t := struct {
 		Title       string
 		Message     string
+		ErrorCode   string
 		ProxyPrefix string
 	}{
 		Title:       fmt.Sprintf("%d %s", code, title),
 		Message:     message,
+		ErrorCode:   errorCode,
 		ProxyPrefix: p.ProxyPrefix,
 	}
-	p.templates.ExecuteTemplate(rw, "error.html", t)
+	p.templates.ExecuteTemplate(rw, templateVariant(p.templates, req, "error"), t)
 }
 
 func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code int) {
 	p.ClearSessionCookie(rw, req)
-	rw.WriteHeader(code)
+	rw.Header().Add("Vary", "Accept, Accept-Language, User-Agent")
 
 	redirect_url := req.URL.RequestURI()
 	if req.Header.Get("X-Auth-Request-Redirect") != "" {
@@ -500,8 +1290,34 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 		redirect_url = "/"
 	}
 
+	signInURL := fmt.Sprintf("%s?%s", p.OAuthStartPath, url.Values{"rd": {redirect_url}}.Encode())
+	if p.Headless {
+		// without a sign in page, browsers go straight to the provider and
+		// other clients are told to authenticate
+		if isPageNavigation(req) {
+			http.Redirect(rw, req, signInURL, 302)
+			return
+		}
+		code = http.StatusUnauthorized
+	}
+	if p.Headless || wantsJSON(req) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(code)
+		json.NewEncoder(rw).Encode(struct {
+			Code      int    `json:"code"`
+			SignInURL string `json:"sign_in_url"`
+		}{
+			Code:      code,
+			SignInURL: signInURL,
+		})
+		return
+	}
+	rw.WriteHeader(code)
+
+	provider, _ := p.loginProvider()
 	t := struct {
 		ProviderName  string
+		Providers     []signInProvider
 		SignInMessage string
 		CustomLogin   bool
 		Redirect      string
@@ -509,7 +1325,8 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 		ProxyPrefix   string
 		Footer        template.HTML
 	}{
-		ProviderName:  p.provider.Data().ProviderName,
+		ProviderName:  provider.Data().ProviderName,
+		Providers:     p.signInProviders(),
 		SignInMessage: p.SignInMessage,
 		CustomLogin:   p.displayCustomLoginForm(),
 		Redirect:      redirect_url,
@@ -517,7 +1334,7 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 		ProxyPrefix:   p.ProxyPrefix,
 		Footer:        template.HTML(p.Footer),
 	}
-	p.templates.ExecuteTemplate(rw, "sign_in.html", t)
+	p.templates.ExecuteTemplate(rw, templateVariant(p.templates, req, "sign_in"), t)
 }
 
 func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (string, bool) {
@@ -531,12 +1348,49 @@ func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (st
 	}
 	// check auth
 	if p.HtpasswdFile.Validate(user, passwd) {
+		if p.blockList.IsBlocked(&providers.SessionState{User: user}) {
+			log.Printf("%s Permission Denied: htpasswd user %q is blocked", getRemoteAddr(req), user)
+			p.audit(req, "sign_in_denied", &providers.SessionState{User: user}, "blocked")
+			return "", false
+		}
 		log.Printf("authenticated %q via HtpasswdFile", user)
+		if p.signInThrottle != nil {
+			p.signInThrottle.Reset(signInUserKey(user))
+		}
 		return user, true
 	}
+	log.Printf("%s failed htpasswd sign in for %q", getRemoteAddr(req), user)
+	signInFailureCounter.WithLabelValues("password").Inc()
+	p.audit(req, "sign_in_denied", &providers.SessionState{User: user}, "invalid password")
+	if p.signInThrottle != nil && p.signInThrottle.Fail(time.Now(), signInKeys(req, user)...) {
+		log.Printf("%s locked out of htpasswd sign in for %q for %s", getRemoteAddr(req), user, p.signInThrottle.lockout)
+	}
 	return "", false
 }
 
+// signInBackoff returns how long the client or the user of a htpasswd sign
+// in has to wait before attempting it again
+func (p *OAuthProxy) signInBackoff(req *http.Request) time.Duration {
+	if p.signInThrottle == nil || req.Method != "POST" || p.HtpasswdFile == nil {
+		return 0
+	}
+	user := req.FormValue("username")
+	if user == "" {
+		return 0
+	}
+	return p.signInThrottle.Wait(time.Now(), signInKeys(req, user)...)
+}
+
+func signInUserKey(user string) string {
+	return "user:" + user
+}
+
+// signInKeys are the keys failed htpasswd sign ins are throttled by: the
+// client IP and the username
+func signInKeys(req *http.Request, user string) []string {
+	return []string{"ip:" + clientIP(req), signInUserKey(user)}
+}
+
 func (p *OAuthProxy) GetRedirect(req *http.Request) (redirect string, err error) {
 	err = req.ParseForm()
 	if err != nil {
@@ -558,9 +1412,80 @@ func (p *OAuthProxy) GetRedirect(req *http.Request) (redirect string, err error)
 	return
 }
 
+// pinnedProvider returns the provider an email's domain must sign in with,
+// if one is configured. Domains match like those of the validator, and the
+// longest matching one wins, ie. "eu.example.com" over "*.example.com".
+func (p *OAuthProxy) pinnedProvider(email string) (string, bool) {
+	email = strings.ToLower(email)
+	var provider, matched string
+	for domain, id := range p.providerDomains {
+		suffix := emailDomainSuffix(domain)
+		if strings.HasSuffix(email, suffix) && len(suffix) > len(matched) {
+			provider, matched = id, suffix
+		}
+	}
+	return provider, matched != ""
+}
+
+// isPinnedElsewhere reports whether email belongs to a domain pinned to a
+// provider other than id, the one handling this login.
+func (p *OAuthProxy) isPinnedElsewhere(email, id string) bool {
+	provider, ok := p.pinnedProvider(email)
+	return ok && provider != id
+}
+
+// emailExpired tells whether email is denied only because its entry in the
+// authenticated emails file expired
+func (p *OAuthProxy) emailExpired(email string) bool {
+	return p.AuthenticatedEmails != nil && p.AuthenticatedEmails.IsExpired(email) && !p.Validator(email)
+}
+
 func (p *OAuthProxy) IsWhitelistedRequest(req *http.Request) (ok bool) {
 	isPreflightRequestAllowed := p.skipAuthPreflight && req.Method == "OPTIONS"
-	return isPreflightRequestAllowed || p.IsWhitelistedPath(req.URL.Path)
+	return isPreflightRequestAllowed || p.IsWhitelistedPath(req.URL.Path) || p.IsTrustedIP(req)
+}
+
+// IsTrustedIP tells whether the request comes from a trusted network. The
+// address the connection comes from is used, never a forwarded header. The
+// proxy's own endpoints aren't bypassed, so users there can still sign in.
+func (p *OAuthProxy) IsTrustedIP(req *http.Request) bool {
+	if len(p.trustedNets) == 0 || strings.HasPrefix(req.URL.Path, p.ProxyPrefix+"/") {
+		return false
+	}
+	return ipInNetworks(peerIP(req), p.trustedNets)
+}
+
+// ipInNetworks tells whether the address ip is in one of nets
+func ipInNetworks(ip string, nets []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHeaders identify the client behind a downstream proxy, in the
+// logs and to upstreams
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Real-IP"}
+
+// stripForwardedHeaders removes the forwarded headers of requests that don't
+// come from a trusted downstream proxy, so clients can't spoof their address.
+// Without trusted downstream proxies all of them are honored.
+func (p *OAuthProxy) stripForwardedHeaders(req *http.Request) {
+	if len(p.trustedDownstreams) == 0 || ipInNetworks(peerIP(req), p.trustedDownstreams) {
+		return
+	}
+	for _, header := range forwardedHeaders {
+		req.Header.Del(header)
+	}
+	if realClientIPHeader != "" {
+		req.Header.Del(realClientIPHeader)
+	}
 }
 
 func (p *OAuthProxy) IsWhitelistedPath(path string) (ok bool) {
@@ -575,56 +1500,163 @@ func (p *OAuthProxy) IsWhitelistedPath(path string) (ok bool) {
 
 func getRemoteAddr(req *http.Request) (s string) {
 	s = req.RemoteAddr
-	if req.Header.Get("X-Real-IP") != "" {
-		s += fmt.Sprintf(" (%q)", req.Header.Get("X-Real-IP"))
+	if client := req.Header.Get(clientIPLogHeader()); client != "" {
+		s += fmt.Sprintf(" (%q)", client)
 	}
 	return
 }
 
-func instrument(next http.HandlerFunc, dvec *prometheus.HistogramVec, spanName string) http.Handler {
-	return promhttp.InstrumentHandlerDuration(dvec, next)
+func (p *OAuthProxy) instrument(next http.HandlerFunc, dvec *prometheus.HistogramVec, spanName string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		labels := p.metricLabelValues(req)
+		labels[proxyUpstreamLabel] = ""
+		if dvec == proxyVec {
+			labels[proxyUpstreamLabel] = p.upstreamLabel(req)
+		}
+		observer := dvec.MustCurryWith(labels)
+		promhttp.InstrumentHandlerDuration(observer, next).ServeHTTP(rw, req)
+	})
+}
+
+// serveHealth serves the liveness, readiness and metrics endpoints, and
+// returns whether req was for one of them
+func (p *OAuthProxy) serveHealth(rw http.ResponseWriter, req *http.Request) bool {
+	switch req.URL.Path {
+	case p.MetricsPath:
+		metricsHandler.ServeHTTP(rw, req)
+	case p.PingPath:
+		p.instrument(func(rw http.ResponseWriter, req *http.Request) {
+			p.PingPage(rw)
+		}, pingVec, "ping").ServeHTTP(rw, req)
+	case p.ReadyPath:
+		p.instrument(func(rw http.ResponseWriter, req *http.Request) {
+			p.ReadinessPage(rw)
+		}, readyVec, "ready").ServeHTTP(rw, req)
+	default:
+		return false
+	}
+	return true
+}
+
+// HealthHandler serves the liveness, readiness and metrics endpoints on the
+// metrics listener, and nothing else
+func (p *OAuthProxy) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !p.serveHealth(rw, req) {
+			http.NotFound(rw, req)
+		}
+	})
 }
 
 func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	p.stripForwardedHeaders(req)
+	if p.metricsAddress == "" && p.serveHealth(rw, req) {
+		return
+	}
 	switch path := req.URL.Path; {
 	case path == p.RobotsPath:
-		instrument(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		p.instrument(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 			p.RobotsTxt(rw)
 		}), robotsVec, "robots").ServeHTTP(rw, req)
-	case path == p.MetricsPath:
-		promhttp.Handler().ServeHTTP(rw, req)
-	case path == p.PingPath:
-		instrument(func(rw http.ResponseWriter, req *http.Request) {
-			p.PingPage(rw)
-		}, pingVec, "ping").ServeHTTP(rw, req)
+	case path == p.ConfigurationPath:
+		p.instrument(p.ConfigurationPage, configVec, "configuration").ServeHTTP(rw, req)
 	case p.IsWhitelistedRequest(req):
-		instrument(p.serveMux.ServeHTTP, whitelistVec, "whitelist").ServeHTTP(rw, req)
+		if p.PassOriginal {
+			proxiedOriginalRequest(req).setHeaders(req.Header)
+		}
+		p.instrument(p.serveMux.ServeHTTP, whitelistVec, "whitelist").ServeHTTP(rw, req)
 	case path == p.SignInPath:
-		instrument(p.SignIn, signInVec, "signIn").ServeHTTP(rw, req)
+		p.instrument(p.SignIn, signInVec, "signIn").ServeHTTP(rw, req)
 	case path == p.SignOutPath:
-		instrument(p.SignOut, signOutVec, "signOut").ServeHTTP(rw, req)
+		p.instrument(p.SignOut, signOutVec, "signOut").ServeHTTP(rw, req)
 	case path == p.OAuthStartPath:
-		instrument(p.OAuthStart, startVec, "start").ServeHTTP(rw, req)
+		p.instrument(p.limitAuth(p.OAuthStart, "start"), startVec, "start").ServeHTTP(rw, req)
 	case path == p.OAuthCallbackPath:
-		instrument(p.OAuthCallback, callbackVec, "callback").ServeHTTP(rw, req)
+		p.instrument(p.limitAuth(p.OAuthCallback, "callback"), callbackVec, "callback").ServeHTTP(rw, req)
 	case path == p.AuthOnlyPath:
-		instrument(p.AuthenticateOnly, authOnlyVec, "authOnly").ServeHTTP(rw, req)
+		p.instrument(p.AuthenticateOnly, authOnlyVec, "authOnly").ServeHTTP(rw, req)
+	case path == p.SilentPath && p.SilentReauth:
+		p.instrument(p.limitAuth(p.SilentReauthPage, "silent"), silentVec, "silent").ServeHTTP(rw, req)
+	case path == p.GuestPath:
+		p.instrument(p.Guest, guestVec, "guest").ServeHTTP(rw, req)
+	case path == p.TestClockPath && p.testMode != nil:
+		p.TestClock(rw, req)
 	default:
-		instrument(p.Proxy, proxyVec, "proxy").ServeHTTP(rw, req)
+		p.instrument(p.Proxy, proxyVec, "proxy").ServeHTTP(rw, req)
+	}
+}
+
+// allowProxy applies the rate limit of the request's path to the user of
+// session, or to the client IP without a session, ie. with a client
+// certificate
+func (p *OAuthProxy) allowProxy(req *http.Request, session *providers.SessionState) (bool, time.Duration) {
+	key := "ip:" + clientIP(req)
+	if session != nil && session.Email != "" {
+		key = "user:" + session.Email
+	} else if session != nil && session.User != "" {
+		key = "user:" + session.User
+	}
+	ok, wait, route := p.proxyRateLimits.Allow(req.URL.Path, key, time.Now())
+	if !ok {
+		log.Printf("%s rate limited %s request for %q", getRemoteAddr(req), key, req.URL.Path)
+		if route == "" {
+			route = "default"
+		}
+		proxyLimitedCounter.WithLabelValues(route).Inc()
+	}
+	return ok, wait
+}
+
+// limitAuth applies the per-IP rate limit and the concurrency limit shared
+// by the endpoints that start and finish a login, each of which leads to a
+// provider call, separately from proxied traffic.
+func (p *OAuthProxy) limitAuth(next http.HandlerFunc, handler string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if p.authRateLimiter != nil {
+			if ok, wait := p.authRateLimiter.Allow(clientIP(req), time.Now()); !ok {
+				log.Printf("%s rate limited %s request", getRemoteAddr(req), handler)
+				authLimitedCounter.WithLabelValues(handler, "rate").Inc()
+				rw.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+				p.ErrorPage(rw, req, http.StatusTooManyRequests, "Too Many Requests", "Too many sign in attempts, try again later")
+				return
+			}
+		}
+		if p.authConcurrency != nil {
+			if !p.authConcurrency.TryAcquire() {
+				log.Printf("%s too many concurrent sign in requests, rejecting %s request", getRemoteAddr(req), handler)
+				authLimitedCounter.WithLabelValues(handler, "concurrency").Inc()
+				rw.Header().Set("Retry-After", "1")
+				p.ErrorPage(rw, req, http.StatusServiceUnavailable, "Service Unavailable", "Too many sign in attempts, try again later")
+				return
+			}
+			defer p.authConcurrency.Release()
+		}
+		next(rw, req)
 	}
 }
 
 func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 	redirect, err := p.GetRedirect(req)
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
 
+	if wait := p.signInBackoff(req); wait > 0 {
+		user := req.FormValue("username")
+		log.Printf("%s throttled htpasswd sign in for %q", getRemoteAddr(req), user)
+		signInFailureCounter.WithLabelValues("throttled").Inc()
+		p.audit(req, "sign_in_denied", &providers.SessionState{User: user}, "too many failed attempts")
+		rw.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+		p.ErrorPage(rw, req, http.StatusTooManyRequests, "Too Many Requests", "Too many failed sign in attempts, try again later")
+		return
+	}
 	user, ok := p.ManualSignIn(rw, req)
 	if ok {
 		session := &providers.SessionState{User: user}
 		p.SaveSession(rw, req, session)
+		authOutcomesCounter.WithLabelValues("sign_in").Inc()
+		p.audit(req, "sign_in", session, "")
 		http.Redirect(rw, req, redirect, 302)
 	} else {
 		p.SignInPage(rw, req, 200)
@@ -632,90 +1664,291 @@ func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (p *OAuthProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
+	session, _, _ := p.LoadCookiedSession(req)
+	if session != nil {
+		p.audit(req, "sign_out", session, "")
+	}
+	p.invalidateAuthOnly(req)
 	p.ClearSessionCookie(rw, req)
+	p.ClearSignInCookies(rw, req)
+	// end the provider session too when the provider supports it
+	if logoutURL := p.sessionProvider(session).GetLogoutURL(p.absoluteURL(req.Host, "/")); logoutURL != "" {
+		http.Redirect(rw, req, logoutURL, 302)
+		return
+	}
 	http.Redirect(rw, req, "/", 302)
 }
 
 func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
-	nonce, err := cookie.Nonce()
+	if p.filterBot(rw, req, true) {
+		return
+	}
+	provider, tag, ok := p.chosenProvider(req.URL.Query().Get("provider"))
+	if !ok {
+		p.ErrorPage(rw, req, 400, "Bad Request", "Unknown Provider")
+		return
+	}
+	nonce, err := loginNonce(tag)
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
 	p.SetCSRFCookie(rw, req, nonce)
 	redirect, err := p.GetRedirect(req)
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
+		return
+	}
+	loginHint := req.Form.Get("login_hint")
+	if loginHint != "" && p.isPinnedElsewhere(loginHint, p.pinnedID(tag)) {
+		provider, _ := p.pinnedProvider(loginHint)
+		log.Printf("%s login_hint %q must sign in with provider %q", getRemoteAddr(req), loginHint, provider)
+		p.ErrorPage(rw, req, 403, "Permission Denied", "Invalid Account")
 		return
 	}
 	redirectURI := p.GetRedirectURI(req.Host)
-	http.Redirect(rw, req, p.provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect)), 302)
+	loginURL := provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", p.csrfState(req, nonce, time.Now()), redirect))
+	if loginHint != "" {
+		loginURL = setLoginURLParam(loginURL, "login_hint", loginHint)
+	}
+	if scopes := p.requestedScopes(req, redirect); len(scopes) > 0 {
+		base := strings.Fields(provider.Data().Scope)
+		loginURL = setLoginURLParam(loginURL, "scope", strings.Join(mergeScopes(base, scopes), " "))
+	}
+	http.Redirect(rw, req, loginURL, 302)
+}
+
+// setLoginURLParam passes an additional OpenID Connect parameter, such as
+// login_hint or prompt, on to the provider
+func setLoginURLParam(loginURL, name, value string) string {
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+	params := u.Query()
+	params.Set(name, value)
+	if name == "prompt" {
+		// providers such as Google reject approval_prompt alongside prompt
+		params.Del("approval_prompt")
+	}
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// silentReauthResult is the page served in the silent re-authentication
+// iframe. It reports the outcome to the embedding page, which must be on the
+// same origin.
+var silentReauthResult = template.Must(template.New("silent").Parse(`<!DOCTYPE html>
+<html><body><script>
+window.parent.postMessage({type: "oauth2_proxy_silent", status: {{.Status}}, expiresIn: {{.ExpiresIn}}}, window.location.origin);
+</script></body></html>
+`))
+
+// sessionExpiresIn is how long until a session stops being accepted, either
+// because its cookie is too old or because its token expires
+func (p *OAuthProxy) sessionExpiresIn(s *providers.SessionState, age time.Duration) time.Duration {
+	expiresIn := p.CookieExpire - age
+	if !s.ExpiresOn.IsZero() {
+		if d := s.ExpiresOn.Sub(providers.Now()); d < expiresIn {
+			expiresIn = d
+		}
+	}
+	return expiresIn
+}
+
+// SilentReauthPage is loaded in a hidden iframe by pages that want the
+// session renewed before it expires, for providers that don't issue refresh
+// tokens. When the session is close to expiry it runs the OAuth flow with
+// prompt=none, which succeeds without user interaction while the user is
+// still signed in with the provider.
+func (p *OAuthProxy) SilentReauthPage(rw http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
+		return
+	}
+
+	session, age, err := p.LoadCookiedSession(req)
+	valid := err == nil && !session.IsExpired()
+	var expiresIn time.Duration
+	if valid {
+		expiresIn = p.sessionExpiresIn(session, age)
+	}
+
+	// back from the provider, or the session doesn't need renewing yet
+	if req.Form.Get("done") != "" || (valid && expiresIn > p.SilentReauthWindow) {
+		status := "ok"
+		if req.Form.Get("error") != "" {
+			status = newProviderError(req.Form).Code
+		} else if !valid {
+			status = "login_required"
+		}
+		rw.Header().Set("Cache-Control", "no-store")
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		silentReauthResult.Execute(rw, struct {
+			Status    string
+			ExpiresIn int
+		}{status, int(expiresIn.Seconds())})
+		return
+	}
+
+	// renew with the provider that issued the session
+	provider, tag := p.loginProvider()
+	if session != nil {
+		if e := p.extraProvider(session.Provider); e != nil {
+			provider, tag = e.provider, e.id
+		}
+	}
+	nonce, err := loginNonce(tag)
+	if err != nil {
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
+		return
+	}
+	p.SetCSRFCookie(rw, req, nonce)
+	redirectURI := p.GetRedirectURI(req.Host)
+	state := fmt.Sprintf("%v:%v?done=1", p.csrfState(req, nonce, time.Now()), p.SilentPath)
+	loginURL := provider.GetLoginURL(redirectURI, state)
+	http.Redirect(rw, req, setLoginURLParam(loginURL, "prompt", "none"), 302)
+}
+
+// silentReauthError sends the provider's error for a prompt=none login back
+// to the silent re-authentication page, returning false for other logins
+func (p *OAuthProxy) silentReauthError(rw http.ResponseWriter, req *http.Request, errorString string) bool {
+	s := strings.SplitN(req.Form.Get("state"), ":", 2)
+	if !p.SilentReauth || len(s) != 2 || !strings.HasPrefix(s[1], p.SilentPath+"?") {
+		return false
+	}
+	p.ClearCSRFCookie(rw, req)
+	params := url.Values{"done": {"1"}, "error": {errorString}}
+	http.Redirect(rw, req, p.SilentPath+"?"+params.Encode(), 302)
+	return true
 }
 
 func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 	remoteAddr := getRemoteAddr(req)
+	trace := newCallbackTrace(req)
+	defer trace.end()
 
 	// finish the oauth cycle
+	trace.begin("authorize")
 	err := req.ParseForm()
 	if err != nil {
-		p.ErrorPage(rw, 500, "Internal Error", err.Error())
+		trace.fail(err)
+		p.ErrorPage(rw, req, 500, "Internal Error", err.Error())
 		return
 	}
-	errorString := req.Form.Get("error")
-	if errorString != "" {
-		p.ErrorPage(rw, 403, "Permission Denied", errorString)
-		return
-	}
-
-	session, err := p.redeemCode(req.Host, req.Form.Get("token"))
-	if err != nil {
-		log.Printf("%s error redeeming code %s", remoteAddr, err)
-		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
+	if req.Form.Get("error") != "" {
+		providerErr := newProviderError(req.Form)
+		trace.fail(fmt.Errorf("provider returned error %q", providerErr.Code))
+		if p.silentReauthError(rw, req, providerErr.Code) {
+			return
+		}
+		p.ProviderErrorPage(rw, req, providerErr)
 		return
 	}
 
+	trace.begin("state")
 	s := strings.SplitN(req.Form.Get("state"), ":", 2)
 	if len(s) != 2 {
-		p.ErrorPage(rw, 500, "Internal Error", "Invalid State")
+		trace.fail(fmt.Errorf("invalid state %q", req.Form.Get("state")))
+		p.ErrorPage(rw, req, 500, "Internal Error", "Invalid State")
 		return
 	}
 	nonce := s[0]
 	redirect := s[1]
-	c, err := req.Cookie(p.CSRFCookieName)
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+		redirect = "/"
+	}
+
+	trace.begin("csrf")
+	p.ClearCSRFCookie(rw, req)
+	if err := p.checkCSRF(req, nonce); err != nil {
+		trace.fail(fmt.Errorf("potential attack: %s", err))
+		authOutcomesCounter.WithLabelValues("csrf_failed").Inc()
+		p.audit(req, "sign_in_denied", nil, "csrf: "+err.Error())
+		p.ErrorPage(rw, req, 403, "Permission Denied", err.Error())
+		return
+	}
+
+	trace.begin("redeem")
+	code := req.Form.Get("token")
+	if code == "" {
+		code = req.Form.Get("code")
+	}
+	provider, tag := p.callbackProvider(req.Form.Get("state"))
+	session, err := p.redeemCode(provider, req.Host, code)
 	if err != nil {
-		p.ErrorPage(rw, 403, "Permission Denied", err.Error())
+		trace.fail(fmt.Errorf("error redeeming code %s", err))
+		p.callbackError(rw, req, "redeem", redirect, err)
 		return
 	}
-	p.ClearCSRFCookie(rw, req)
-	if c.Value != nonce {
-		log.Printf("%s csrf token mismatch, potential attack", remoteAddr)
-		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
+
+	trace.begin("email")
+	if err := p.fetchIdentity(provider, session); err != nil {
+		trace.fail(fmt.Errorf("error getting the email address or groups %s", err))
+		p.callbackError(rw, req, "email", redirect, err)
 		return
 	}
 
-	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
-		redirect = "/"
+	trace.begin("validate")
+	if p.isPinnedElsewhere(session.Email, p.pinnedID(tag)) {
+		provider, _ := p.pinnedProvider(session.Email)
+		trace.fail(fmt.Errorf("Permission Denied: %q must sign in with provider %q", session.Email, provider))
+		p.audit(req, "sign_in_denied", session, "pinned to provider "+provider)
+		p.ErrorPage(rw, req, 403, "Permission Denied", "Invalid Account")
+		return
+	}
+	if p.blockList.IsBlocked(session) {
+		trace.fail(fmt.Errorf("Permission Denied: %q is blocked", session.Email))
+		p.audit(req, "sign_in_denied", session, "blocked")
+		p.ErrorPage(rw, req, 403, "Permission Denied", "Invalid Account")
+		return
+	}
+	if p.emailExpired(session.Email) {
+		trace.fail(fmt.Errorf("Permission Denied: the access of %q expired", session.Email))
+		p.audit(req, "sign_in_denied", session, "expired")
+		p.ErrorPage(rw, req, 403, "Permission Denied", "Invalid Account")
+		return
+	}
+	if !p.Validator(session.Email) || !provider.ValidateGroup(session.Email) {
+		trace.fail(fmt.Errorf("Permission Denied: %q is unauthorized", session.Email))
+		authOutcomesCounter.WithLabelValues("validator_rejected").Inc()
+		p.audit(req, "sign_in_denied", session, "unauthorized")
+		p.ErrorPage(rw, req, 403, "Permission Denied", "Invalid Account")
+		return
 	}
 
-	// set cookie, or deny
-	if p.Validator(session.Email) && p.provider.ValidateGroup(session.Email) {
-		log.Printf("%s authentication complete %s", remoteAddr, session)
-		err := p.SaveSession(rw, req, session)
-		if err != nil {
-			log.Printf("%s %s", remoteAddr, err)
-			p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
-			return
-		}
-		http.Redirect(rw, req, redirect, 302)
-	} else {
-		log.Printf("%s Permission Denied: %q is unauthorized", remoteAddr, session.Email)
-		p.ErrorPage(rw, 403, "Permission Denied", "Invalid Account")
+	// set cookie
+	trace.begin("save")
+	session.Provider = tag
+	session.Scopes = p.requestedScopes(req, redirect)
+	log.Printf("%s authentication complete %s", remoteAddr, session)
+	if err := p.SaveSession(rw, req, session); err != nil {
+		trace.fail(err)
+		p.ErrorPage(rw, req, 500, "Internal Error", "Internal Error")
+		return
 	}
+	authOutcomesCounter.WithLabelValues("sign_in").Inc()
+	p.audit(req, "sign_in", session, "")
+	http.Redirect(rw, req, redirect, 302)
 }
 
 func (p *OAuthProxy) AuthenticateOnly(rw http.ResponseWriter, req *http.Request) {
+	if p.PassOriginal {
+		authOriginalRequest(req).setHeaders(rw.Header())
+	}
+	var key authOnlyKey
+	cacheable := false
+	if p.authOnlyCache != nil {
+		key, cacheable = p.authOnlyCacheKey(req)
+		if cacheable && p.serveCachedAuthOnly(rw, key) {
+			return
+		}
+	}
 	status := p.Authenticate(rw, req)
 	if status == http.StatusAccepted {
+		if cacheable {
+			p.cacheAuthOnly(rw, key)
+		}
 		rw.WriteHeader(http.StatusAccepted)
 	} else {
 		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
@@ -723,65 +1956,202 @@ func (p *OAuthProxy) AuthenticateOnly(rw http.ResponseWriter, req *http.Request)
 }
 
 func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
-	status := p.Authenticate(rw, req)
+	status, session := p.authenticate(rw, req)
 	if status == http.StatusInternalServerError {
-		p.ErrorPage(rw, http.StatusInternalServerError,
+		p.ErrorPage(rw, req, http.StatusInternalServerError,
 			"Internal Error", "Internal Error")
+	} else if status == http.StatusUnauthorized {
+		p.ErrorPage(rw, req, http.StatusForbidden,
+			"Permission Denied", "Guest access is not permitted here")
 	} else if status == http.StatusForbidden {
-		if p.SkipProviderButton {
+		if p.SkipProviderButton && !p.Headless {
 			p.OAuthStart(rw, req)
-		} else {
+		} else if !p.filterBot(rw, req, false) {
 			p.SignInPage(rw, req, http.StatusForbidden)
 		}
+	} else if status == statusSessionTooOld {
+		p.reauthenticate(rw, req)
+	} else if ok, wait := p.allowProxy(req, session); !ok {
+		rw.Header().Set("Retry-After", fmt.Sprintf("%d", int(wait.Seconds())+1))
+		p.ErrorPage(rw, req, http.StatusTooManyRequests, "Too Many Requests", "Too many requests, try again later")
+	} else if missing := p.missingScopes(session, req.URL.Path); len(missing) > 0 {
+		p.requestScopes(rw, req, missing)
 	} else {
+		if p.PassOriginal {
+			proxiedOriginalRequest(req).setHeaders(req.Header)
+		}
+		if p.hooks.ModifyUpstreamRequest != nil {
+			p.hooks.ModifyUpstreamRequest(req, session)
+		}
+		if p.cacheControlRoute(req.URL.Path) {
+			rw = &cacheControlWriter{
+				ResponseWriter: rw,
+				policy:         p.cacheControl,
+				contentTypes:   p.cacheContentTypes,
+			}
+		}
+		if session != nil {
+			// sticky upstream pools pin users rather than sessions, which
+			// change when they are refreshed
+			key := session.Email
+			if key == "" {
+				key = session.User
+			}
+			req = req.WithContext(withAffinityKey(req.Context(), key))
+		}
 		p.serveMux.ServeHTTP(rw, req)
 	}
 }
 
 func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int {
+	status, _ := p.authenticate(rw, req)
+	return status
+}
+
+// authenticate runs the hooks around checkAuthentication
+func (p *OAuthProxy) authenticate(rw http.ResponseWriter, req *http.Request) (int, *providers.SessionState) {
+	status, session := p.checkAuthentication(rw, req)
+	if status == http.StatusAccepted && p.hooks.OnAuthSuccess != nil {
+		if err := p.hooks.OnAuthSuccess(rw, req, session); err != nil {
+			log.Printf("%s Permission Denied: %s", getRemoteAddr(req), err)
+			status = http.StatusUnauthorized
+		}
+	}
+	if status != http.StatusAccepted && p.hooks.OnAuthFailure != nil {
+		p.hooks.OnAuthFailure(rw, req, status)
+	}
+	return status, session
+}
+
+// checkAuthentication returns the status of the request, and its session
+// when it's accepted. Requests authenticated by a client certificate have
+// no session.
+func (p *OAuthProxy) checkAuthentication(rw http.ResponseWriter, req *http.Request) (int, *providers.SessionState) {
 	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
-		return http.StatusAccepted
+		return http.StatusAccepted, nil
 	}
 
 	var saveSession, clearSession, revalidated bool
 	remoteAddr := getRemoteAddr(req)
 
-	session, sessionAge, err := p.LoadCookiedSession(req)
+	session, sessionAge, migrated, err := p.loadCookiedSession(req)
+	if minted := p.testModeSession(req); minted != nil {
+		session, sessionAge, migrated, err = minted, 0, false, nil
+		saveSession = true
+	}
 	if err != nil {
 		log.Printf("%s %s", remoteAddr, err)
 	}
+	issued := time.Now().Add(-sessionAge)
+	if session != nil && migrated {
+		log.Printf("%s re-issuing session cookie written in the previous cookie format for %s", remoteAddr, session)
+		cookieMigrationCounter.Inc()
+		saveSession = true
+	}
+	if aliased := p.aliasCookies(req); len(aliased) > 0 {
+		if session != nil && len(p.sessionCookies(req)) == 0 {
+			log.Printf("%s re-issuing session cookie %q as %q for %s", remoteAddr, aliased[0].Name, p.CookieName, session)
+			saveSession = true
+		}
+		p.ClearAliasCookies(rw, req)
+	}
+	var loadedKey sessionKey
+	if session != nil && p.decisions != nil {
+		loadedKey = decisionSessionKey(session)
+	}
+	if n := len(p.sessionCookies(req)); n > 1 {
+		log.Printf("%s found %d %q cookies, expiring duplicates", remoteAddr, n, p.CookieName)
+		duplicateCookiesCounter.Inc()
+		p.ClearDuplicateSessionCookies(rw, req)
+		if session != nil {
+			// re-issue the valid session on the canonical domain
+			saveSession = true
+		}
+	}
 	if session != nil && sessionAge > p.CookieRefresh && p.CookieRefresh != time.Duration(0) {
 		log.Printf("%s refreshing %s old session cookie for %s (refresh after %s)", remoteAddr, sessionAge, session, p.CookieRefresh)
 		saveSession = true
 	}
 
-	if ok, err := p.provider.RefreshSessionIfNeeded(session); err != nil {
-		log.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
-		clearSession = true
-		session = nil
+	var trusted bool
+	ok, err := p.sessionProvider(session).RefreshSessionIfNeeded(session)
+	// a refresh token the provider refused isn't a provider failure, and is
+	// never trusted in degraded mode
+	unavailable := providers.Unavailable(err)
+	if ok || unavailable {
+		p.recordProviderCall(unavailable)
+	}
+	if err != nil {
+		p.streamSessionEvent(req, "refresh_failed", session, err.Error())
+		if unavailable && p.trustDegraded(remoteAddr, session, "refresh") {
+			trusted = true
+		} else {
+			log.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
+			clearSession = true
+			session = nil
+		}
 	} else if ok {
+		p.streamSessionEvent(req, "session_refreshed", session, "")
 		saveSession = true
 		revalidated = true
 	}
 
-	if session != nil && session.IsExpired() {
+	if session != nil && !revalidated && !trusted {
+		path := p.sessionAgePath(req)
+		if maxAge, ok := p.routeMaxSessionAge(path); ok && sessionAge > maxAge {
+			if refreshed := p.refreshStaleSession(session); refreshed != nil {
+				log.Printf("%s refreshed %s old session for %s, %q needs one younger than %s", remoteAddr, sessionAge, session, path, maxAge)
+				p.streamSessionEvent(req, "session_refreshed", refreshed, "max session age")
+				session = refreshed
+				saveSession = true
+				revalidated = true
+			} else {
+				// sign in again, keeping the session for other routes
+				log.Printf("%s %s old session for %s can't be refreshed, %q needs one younger than %s", remoteAddr, sessionAge, session, path, maxAge)
+				return statusSessionTooOld, nil
+			}
+		}
+	}
+
+	if session != nil && session.IsExpired() && !trusted && !p.trustDegraded(remoteAddr, session, "expiry") {
 		log.Printf("%s removing session. token expired %s", remoteAddr, session)
+		authOutcomesCounter.WithLabelValues("session_expired").Inc()
+		p.streamSessionEvent(req, "session_removed", session, "token expired")
 		session = nil
 		saveSession = false
 		clearSession = true
 	}
 
 	if saveSession && !revalidated && session != nil && session.AccessToken != "" {
-		if !p.provider.ValidateSessionState(session) {
+		valid, err := p.sessionProvider(session).ValidateSessionState(session)
+		p.recordProviderCall(err != nil)
+		if err != nil && p.trustDegraded(remoteAddr, session, "validate") {
+			// validate again on the next request rather than after the
+			// cookie refresh period
+			saveSession = false
+		} else if !valid {
 			log.Printf("%s removing session. error validating %s", remoteAddr, session)
+			p.streamSessionEvent(req, "session_removed", session, "invalid token")
 			saveSession = false
 			session = nil
 			clearSession = true
 		}
 	}
 
-	if session != nil && session.Email != "" && !p.Validator(session.Email) {
+	if (saveSession || clearSession) && p.decisions != nil {
+		// the session changed, so decisions made for it may be stale
+		p.decisions.Invalidate(loadedKey)
+	}
+
+	if session != nil && p.authorize(session, req.URL.Path) == accessDeniedUser {
 		log.Printf("%s Permission Denied: removing session %s", remoteAddr, session)
+		if p.blockList.IsBlocked(session) {
+			p.audit(req, "access_denied", session, "blocked")
+		} else if p.emailExpired(session.Email) {
+			p.audit(req, "access_denied", session, "expired")
+		} else {
+			authOutcomesCounter.WithLabelValues("validator_rejected").Inc()
+		}
 		session = nil
 		saveSession = false
 		clearSession = true
@@ -791,54 +2161,113 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		err := p.SaveSession(rw, req, session)
 		if err != nil {
 			log.Printf("%s %s", remoteAddr, err)
-			return http.StatusInternalServerError
+			return http.StatusInternalServerError, nil
 		}
+		issued = time.Now()
 	}
 
 	if clearSession {
 		p.ClearSessionCookie(rw, req)
 	}
 
+	fromCookie := session != nil
 	if session == nil {
 		session, err = p.CheckAuthHeader(req)
 		if err != nil {
 			log.Printf("%s %s", remoteAddr, err)
 		}
+		if p.blockList.IsBlocked(session) {
+			log.Printf("%s Permission Denied: %s is blocked", remoteAddr, session)
+			p.audit(req, "access_denied", session, "blocked")
+			session = nil
+		}
 	}
 
 	if session == nil {
-		return http.StatusForbidden
+		return http.StatusForbidden, nil
+	}
+
+	if p.authorize(session, req.URL.Path) == accessDeniedRoute {
+		log.Printf("%s Permission Denied: %s may not access %q", remoteAddr, session, req.URL.Path)
+		return http.StatusUnauthorized, nil
+	}
+
+	roles := p.roleMap.Roles(session.Groups)
+	if p.opa != nil {
+		allowed, err := p.opa.Allow(newOPAInput(req, session, roles))
+		if err != nil {
+			log.Printf("%s error querying OPA for %s: %s", remoteAddr, session, err)
+			return http.StatusInternalServerError, nil
+		}
+		if !allowed {
+			log.Printf("%s Permission Denied: OPA policy denies %s %s %q", remoteAddr, session, req.Method, req.URL.Path)
+			return http.StatusUnauthorized, nil
+		}
 	}
 
 	// At this point, the user is authenticated. proxy normally
+	// upstreams authorize on roles, so clients mustn't claim any, whether
+	// or not roles are mapped
+	req.Header.Del("X-Forwarded-Roles")
+	// upstreams authorize on groups, so clients mustn't claim any, whether
+	// or not the session has groups
+	req.Header.Del("X-Forwarded-Groups")
+	if p.experiments != nil {
+		bucket := p.experiments.Bucket(session)
+		req.Header["X-Experiment-Bucket"] = []string{bucket}
+		if p.SetXAuthRequest {
+			rw.Header().Set("X-Auth-Request-Experiment-Bucket", bucket)
+		}
+	}
 	if p.PassBasicAuth {
 		req.SetBasicAuth(session.User, p.BasicAuthPassword)
 		req.Header["X-Forwarded-User"] = []string{session.User}
 		if session.Email != "" {
 			req.Header["X-Forwarded-Email"] = []string{session.Email}
 		}
+		if len(session.Groups) > 0 {
+			req.Header["X-Forwarded-Groups"] = []string{strings.Join(session.Groups, ",")}
+		}
+		if len(roles) > 0 {
+			req.Header["X-Forwarded-Roles"] = []string{strings.Join(roles, ",")}
+		}
 	}
 	if p.PassUserHeaders {
 		req.Header["X-Forwarded-User"] = []string{session.User}
 		if session.Email != "" {
 			req.Header["X-Forwarded-Email"] = []string{session.Email}
 		}
+		if len(session.Groups) > 0 {
+			req.Header["X-Forwarded-Groups"] = []string{strings.Join(session.Groups, ",")}
+		}
+		if len(roles) > 0 {
+			req.Header["X-Forwarded-Roles"] = []string{strings.Join(roles, ",")}
+		}
 	}
 	if p.SetXAuthRequest {
 		rw.Header().Set("X-Auth-Request-User", session.User)
 		if session.Email != "" {
 			rw.Header().Set("X-Auth-Request-Email", session.Email)
 		}
+		if len(session.Groups) > 0 {
+			rw.Header().Set("X-Auth-Request-Groups", strings.Join(session.Groups, ","))
+		}
+		if len(roles) > 0 {
+			rw.Header().Set("X-Auth-Request-Roles", strings.Join(roles, ","))
+		}
 	}
 	if p.PassAccessToken && session.AccessToken != "" {
 		req.Header["X-Forwarded-Access-Token"] = []string{session.AccessToken}
 	}
+	if p.SessionExpiryHeaders && fromCookie {
+		p.setSessionExpiryHeaders(rw, session, issued)
+	}
 	if session.Email == "" {
 		rw.Header().Set("GAP-Auth", session.User)
 	} else {
 		rw.Header().Set("GAP-Auth", session.Email)
 	}
-	return http.StatusAccepted
+	return http.StatusAccepted, session
 }
 
 func (p *OAuthProxy) CheckAuthHeader(req *http.Request) (*providers.SessionState, error) {
@@ -883,6 +2312,7 @@ func (p *OAuthProxy) CheckBasicAuth(value string) (*providers.SessionState, erro
 func (p *OAuthProxy) CheckBearerAuth(value string) (*providers.SessionState, error) {
 	email, err := p.provider.GetEmailAddress(&providers.SessionState{AccessToken: value})
 	if err != nil {
+		authOutcomesCounter.WithLabelValues("bearer_rejected").Inc()
 		return nil, errors.New("invalid bearer token")
 	}
 	return &providers.SessionState{
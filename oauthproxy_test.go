@@ -1,19 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"github.com/18F/hmacauth"
 	"github.com/bitly/oauth2_proxy/providers"
 	"github.com/bmizerany/assert"
+	"github.com/uber/jaeger-client-go"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -37,7 +52,7 @@ func TestNewReverseProxy(t *testing.T) {
 	backendHost := net.JoinHostPort(backendHostname, backendPort)
 	proxyURL, _ := url.Parse(backendURL.Scheme + "://" + backendHost + "/")
 
-	proxyHandler := NewReverseProxy(proxyURL)
+	proxyHandler := NewReverseProxy(proxyURL, nil)
 	setProxyUpstreamHostHeader(proxyHandler, proxyURL)
 	frontend := httptest.NewServer(proxyHandler)
 	defer frontend.Close()
@@ -50,6 +65,287 @@ func TestNewReverseProxy(t *testing.T) {
 	}
 }
 
+func TestUpstreamDialAddressAndServerName(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(r.TLS.ServerName))
+	}))
+	defer backend.Close()
+
+	certpool := x509.NewCertPool()
+	certpool.AddCert(backend.Certificate())
+
+	opts := NewOptions()
+	// the test certificate is issued for example.com, not the upstream host
+	opts.Upstreams = []string{"https://backend.invalid/?dial_address=" +
+		backend.Listener.Addr().String() + "&tls_server_name=example.com"}
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	opts.tlsclientconfig = &tls.Config{RootCAs: certpool}
+
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RequestURI = "/"
+	proxy.serveMux.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "example.com", rw.Body.String())
+}
+
+// writeClientCertificate writes a self-signed client certificate and its key
+// to temporary files
+func writeClientCertificate(t *testing.T) (cert *x509.Certificate, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, nil, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "oauth2_proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Equal(t, nil, err)
+	cert, _ = x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Equal(t, nil, err)
+
+	write := func(blockType string, data []byte) string {
+		f, err := ioutil.TempFile("", "test_client_cert_")
+		assert.Equal(t, nil, err)
+		defer f.Close()
+		pem.Encode(f, &pem.Block{Type: blockType, Bytes: data})
+		return f.Name()
+	}
+	return cert, write("CERTIFICATE", der), write("EC PRIVATE KEY", keyDER)
+}
+
+func TestUpstreamClientCertificate(t *testing.T) {
+	cert, certFile, keyFile := writeClientCertificate(t)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	backend.StartTLS()
+	defer backend.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{backend.URL}
+	opts.TLSInsecureSkipVerify = true
+	opts.UpstreamTLSCertFile = certFile
+	opts.UpstreamTLSKeyFile = keyFile
+	assert.Equal(t, nil, opts.Validate())
+
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RequestURI = "/"
+	proxy.serveMux.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "oauth2_proxy", rw.Body.String())
+
+	opts = testOptions()
+	opts.UpstreamTLSCertFile = certFile
+	err := opts.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"upstream_tls_cert_file and upstream_tls_key_file must be set together",
+	}), err.Error())
+}
+
+func TestUpstreamConnSettings(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	opts := testOptions()
+	opts.Upstreams = []string{backend.URL}
+	opts.UpstreamMaxIdleConnsPerHost = 200
+	opts.UpstreamResponseHeaderTimeout = 50 * time.Millisecond
+	assert.Equal(t, nil, opts.Validate())
+
+	transport := newUpstreamTransport(nil, opts.upstreamConns, upstreamOverride{})
+	assert.Equal(t, 200, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 200, transport.MaxIdleConns)
+	assert.Equal(t, 90*time.Second, transport.IdleConnTimeout)
+	assert.Equal(t, 10*time.Second, transport.TLSHandshakeTimeout)
+
+	// an upstream that doesn't answer in time is a bad gateway
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RequestURI = "/"
+	proxy.serveMux.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+}
+
+func TestH2CUpstream(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("X-Proto", r.Proto)
+		w.Header().Set("X-Te", r.Header.Get("Te"))
+		w.Write([]byte("response"))
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{strings.Replace(backend.URL, "http://", "h2c://", 1) + "/grpc.Service/"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/grpc.Service/Method", strings.NewReader("request"))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	proxy.serveMux.ServeHTTP(rw, req)
+	resp := rw.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "response", string(body))
+	assert.Equal(t, "HTTP/2.0", resp.Header.Get("X-Proto"))
+	assert.Equal(t, "trailers", resp.Header.Get("X-Te"))
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestUpstreamHTTPVersion(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		w.Header().Set("X-Close", strconv.FormatBool(r.Close))
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	for query, expected := range map[string][]string{
+		"":                 {"HTTP/2.0", "false"},
+		"http_version=1.1": {"HTTP/1.1", "false"},
+		"alpn=http/1.1":    {"HTTP/1.1", "false"},
+		"alpn=none":        {"HTTP/1.1", "false"},
+		"http_version=2":   {"HTTP/2.0", "false"},
+		"keep_alive=false": {"HTTP/1.1", "true"},
+	} {
+		opts := testOptions()
+		opts.Upstreams = []string{backend.URL + "/?" + query}
+		opts.TLSInsecureSkipVerify = true
+		assert.Equal(t, nil, opts.Validate())
+		proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		proxy.serveMux.ServeHTTP(rw, req)
+		assert.Equal(t, 200, rw.Code)
+		assert.Equal(t, expected, []string{rw.HeaderMap.Get("X-Proto"), rw.HeaderMap.Get("X-Close")})
+	}
+
+	// an upstream pinned to HTTP/2 that only speaks HTTP/1.1 isn't reached
+	backend.Close()
+	backend = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	opts := testOptions()
+	opts.Upstreams = []string{backend.URL + "/?http_version=2"}
+	opts.TLSInsecureSkipVerify = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	rw := httptest.NewRecorder()
+	proxy.serveMux.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+}
+
+func TestStaticUpstream(t *testing.T) {
+	opts := testOptions()
+	opts.Upstreams = []string{
+		"http://127.0.0.1:8080/",
+		"static://200/healthz?body=OK&name=health",
+		"static://404/placeholder/",
+	}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	proxy.serveMux.ServeHTTP(rw, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "OK", rw.Body.String())
+	assert.Equal(t, "health", rw.HeaderMap.Get("GAP-Upstream-Address"))
+
+	rw = httptest.NewRecorder()
+	proxy.serveMux.ServeHTTP(rw, httptest.NewRequest("GET", "/placeholder/page", nil))
+	assert.Equal(t, 404, rw.Code)
+	assert.Equal(t, "", rw.Body.String())
+}
+
+func TestUpstreamTagLogging(t *testing.T) {
+	opts := testOptions()
+	opts.Upstreams = []string{
+		"static://200/billing/?name=billing",
+		"static://200/?name=other",
+	}
+	opts.UpstreamTags = []string{"billing=payments"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	var out bytes.Buffer
+	handler := TaggedLoggingHandler(&out, proxy.serveMux, true)
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/billing/invoices", nil))
+	assert.Equal(t, "", rw.HeaderMap.Get("GAP-Upstream-Tag"))
+	assert.Equal(t, true, strings.HasSuffix(out.String(), " payments\n"))
+
+	out.Reset()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, true, strings.HasSuffix(out.String(), " -\n"))
+}
+
+func TestJSONLogging(t *testing.T) {
+	opts := testOptions()
+	opts.Upstreams = []string{"static://200/billing/?name=billing"}
+	opts.UpstreamTags = []string{"billing=payments"}
+	opts.LoggingFormat = loggingFormatJSON
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	tracer, closer := jaeger.NewTracer("oauth2_proxy", jaeger.NewConstSampler(true), jaeger.NewNullReporter())
+	defer closer.Close()
+
+	var out bytes.Buffer
+	handler := newTraceHandler(tracer, newTraceSampler(opts), loggingHandler{
+		writer: &out, handler: proxy.serveMux, enabled: true, tagged: true, json: true})
+	req := httptest.NewRequest("GET", "/billing/invoices?page=2", nil)
+	req.RemoteAddr = "10.0.0.1:53214"
+	req.Header.Set("User-Agent", "test")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, true, strings.HasSuffix(out.String(), "}\n"))
+	var e logEntry
+	assert.Equal(t, nil, json.Unmarshal(out.Bytes(), &e))
+	assert.Equal(t, "10.0.0.1", e.Client)
+	assert.Equal(t, "GET", e.Method)
+	assert.Equal(t, "/billing/invoices?page=2", e.Path)
+	assert.Equal(t, "test", e.UserAgent)
+	assert.Equal(t, "billing", e.Upstream)
+	assert.Equal(t, "payments", e.Tag)
+	assert.Equal(t, 200, e.Status)
+	assert.NotEqual(t, "", e.TraceID)
+	_, err := time.Parse(time.RFC3339Nano, e.Time)
+	assert.Equal(t, nil, err)
+
+	opts = testOptions()
+	opts.LoggingFormat = "logfmt"
+	assert.Equal(t, errorMsg([]string{`invalid logging_format "logfmt", expected text or json`}), opts.Validate().Error())
+}
+
 func TestEncodedSlashes(t *testing.T) {
 	var seen string
 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -59,7 +355,7 @@ func TestEncodedSlashes(t *testing.T) {
 	defer backend.Close()
 
 	b, _ := url.Parse(backend.URL)
-	proxyHandler := NewReverseProxy(b)
+	proxyHandler := NewReverseProxy(b, nil)
 	setProxyDirector(proxyHandler)
 	frontend := httptest.NewServer(proxyHandler)
 	defer frontend.Close()
@@ -95,6 +391,7 @@ type TestProvider struct {
 	*providers.ProviderData
 	EmailAddress string
 	ValidToken   bool
+	ValidateErr  error
 }
 
 func NewTestProvider(provider_url *url.URL, email_address string) *TestProvider {
@@ -126,8 +423,8 @@ func (tp *TestProvider) GetEmailAddress(session *providers.SessionState) (string
 	return tp.EmailAddress, nil
 }
 
-func (tp *TestProvider) ValidateSessionState(session *providers.SessionState) bool {
-	return tp.ValidToken
+func (tp *TestProvider) ValidateSessionState(session *providers.SessionState) (bool, error) {
+	return tp.ValidToken, tp.ValidateErr
 }
 
 func TestBasicAuthPassword(t *testing.T) {
@@ -170,7 +467,7 @@ func TestBasicAuthPassword(t *testing.T) {
 	})
 
 	rw := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:",
+	req, _ := http.NewRequest("GET", "/oauth2/callback?token=callback_code&state=nonce:",
 		strings.NewReader(""))
 	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
 	proxy.ServeHTTP(rw, req)
@@ -210,6 +507,177 @@ func TestBasicAuthPassword(t *testing.T) {
 	provider_server.Close()
 }
 
+func TestOAuthCallbackRejectsDomainPinnedElsewhere(t *testing.T) {
+	provider_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer provider_server.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, provider_server.URL)
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecure = false
+	opts.ProviderDomains = []string{"gsa.gov=github"}
+	opts.Validate()
+
+	provider_url, _ := url.Parse(provider_server.URL)
+	opts.provider = NewTestProvider(provider_url, "michael.bland@gsa.gov")
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?token=callback_code&state=nonce:",
+		strings.NewReader(""))
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestOAuthCallbackAcceptsFormPost(t *testing.T) {
+	provider_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer provider_server.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, provider_server.URL)
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecure = false
+	opts.Validate()
+
+	provider_url, _ := url.Parse(provider_server.URL)
+	opts.provider = NewTestProvider(provider_url, "michael.bland@gsa.gov")
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/oauth2/callback",
+		strings.NewReader("code=callback_code&state=nonce:/app"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/app", rw.HeaderMap.Get("Location"))
+}
+
+func newSilentReauthTestProxy() *OAuthProxy {
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, "http://127.0.0.1:8080/")
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.SilentReauth = true
+	opts.Validate()
+	return NewOAuthProxy(opts, func(string) bool { return true })
+}
+
+func silentReauthRequest(proxy *OAuthProxy, target string, s *providers.SessionState) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", target, nil)
+	if s != nil {
+		value, _ := proxy.provider.CookieForSession(s, proxy.CookieCipher)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+	}
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestSilentReauthFreshSession(t *testing.T) {
+	proxy := newSilentReauthTestProxy()
+	rw := silentReauthRequest(proxy, "/oauth2/silent", &providers.SessionState{
+		Email: "michael.bland@gsa.gov", ExpiresOn: time.Now().Add(time.Hour)})
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, true, strings.Contains(rw.Body.String(), `status: "ok"`))
+}
+
+func TestSilentReauthRenewsWithPromptNone(t *testing.T) {
+	proxy := newSilentReauthTestProxy()
+	rw := silentReauthRequest(proxy, "/oauth2/silent", &providers.SessionState{
+		Email: "michael.bland@gsa.gov", ExpiresOn: time.Now().Add(time.Minute)})
+	assert.Equal(t, 302, rw.Code)
+
+	loginURL, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	params := loginURL.Query()
+	assert.Equal(t, "none", params.Get("prompt"))
+	assert.Equal(t, "", params.Get("approval_prompt"))
+	assert.Equal(t, true, strings.HasSuffix(params.Get("state"), ":/oauth2/silent?done=1"))
+}
+
+func TestSilentReauthProviderError(t *testing.T) {
+	proxy := newSilentReauthTestProxy()
+	rw := silentReauthRequest(proxy,
+		"/oauth2/callback?error=login_required&state=nonce:/oauth2/silent?done=1", nil)
+	assert.Equal(t, 302, rw.Code)
+	location := rw.HeaderMap.Get("Location")
+	assert.Equal(t, "/oauth2/silent?done=1&error=login_required", location)
+
+	rw = silentReauthRequest(proxy, location, nil)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, true, strings.Contains(rw.Body.String(), `status: "login_required"`))
+}
+
+func TestSilentReauthDisabled(t *testing.T) {
+	proxy := newSilentReauthTestProxy()
+	proxy.SilentReauth = false
+	rw := silentReauthRequest(proxy, "/oauth2/callback?error=login_required&state=nonce:/oauth2/silent?done=1", nil)
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestSignOutRedirectsToProviderLogout(t *testing.T) {
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, "http://127.0.0.1:8080/")
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.Provider = "cognito"
+	opts.CognitoDomain = "https://app.auth.us-east-1.amazoncognito.com"
+	opts.RedirectURL = "https://example.com/oauth2/callback"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_out", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "https://app.auth.us-east-1.amazoncognito.com/logout?"+
+		"client_id=bazquux&logout_uri=https%3A%2F%2Fexample.com%2F",
+		rw.HeaderMap.Get("Location"))
+}
+
+func TestSignOutExpiresAllCookies(t *testing.T) {
+	opts := testOptions()
+	opts.CookieDomain = ".example.com"
+	opts.CookieNamePrevious = []string{"_legacy_proxy"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_out", nil)
+	req.Host = "app.example.com"
+	req.AddCookie(&http.Cookie{Name: "_oauth2_proxy_0", Value: "chunk"})
+	req.AddCookie(&http.Cookie{Name: "_legacy_proxy_1", Value: "chunk"})
+	req.AddCookie(&http.Cookie{Name: "_oauth2_proxy_other", Value: "unrelated"})
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	expired := make(map[string][]string)
+	for _, c := range rw.Result().Cookies() {
+		assert.Equal(t, "", c.Value)
+		expired[c.Name] = append(expired[c.Name], c.Domain)
+	}
+	for _, name := range []string{"_oauth2_proxy", "_oauth2_proxy_0", "_legacy_proxy",
+		"_legacy_proxy_1", "_oauth2_proxy_csrf", "_legacy_proxy_csrf"} {
+		assert.Equal(t, []string{"example.com", "", "app.example.com"}, expired[name])
+	}
+	assert.Equal(t, 0, len(expired["_oauth2_proxy_other"]))
+}
+
 type PassAccessTokenTest struct {
 	provider_server *httptest.Server
 	proxy           *OAuthProxy
@@ -269,7 +737,7 @@ func (pat_test *PassAccessTokenTest) Close() {
 func (pat_test *PassAccessTokenTest) getCallbackEndpoint() (http_code int,
 	cookie string) {
 	rw := httptest.NewRecorder()
-	req, err := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:",
+	req, err := http.NewRequest("GET", "/oauth2/callback?token=callback_code&state=nonce:",
 		strings.NewReader(""))
 	if err != nil {
 		return 0, ""
@@ -408,6 +876,49 @@ func TestSignInPageIncludesTargetRedirect(t *testing.T) {
 	}
 }
 
+func TestOAuthStartPassesLoginHint(t *testing.T) {
+	sip_test := NewSignInPageTest()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?login_hint=user%40example.com", nil)
+	sip_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	location, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "user@example.com", location.Query().Get("login_hint"))
+}
+
+func TestOAuthStartRejectsLoginHintPinnedElsewhere(t *testing.T) {
+	sip_test := NewSignInPageTest()
+	sip_test.proxy.providerDomains = map[string]string{"example.com": "github"}
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?login_hint=user%40example.com", nil)
+	sip_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestPinnedProviderWildcardDomain(t *testing.T) {
+	sip_test := NewSignInPageTest()
+	sip_test.proxy.providerDomains = map[string]string{
+		"*.example.com":  "github",
+		"eu.example.com": "azure",
+	}
+	for email, expected := range map[string]string{
+		"user@us.example.com":  "github",
+		"user@a.b.example.com": "github",
+		"USER@EU.example.com":  "azure",
+		"user@example.com":     "",
+		"user@notexample.com":  "",
+	} {
+		provider, ok := sip_test.proxy.pinnedProvider(email)
+		assert.Equal(t, expected, provider)
+		assert.Equal(t, expected != "", ok)
+	}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?login_hint=user%40us.example.com", nil)
+	sip_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+}
+
 func TestSignInPageDirectAccessRedirectsToRoot(t *testing.T) {
 	sip_test := NewSignInPageTest()
 	code, body := sip_test.GetEndpoint("/oauth2/sign_in")
@@ -501,6 +1012,37 @@ func TestLoadCookiedSession(t *testing.T) {
 	assert.Equal(t, startSession.AccessToken, session.AccessToken)
 }
 
+func TestLoadCookiedSessionPrefersValidDuplicate(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+
+	pc_test.req.AddCookie(&http.Cookie{Name: pc_test.proxy.CookieName, Value: "garbage"})
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	session, _, err := pc_test.LoadCookiedSession()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, startSession.Email, session.Email)
+}
+
+func TestDuplicateSessionCookiesAreExpired(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.CookieDomain = ".example.com"
+	pc_test.req.Host = "app.example.com"
+
+	pc_test.req.AddCookie(&http.Cookie{Name: pc_test.proxy.CookieName, Value: "garbage"})
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	pc_test.proxy.Authenticate(pc_test.rw, pc_test.req)
+	cookies := pc_test.rw.HeaderMap["Set-Cookie"]
+	assert.Equal(t, 3, len(cookies))
+	assert.Equal(t, false, strings.Contains(cookies[0], "Domain="))
+	assert.Equal(t, true, strings.Contains(cookies[1], "Domain=app.example.com"))
+	// the valid session is re-issued on the configured domain
+	assert.Equal(t, true, strings.Contains(cookies[2], "Domain=example.com"))
+	assert.Equal(t, false, strings.HasPrefix(cookies[2], pc_test.proxy.CookieName+"=;"))
+}
+
 func TestProcessCookieNoCookieError(t *testing.T) {
 	pc_test := NewProcessCookieTestWithDefaults()
 
@@ -641,6 +1183,66 @@ func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
 	assert.Equal(t, "oauth_user@example.com", pc_test.rw.HeaderMap["X-Auth-Request-Email"][0])
 }
 
+func TestAuthOnlyEndpointSetXAuthRequestGroupsHeader(t *testing.T) {
+	var pc_test ProcessCookieTest
+
+	pc_test.opts = NewOptions()
+	pc_test.opts.SetXAuthRequest = true
+	pc_test.opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	pc_test.opts.PassAccessToken = true
+	pc_test.opts.Validate()
+
+	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool {
+		return pc_test.validate_user
+	})
+	pc_test.proxy.provider = &TestProvider{
+		ProviderData: &providers.ProviderData{},
+		ValidToken:   true,
+	}
+
+	pc_test.validate_user = true
+
+	pc_test.rw = httptest.NewRecorder()
+	pc_test.req, _ = http.NewRequest("GET",
+		pc_test.opts.ProxyPrefix+"/auth", nil)
+
+	startSession := &providers.SessionState{
+		Email: "oauth_user@example.com", AccessToken: "oauth_token",
+		Groups: []string{"admins", "devs"}}
+	pc_test.SaveSession(startSession, time.Now())
+
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	assert.Equal(t, http.StatusAccepted, pc_test.rw.Code)
+	assert.Equal(t, "admins,devs", pc_test.rw.HeaderMap["X-Auth-Request-Groups"][0])
+}
+
+func TestForwardedGroupsNotSpoofed(t *testing.T) {
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, "http://127.0.0.1:8080/")
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.PassAccessToken = true
+	opts.PassUserHeaders = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	authenticate := func(groups []string) *http.Request {
+		session := &providers.SessionState{Email: "user@example.com", User: "user", AccessToken: "token", Groups: groups}
+		value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+		assert.Equal(t, nil, err)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Forwarded-Groups", "admins")
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+		assert.Equal(t, http.StatusAccepted, proxy.Authenticate(httptest.NewRecorder(), req))
+		return req
+	}
+	assert.Equal(t, "devs", authenticate([]string{"devs"}).Header.Get("X-Forwarded-Groups"))
+	// a session without groups doesn't pass on the client's
+	assert.Equal(t, "", authenticate(nil).Header.Get("X-Forwarded-Groups"))
+}
+
 func TestAuthSkippedForPreflightRequests(t *testing.T) {
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
@@ -668,6 +1270,90 @@ func TestAuthSkippedForPreflightRequests(t *testing.T) {
 	assert.Equal(t, "response", rw.Body.String())
 }
 
+func TestAuthSkippedForTrustedIPs(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte("response"))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"example.com"}
+	opts.TrustedIPs = []string{"10.0.0.0/8", "fd00::1"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return false })
+
+	serve := func(remoteAddr, path string, header http.Header) int {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	assert.Equal(t, 200, serve("10.1.2.3:5000", "/", nil))
+	assert.Equal(t, 200, serve("[fd00::1]:5000", "/", nil))
+	assert.Equal(t, 403, serve("192.168.1.1:5000", "/", nil))
+	assert.Equal(t, 403, serve("[fd00::2]:5000", "/", nil))
+	// forwarded headers can't claim a trusted address
+	assert.Equal(t, 403, serve("192.168.1.1:5000", "/", http.Header{
+		"X-Real-Ip":       {"10.1.2.3"},
+		"X-Forwarded-For": {"10.1.2.3"},
+	}))
+	// the proxy's own endpoints aren't bypassed
+	assert.Equal(t, 401, serve("10.1.2.3:5000", "/oauth2/auth", nil))
+}
+
+func TestForwardedHeadersFromTrustedDownstreams(t *testing.T) {
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"example.com"}
+	opts.SkipAuthRegex = []string{"^/public"}
+	opts.TrustedDownstreams = []string{"10.0.0.1", "fd00::/8"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	serve := func(remoteAddr string) http.Header {
+		req := httptest.NewRequest("GET", "/public", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Real-IP", "1.2.3.4")
+		req.Header.Set("X-Forwarded-For", "1.2.3.4")
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, req.Header.Get("X-Real-IP") != "", strings.Contains(getRemoteAddr(req), "1.2.3.4"))
+		return upstreamHeader
+	}
+	header := serve("10.0.0.1:5000")
+	assert.Equal(t, "1.2.3.4", header.Get("X-Real-IP"))
+	assert.Equal(t, "1.2.3.4, 10.0.0.1", header.Get("X-Forwarded-For"))
+	header = serve("[fd00::5]:5000")
+	assert.Equal(t, "1.2.3.4", header.Get("X-Real-IP"))
+
+	// other clients' headers are dropped, and they are identified by their
+	// own address
+	header = serve("192.168.1.1:5000")
+	assert.Equal(t, "", header.Get("X-Real-IP"))
+	assert.Equal(t, "192.168.1.1", header.Get("X-Forwarded-For"))
+
+	o := testOptions()
+	o.TrustedDownstreams = []string{"10.0.0.0/40"}
+	assert.Equal(t, errorMsg([]string{`invalid trusted_downstream_cidr "10.0.0.0/40", expected an address or a CIDR`}), o.Validate().Error())
+}
+
 type SignatureAuthenticator struct {
 	auth hmacauth.HmacAuth
 }
@@ -772,8 +1458,10 @@ func (st *SignatureTest) MakeRequestWithExpectedKey(method, body, key string) {
 	cookie := proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now())
 	req.AddCookie(cookie)
 	// This is used by the upstream to validate the signature.
-	st.authenticator.auth = hmacauth.NewHmacAuth(
-		crypto.SHA1, []byte(key), SignatureHeader, SignatureHeaders)
+	if st.authenticator.auth == nil {
+		st.authenticator.auth = hmacauth.NewHmacAuth(
+			crypto.SHA1, []byte(key), SignatureHeader, SignatureHeaders)
+	}
 	proxy.ServeHTTP(st.rw, req)
 }
 
@@ -794,6 +1482,19 @@ func TestRequestSignatureGetRequest(t *testing.T) {
 	assert.Equal(t, st.rw.Body.String(), "signatures match")
 }
 
+func TestRequestSignatureUpstreamHeaders(t *testing.T) {
+	st := NewSignatureTest()
+	defer st.Close()
+	st.opts.SignatureKey = "sha1:foobar"
+	st.opts.Upstreams[0] += "/?signature_header=X-Hub-Signature&signature_headers=date,X-Forwarded-Email"
+	st.authenticator.auth = hmacauth.NewHmacAuth(crypto.SHA1, []byte("foobar"),
+		"X-Hub-Signature", []string{"Date", "X-Forwarded-Email"})
+	st.MakeRequestWithExpectedKey("GET", "", "foobar")
+	assert.Equal(t, 200, st.rw.Code)
+	assert.Equal(t, st.rw.Body.String(), "signatures match")
+	assert.Equal(t, "", st.opts.proxyURLs[0].RawQuery)
+}
+
 func TestRequestSignaturePostRequest(t *testing.T) {
 	st := NewSignatureTest()
 	defer st.Close()
@@ -803,3 +1504,84 @@ func TestRequestSignaturePostRequest(t *testing.T) {
 	assert.Equal(t, 200, st.rw.Code)
 	assert.Equal(t, st.rw.Body.String(), "signatures match")
 }
+
+func TestHeadless(t *testing.T) {
+	opts := testOptions()
+	opts.Headless = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	// browsers are sent to the provider
+	req, _ := http.NewRequest("GET", "/app/page?x=1", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/oauth2/start?rd=%2Fapp%2Fpage%3Fx%3D1", rw.HeaderMap.Get("Location"))
+
+	// other clients are told to authenticate
+	req, _ = http.NewRequest("GET", "/api/items", nil)
+	req.Header.Set("Accept", "*/*")
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 401, rw.Code)
+	assert.Equal(t, "application/json", rw.HeaderMap.Get("Content-Type"))
+	assert.Equal(t, `{"code":401,"sign_in_url":"/oauth2/start?rd=%2Fapi%2Fitems"}`,
+		strings.TrimSpace(rw.Body.String()))
+
+	// and errors are never HTML
+	req, _ = http.NewRequest("GET", "/oauth2/start?provider=unknown", nil)
+	req.Header.Set("Accept", "text/html")
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 400, rw.Code)
+	assert.Equal(t, "application/json", rw.HeaderMap.Get("Content-Type"))
+}
+
+func TestRequestLoggingFormat(t *testing.T) {
+	opts := testOptions()
+	opts.Upstreams = []string{"static://200/?name=app"}
+	opts.RequestLoggingFormat = `{{.Client}} {{.Host}} {{.RequestMethod}} {{.RequestURI}} {{.Upstream}} {{.StatusCode}} {{.Username}} "{{.UserAgent}}"`
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	var out bytes.Buffer
+	handler := loggingHandler{writer: &out, handler: proxy.serveMux, enabled: true, template: opts.logTemplate}
+	req := httptest.NewRequest("GET", "/page?q=1", nil)
+	req.RemoteAddr = "10.0.0.1:53214"
+	req.Header.Set("User-Agent", "test")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "10.0.0.1 example.com GET /page?q=1 app 200 - \"test\"\n", out.String())
+
+	opts = testOptions()
+	opts.RequestLoggingFormat = "{{.Client} {{.Method}}"
+	err := opts.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.Contains(err.Error(), "invalid request_logging_format"))
+	opts.RequestLoggingFormat = "{{.Method}}"
+	assert.Equal(t, true, strings.Contains(opts.Validate().Error(), "can't evaluate field Method"))
+	opts.RequestLoggingFormat = "{{.Client}}"
+	opts.LoggingFormat = loggingFormatJSON
+	assert.Equal(t, errorMsg([]string{"request_logging_format is only used with logging_format=text"}), opts.Validate().Error())
+}
+
+func TestExcludeLoggingPaths(t *testing.T) {
+	opts := testOptions()
+	opts.Upstreams = []string{"static://200/"}
+	opts.ExcludeLoggingPaths = []string{"/ping,/robots.txt", "/oauth2/metrics"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	var out bytes.Buffer
+	handler := loggingHandler{writer: &out, handler: proxy.serveMux, enabled: true, excluded: opts.excludeLogging}
+	for _, path := range []string{"/ping", "/oauth2/metrics", "/robots.txt?x=1"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	assert.Equal(t, "", out.String())
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ping/other", nil))
+	assert.Equal(t, true, strings.Contains(out.String(), "\"/ping/other\""))
+
+	opts = testOptions()
+	opts.ExcludeLoggingPaths = []string{"/ping,ping"}
+	assert.Equal(t, errorMsg([]string{`invalid exclude-logging-path="ping", expected a path starting with /`}), opts.Validate().Error())
+}
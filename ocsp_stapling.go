@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspRetryInterval is how long a failed OCSP request waits to be retried
+	ocspRetryInterval = time.Duration(5) * time.Minute
+	// ocspRefreshInterval is how often responses without a next update are
+	// refreshed
+	ocspRefreshInterval = time.Duration(12) * time.Hour
+	ocspTimeout         = time.Duration(10) * time.Second
+)
+
+// ocspStapler serves certificates with OCSP responses from the responders
+// their issuers name stapled, so clients don't have to ask the responders
+// themselves. Responses are refreshed halfway through their validity.
+type ocspStapler struct {
+	client *http.Client
+
+	sync.RWMutex
+	certs []*tls.Certificate
+}
+
+func newOCSPStapler(certs []tls.Certificate) *ocspStapler {
+	s := &ocspStapler{
+		client: &http.Client{Timeout: ocspTimeout},
+		certs:  make([]*tls.Certificate, len(certs)),
+	}
+	for i := range certs {
+		cert := certs[i]
+		if cert.Leaf == nil && len(cert.Certificate) > 0 {
+			cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		}
+		s.certs[i] = &cert
+	}
+	return s
+}
+
+// Run staples a response to each certificate that names an OCSP responder
+// and includes its issuer before returning, and keeps the responses fresh
+func (s *ocspStapler) Run() {
+	for i, cert := range s.certs {
+		if cert.Leaf == nil || len(cert.Leaf.OCSPServer) == 0 || len(cert.Certificate) < 2 {
+			log.Printf("HTTPS: not stapling OCSP responses to certificate %d, it doesn't name a responder or include its issuer", i)
+			continue
+		}
+		next := s.refresh(i, time.Now())
+		go func(i int, next time.Duration) {
+			for {
+				time.Sleep(next)
+				next = s.refresh(i, time.Now())
+			}
+		}(i, next)
+	}
+}
+
+// GetCertificate returns the first certificate the client supports, like
+// crypto/tls picks from tls.Config.Certificates
+func (s *ocspStapler) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.RLock()
+	defer s.RUnlock()
+	for _, cert := range s.certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return s.certs[0], nil
+}
+
+// refresh staples a new response to certificate i, and returns how long it
+// stays fresh. A stale response is removed when a new one can't be fetched.
+func (s *ocspStapler) refresh(i int, now time.Time) time.Duration {
+	s.RLock()
+	cert := *s.certs[i]
+	s.RUnlock()
+
+	staple, resp, err := s.fetch(&cert)
+	if err != nil {
+		log.Printf("ERROR: fetching the OCSP response for %s - %s", cert.Leaf.Subject.CommonName, err)
+		if len(cert.OCSPStaple) != 0 {
+			if old, err := ocsp.ParseResponse(cert.OCSPStaple, nil); err != nil || old.NextUpdate.Before(now) {
+				cert.OCSPStaple = nil
+				s.set(i, &cert)
+			}
+		}
+		return ocspRetryInterval
+	}
+
+	cert.OCSPStaple = staple
+	s.set(i, &cert)
+	if resp.NextUpdate.IsZero() {
+		return ocspRefreshInterval
+	}
+	refresh := resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2).Sub(now)
+	if refresh < time.Minute {
+		refresh = time.Minute
+	}
+	return refresh
+}
+
+func (s *ocspStapler) set(i int, cert *tls.Certificate) {
+	s.Lock()
+	s.certs[i] = cert
+	s.Unlock()
+}
+
+// fetch asks the responder of cert for its status, which has to be good, and
+// returns the raw response with its parsed form
+func (s *ocspStapler) fetch(cert *tls.Certificate) ([]byte, *ocsp.Response, error) {
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := ocsp.CreateRequest(cert.Leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	httpResp, err := s.client.Post(cert.Leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("got %d from %s", httpResp.StatusCode, cert.Leaf.OCSPServer[0])
+	}
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocsp.ParseResponseForCert(body, cert.Leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return body, resp, nil
+	case ocsp.Revoked:
+		return nil, nil, errors.New("the certificate is revoked")
+	default:
+		return nil, nil, errors.New("the responder doesn't know the certificate")
+	}
+}
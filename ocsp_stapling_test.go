@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPStapler(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.Equal(t, nil, err)
+	ca, _ := x509.ParseCertificate(caDER)
+
+	status := ocsp.Good
+	thisUpdate := time.Now().Truncate(time.Minute)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		assert.Equal(t, nil, err)
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   thisUpdate,
+			NextUpdate:   thisUpdate.Add(4 * time.Hour),
+			RevokedAt:    thisUpdate,
+		}, caKey)
+		assert.Equal(t, nil, err)
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "auth.example.com"},
+		DNSNames:     []string{"auth.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{responder.URL},
+	}, ca, &key.PublicKey, caKey)
+	assert.Equal(t, nil, err)
+
+	s := newOCSPStapler([]tls.Certificate{{
+		Certificate: [][]byte{leafDER, caDER},
+		PrivateKey:  key,
+	}})
+	s.Run()
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "auth.example.com"})
+	assert.Equal(t, nil, err)
+	resp, err := ocsp.ParseResponseForCert(cert.OCSPStaple, cert.Leaf, ca)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ocsp.Good, resp.Status)
+
+	// responses are refreshed halfway through their validity
+	assert.Equal(t, 2*time.Hour, s.refresh(0, thisUpdate))
+
+	// a stale response is removed once the certificate is revoked
+	status = ocsp.Revoked
+	assert.Equal(t, ocspRetryInterval, s.refresh(0, thisUpdate.Add(time.Hour)))
+	cert, _ = s.GetCertificate(&tls.ClientHelloInfo{ServerName: "auth.example.com"})
+	assert.NotEqual(t, 0, len(cert.OCSPStaple))
+	s.refresh(0, thisUpdate.Add(5*time.Hour))
+	cert, _ = s.GetCertificate(&tls.ClientHelloInfo{ServerName: "auth.example.com"})
+	assert.Equal(t, 0, len(cert.OCSPStaple))
+}
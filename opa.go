@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// opaHiddenHeaders hold credentials, and aren't sent to the policy
+var opaHiddenHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"X-Forwarded-Access-Token",
+}
+
+var opaDecisionsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "opa_decisions_total",
+	Help: "Open Policy Agent authorization decisions by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(opaDecisionsCounter)
+}
+
+// opaInput is the document a policy is evaluated against
+type opaInput struct {
+	Email   string      `json:"email"`
+	User    string      `json:"user"`
+	Groups  []string    `json:"groups"`
+	Roles   []string    `json:"roles"`
+	Path    string      `json:"path"`
+	Method  string      `json:"method"`
+	Headers http.Header `json:"headers"`
+}
+
+// opaAuthorizer asks an Open Policy Agent server whether an authenticated
+// request is allowed, through its data API. The policy decision is either a
+// boolean, or an object with a boolean "allow" field.
+type opaAuthorizer struct {
+	url    string
+	client *http.Client
+}
+
+func newOPAAuthorizer(url string, timeout time.Duration) *opaAuthorizer {
+	return &opaAuthorizer{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func newOPAInput(req *http.Request, s *providers.SessionState, roles []string) opaInput {
+	headers := make(http.Header, len(req.Header))
+	for name, values := range req.Header {
+		headers[name] = values
+	}
+	for _, name := range opaHiddenHeaders {
+		headers.Del(name)
+	}
+	groups := s.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	if roles == nil {
+		roles = []string{}
+	}
+	return opaInput{
+		Email:   s.Email,
+		User:    s.User,
+		Groups:  groups,
+		Roles:   roles,
+		Path:    req.URL.Path,
+		Method:  req.Method,
+		Headers: headers,
+	}
+}
+
+// Allow evaluates the policy for input. An undefined decision denies the
+// request, and any error should too.
+func (a *opaAuthorizer) Allow(input opaInput) (bool, error) {
+	allowed, err := a.query(input)
+	switch {
+	case err != nil:
+		opaDecisionsCounter.WithLabelValues("error").Inc()
+	case allowed:
+		opaDecisionsCounter.WithLabelValues("allow").Inc()
+	default:
+		opaDecisionsCounter.WithLabelValues("deny").Inc()
+	}
+	return allowed, err
+}
+
+func (a *opaAuthorizer) query(input opaInput) (bool, error) {
+	body, err := json.Marshal(struct {
+		Input opaInput `json:"input"`
+	}{input})
+	if err != nil {
+		return false, err
+	}
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("got %d from %q", resp.StatusCode, a.url)
+	}
+	var decision struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return false, fmt.Errorf("decoding policy decision from %q: %s", a.url, err)
+	}
+	if len(decision.Result) == 0 {
+		return false, nil
+	}
+	var allowed bool
+	if err := json.Unmarshal(decision.Result, &allowed); err == nil {
+		return allowed, nil
+	}
+	var result struct {
+		Allow bool `json:"allow"`
+	}
+	if err := json.Unmarshal(decision.Result, &result); err != nil {
+		return false, fmt.Errorf("policy decision from %q is neither a boolean nor an object: %s", a.url, decision.Result)
+	}
+	return result.Allow, nil
+}
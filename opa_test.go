@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestOPAOptions(t *testing.T) {
+	o := testOptions()
+	o.OPAURL = "127.0.0.1:8181/v1/data/oauth2_proxy/allow"
+	o.OPATimeout = 0
+	o.AuthOnlyCacheTTL = time.Second
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		`opa_url "127.0.0.1:8181/v1/data/oauth2_proxy/allow" must be an http or https url`,
+		"opa_timeout must be positive",
+		"auth_only_cache_ttl can't be used with opa_url",
+	}), err.Error())
+}
+
+func TestOPAAuthorization(t *testing.T) {
+	var input opaInput
+	result := `true`
+	opa := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input opaInput `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		input = body.Input
+		if result == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"result":` + result + `}`))
+	}))
+	defer opa.Close()
+
+	opts := testOptions()
+	opts.OPAURL = opa.URL + "/v1/data/oauth2_proxy/allow"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	session := &providers.SessionState{Email: "user@example.com", User: "user"}
+	value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+	assert.Equal(t, nil, err)
+	authenticate := func() int {
+		req := httptest.NewRequest("POST", "/api/items", nil)
+		req.Header.Set("X-Original-URI", "/api/items?page=2")
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+		return proxy.Authenticate(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, http.StatusAccepted, authenticate())
+	assert.Equal(t, "user@example.com", input.Email)
+	assert.Equal(t, "user", input.User)
+	assert.Equal(t, []string{}, input.Groups)
+	assert.Equal(t, []string{}, input.Roles)
+	assert.Equal(t, "/api/items", input.Path)
+	assert.Equal(t, "POST", input.Method)
+	assert.Equal(t, "/api/items?page=2", input.Headers.Get("X-Original-URI"))
+	assert.Equal(t, "", input.Headers.Get("Cookie"))
+
+	result = `{"allow":true}`
+	assert.Equal(t, http.StatusAccepted, authenticate())
+	result = `false`
+	assert.Equal(t, http.StatusUnauthorized, authenticate())
+	// an undefined decision denies the request
+	result = `null`
+	assert.Equal(t, http.StatusUnauthorized, authenticate())
+	result = ""
+	assert.Equal(t, http.StatusInternalServerError, authenticate())
+}
@@ -7,14 +7,21 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/18F/hmacauth"
+	"github.com/bitly/oauth2_proxy/api"
+	"github.com/bitly/oauth2_proxy/cookie"
 	"github.com/bitly/oauth2_proxy/providers"
 )
 
@@ -23,6 +30,9 @@ type Options struct {
 	ProxyPrefix     string   `flag:"proxy-prefix" cfg:"proxy-prefix"`
 	HttpAddress     string   `flag:"http-address" cfg:"http_address"`
 	HttpsAddress    string   `flag:"https-address" cfg:"https_address"`
+	AdminAddress    string   `flag:"admin-address" cfg:"admin_address"`
+	AdminToken      string   `flag:"admin-token" cfg:"admin_token" env:"OAUTH2_PROXY_ADMIN_TOKEN"`
+	MetricsAddress  string   `flag:"metrics-address" cfg:"metrics_address"`
 	RedirectURL     string   `flag:"redirect-url" cfg:"redirect_url"`
 	ClientID        string   `flag:"client-id" cfg:"client_id" env:"OAUTH2_PROXY_CLIENT_ID"`
 	ClientSecret    string   `flag:"client-secret" cfg:"client_secret" env:"OAUTH2_PROXY_CLIENT_SECRET"`
@@ -30,11 +40,61 @@ type Options struct {
 	TLSKeyFile      []string `flag:"tls-key" cfg:"tls_key_file"`
 	TLSClientCAFile string   `flag:"tls-client-ca" cfg:"tls_client_ca_file"`
 
+	// The HTTPS certificate can be obtained and renewed from Let's Encrypt,
+	// for the listed domains only.
+	TLSACME         bool     `flag:"tls-acme" cfg:"tls_acme"`
+	TLSACMEDomains  []string `flag:"tls-acme-domain" cfg:"tls_acme_domains"`
+	TLSACMECacheDir string   `flag:"tls-acme-cache-dir" cfg:"tls_acme_cache_dir"`
+
+	// HTTPS clients negotiating h2 through ALPN are served HTTP/2, with at
+	// most this many concurrent streams per connection.
+	HTTP2MaxConcurrentStreams int `flag:"http2-max-concurrent-streams" cfg:"http2_max_concurrent_streams"`
+
+	// HTTPS clients resume sessions with tickets encrypted by keys rotated
+	// every TLSSessionTicketRotation. Replicas sharing a ticket secret derive
+	// the same keys and resume each other's sessions.
+	TLSSessionTickets        bool          `flag:"tls-session-tickets" cfg:"tls_session_tickets"`
+	TLSSessionTicketSecret   string        `flag:"tls-session-ticket-secret" cfg:"tls_session_ticket_secret" env:"OAUTH2_PROXY_TLS_SESSION_TICKET_SECRET"`
+	TLSSessionTicketRotation time.Duration `flag:"tls-session-ticket-rotation" cfg:"tls_session_ticket_rotation"`
+	TLSOCSPStapling          bool          `flag:"tls-ocsp-stapling" cfg:"tls_ocsp_stapling"`
+
+	// Restarts don't drop connections: with ReusePort a new process binds
+	// the listening address while the old one still serves on it, and
+	// SIGTERM waits up to ShutdownTimeout for the requests in flight.
+	ReusePort       bool          `flag:"reuse-port" cfg:"reuse_port"`
+	ShutdownTimeout time.Duration `flag:"shutdown-timeout" cfg:"shutdown_timeout"`
+
+	LivenessPath  string `flag:"liveness-path" cfg:"liveness_path"`
+	ReadinessPath string `flag:"readiness-path" cfg:"readiness_path"`
+	HealthVerbose bool   `flag:"health-verbose" cfg:"health_verbose"`
+
 	AuthenticatedEmailsFile  string   `flag:"authenticated-emails-file" cfg:"authenticated_emails_file"`
+	RoleMappingFile          string   `flag:"role-mapping-file" cfg:"role_mapping_file"`
+	BlockedEmails            []string `flag:"blocked-email" cfg:"blocked_emails"`
+	BlockedEmailsFile        string   `flag:"blocked-emails-file" cfg:"blocked_emails_file"`
+	AppleTeamID              string   `flag:"apple-team-id" cfg:"apple_team_id"`
+	AppleKeyID               string   `flag:"apple-key-id" cfg:"apple_key_id"`
+	ApplePrivateKeyFile      string   `flag:"apple-private-key-file" cfg:"apple_private_key_file"`
 	AzureTenant              string   `flag:"azure-tenant" cfg:"azure_tenant"`
+	AzureGroups              []string `flag:"azure-group" cfg:"azure_groups"`
+	BitbucketTeam            string   `flag:"bitbucket-team" cfg:"bitbucket_team"`
+	BitbucketRepository      string   `flag:"bitbucket-repository" cfg:"bitbucket_repository"`
+	CognitoDomain            string   `flag:"cognito-domain" cfg:"cognito_domain"`
 	EmailDomains             []string `flag:"email-domain" cfg:"email_domains"`
-	GitHubOrg                string   `flag:"github-org" cfg:"github_org"`
-	GitHubTeam               string   `flag:"github-team" cfg:"github_team"`
+	GitHubOrgs               []string `flag:"github-org" cfg:"github_org"`
+	GitHubTeams              []string `flag:"github-team" cfg:"github_team"`
+	GitHubUsers              []string `flag:"github-user" cfg:"github_user"`
+	GitHubEnterpriseURL      string   `flag:"github-enterprise-url" cfg:"github_enterprise_url"`
+	GitHubRepo               string   `flag:"github-repo" cfg:"github_repo"`
+	GitHubToken              string   `flag:"github-token" cfg:"github_token" env:"OAUTH2_PROXY_GITHUB_TOKEN"`
+	GiteaURL                 string   `flag:"gitea-url" cfg:"gitea_url"`
+	GiteaOrg                 string   `flag:"gitea-org" cfg:"gitea_org"`
+	GiteaTeam                string   `flag:"gitea-team" cfg:"gitea_team"`
+	GitLabURL                string   `flag:"gitlab-url" cfg:"gitlab_url"`
+	GitLabGroups             []string `flag:"gitlab-group" cfg:"gitlab_groups"`
+	GitLabProjects           []string `flag:"gitlab-project" cfg:"gitlab_projects"`
+	KeycloakGroups           []string `flag:"keycloak-group" cfg:"keycloak_groups"`
+	KeycloakRealmRoles       []string `flag:"keycloak-realm-role" cfg:"keycloak_realm_roles"`
 	GoogleGroups             []string `flag:"google-group" cfg:"google_group"`
 	GoogleAdminEmail         string   `flag:"google-admin-email" cfg:"google_admin_email"`
 	GoogleServiceAccountJSON string   `flag:"google-service-account-json" cfg:"google_service_account_json"`
@@ -43,49 +103,255 @@ type Options struct {
 	CustomTemplatesDir       string   `flag:"custom-templates-dir" cfg:"custom_templates_dir"`
 	Footer                   string   `flag:"footer" cfg:"footer"`
 
-	CookieName     string        `flag:"cookie-name" cfg:"cookie_name" env:"OAUTH2_PROXY_COOKIE_NAME"`
-	CookieSecret   string        `flag:"cookie-secret" cfg:"cookie_secret" env:"OAUTH2_PROXY_COOKIE_SECRET"`
-	CookieDomain   string        `flag:"cookie-domain" cfg:"cookie_domain" env:"OAUTH2_PROXY_COOKIE_DOMAIN"`
-	CookieExpire   time.Duration `flag:"cookie-expire" cfg:"cookie_expire" env:"OAUTH2_PROXY_COOKIE_EXPIRE"`
-	CookieRefresh  time.Duration `flag:"cookie-refresh" cfg:"cookie_refresh" env:"OAUTH2_PROXY_COOKIE_REFRESH"`
-	CookieSecure   bool          `flag:"cookie-secure" cfg:"cookie_secure"`
-	CookieHttpOnly bool          `flag:"cookie-httponly" cfg:"cookie_httponly"`
-
-	Upstreams             []string `flag:"upstream" cfg:"upstreams"`
-	SkipAuthRegex         []string `flag:"skip-auth-regex" cfg:"skip_auth_regex"`
-	PassBasicAuth         bool     `flag:"pass-basic-auth" cfg:"pass_basic_auth"`
-	BasicAuthPassword     string   `flag:"basic-auth-password" cfg:"basic_auth_password"`
-	PassAccessToken       bool     `flag:"pass-access-token" cfg:"pass_access_token"`
-	PassHostHeader        bool     `flag:"pass-host-header" cfg:"pass_host_header"`
-	SkipProviderButton    bool     `flag:"skip-provider-button" cfg:"skip_provider_button"`
-	PassUserHeaders       bool     `flag:"pass-user-headers" cfg:"pass_user_headers"`
-	TLSCAFile             string   `flag:"tls-ca" cfg:"tls_ca_file"`
-	TLSInsecureSkipVerify bool     `flag:"tls-insecure-skip-verify" cfg:"tls_insecure_skip_verify"`
-	SetXAuthRequest       bool     `flag:"set-xauthrequest" cfg:"set_xauthrequest"`
-	SkipAuthPreflight     bool     `flag:"skip-auth-preflight" cfg:"skip_auth_preflight"`
+	GoogleGroupCacheTTL         time.Duration `flag:"google-group-cache-ttl" cfg:"google_group_cache_ttl"`
+	GoogleGroupNegativeCacheTTL time.Duration `flag:"google-group-negative-cache-ttl" cfg:"google_group_negative_cache_ttl"`
+
+	GuestAdmins        []string      `flag:"guest-admin" cfg:"guest_admins"`
+	GuestRoutes        []string      `flag:"guest-route" cfg:"guest_routes"`
+	GuestCodeExpire    time.Duration `flag:"guest-code-expire" cfg:"guest_code_expire"`
+	GuestSessionExpire time.Duration `flag:"guest-session-expire" cfg:"guest_session_expire"`
+
+	CookieName           string        `flag:"cookie-name" cfg:"cookie_name" env:"OAUTH2_PROXY_COOKIE_NAME"`
+	CookieNamePrevious   []string      `flag:"cookie-name-previous" cfg:"cookie_name_previous"`
+	CookieNameAliases    []string      `flag:"cookie-name-alias" cfg:"cookie_name_aliases"`
+	CookieSecret         string        `flag:"cookie-secret" cfg:"cookie_secret" env:"OAUTH2_PROXY_COOKIE_SECRET"`
+	CookieSecretPrevious string        `flag:"cookie-secret-previous" cfg:"cookie_secret_previous" env:"OAUTH2_PROXY_COOKIE_SECRET_PREVIOUS"`
+	CookieDomain         string        `flag:"cookie-domain" cfg:"cookie_domain" env:"OAUTH2_PROXY_COOKIE_DOMAIN"`
+	CookieExpire         time.Duration `flag:"cookie-expire" cfg:"cookie_expire" env:"OAUTH2_PROXY_COOKIE_EXPIRE"`
+	CookieRefresh        time.Duration `flag:"cookie-refresh" cfg:"cookie_refresh" env:"OAUTH2_PROXY_COOKIE_REFRESH"`
+	CookieSecure         bool          `flag:"cookie-secure" cfg:"cookie_secure"`
+	CookieHttpOnly       bool          `flag:"cookie-httponly" cfg:"cookie_httponly"`
+	CSRFStateFallback    bool          `flag:"csrf-state-fallback" cfg:"csrf_state_fallback"`
+
+	// With CookieMigration, session cookies in the previous format are still
+	// accepted, and re-issued in the current one. They were signed with
+	// CookieSecretPrevious, or CookieSecret when unset, had their tokens
+	// encrypted with it when CookiePreviousCipher is set, and were
+	// serialized as CookiePreviousSerialization.
+	CookieMigration             bool   `flag:"cookie-migration" cfg:"cookie_migration"`
+	CookiePreviousCipher        bool   `flag:"cookie-previous-cipher" cfg:"cookie_previous_cipher"`
+	CookiePreviousSerialization string `flag:"cookie-previous-serialization" cfg:"cookie_previous_serialization"`
+
+	// With FilterBots, crawlers and scanners, told apart by their user
+	// agent, including BotUserAgents, or by not keeping cookies, are
+	// answered 401 instead of starting sign ins.
+	FilterBots    bool     `flag:"filter-bots" cfg:"filter_bots"`
+	BotUserAgents []string `flag:"bot-user-agent" cfg:"bot_user_agents"`
+
+	// The cookie settings are replaced by those of the bundle in
+	// AuthStateFile, exported by another proxy with -export-auth-state.
+	AuthStateFile string `flag:"auth-state-file" cfg:"auth_state_file"`
+
+	Upstreams             []string      `flag:"upstream" cfg:"upstreams"`
+	UpstreamBalance       string        `flag:"upstream-balance" cfg:"upstream_balance"`
+	UpstreamTags          []string      `flag:"upstream-tag" cfg:"upstream_tags"`
+	SkipAuthRegex         []string      `flag:"skip-auth-regex" cfg:"skip_auth_regex"`
+	TrustedIPs            []string      `flag:"trusted-ip" cfg:"trusted_ips"`
+	TrustedDownstreams    []string      `flag:"trusted-downstream-cidr" cfg:"trusted_downstream_cidrs"`
+	RealClientIPHeader    string        `flag:"real-client-ip-header" cfg:"real_client_ip_header"`
+	PassBasicAuth         bool          `flag:"pass-basic-auth" cfg:"pass_basic_auth"`
+	BasicAuthPassword     string        `flag:"basic-auth-password" cfg:"basic_auth_password"`
+	PassAccessToken       bool          `flag:"pass-access-token" cfg:"pass_access_token"`
+	PassHostHeader        bool          `flag:"pass-host-header" cfg:"pass_host_header"`
+	SkipProviderButton    bool          `flag:"skip-provider-button" cfg:"skip_provider_button"`
+	Headless              bool          `flag:"headless" cfg:"headless"`
+	SilentReauth          bool          `flag:"silent-reauth" cfg:"silent_reauth"`
+	SilentReauthWindow    time.Duration `flag:"silent-reauth-window" cfg:"silent_reauth_window"`
+	PassUserHeaders       bool          `flag:"pass-user-headers" cfg:"pass_user_headers"`
+	PassOriginalRequest   bool          `flag:"pass-original-request" cfg:"pass_original_request"`
+	TLSCAFile             string        `flag:"tls-ca" cfg:"tls_ca_file"`
+	TLSInsecureSkipVerify bool          `flag:"tls-insecure-skip-verify" cfg:"tls_insecure_skip_verify"`
+	UpstreamTLSCertFile   string        `flag:"upstream-tls-cert" cfg:"upstream_tls_cert_file"`
+	UpstreamTLSKeyFile    string        `flag:"upstream-tls-key" cfg:"upstream_tls_key_file"`
+	SetXAuthRequest       bool          `flag:"set-xauthrequest" cfg:"set_xauthrequest"`
+	SessionExpiryHeaders  bool          `flag:"session-expiry-headers" cfg:"session_expiry_headers"`
+	SkipAuthPreflight     bool          `flag:"skip-auth-preflight" cfg:"skip_auth_preflight"`
+	AuthRateLimit         int           `flag:"auth-rate-limit" cfg:"auth_rate_limit"`
+	AuthMaxConcurrent     int           `flag:"auth-max-concurrent" cfg:"auth_max_concurrent"`
+	SignInAttempts        int           `flag:"sign-in-attempts" cfg:"sign_in_attempts"`
+	SignInLockout         time.Duration `flag:"sign-in-lockout" cfg:"sign_in_lockout"`
+	AuthDecisionCacheTTL  time.Duration `flag:"auth-decision-cache-ttl" cfg:"auth_decision_cache_ttl"`
+	AuthOnlyCacheTTL      time.Duration `flag:"auth-only-cache-ttl" cfg:"auth_only_cache_ttl"`
+	RateLimit             int           `flag:"rate-limit" cfg:"rate_limit"`
+	RateLimitRoutes       []string      `flag:"rate-limit-route" cfg:"rate_limit_routes"`
+	MetricsLabels         []string      `flag:"metrics-label" cfg:"metrics_labels"`
+	SignProviderRequests  []string      `flag:"sign-provider-request" cfg:"sign_provider_requests"`
+	ProviderRedirects     string        `flag:"provider-redirects" cfg:"provider_redirects"`
+	ProviderContentTypes  []string      `flag:"provider-content-type" cfg:"provider_content_types"`
+	ProviderTimeout       time.Duration `flag:"provider-timeout" cfg:"provider_timeout"`
+	TraceSampleRate       float64       `flag:"trace-sample-rate" cfg:"trace_sample_rate"`
+	TraceSampleRoutes     []string      `flag:"trace-sample-route" cfg:"trace_sample_routes"`
+
+	// Sampled traces and the metrics, every OTLPMetricsInterval, are
+	// exported to an OpenTelemetry collector at OTLPEndpoint with OTLP over
+	// HTTP, sending OTLPHeaders, ie. for authentication.
+	OTLPEndpoint           string        `flag:"otlp-endpoint" cfg:"otlp_endpoint"`
+	OTLPHeaders            []string      `flag:"otlp-header" cfg:"otlp_headers"`
+	OTLPResourceAttributes []string      `flag:"otlp-resource-attribute" cfg:"otlp_resource_attributes"`
+	OTLPMetricsInterval    time.Duration `flag:"otlp-metrics-interval" cfg:"otlp_metrics_interval"`
+
+	// Authenticated proxied responses on the routes matching
+	// CacheControlRoutes, or all routes, whose content type starts with one
+	// of CacheControlContentTypes, or of any type, get this Cache-Control
+	// header so shared caches don't serve them to other users.
+	CacheControl             string   `flag:"cache-control" cfg:"cache_control"`
+	CacheControlRoutes       []string `flag:"cache-control-route" cfg:"cache_control_routes"`
+	CacheControlContentTypes []string `flag:"cache-control-content-type" cfg:"cache_control_content_types"`
+
+	// With an ExperimentSalt, authenticated requests carry the user's
+	// experiment bucket, from 0 to ExperimentBuckets - 1, in the
+	// X-Experiment-Bucket header.
+	ExperimentSalt    string `flag:"experiment-salt" cfg:"experiment_salt" env:"OAUTH2_PROXY_EXPERIMENT_SALT"`
+	ExperimentBuckets int    `flag:"experiment-buckets" cfg:"experiment_buckets"`
+
+	// UnsafeTestMode mints sessions from X-Test-Identity headers signed with
+	// TestModeSecret and lets tests move the session clock, for integration
+	// test environments without an identity provider. Never enable it in
+	// production.
+	UnsafeTestMode bool   `flag:"unsafe-test-mode" cfg:"unsafe_test_mode"`
+	TestModeSecret string `flag:"test-mode-secret" cfg:"test_mode_secret" env:"OAUTH2_PROXY_TEST_MODE_SECRET"`
 
 	// These options allow for other providers besides Google, with
 	// potential overrides.
-	Provider          string `flag:"provider" cfg:"provider"`
-	LoginURL          string `flag:"login-url" cfg:"login_url"`
-	RedeemURL         string `flag:"redeem-url" cfg:"redeem_url"`
-	ProfileURL        string `flag:"profile-url" cfg:"profile_url"`
-	ProtectedResource string `flag:"resource" cfg:"resource"`
-	ValidateURL       string `flag:"validate-url" cfg:"validate_url"`
-	JWTKeysURL        string `flag:"jwt-keys-url" cfg:"jwt_keys_url"`
-	Scope             string `flag:"scope" cfg:"scope"`
-	ApprovalPrompt    string `flag:"approval-prompt" cfg:"approval_prompt"`
+	Provider          string   `flag:"provider" cfg:"provider"`
+	ProviderDomains   []string `flag:"provider-domain" cfg:"provider_domains"`
+	ExtraProviders    []string `flag:"extra-provider" cfg:"extra_providers"`
+	LoginURL          string   `flag:"login-url" cfg:"login_url"`
+	RedeemURL         string   `flag:"redeem-url" cfg:"redeem_url"`
+	ProfileURL        string   `flag:"profile-url" cfg:"profile_url"`
+	ProtectedResource string   `flag:"resource" cfg:"resource"`
+	ValidateURL       string   `flag:"validate-url" cfg:"validate_url"`
+	JWTKeysURL        string   `flag:"jwt-keys-url" cfg:"jwt_keys_url"`
+	Scope             string   `flag:"scope" cfg:"scope"`
+	ScopeRoutes       []string `flag:"scope-route" cfg:"scope_routes"`
+	SessionAgeRoutes  []string `flag:"max-session-age-route" cfg:"max_session_age_routes"`
+	ApprovalPrompt    string   `flag:"approval-prompt" cfg:"approval_prompt"`
+
+	// The failover provider takes over sign ins when the primary provider's
+	// endpoints are unreachable.
+	FailoverProvider     string        `flag:"failover-provider" cfg:"failover_provider"`
+	FailoverClientID     string        `flag:"failover-client-id" cfg:"failover_client_id" env:"OAUTH2_PROXY_FAILOVER_CLIENT_ID"`
+	FailoverClientSecret string        `flag:"failover-client-secret" cfg:"failover_client_secret" env:"OAUTH2_PROXY_FAILOVER_CLIENT_SECRET"`
+	FailoverLoginURL     string        `flag:"failover-login-url" cfg:"failover_login_url"`
+	FailoverRedeemURL    string        `flag:"failover-redeem-url" cfg:"failover_redeem_url"`
+	FailoverProfileURL   string        `flag:"failover-profile-url" cfg:"failover_profile_url"`
+	FailoverValidateURL  string        `flag:"failover-validate-url" cfg:"failover_validate_url"`
+	FailoverScope        string        `flag:"failover-scope" cfg:"failover_scope"`
+	FailoverThreshold    int           `flag:"failover-threshold" cfg:"failover_threshold"`
+	FailoverCooldown     time.Duration `flag:"failover-cooldown" cfg:"failover_cooldown"`
+
+	// Degraded mode trusts existing sessions while calls to the provider
+	// fail at more than the error rate.
+	DegradeErrorRate    float64       `flag:"degrade-error-rate" cfg:"degrade_error_rate"`
+	DegradeWindow       time.Duration `flag:"degrade-window" cfg:"degrade_window"`
+	DegradeSessionGrace time.Duration `flag:"degrade-session-grace" cfg:"degrade_session_grace"`
+
+	// Authenticated requests are also authorized by an Open Policy Agent
+	// decision when opa-url is set.
+	OPAURL     string        `flag:"opa-url" cfg:"opa_url"`
+	OPATimeout time.Duration `flag:"opa-timeout" cfg:"opa_timeout"`
+
+	// Sign ins, denied sign ins and sign outs are sent in batches to the
+	// audit webhook, Kafka topic or bucket, and spilled to the spool
+	// directory while it fails.
+	AuditWebhookURL    string        `flag:"audit-webhook-url" cfg:"audit_webhook_url"`
+	AuditKafkaURL      string        `flag:"audit-kafka-url" cfg:"audit_kafka_url"`
+	AuditBucketURL     string        `flag:"audit-bucket-url" cfg:"audit_bucket_url"`
+	AuditBucketRegion  string        `flag:"audit-bucket-region" cfg:"audit_bucket_region"`
+	AuditSpoolDir      string        `flag:"audit-spool-dir" cfg:"audit_spool_dir"`
+	AuditBatchSize     int           `flag:"audit-batch-size" cfg:"audit_batch_size"`
+	AuditFlushInterval time.Duration `flag:"audit-flush-interval" cfg:"audit_flush_interval"`
+
+	// Every session event is also written to the audit log file as it
+	// happens, or to stdout with "-".
+	AuditLogFile string `flag:"audit-log-file" cfg:"audit_log_file"`
+
+	// Upstreams sharing a path are health checked, and taken out of rotation
+	// while they fail.
+	UpstreamHealthPath     string        `flag:"upstream-health-path" cfg:"upstream_health_path"`
+	UpstreamHealthInterval time.Duration `flag:"upstream-health-interval" cfg:"upstream_health_interval"`
+	UpstreamMaxFails       int           `flag:"upstream-max-fails" cfg:"upstream_max_fails"`
+	UpstreamSRVInterval    time.Duration `flag:"upstream-srv-interval" cfg:"upstream_srv_interval"`
+
+	// Connections to upstreams are pooled and timed out as tuned here.
+	UpstreamMaxIdleConnsPerHost   int           `flag:"upstream-max-idle-conns-per-host" cfg:"upstream_max_idle_conns_per_host"`
+	UpstreamIdleConnTimeout       time.Duration `flag:"upstream-idle-conn-timeout" cfg:"upstream_idle_conn_timeout"`
+	UpstreamDialTimeout           time.Duration `flag:"upstream-dial-timeout" cfg:"upstream_dial_timeout"`
+	UpstreamTLSHandshakeTimeout   time.Duration `flag:"upstream-tls-handshake-timeout" cfg:"upstream_tls_handshake_timeout"`
+	UpstreamResponseHeaderTimeout time.Duration `flag:"upstream-response-header-timeout" cfg:"upstream_response_header_timeout"`
 
 	RequestLogging bool `flag:"request-logging" cfg:"request_logging"`
 
+	// The request log is written as LoggingFormat to AccessLogFile instead
+	// of stdout, which is rotated once it grows beyond AccessLogMaxSize
+	// megabytes.
+	LoggingFormat       string `flag:"logging-format" cfg:"logging_format"`
+	AccessLogFile       string `flag:"access-log-file" cfg:"access_log_file"`
+	AccessLogMaxSize    int    `flag:"access-log-max-size" cfg:"access_log_max_size"`
+	AccessLogMaxBackups int    `flag:"access-log-max-backups" cfg:"access_log_max_backups"`
+
+	// The proxy's own log is written to LoggingFilename instead of stderr,
+	// rotated like the access log, and rotated files are removed after
+	// LoggingMaxAge days.
+	LoggingFilename   string `flag:"logging-filename" cfg:"logging_filename"`
+	LoggingMaxSize    int    `flag:"logging-max-size" cfg:"logging_max_size"`
+	LoggingMaxBackups int    `flag:"logging-max-backups" cfg:"logging_max_backups"`
+	LoggingMaxAge     int    `flag:"logging-max-age" cfg:"logging_max_age"`
+
+	// Both the request log and the proxy's own log are sent to the local
+	// syslog daemon with LoggingSyslog, at the info level of
+	// LoggingSyslogFacility and tagged with LoggingSyslogTag.
+	LoggingSyslog         bool   `flag:"logging-syslog" cfg:"logging_syslog"`
+	LoggingSyslogFacility string `flag:"logging-syslog-facility" cfg:"logging_syslog_facility"`
+	LoggingSyslogTag      string `flag:"logging-syslog-tag" cfg:"logging_syslog_tag"`
+
+	// Text request log lines are formatted with RequestLoggingFormat, a
+	// template of a logTemplateData, rather than the default format.
+	RequestLoggingFormat string `flag:"request-logging-format" cfg:"request_logging_format"`
+
+	// Requests for ExcludeLoggingPaths, ie. health checks and metric
+	// scrapes, aren't logged.
+	ExcludeLoggingPaths []string `flag:"exclude-logging-path" cfg:"exclude_logging_paths"`
+
 	SignatureKey string `flag:"signature-key" cfg:"signature_key" env:"OAUTH2_PROXY_SIGNATURE_KEY"`
 
 	// internal values that are set after config validation
-	redirectURL   *url.URL
-	proxyURLs     []*url.URL
-	CompiledRegex []*regexp.Regexp
-	provider      providers.Provider
-	signatureData *SignatureData
+	redirectURL       *url.URL
+	proxyURLs         []*url.URL
+	upstreamOverrides []upstreamOverride
+	upstreamSigning   []upstreamSignature
+	upstreamFilters   []responseHeaderFilter
+	upstreamNames     []string
+	upstreamTags      map[string]string
+	upstreamConns     upstreamConnSettings
+	roleMap           *RoleMap
+	blockList         *BlockList
+	metricLabels      []*metricLabel
+	signingRules      []api.SigningRule
+	CompiledRegex     []*regexp.Regexp
+	trustedNets       []*net.IPNet
+	guestRoutes       []*regexp.Regexp
+	guestUpstreams    map[string]bool
+	provider          providers.Provider
+	failoverProvider  providers.Provider
+	errorBudget       *errorBudget
+	extraProviders    []*extraProvider
+	providerDomains   map[string]string
+	signatureData     *SignatureData
+	cacheRoutes       []*regexp.Regexp
+	scopeRoutes       []scopeRoute
+	sessionAgeRoutes  []sessionAgeRoute
+	traceRoutes       []traceRoute
+	rateLimitRoutes   []rateLimitRoute
+	logTemplate       *template.Template
+	excludeLogging    map[string]bool
+	botUserAgents     []*regexp.Regexp
+	otlpHeaders       http.Header
+	otlpResource      []otlpKeyValue
+	auditBucket       *url.URL
+
+	providerContentTypes []string
+	trustedDownstreams   []*net.IPNet
 
 	tlsclientconfig *tls.Config
 }
@@ -100,20 +366,61 @@ func NewOptions() *Options {
 		ProxyPrefix:         "/oauth2",
 		HttpAddress:         "127.0.0.1:4180",
 		HttpsAddress:        ":443",
+		LivenessPath:        "/ping",
+		ReadinessPath:       "/ready",
 		DisplayHtpasswdForm: true,
 		CookieName:          "_oauth2_proxy",
 		CookieSecure:        true,
 		CookieHttpOnly:      true,
 		CookieExpire:        time.Duration(168) * time.Hour,
 		CookieRefresh:       time.Duration(0),
+		SilentReauthWindow:  time.Duration(10) * time.Minute,
+		GuestCodeExpire:     time.Duration(24) * time.Hour,
+		GuestSessionExpire:  time.Duration(1) * time.Hour,
 		SetXAuthRequest:     false,
 		SkipAuthPreflight:   false,
 		PassBasicAuth:       true,
 		PassUserHeaders:     true,
 		PassAccessToken:     false,
 		PassHostHeader:      true,
+		UpstreamBalance:     upstreamBalanceRoundRobin,
 		ApprovalPrompt:      "force",
+		FailoverThreshold:   3,
+		FailoverCooldown:    time.Duration(1) * time.Minute,
+		DegradeWindow:       time.Duration(1) * time.Minute,
+		DegradeSessionGrace: time.Duration(1) * time.Hour,
+		OPATimeout:          time.Duration(1) * time.Second,
 		RequestLogging:      true,
+		LoggingFormat:       loggingFormatText,
+
+		HTTP2MaxConcurrentStreams: 250,
+		TLSSessionTickets:         true,
+		TLSSessionTicketRotation:  time.Duration(12) * time.Hour,
+		ShutdownTimeout:           time.Duration(30) * time.Second,
+		SignInAttempts:            5,
+		SignInLockout:             time.Duration(15) * time.Minute,
+		ExperimentBuckets:         100,
+		TraceSampleRate:           0.01,
+		OTLPMetricsInterval:       time.Duration(60) * time.Second,
+		ProviderRedirects:         api.RedirectNone,
+		ProviderTimeout:           time.Duration(30) * time.Second,
+
+		LoggingSyslogFacility: "daemon",
+		LoggingSyslogTag:      "oauth2_proxy",
+
+		AuditBatchSize:     100,
+		AuditFlushInterval: time.Duration(5) * time.Second,
+
+		UpstreamHealthInterval: time.Duration(10) * time.Second,
+		UpstreamMaxFails:       3,
+		UpstreamSRVInterval:    time.Duration(30) * time.Second,
+
+		UpstreamMaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+		UpstreamIdleConnTimeout:     time.Duration(90) * time.Second,
+		UpstreamDialTimeout:         time.Duration(30) * time.Second,
+		UpstreamTLSHandshakeTimeout: time.Duration(10) * time.Second,
+
+		CookiePreviousSerialization: cookieSerializationSession,
 	}
 }
 
@@ -128,6 +435,7 @@ func parseURL(to_parse string, urltype string, msgs []string) (*url.URL, []strin
 
 func (o *Options) Validate() error {
 	msgs := make([]string, 0)
+	msgs = loadAuthState(o, msgs)
 	if len(o.Upstreams) < 1 {
 		msgs = append(msgs, "missing setting: upstream")
 	}
@@ -137,9 +445,15 @@ func (o *Options) Validate() error {
 	if o.ClientID == "" {
 		msgs = append(msgs, "missing setting: client-id")
 	}
-	if o.ClientSecret == "" {
+	// Apple client secrets are generated from the apple-private-key-file
+	if o.ClientSecret == "" && o.Provider != "apple" {
 		msgs = append(msgs, "missing setting: client-secret")
 	}
+	for _, domain := range o.EmailDomains {
+		if domain == "*." || domain != "*" && strings.Contains(strings.TrimPrefix(domain, "*."), "*") {
+			msgs = append(msgs, fmt.Sprintf("invalid email_domain %q: a wildcard may only start a domain, ie. *.example.com", domain))
+		}
+	}
 	if o.AuthenticatedEmailsFile == "" && len(o.EmailDomains) == 0 && o.HtpasswdFile == "" {
 		msgs = append(msgs, "missing setting for email validation: email-domain or authenticated-emails-file required.\n      use email-domain=* to authorize all email addresses")
 	}
@@ -156,9 +470,26 @@ func (o *Options) Validate() error {
 		if upstreamURL.Path == "" {
 			upstreamURL.Path = "/"
 		}
+		var name string
+		name, msgs = parseUpstreamName(upstreamURL, o.upstreamNames, msgs)
+		var override upstreamOverride
+		override, msgs = parseUpstreamOverride(upstreamURL, msgs)
+		var signature upstreamSignature
+		signature, msgs = parseUpstreamSignature(upstreamURL, o.SignatureKey != "", msgs)
+		var filter responseHeaderFilter
+		filter, msgs = parseResponseHeaderFilter(upstreamURL, msgs)
+		msgs = validateStaticUpstream(upstreamURL, msgs)
+		msgs = validateSRVUpstream(upstreamURL, msgs)
 		o.proxyURLs = append(o.proxyURLs, upstreamURL)
+		o.upstreamOverrides = append(o.upstreamOverrides, override)
+		o.upstreamSigning = append(o.upstreamSigning, signature)
+		o.upstreamFilters = append(o.upstreamFilters, filter)
+		o.upstreamNames = append(o.upstreamNames, name)
 	}
 
+	msgs = validateUpstreamPools(o, msgs)
+	msgs = parseUpstreamConns(o, msgs)
+
 	for _, u := range o.SkipAuthRegex {
 		CompiledRegex, err := regexp.Compile(u)
 		if err != nil {
@@ -167,7 +498,13 @@ func (o *Options) Validate() error {
 		}
 		o.CompiledRegex = append(o.CompiledRegex, CompiledRegex)
 	}
+	msgs = parseTrustedIPs(o, msgs)
+	msgs = parseDegradation(o, msgs)
 	msgs = parseProviderInfo(o, msgs)
+	msgs = parseFailoverProvider(o, msgs)
+	msgs = parseExtraProviders(o, msgs)
+	msgs = parseProviderSigning(o, msgs)
+	msgs = parseProviderResponsePolicy(o, msgs)
 
 	if o.PassAccessToken || (o.CookieRefresh != time.Duration(0)) {
 		valid_cookie_secret_size := false
@@ -194,6 +531,68 @@ func (o *Options) Validate() error {
 		}
 	}
 
+	if o.AuthRateLimit < 0 {
+		msgs = append(msgs, "auth_rate_limit must not be negative")
+	}
+	if o.AuthMaxConcurrent < 0 {
+		msgs = append(msgs, "auth_max_concurrent must not be negative")
+	}
+	if o.SignInAttempts < 0 {
+		msgs = append(msgs, "sign_in_attempts must not be negative")
+	}
+	if o.SignInAttempts > 0 && o.SignInLockout <= 0 {
+		msgs = append(msgs, "sign_in_lockout must be positive")
+	}
+	if o.ExperimentSalt != "" && o.ExperimentBuckets < 1 {
+		msgs = append(msgs, "experiment_buckets must be positive")
+	}
+	if o.UnsafeTestMode && len(o.TestModeSecret) < 16 {
+		msgs = append(msgs, "unsafe_test_mode requires a test_mode_secret of at least 16 bytes")
+	}
+	if !o.UnsafeTestMode && o.TestModeSecret != "" {
+		msgs = append(msgs, "test_mode_secret is only used with unsafe_test_mode")
+	}
+	if o.LoggingFormat != loggingFormatText && o.LoggingFormat != loggingFormatJSON {
+		msgs = append(msgs, fmt.Sprintf("invalid logging_format %q, expected text or json", o.LoggingFormat))
+	}
+	msgs = parseRequestLoggingFormat(o, msgs)
+	msgs = parseExcludeLoggingPaths(o, msgs)
+	msgs = parseBotUserAgents(o, msgs)
+	if o.AccessLogMaxSize < 0 || o.AccessLogMaxBackups < 0 {
+		msgs = append(msgs, "access_log_max_size and access_log_max_backups must not be negative")
+	}
+	if o.AccessLogFile == "" && (o.AccessLogMaxSize > 0 || o.AccessLogMaxBackups > 0) {
+		msgs = append(msgs, "access_log_max_size and access_log_max_backups are only used with access_log_file")
+	}
+	if o.LoggingMaxSize < 0 || o.LoggingMaxBackups < 0 || o.LoggingMaxAge < 0 {
+		msgs = append(msgs, "logging_max_size, logging_max_backups and logging_max_age must not be negative")
+	}
+	if o.LoggingFilename == "" && (o.LoggingMaxSize > 0 || o.LoggingMaxBackups > 0 || o.LoggingMaxAge > 0) {
+		msgs = append(msgs, "logging_max_size, logging_max_backups and logging_max_age are only used with logging_filename")
+	}
+	msgs = validateSyslog(o, msgs)
+	if o.AdminToken != "" && len(o.AdminToken) < 16 {
+		msgs = append(msgs, "admin_token must be at least 16 bytes")
+	}
+	if o.AdminToken != "" && o.AdminAddress == "" {
+		msgs = append(msgs, "admin_token is only used with admin_address")
+	}
+	if o.MetricsAddress != "" && (o.MetricsAddress == o.HttpAddress || o.MetricsAddress == o.AdminAddress) {
+		msgs = append(msgs, "metrics_address must differ from http_address and admin_address")
+	}
+	if o.AuthDecisionCacheTTL < 0 {
+		msgs = append(msgs, "auth_decision_cache_ttl must not be negative")
+	}
+	if o.AuthOnlyCacheTTL < 0 || o.AuthOnlyCacheTTL > authOnlyCacheMaxTTL {
+		msgs = append(msgs, fmt.Sprintf("auth_only_cache_ttl must be between 0 and %s", authOnlyCacheMaxTTL))
+	}
+	if o.GoogleGroupCacheTTL < 0 {
+		msgs = append(msgs, "google_group_cache_ttl must not be negative")
+	}
+	if o.GoogleGroupNegativeCacheTTL < 0 {
+		msgs = append(msgs, "google_group_negative_cache_ttl must not be negative")
+	}
+
 	if o.CookieRefresh >= o.CookieExpire {
 		msgs = append(msgs, fmt.Sprintf(
 			"cookie_refresh (%s) must be less than "+
@@ -215,15 +614,36 @@ func (o *Options) Validate() error {
 	}
 
 	msgs = parseSignatureKey(o, msgs)
+	msgs = parseProviderDomains(o, msgs)
+	msgs = parseGuestRoutes(o, msgs)
+	msgs = parseCacheControl(o, msgs)
+	msgs = parseScopeRoutes(o, msgs)
+	msgs = parseSessionAgeRoutes(o, msgs)
+	msgs = parseTraceSampling(o, msgs)
+	msgs = parseOTLP(o, msgs)
+	msgs = parseRateLimitRoutes(o, msgs)
+	msgs = parseUpstreamTags(o, msgs)
+	msgs = parseMetricLabels(o, msgs)
+	msgs = parseOPA(o, msgs)
+	msgs = validateAudit(o, msgs)
+	msgs = validateACME(o, msgs)
+	msgs = validateTLSSessions(o, msgs)
+	if o.ShutdownTimeout < 0 {
+		msgs = append(msgs, "shutdown_timeout must not be negative")
+	}
+	if o.HTTP2MaxConcurrentStreams <= 0 {
+		msgs = append(msgs, "http2_max_concurrent_streams must be positive")
+	}
+	msgs = parseRoleMapping(o, msgs)
+	msgs = parseBlockList(o, msgs)
+	msgs = validateHealthPaths(o, msgs)
 	msgs = validateCookieName(o, msgs)
+	msgs = validateCookieMigration(o, msgs)
 
-	// The default client is used when talking out for token exchange
-	// we need to differentiate from the client used to talk to upstream
+	// the client talking to the provider is set up by newProviderClient,
+	// this one talks to upstreams
 	if o.TLSInsecureSkipVerify {
-		insecureTransport := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		http.DefaultClient = &http.Client{Transport: insecureTransport}
+		o.tlsclientconfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
 	if o.TLSCAFile != "" {
@@ -234,10 +654,12 @@ func (o *Options) Validate() error {
 		certpool := x509.NewCertPool()
 		certpool.AppendCertsFromPEM(certs)
 
-		o.tlsclientconfig = &tls.Config{
-			RootCAs: certpool,
+		if o.tlsclientconfig == nil {
+			o.tlsclientconfig = &tls.Config{}
 		}
+		o.tlsclientconfig.RootCAs = certpool
 	}
+	msgs = parseUpstreamTLSCert(o, msgs)
 
 	if len(msgs) != 0 {
 		return fmt.Errorf("Invalid configuration:\n  %s",
@@ -246,6 +668,27 @@ func (o *Options) Validate() error {
 	return nil
 }
 
+// parseUpstreamTLSCert loads the client certificate presented to upstreams
+// that require mutual TLS
+func parseUpstreamTLSCert(o *Options, msgs []string) []string {
+	if o.UpstreamTLSCertFile == "" && o.UpstreamTLSKeyFile == "" {
+		return msgs
+	}
+	if o.UpstreamTLSCertFile == "" || o.UpstreamTLSKeyFile == "" {
+		return append(msgs, "upstream_tls_cert_file and upstream_tls_key_file must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(o.UpstreamTLSCertFile, o.UpstreamTLSKeyFile)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error loading upstream client certificate (%s, %s): %s",
+			o.UpstreamTLSCertFile, o.UpstreamTLSKeyFile, err))
+	}
+	if o.tlsclientconfig == nil {
+		o.tlsclientconfig = &tls.Config{}
+	}
+	o.tlsclientconfig.Certificates = []tls.Certificate{cert}
+	return msgs
+}
+
 func parseProviderInfo(o *Options, msgs []string) []string {
 	p := &providers.ProviderData{
 		Scope:          o.Scope,
@@ -261,24 +704,918 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 	p.JWTKeysURL, msgs = parseURL(o.JWTKeysURL, "jwtKeys", msgs)
 
 	o.provider = providers.New(o.Provider, p)
-	switch p := o.provider.(type) {
+	return configureProvider(o, o.provider, msgs)
+}
+
+// parseDegradation creates the error budget that switches to degraded mode,
+// before the providers that serve cached group memberships during it
+func parseDegradation(o *Options, msgs []string) []string {
+	if o.DegradeErrorRate == 0 {
+		return msgs
+	}
+	if o.DegradeErrorRate < 0 || o.DegradeErrorRate >= 1 {
+		msgs = append(msgs, "degrade_error_rate must be between 0 and 1")
+	}
+	if o.DegradeWindow < time.Second {
+		msgs = append(msgs, "degrade_window must be at least 1s")
+	}
+	if o.DegradeSessionGrace < 0 {
+		msgs = append(msgs, "degrade_session_grace must not be negative")
+	}
+	o.errorBudget = newErrorBudget(o.DegradeErrorRate, o.DegradeWindow)
+	return msgs
+}
+
+// validateHealthPaths checks the liveness and readiness endpoints are
+// distinct paths outside the proxy prefix
+func validateHealthPaths(o *Options, msgs []string) []string {
+	for _, p := range []struct{ name, path string }{
+		{"liveness_path", o.LivenessPath},
+		{"readiness_path", o.ReadinessPath},
+	} {
+		if !strings.HasPrefix(p.path, "/") {
+			msgs = append(msgs, fmt.Sprintf("%s %q must start with /", p.name, p.path))
+		} else if strings.HasPrefix(p.path, o.ProxyPrefix+"/") {
+			msgs = append(msgs, fmt.Sprintf("%s %q must not be under the proxy prefix %q", p.name, p.path, o.ProxyPrefix))
+		}
+	}
+	if o.LivenessPath == o.ReadinessPath {
+		msgs = append(msgs, "liveness_path and readiness_path must differ")
+	}
+	return msgs
+}
+
+// validateACME checks that certificates are only obtained for a domain
+// whitelist, and kept across restarts so the rate limits of Let's Encrypt
+// aren't hit
+func validateACME(o *Options, msgs []string) []string {
+	if !o.TLSACME {
+		return msgs
+	}
+	if len(o.TLSCertFile) > 0 {
+		msgs = append(msgs, "tls_acme can't be used with tls_cert_file")
+	}
+	if len(o.TLSACMEDomains) == 0 {
+		msgs = append(msgs, "tls_acme requires at least one tls_acme_domain")
+	}
+	if o.TLSACMECacheDir == "" {
+		msgs = append(msgs, "tls_acme requires tls_acme_cache_dir")
+	}
+	return msgs
+}
+
+// validateTLSSessions checks the session ticket keys can be derived, and that
+// OCSP responses are stapled to certificate files only
+func validateTLSSessions(o *Options, msgs []string) []string {
+	if o.TLSSessionTicketSecret != "" {
+		if !o.TLSSessionTickets {
+			msgs = append(msgs, "tls_session_ticket_secret requires tls_session_tickets")
+		}
+		if len(o.TLSSessionTicketSecret) < minSessionTicketSecret {
+			msgs = append(msgs, fmt.Sprintf("tls_session_ticket_secret must be at least %d bytes", minSessionTicketSecret))
+		}
+		if o.TLSSessionTicketRotation <= 0 {
+			msgs = append(msgs, "tls_session_ticket_rotation must be positive")
+		}
+	}
+	if o.TLSOCSPStapling && o.TLSACME {
+		msgs = append(msgs, "tls_ocsp_stapling can't be used with tls_acme")
+	}
+	return msgs
+}
+
+// validateAudit checks the audit sink and its spool directory
+func validateAudit(o *Options, msgs []string) []string {
+	var sinks []string
+	for name, value := range map[string]string{
+		"audit_webhook_url": o.AuditWebhookURL,
+		"audit_kafka_url":   o.AuditKafkaURL,
+		"audit_bucket_url":  o.AuditBucketURL,
+	} {
+		if value != "" {
+			sinks = append(sinks, name)
+		}
+	}
+	sort.Strings(sinks)
+	if o.AuditBucketRegion != "" && o.AuditBucketURL == "" {
+		msgs = append(msgs, "audit_bucket_region requires audit_bucket_url")
+	}
+	if len(sinks) == 0 {
+		if o.AuditSpoolDir != "" {
+			msgs = append(msgs, "audit_spool_dir requires audit_webhook_url, audit_kafka_url or audit_bucket_url")
+		}
+		return msgs
+	}
+	if len(sinks) > 1 {
+		msgs = append(msgs, fmt.Sprintf("only one of %s can be set", strings.Join(sinks, ", ")))
+	}
+	if o.AuditWebhookURL != "" {
+		u, err := url.Parse(o.AuditWebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			msgs = append(msgs, fmt.Sprintf("audit_webhook_url %q must be an http or https url", o.AuditWebhookURL))
+		}
+	}
+	if o.AuditKafkaURL != "" {
+		u, err := url.Parse(o.AuditKafkaURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || !strings.Contains(u.Path, "/topics/") {
+			msgs = append(msgs, fmt.Sprintf("audit_kafka_url %q must be the http or https url of a Kafka REST Proxy topic, ie. http://kafka-rest:8082/topics/audit", o.AuditKafkaURL))
+		}
+	}
+	if o.AuditBucketURL != "" {
+		msgs = parseAuditBucket(o, msgs)
+	}
+	if o.AuditBatchSize <= 0 {
+		msgs = append(msgs, "audit_batch_size must be positive")
+	}
+	if o.AuditFlushInterval <= 0 {
+		msgs = append(msgs, "audit_flush_interval must be positive")
+	}
+	if o.AuditSpoolDir != "" {
+		if err := os.MkdirAll(o.AuditSpoolDir, 0700); err != nil {
+			msgs = append(msgs, fmt.Sprintf("error creating audit_spool_dir %q: %s", o.AuditSpoolDir, err))
+		}
+	}
+	return msgs
+}
+
+// parseAuditBucket checks the s3:// or gs:// bucket audit events are
+// uploaded to. S3 buckets need their region.
+func parseAuditBucket(o *Options, msgs []string) []string {
+	u, err := url.Parse(o.AuditBucketURL)
+	if err != nil || (u.Scheme != "s3" && u.Scheme != "gs") || u.Host == "" || u.RawQuery != "" {
+		return append(msgs, fmt.Sprintf("audit_bucket_url %q must be an s3://bucket/prefix or gs://bucket/prefix url", o.AuditBucketURL))
+	}
+	if u.Scheme == "s3" && o.AuditBucketRegion == "" {
+		msgs = append(msgs, "audit_bucket_region is required for s3 buckets")
+	}
+	if u.Scheme == "gs" && o.AuditBucketRegion != "" {
+		msgs = append(msgs, "audit_bucket_region is only used with s3 buckets")
+	}
+	o.auditBucket = u
+	return msgs
+}
+
+// parseOPA checks the Open Policy Agent decision endpoint
+func parseOPA(o *Options, msgs []string) []string {
+	if o.OPAURL == "" {
+		return msgs
+	}
+	u, err := url.Parse(o.OPAURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		msgs = append(msgs, fmt.Sprintf("opa_url %q must be an http or https url", o.OPAURL))
+	}
+	if o.OPATimeout <= 0 {
+		msgs = append(msgs, "opa_timeout must be positive")
+	}
+	if o.AuthOnlyCacheTTL > 0 {
+		// policies may decide on the path, method and headers, which the
+		// auth endpoint cache doesn't key on
+		msgs = append(msgs, "auth_only_cache_ttl can't be used with opa_url")
+	}
+	return msgs
+}
+
+// parseRoleMapping reads the role mapping file
+func parseRoleMapping(o *Options, msgs []string) []string {
+	if o.RoleMappingFile == "" {
+		return msgs
+	}
+	roleMap, err := NewRoleMap(o.RoleMappingFile)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error reading role-mapping-file=%q: %s", o.RoleMappingFile, err))
+	}
+	o.roleMap = roleMap
+	return msgs
+}
+
+// parseBlockList reads the blocked emails and the blocked emails file
+func parseBlockList(o *Options, msgs []string) []string {
+	if len(o.BlockedEmails) == 0 && o.BlockedEmailsFile == "" {
+		return msgs
+	}
+	blockList, err := NewBlockList(o.BlockedEmails, o.BlockedEmailsFile)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error reading blocked-emails-file=%q: %s", o.BlockedEmailsFile, err))
+	}
+	o.blockList = blockList
+	return msgs
+}
+
+// parseFailoverProvider creates the failover provider. It shares the
+// provider specific settings, such as group restrictions, with the primary.
+func parseFailoverProvider(o *Options, msgs []string) []string {
+	if o.FailoverProvider == "" {
+		return msgs
+	}
+	if o.FailoverClientID == "" {
+		msgs = append(msgs, "missing setting: failover-client-id")
+	}
+	if o.FailoverClientSecret == "" {
+		msgs = append(msgs, "missing setting: failover-client-secret")
+	}
+	if o.FailoverThreshold < 1 {
+		msgs = append(msgs, "failover_threshold must be at least 1")
+	}
+	if o.FailoverCooldown <= 0 {
+		msgs = append(msgs, "failover_cooldown must be positive")
+	}
+	p := &providers.ProviderData{
+		Scope:          o.FailoverScope,
+		ClientID:       o.FailoverClientID,
+		ClientSecret:   o.FailoverClientSecret,
+		ApprovalPrompt: o.ApprovalPrompt,
+	}
+	p.LoginURL, msgs = parseURL(o.FailoverLoginURL, "failover-login", msgs)
+	p.RedeemURL, msgs = parseURL(o.FailoverRedeemURL, "failover-redeem", msgs)
+	p.ProfileURL, msgs = parseURL(o.FailoverProfileURL, "failover-profile", msgs)
+	p.ValidateURL, msgs = parseURL(o.FailoverValidateURL, "failover-validate", msgs)
+	p.ProtectedResource, msgs = parseURL(o.ProtectedResource, "resource", msgs)
+	p.JWTKeysURL = &url.URL{}
+
+	o.failoverProvider = providers.New(o.FailoverProvider, p)
+	return configureProvider(o, o.failoverProvider, msgs)
+}
+
+var extraProviderIDRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// parseExtraProviders creates the providers offered on the sign in page
+// alongside the primary one, given as
+// "<id>=<provider>?client-id=...&client-secret=...". The optional name,
+// login-url, redeem-url, profile-url, validate-url and scope parameters
+// override the provider's defaults. The provider specific settings, such as
+// github-org, apply to every provider of that kind.
+func parseExtraProviders(o *Options, msgs []string) []string {
+	primaryID := strings.ToLower(o.Provider)
+	if primaryID == "" {
+		primaryID = "google"
+	}
+	// extra providers are looked up by the tag of their sessions, which
+	// mustn't be mistaken for the internal ones
+	seen := map[string]bool{
+		primaryID:               true,
+		sessionProviderPrimary:  true,
+		sessionProviderFailover: true,
+		sessionProviderTestMode: true,
+	}
+	for _, spec := range o.ExtraProviders {
+		components := strings.SplitN(spec, "=", 2)
+		if len(components) != 2 {
+			msgs = append(msgs, "invalid extra-provider <id>=<provider>?<params> spec: "+spec)
+			continue
+		}
+		id := components[0]
+		if !extraProviderIDRegex.MatchString(id) {
+			msgs = append(msgs, fmt.Sprintf("invalid extra-provider id %q", id))
+			continue
+		}
+		if seen[id] {
+			msgs = append(msgs, fmt.Sprintf("extra-provider id %q is already in use", id))
+			continue
+		}
+		seen[id] = true
+
+		components = strings.SplitN(components[1], "?", 2)
+		var params url.Values
+		if len(components) == 2 {
+			var err error
+			params, err = url.ParseQuery(components[1])
+			if err != nil {
+				msgs = append(msgs, fmt.Sprintf("invalid extra-provider %q parameters: %s", id, err))
+				continue
+			}
+		}
+		valid := true
+		for name := range params {
+			switch name {
+			case "name", "client-id", "client-secret", "login-url", "redeem-url", "profile-url", "validate-url", "scope":
+			default:
+				msgs = append(msgs, fmt.Sprintf("unknown extra-provider %q parameter %q", id, name))
+				valid = false
+			}
+		}
+		if params.Get("client-id") == "" {
+			msgs = append(msgs, fmt.Sprintf("missing extra-provider %q parameter: client-id", id))
+			valid = false
+		}
+		if params.Get("client-secret") == "" {
+			msgs = append(msgs, fmt.Sprintf("missing extra-provider %q parameter: client-secret", id))
+			valid = false
+		}
+		if !valid {
+			continue
+		}
+
+		p := &providers.ProviderData{
+			Scope:          params.Get("scope"),
+			ClientID:       params.Get("client-id"),
+			ClientSecret:   params.Get("client-secret"),
+			ApprovalPrompt: o.ApprovalPrompt,
+		}
+		p.LoginURL, msgs = parseURL(params.Get("login-url"), id+" login", msgs)
+		p.RedeemURL, msgs = parseURL(params.Get("redeem-url"), id+" redeem", msgs)
+		p.ProfileURL, msgs = parseURL(params.Get("profile-url"), id+" profile", msgs)
+		p.ValidateURL, msgs = parseURL(params.Get("validate-url"), id+" validate", msgs)
+		p.ProtectedResource, msgs = parseURL(o.ProtectedResource, "resource", msgs)
+		p.JWTKeysURL = &url.URL{}
+
+		provider := providers.New(components[0], p)
+		name := params.Get("name")
+		if name == "" {
+			name = provider.Data().ProviderName
+		}
+		o.extraProviders = append(o.extraProviders, &extraProvider{id: id, name: name, provider: provider})
+		msgs = configureProvider(o, provider, msgs)
+	}
+	return msgs
+}
+
+// configureProvider applies the provider specific settings to provider
+func configureProvider(o *Options, provider providers.Provider, msgs []string) []string {
+	switch p := provider.(type) {
+	case *providers.AppleProvider:
+		if o.AppleTeamID == "" {
+			msgs = append(msgs, "missing setting: apple-team-id")
+		}
+		if o.AppleKeyID == "" {
+			msgs = append(msgs, "missing setting: apple-key-id")
+		}
+		if o.ApplePrivateKeyFile == "" {
+			msgs = append(msgs, "missing setting: apple-private-key-file")
+			break
+		}
+		key, err := ioutil.ReadFile(o.ApplePrivateKeyFile)
+		if err != nil {
+			msgs = append(msgs, "invalid apple-private-key-file: "+err.Error())
+			break
+		}
+		if err := p.SetClientSecretKey(o.AppleTeamID, o.AppleKeyID, key); err != nil {
+			msgs = append(msgs, err.Error())
+		}
 	case *providers.AzureProvider:
 		p.Configure(o.AzureTenant)
+		p.SetGroupRestriction(o.AzureGroups)
+	case *providers.BitbucketProvider:
+		p.SetTeam(o.BitbucketTeam)
+		p.SetRepository(o.BitbucketRepository)
+	case *providers.CognitoProvider:
+		if o.CognitoDomain == "" {
+			msgs = append(msgs, "missing setting: cognito-domain")
+			break
+		}
+		var domain *url.URL
+		domain, msgs = parseURL(o.CognitoDomain, "cognito-domain", msgs)
+		if domain != nil {
+			p.Configure(domain)
+		}
 	case *providers.GitHubProvider:
-		p.SetOrgTeam(o.GitHubOrg, o.GitHubTeam)
+		if o.GitHubEnterpriseURL != "" {
+			var baseURL *url.URL
+			baseURL, msgs = parseURL(o.GitHubEnterpriseURL, "github-enterprise", msgs)
+			if baseURL != nil {
+				p.SetEnterpriseURL(baseURL)
+			}
+		}
+		if err := p.SetOrgsTeams(o.GitHubOrgs, o.GitHubTeams); err != nil {
+			msgs = append(msgs, err.Error())
+		}
+		if o.GitHubRepo != "" && strings.Count(o.GitHubRepo, "/") != 1 {
+			msgs = append(msgs, fmt.Sprintf("invalid github-repo %q, expected <owner>/<name>", o.GitHubRepo))
+		}
+		if o.GitHubToken != "" && o.GitHubRepo == "" {
+			msgs = append(msgs, "missing setting: github-repo (required with github-token)")
+		}
+		p.SetRepo(o.GitHubRepo, o.GitHubToken)
+		p.SetUsers(o.GitHubUsers)
+	case *providers.GiteaProvider:
+		if o.GiteaURL == "" {
+			msgs = append(msgs, "missing setting: gitea-url")
+			break
+		}
+		var baseURL *url.URL
+		baseURL, msgs = parseURL(o.GiteaURL, "gitea", msgs)
+		if baseURL != nil {
+			p.Configure(baseURL)
+		}
+		p.SetOrgTeam(o.GiteaOrg, o.GiteaTeam)
+	case *providers.GitLabProvider:
+		if o.GitLabURL != "" {
+			var baseURL *url.URL
+			baseURL, msgs = parseURL(o.GitLabURL, "gitlab", msgs)
+			if baseURL != nil {
+				p.SetBaseURL(baseURL)
+			}
+		}
+		var projects []*providers.GitLabProject
+		for _, spec := range o.GitLabProjects {
+			project, err := providers.NewGitLabProject(spec)
+			if err != nil {
+				msgs = append(msgs, err.Error())
+				continue
+			}
+			projects = append(projects, project)
+		}
+		p.SetGroupsProjects(o.GitLabGroups, projects)
+	case *providers.KeycloakProvider:
+		p.SetGroups(o.KeycloakGroups)
+		p.SetRealmRoles(o.KeycloakRealmRoles)
 	case *providers.GoogleProvider:
+		p.SetHostedDomains(hostedDomains(o.EmailDomains))
 		if o.GoogleServiceAccountJSON != "" {
 			file, err := os.Open(o.GoogleServiceAccountJSON)
 			if err != nil {
 				msgs = append(msgs, "invalid Google credentials file: "+o.GoogleServiceAccountJSON)
 			} else {
 				p.SetGroupRestriction(o.GoogleGroups, o.GoogleAdminEmail, file)
+				p.SetGroupCache(o.GoogleGroupCacheTTL, o.GoogleGroupNegativeCacheTTL)
+				if o.errorBudget != nil {
+					p.SetStaleGroups(func() bool { return o.errorBudget.Degraded(time.Now()) })
+				}
+			}
+		}
+	}
+	return msgs
+}
+
+// hostedDomains are the Google Workspace domains accounts must belong to:
+// the configured email domains, unless any email domain is allowed
+func hostedDomains(emailDomains []string) []string {
+	var domains []string
+	for _, domain := range emailDomains {
+		if domain == "*" {
+			return nil
+		}
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+// parseTrustedIPs reads the networks whose requests skip authentication,
+// and the downstream proxies whose forwarded headers are honored
+func parseTrustedIPs(o *Options, msgs []string) []string {
+	o.trustedNets, msgs = parseNetworks(o.TrustedIPs, "trusted_ip", msgs)
+	o.trustedDownstreams, msgs = parseNetworks(o.TrustedDownstreams, "trusted_downstream_cidr", msgs)
+	return msgs
+}
+
+// parseNetworks reads the networks of the option name, given as CIDRs or
+// single addresses
+func parseNetworks(specs []string, name string, msgs []string) ([]*net.IPNet, []string) {
+	var nets []*net.IPNet
+	for _, s := range specs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				msgs = append(msgs, fmt.Sprintf("invalid %s %q, expected an address or a CIDR", name, s))
+				continue
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid %s %q, expected an address or a CIDR", name, s))
+			continue
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, msgs
+}
+
+// parseProviderResponsePolicy checks the redirect policy, the content types
+// allowed from provider endpoints and their timeout
+func parseProviderResponsePolicy(o *Options, msgs []string) []string {
+	if !api.ValidRedirectPolicy(o.ProviderRedirects) {
+		msgs = append(msgs, fmt.Sprintf("invalid provider_redirects %q, expected %s, %s or %s",
+			o.ProviderRedirects, api.RedirectNone, api.RedirectSameHost, api.RedirectAny))
+	}
+	if o.ProviderTimeout <= 0 {
+		msgs = append(msgs, "provider_timeout must be positive")
+	}
+	o.providerContentTypes = api.DefaultContentTypes
+	if len(o.ProviderContentTypes) > 0 {
+		o.providerContentTypes = nil
+		for _, contentType := range o.ProviderContentTypes {
+			mediaType, _, err := mime.ParseMediaType(contentType)
+			if err != nil || !strings.Contains(mediaType, "/") {
+				msgs = append(msgs, fmt.Sprintf("invalid provider_content_type %q, expected <type>/<subtype>", contentType))
+				continue
+			}
+			o.providerContentTypes = append(o.providerContentTypes, mediaType)
+		}
+	}
+	return msgs
+}
+
+// validateSyslog checks the syslog facility, and that the logs don't also
+// go to files
+func validateSyslog(o *Options, msgs []string) []string {
+	if !o.LoggingSyslog {
+		return msgs
+	}
+	if o.AccessLogFile != "" || o.LoggingFilename != "" {
+		msgs = append(msgs, "logging_syslog can't be combined with access_log_file or logging_filename")
+	}
+	if err := checkSyslogFacility(o.LoggingSyslogFacility); err != nil {
+		msgs = append(msgs, err.Error())
+	}
+	return msgs
+}
+
+// parseBotUserAgents compiles the user agents of bots
+func parseBotUserAgents(o *Options, msgs []string) []string {
+	if !o.FilterBots {
+		if len(o.BotUserAgents) > 0 {
+			msgs = append(msgs, "bot_user_agents is only used with filter_bots")
+		}
+		return msgs
+	}
+	var err error
+	if o.botUserAgents, err = compileBotUserAgents(o.BotUserAgents); err != nil {
+		msgs = append(msgs, fmt.Sprintf("error compiling bot-user-agent %s", err))
+	}
+	return msgs
+}
+
+// parseExcludeLoggingPaths reads the paths left out of the request log,
+// which may be given as comma separated lists
+func parseExcludeLoggingPaths(o *Options, msgs []string) []string {
+	o.excludeLogging = make(map[string]bool)
+	for _, paths := range o.ExcludeLoggingPaths {
+		for _, path := range strings.Split(paths, ",") {
+			path = strings.TrimSpace(path)
+			if !strings.HasPrefix(path, "/") {
+				msgs = append(msgs, fmt.Sprintf("invalid exclude-logging-path=%q, expected a path starting with /", path))
+				continue
+			}
+			o.excludeLogging[path] = true
+		}
+	}
+	return msgs
+}
+
+func parseRequestLoggingFormat(o *Options, msgs []string) []string {
+	if o.RequestLoggingFormat == "" {
+		return msgs
+	}
+	if o.LoggingFormat != loggingFormatText {
+		return append(msgs, "request_logging_format is only used with logging_format=text")
+	}
+	t, err := template.New("request_logging_format").Parse(o.RequestLoggingFormat)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid request_logging_format: %s", err))
+	}
+	// executed on sample data, so fields that don't exist are found up front
+	if err := t.Execute(ioutil.Discard, logTemplateData{}); err != nil {
+		return append(msgs, fmt.Sprintf("invalid request_logging_format: %s", err))
+	}
+	o.logTemplate = t
+	return msgs
+}
+
+// parseProviderSigning reads the "<endpoint>=<signer>" request signing
+// rules. The endpoint is a URL prefix, or one of the provider's redeem,
+// profile, validate or jwt-keys URLs.
+func parseProviderSigning(o *Options, msgs []string) []string {
+	for _, spec := range o.SignProviderRequests {
+		i := strings.LastIndex(spec, "=")
+		if i < 1 {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid sign-provider-request %q, expected <endpoint>=<signer>", spec))
+			continue
+		}
+		endpoint, signerSpec := spec[:i], spec[i+1:]
+
+		var prefix *url.URL
+		switch endpoint {
+		case "redeem":
+			prefix = o.provider.Data().RedeemURL
+		case "profile":
+			prefix = o.provider.Data().ProfileURL
+		case "validate":
+			prefix = o.provider.Data().ValidateURL
+		case "jwt-keys":
+			prefix = o.provider.Data().JWTKeysURL
+		default:
+			u, err := url.Parse(endpoint)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				msgs = append(msgs, fmt.Sprintf(
+					"invalid sign-provider-request endpoint %q", endpoint))
+				continue
 			}
+			prefix = u
+		}
+		if prefix == nil || prefix.String() == "" {
+			msgs = append(msgs, fmt.Sprintf(
+				"sign-provider-request: no %s url is configured", endpoint))
+			continue
+		}
+
+		signer, err := api.NewSigner(signerSpec)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid sign-provider-request %q: %s", spec, err))
+			continue
+		}
+		o.signingRules = append(o.signingRules, api.SigningRule{
+			Prefix: prefix.String(),
+			Signer: signer,
+		})
+	}
+	return msgs
+}
+
+var upstreamNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// parseUpstreamName reads and strips the name query parameter of an upstream
+// URL, which must be unique among the names already given
+func parseUpstreamName(u *url.URL, names []string, msgs []string) (string, []string) {
+	params := u.Query()
+	name := params.Get("name")
+	if name == "" {
+		return "", msgs
+	}
+	params.Del("name")
+	u.RawQuery = params.Encode()
+
+	if !upstreamNameRegex.MatchString(name) {
+		return "", append(msgs, fmt.Sprintf("invalid name=%q for upstream %q", name, u))
+	}
+	for _, n := range names {
+		if n == name {
+			return "", append(msgs, fmt.Sprintf("duplicate upstream name %q", name))
+		}
+	}
+	return name, msgs
+}
+
+// validateUpstreamPools checks the upstreams sharing a path can be
+// balanced across: they must all be http or https, and at most one of them
+// may be named. It also checks how they are balanced, health checked and
+// discovered.
+func validateUpstreamPools(o *Options, msgs []string) []string {
+	switch o.UpstreamBalance {
+	case upstreamBalanceRoundRobin, upstreamBalanceLeastConn, upstreamBalanceSticky:
+	default:
+		msgs = append(msgs, fmt.Sprintf("upstream_balance must be %q, %q or %q",
+			upstreamBalanceRoundRobin, upstreamBalanceLeastConn, upstreamBalanceSticky))
+	}
+	if o.UpstreamHealthPath != "" && !strings.HasPrefix(o.UpstreamHealthPath, "/") {
+		msgs = append(msgs, fmt.Sprintf("upstream_health_path %q must start with /", o.UpstreamHealthPath))
+	}
+	if o.UpstreamHealthInterval < time.Second {
+		msgs = append(msgs, "upstream_health_interval must be at least 1s")
+	}
+	if o.UpstreamMaxFails < 0 {
+		msgs = append(msgs, "upstream_max_fails must not be negative")
+	}
+	if o.UpstreamSRVInterval < time.Second {
+		msgs = append(msgs, "upstream_srv_interval must be at least 1s")
+	}
+	type pool struct{ upstreams, named, other int }
+	var paths []string
+	pools := make(map[string]*pool)
+	for i, u := range o.proxyURLs {
+		path := u.Path
+		if u.Scheme == "file" && u.Fragment != "" {
+			path = u.Fragment
+		}
+		p, ok := pools[path]
+		if !ok {
+			p = &pool{}
+			pools[path] = p
+			paths = append(paths, path)
+		}
+		p.upstreams++
+		if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "h2c" {
+			p.other++
 		}
+		if o.upstreamNames[i] != "" {
+			p.named++
+		}
+	}
+	for _, path := range paths {
+		p := pools[path]
+		if p.upstreams < 2 {
+			continue
+		}
+		if p.other > 0 {
+			msgs = append(msgs, fmt.Sprintf("path %q has several upstreams, which is only supported for http, https and h2c upstreams", path))
+		}
+		if p.named > 1 {
+			msgs = append(msgs, fmt.Sprintf("only one of the upstreams for path %q may be named", path))
+		}
+	}
+	return msgs
+}
+
+// parseUpstreamConns checks the upstream connection settings, none of which
+// may be negative
+func parseUpstreamConns(o *Options, msgs []string) []string {
+	if o.UpstreamMaxIdleConnsPerHost < 0 {
+		msgs = append(msgs, "upstream_max_idle_conns_per_host must not be negative")
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"upstream_idle_conn_timeout", o.UpstreamIdleConnTimeout},
+		{"upstream_dial_timeout", o.UpstreamDialTimeout},
+		{"upstream_tls_handshake_timeout", o.UpstreamTLSHandshakeTimeout},
+		{"upstream_response_header_timeout", o.UpstreamResponseHeaderTimeout},
+	} {
+		if d.value < 0 {
+			msgs = append(msgs, fmt.Sprintf("%s must not be negative", d.name))
+		}
+	}
+	o.upstreamConns = upstreamConnSettings{
+		MaxIdleConnsPerHost:   o.UpstreamMaxIdleConnsPerHost,
+		IdleConnTimeout:       o.UpstreamIdleConnTimeout,
+		DialTimeout:           o.UpstreamDialTimeout,
+		TLSHandshakeTimeout:   o.UpstreamTLSHandshakeTimeout,
+		ResponseHeaderTimeout: o.UpstreamResponseHeaderTimeout,
+	}
+	return msgs
+}
+
+// validateStaticUpstream checks the status code of a static:// upstream,
+// and that body is its only query parameter
+func validateStaticUpstream(u *url.URL, msgs []string) []string {
+	if u.Scheme != "static" {
+		return msgs
+	}
+	if code, err := strconv.Atoi(u.Host); err != nil || code < 100 || code > 599 {
+		msgs = append(msgs, fmt.Sprintf("invalid status code %q for static upstream %q", u.Host, u))
+	}
+	for name := range u.Query() {
+		if name != "body" {
+			msgs = append(msgs, fmt.Sprintf("unknown parameter %q for static upstream %q", name, u))
+		}
+	}
+	return msgs
+}
+
+// validateSRVUpstream checks the record name and scheme parameter of an
+// srv:// upstream. The port of its upstreams comes from the records.
+func validateSRVUpstream(u *url.URL, msgs []string) []string {
+	if u.Scheme != "srv" {
+		return msgs
+	}
+	if u.Hostname() == "" {
+		msgs = append(msgs, fmt.Sprintf("missing SRV record name for srv upstream %q", u))
+	}
+	if u.Port() != "" {
+		msgs = append(msgs, fmt.Sprintf("srv upstream %q can't have a port, it comes from the SRV records", u))
+	}
+	if scheme := u.Query().Get("scheme"); scheme != "" && scheme != "http" && scheme != "https" && scheme != "h2c" {
+		msgs = append(msgs, fmt.Sprintf("invalid scheme %q for srv upstream %q", scheme, u))
+	}
+	return msgs
+}
+
+// upstreamScheme is the scheme requests are proxied to an upstream with:
+// its own, or for srv upstreams the one given as their scheme parameter
+func upstreamScheme(u *url.URL) string {
+	if u.Scheme != "srv" {
+		return u.Scheme
+	}
+	if scheme := u.Query().Get("scheme"); scheme != "" {
+		return scheme
+	}
+	return "http"
+}
+
+// parseUpstreamOverride reads and strips the tls_server_name, dial_address,
+// http_version, alpn and keep_alive query parameters of an upstream URL
+func parseUpstreamOverride(u *url.URL, msgs []string) (upstreamOverride, []string) {
+	var o upstreamOverride
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "h2c" && u.Scheme != "srv" {
+		return o, msgs
+	}
+	params := u.Query()
+	o.TLSServerName = params.Get("tls_server_name")
+	o.DialAddress = params.Get("dial_address")
+	o.HTTPVersion = params.Get("http_version")
+	alpn := params.Get("alpn")
+	keepAlive := params.Get("keep_alive")
+	params.Del("tls_server_name")
+	params.Del("dial_address")
+	params.Del("http_version")
+	params.Del("alpn")
+	params.Del("keep_alive")
+	u.RawQuery = params.Encode()
+	msgs = parseUpstreamProtocol(u, &o, alpn, keepAlive, msgs)
+
+	if o.TLSServerName != "" && upstreamScheme(u) != "https" {
+		msgs = append(msgs, fmt.Sprintf(
+			"tls_server_name is only supported for https upstreams: %q", u))
+	}
+	if o.DialAddress != "" && u.Scheme == "srv" {
+		msgs = append(msgs, fmt.Sprintf(
+			"dial_address isn't supported for srv upstreams: %q", u))
+	} else if o.DialAddress != "" {
+		if _, _, err := net.SplitHostPort(o.DialAddress); err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid dial_address=%q for upstream %q: %s", o.DialAddress, u, err))
+		}
+	}
+	return o, msgs
+}
+
+// parseUpstreamProtocol validates the http_version of an upstream, and
+// reads its alpn and keep_alive parameters into o
+func parseUpstreamProtocol(u *url.URL, o *upstreamOverride, alpn, keepAlive string, msgs []string) []string {
+	https := upstreamScheme(u) == "https"
+	switch {
+	case o.HTTPVersion != "" && u.Scheme == "h2c":
+		msgs = append(msgs, fmt.Sprintf(
+			"http_version isn't supported for h2c upstreams, which always speak HTTP/2: %q", u))
+	case o.HTTPVersion == "2" && !https:
+		msgs = append(msgs, fmt.Sprintf(
+			"http_version=2 is only supported for https upstreams, use h2c:// for HTTP/2 over cleartext: %q", u))
+	case o.HTTPVersion != "" && o.HTTPVersion != "1.1" && o.HTTPVersion != "2":
+		msgs = append(msgs, fmt.Sprintf(
+			"invalid http_version=%q for upstream %q, expected 1.1 or 2", o.HTTPVersion, u))
+	}
+
+	if keepAlive != "" {
+		enabled, err := strconv.ParseBool(keepAlive)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid keep_alive=%q for upstream %q, expected true or false", keepAlive, u))
+		}
+		o.DisableKeepAlives = err == nil && !enabled
+	}
+
+	if alpn != "" {
+		var protos []string
+		for _, proto := range strings.Split(alpn, ",") {
+			if proto = strings.TrimSpace(proto); proto != "" {
+				protos = append(protos, proto)
+			}
+		}
+		o.ALPN = strings.Join(protos, ",")
+		offersH2 := strings.Contains(","+o.ALPN+",", ",h2,")
+		switch {
+		case !https:
+			msgs = append(msgs, fmt.Sprintf(
+				"alpn is only supported for https upstreams: %q", u))
+		case o.ALPN == "" || (o.ALPN != "none" && strings.Contains(","+o.ALPN+",", ",none,")):
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid alpn=%q for upstream %q, expected <protocol>,... or none", alpn, u))
+		case offersH2 && o.HTTPVersion == "1.1":
+			msgs = append(msgs, fmt.Sprintf(
+				"alpn=%q offers h2, which http_version=1.1 doesn't speak: %q", o.ALPN, u))
+		case offersH2 && o.DisableKeepAlives:
+			msgs = append(msgs, fmt.Sprintf(
+				"alpn=%q offers h2, which keep_alive=false doesn't speak: %q", o.ALPN, u))
+		case !offersH2 && o.HTTPVersion == "2":
+			msgs = append(msgs, fmt.Sprintf(
+				"alpn=%q doesn't offer h2, which http_version=2 requires: %q", o.ALPN, u))
+		}
+	}
+
+	if o.DisableKeepAlives && (u.Scheme == "h2c" || o.HTTPVersion == "2") {
+		msgs = append(msgs, fmt.Sprintf(
+			"keep_alive=false isn't supported for HTTP/2 upstreams: %q", u))
 	}
 	return msgs
 }
 
+// parseUpstreamSignature reads and strips the signature_header and
+// signature_headers query parameters of an upstream URL. signed is whether
+// a signature key is configured.
+func parseUpstreamSignature(u *url.URL, signed bool, msgs []string) (upstreamSignature, []string) {
+	var s upstreamSignature
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "h2c" && u.Scheme != "srv" {
+		return s, msgs
+	}
+	params := u.Query()
+	s.Header = params.Get("signature_header")
+	for _, name := range strings.Split(params.Get("signature_headers"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			s.Headers = append(s.Headers, http.CanonicalHeaderKey(name))
+		}
+	}
+	params.Del("signature_header")
+	params.Del("signature_headers")
+	u.RawQuery = params.Encode()
+
+	if (s.Header != "" || s.Headers != nil) && !signed {
+		msgs = append(msgs, fmt.Sprintf(
+			"signature_header and signature_headers require signature-key: %q", u))
+	}
+	for _, name := range append([]string{s.Header}, s.Headers...) {
+		if strings.ContainsAny(name, " \t\r\n:") {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid signature header name %q for upstream %q", name, u))
+		}
+	}
+	return s, msgs
+}
+
 func parseSignatureKey(o *Options, msgs []string) []string {
 	if o.SignatureKey == "" {
 		return msgs
@@ -300,10 +1637,307 @@ func parseSignatureKey(o *Options, msgs []string) []string {
 	return msgs
 }
 
+// parseProviderDomains reads the domain=provider pairs used to pin email
+// domains to the provider they must sign in with.
+func parseProviderDomains(o *Options, msgs []string) []string {
+	o.providerDomains = make(map[string]string)
+	for _, pd := range o.ProviderDomains {
+		components := strings.SplitN(pd, "=", 2)
+		if len(components) != 2 || components[0] == "" || components[1] == "" {
+			msgs = append(msgs, "invalid provider-domain domain=provider spec: "+pd)
+			continue
+		}
+		domain := strings.ToLower(strings.TrimPrefix(components[0], "@"))
+		o.providerDomains[domain] = strings.ToLower(components[1])
+	}
+	return msgs
+}
+
+// parseGuestRoutes compiles the path patterns guest sessions may access,
+// or collects the upstream names given as "upstream:<name>".
+// Guest access is only enabled when admins are configured to mint codes.
+func parseGuestRoutes(o *Options, msgs []string) []string {
+	if len(o.GuestAdmins) > 0 && len(o.GuestRoutes) == 0 {
+		msgs = append(msgs, "missing setting: guest-route")
+	}
+	for _, r := range o.GuestRoutes {
+		if strings.HasPrefix(r, "upstream:") {
+			name := strings.TrimPrefix(r, "upstream:")
+			for _, n := range o.upstreamNames {
+				if n == name {
+					if o.guestUpstreams == nil {
+						o.guestUpstreams = make(map[string]bool)
+					}
+					o.guestUpstreams[name] = true
+				}
+			}
+			if !o.guestUpstreams[name] {
+				msgs = append(msgs, fmt.Sprintf("guest-route=%q names an unknown upstream", r))
+			}
+			continue
+		}
+		compiled, err := regexp.Compile(r)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"error compiling guest-route=%q %s", r, err))
+			continue
+		}
+		o.guestRoutes = append(o.guestRoutes, compiled)
+	}
+	return msgs
+}
+
+// parseCacheControl compiles the routes whose authenticated responses get
+// the cache_control header
+func parseCacheControl(o *Options, msgs []string) []string {
+	if o.CacheControl == "" {
+		if len(o.CacheControlRoutes) > 0 || len(o.CacheControlContentTypes) > 0 {
+			msgs = append(msgs, "cache_control_routes and cache_control_content_types require cache_control")
+		}
+		return msgs
+	}
+	if strings.ContainsAny(o.CacheControl, "\r\n") {
+		msgs = append(msgs, fmt.Sprintf("invalid cache_control %q", o.CacheControl))
+	}
+	for _, r := range o.CacheControlRoutes {
+		compiled, err := regexp.Compile(r)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"error compiling cache-control-route=%q %s", r, err))
+			continue
+		}
+		o.cacheRoutes = append(o.cacheRoutes, compiled)
+	}
+	return msgs
+}
+
+// rateLimitRoute is the per-user rate limit of the paths starting with
+// prefix, in requests per minute, or none when 0
+type rateLimitRoute struct {
+	prefix    string
+	perMinute int
+}
+
+// parseRateLimitRoutes reads the "<path prefix>=<requests per minute>"
+// routes whose proxied requests have their own rate limit
+func parseRateLimitRoutes(o *Options, msgs []string) []string {
+	if o.RateLimit < 0 {
+		msgs = append(msgs, "rate_limit must not be negative")
+	}
+	for _, spec := range o.RateLimitRoutes {
+		i := strings.LastIndex(spec, "=")
+		if i < 1 || !strings.HasPrefix(spec, "/") {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid rate-limit-route=%q, expected <path prefix>=<requests per minute>", spec))
+			continue
+		}
+		perMinute, err := strconv.Atoi(spec[i+1:])
+		if err != nil || perMinute < 0 {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid rate-limit-route=%q, the rate must be a number of requests per minute, or 0 for none", spec))
+			continue
+		}
+		o.rateLimitRoutes = append(o.rateLimitRoutes, rateLimitRoute{prefix: spec[:i], perMinute: perMinute})
+	}
+	return msgs
+}
+
+// parseScopeRoutes reads the "<path regex>=<scope>[ <scope>...]" routes that
+// need scopes beyond the base scope
+func parseScopeRoutes(o *Options, msgs []string) []string {
+	if len(o.ScopeRoutes) > 0 && !o.PassAccessToken {
+		// the merged token is only kept in the session, and passed on, with
+		// pass_access_token
+		msgs = append(msgs, "scope_routes requires pass_access_token")
+	}
+	for _, spec := range o.ScopeRoutes {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || len(strings.Fields(parts[1])) == 0 {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid scope-route=%q, expected <path regex>=<scope>", spec))
+			continue
+		}
+		compiled, err := regexp.Compile(parts[0])
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"error compiling scope-route=%q %s", spec, err))
+			continue
+		}
+		o.scopeRoutes = append(o.scopeRoutes, scopeRoute{
+			path:   compiled,
+			scopes: strings.Fields(parts[1]),
+		})
+	}
+	return msgs
+}
+
+// parseSessionAgeRoutes reads the "<path regex>=<duration>" routes that
+// need a session younger than the duration
+func parseSessionAgeRoutes(o *Options, msgs []string) []string {
+	for _, spec := range o.SessionAgeRoutes {
+		i := strings.LastIndex(spec, "=")
+		if i < 0 {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid max-session-age-route=%q, expected <path regex>=<duration>", spec))
+			continue
+		}
+		compiled, err := regexp.Compile(spec[:i])
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"error compiling max-session-age-route=%q %s", spec, err))
+			continue
+		}
+		maxAge, err := time.ParseDuration(spec[i+1:])
+		if err != nil || maxAge <= 0 {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid max-session-age-route=%q, the duration must be positive", spec))
+			continue
+		}
+		o.sessionAgeRoutes = append(o.sessionAgeRoutes, sessionAgeRoute{path: compiled, maxAge: maxAge})
+	}
+	if len(o.SessionAgeRoutes) > 0 && o.AuthOnlyCacheTTL > 0 {
+		// the auth endpoint checks the path it's asked about, which its
+		// cache doesn't key on
+		msgs = append(msgs, "auth_only_cache_ttl can't be used with max_session_age_routes")
+	}
+	return msgs
+}
+
+// parseTraceSampling reads the "<path regex>=<rate>" sampling rates of the
+// routes traced at other than trace_sample_rate
+func parseTraceSampling(o *Options, msgs []string) []string {
+	if o.TraceSampleRate < 0 || o.TraceSampleRate > 1 {
+		msgs = append(msgs, "trace_sample_rate must be between 0 and 1")
+	}
+	for _, spec := range o.TraceSampleRoutes {
+		i := strings.LastIndex(spec, "=")
+		if i < 0 {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid trace-sample-route=%q, expected <path regex>=<rate>", spec))
+			continue
+		}
+		rate, err := strconv.ParseFloat(spec[i+1:], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid trace-sample-route=%q, the rate must be between 0 and 1", spec))
+			continue
+		}
+		compiled, err := regexp.Compile(spec[:i])
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf(
+				"error compiling trace-sample-route=%q %s", spec, err))
+			continue
+		}
+		o.traceRoutes = append(o.traceRoutes, traceRoute{path: compiled, rate: rate})
+	}
+	return msgs
+}
+
+// parseOTLP reads the endpoint, "<name>=<value>" headers and "<key>=<value>"
+// resource attributes of the OTLP export
+func parseOTLP(o *Options, msgs []string) []string {
+	if o.OTLPEndpoint == "" {
+		if len(o.OTLPHeaders) > 0 || len(o.OTLPResourceAttributes) > 0 {
+			msgs = append(msgs, "otlp_headers and otlp_resource_attributes are only used with otlp_endpoint")
+		}
+		return msgs
+	}
+	if u, err := url.Parse(o.OTLPEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		msgs = append(msgs, fmt.Sprintf("invalid otlp_endpoint %q, expected an http(s) url", o.OTLPEndpoint))
+	}
+	if o.OTLPMetricsInterval <= 0 {
+		msgs = append(msgs, "otlp_metrics_interval must be positive")
+	}
+	o.otlpHeaders = make(http.Header)
+	for _, spec := range o.OTLPHeaders {
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid otlp-header=%q, expected <name>=<value>", spec))
+			continue
+		}
+		o.otlpHeaders.Add(kv[0], kv[1])
+	}
+	for _, spec := range o.OTLPResourceAttributes {
+		if kv := strings.SplitN(spec, "=", 2); len(kv) != 2 || kv[0] == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid otlp-resource-attribute=%q, expected <key>=<value>", spec))
+		}
+	}
+	o.otlpResource = otlpResourceAttributes(o.OTLPResourceAttributes)
+	return msgs
+}
+
+// upstreamTagRegex matches the tags that may be put in logs and metric
+// labels
+var upstreamTagRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// parseUpstreamTags reads the "<upstream name>=<tag>" cost attribution
+// tags of named upstreams
+func parseUpstreamTags(o *Options, msgs []string) []string {
+	for _, spec := range o.UpstreamTags {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || !upstreamTagRegex.MatchString(parts[1]) {
+			msgs = append(msgs, fmt.Sprintf("invalid upstream-tag %q, expected <upstream name>=<tag>", spec))
+			continue
+		}
+		name, tag := parts[0], parts[1]
+		known := false
+		for _, n := range o.upstreamNames {
+			known = known || (n != "" && n == name)
+		}
+		if !known {
+			msgs = append(msgs, fmt.Sprintf("upstream-tag=%q names an unknown upstream", spec))
+			continue
+		}
+		if _, ok := o.upstreamTags[name]; ok {
+			msgs = append(msgs, fmt.Sprintf("upstream %q is tagged more than once", name))
+			continue
+		}
+		if o.upstreamTags == nil {
+			o.upstreamTags = make(map[string]string)
+		}
+		o.upstreamTags[name] = tag
+	}
+	return msgs
+}
+
 func validateCookieName(o *Options, msgs []string) []string {
-	cookie := &http.Cookie{Name: o.CookieName}
-	if cookie.String() == "" {
-		return append(msgs, fmt.Sprintf("invalid cookie name: %q", o.CookieName))
+	names := append([]string{o.CookieName}, o.CookieNamePrevious...)
+	for _, name := range append(names, o.CookieNameAliases...) {
+		cookie := &http.Cookie{Name: name}
+		if cookie.String() == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid cookie name: %q", name))
+		}
+	}
+	return msgs
+}
+
+// validateCookieMigration checks the previous cookie format is one the
+// current cipher can't read, and that it can be read
+func validateCookieMigration(o *Options, msgs []string) []string {
+	switch o.CookiePreviousSerialization {
+	case cookieSerializationSession, cookieSerializationEmail:
+	default:
+		msgs = append(msgs, fmt.Sprintf("invalid cookie_previous_serialization %q, expected %s or %s",
+			o.CookiePreviousSerialization, cookieSerializationSession, cookieSerializationEmail))
+	}
+	if !o.CookieMigration {
+		if o.CookieSecretPrevious != "" || o.CookiePreviousCipher || o.CookiePreviousSerialization != cookieSerializationSession {
+			msgs = append(msgs, "cookie_secret_previous, cookie_previous_cipher and cookie_previous_serialization are only used with cookie_migration")
+		}
+		return msgs
+	}
+	secret := o.CookieSecretPrevious
+	if secret == "" {
+		secret = o.CookieSecret
+	}
+	if o.CookiePreviousCipher {
+		if _, err := cookie.NewCipher(secretBytes(secret)); err != nil {
+			msgs = append(msgs, fmt.Sprintf("cookie_previous_cipher needs a previous cookie secret of 16, 24 or 32 bytes: %s", err))
+		}
+	}
+	encrypted := o.PassAccessToken || o.CookieRefresh != time.Duration(0)
+	if secret == o.CookieSecret && o.CookiePreviousCipher == encrypted && o.CookiePreviousSerialization == cookieSerializationSession {
+		msgs = append(msgs, "cookie_migration needs a previous format other than the current one: set cookie_secret_previous, cookie_previous_cipher or cookie_previous_serialization")
 	}
 	return msgs
 }
@@ -3,11 +3,14 @@ package main
 import (
 	"crypto"
 	"fmt"
+	"net/http"
 	"net/url"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/bitly/oauth2_proxy/api"
+	"github.com/bitly/oauth2_proxy/providers"
 	"github.com/bmizerany/assert"
 )
 
@@ -54,6 +57,32 @@ func TestGoogleGroupOptions(t *testing.T) {
 	assert.Equal(t, expected, err.Error())
 }
 
+func TestGoogleHostedDomains(t *testing.T) {
+	o := testOptions()
+	o.EmailDomains = []string{"example.com", "example.org"}
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.GoogleProvider)
+	assert.Equal(t, []string{"example.com", "example.org"}, p.HostedDomains)
+
+	o = testOptions()
+	o.EmailDomains = []string{"example.com", "*"}
+	assert.Equal(t, nil, o.Validate())
+	p = o.provider.(*providers.GoogleProvider)
+	assert.Equal(t, 0, len(p.HostedDomains))
+}
+
+func TestWildcardEmailDomains(t *testing.T) {
+	o := testOptions()
+	o.EmailDomains = []string{"*.example.com"}
+	assert.Equal(t, nil, o.Validate())
+
+	o = testOptions()
+	o.EmailDomains = []string{"eu.*.com", "*."}
+	assert.Equal(t, errorMsg([]string{
+		`invalid email_domain "eu.*.com": a wildcard may only start a domain, ie. *.example.com`,
+		`invalid email_domain "*.": a wildcard may only start a domain, ie. *.example.com`}), o.Validate().Error())
+}
+
 func TestGoogleGroupInvalidFile(t *testing.T) {
 	o := testOptions()
 	o.GoogleGroups = []string{"test_group"}
@@ -96,6 +125,174 @@ func TestProxyURLs(t *testing.T) {
 	assert.Equal(t, expected, o.proxyURLs)
 }
 
+func TestUpstreamOverrides(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"https://app.internal/?dial_address=10.0.0.1:443&tls_server_name=app.example.com&x=1",
+		"http://127.0.0.1:8081/",
+	}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "x=1", o.proxyURLs[0].RawQuery)
+	assert.Equal(t, upstreamOverride{
+		TLSServerName: "app.example.com",
+		DialAddress:   "10.0.0.1:443",
+	}, o.upstreamOverrides[0])
+	assert.Equal(t, upstreamOverride{}, o.upstreamOverrides[1])
+}
+
+func TestUpstreamOverridesInvalid(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"http://app.internal/?tls_server_name=app.example.com",
+		"https://app.internal/?dial_address=10.0.0.1",
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.Contains(err.Error(),
+		"tls_server_name is only supported for https upstreams"))
+	assert.Equal(t, true, strings.Contains(err.Error(),
+		`invalid dial_address="10.0.0.1"`))
+}
+
+func TestUpstreamProtocol(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"https://a.internal/?http_version=2&alpn=h2,+http/1.1",
+		"https://b.internal/?http_version=1.1&keep_alive=false",
+		"https://c.internal/?alpn=none",
+	}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "", o.proxyURLs[0].RawQuery)
+	assert.Equal(t, upstreamOverride{HTTPVersion: "2", ALPN: "h2,http/1.1"}, o.upstreamOverrides[0])
+	assert.Equal(t, upstreamOverride{HTTPVersion: "1.1", DisableKeepAlives: true}, o.upstreamOverrides[1])
+	assert.Equal(t, upstreamOverride{ALPN: "none"}, o.upstreamOverrides[2])
+}
+
+func TestUpstreamProtocolInvalid(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"http://a.internal/?http_version=2",
+		"h2c://b.internal/?http_version=2",
+		"https://c.internal/?http_version=3",
+		"http://d.internal/?alpn=h2",
+		"https://e.internal/?alpn=h2&http_version=1.1",
+		"https://f.internal/?alpn=none,h2",
+		"https://g.internal/?keep_alive=maybe",
+		"https://h.internal/?keep_alive=false&http_version=2",
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	for _, msg := range []string{
+		`http_version=2 is only supported for https upstreams, use h2c:// for HTTP/2 over cleartext: "http://a.internal/"`,
+		`http_version isn't supported for h2c upstreams, which always speak HTTP/2: "h2c://b.internal/"`,
+		`invalid http_version="3" for upstream "https://c.internal/", expected 1.1 or 2`,
+		`alpn is only supported for https upstreams: "http://d.internal/"`,
+		`alpn="h2" offers h2, which http_version=1.1 doesn't speak: "https://e.internal/"`,
+		`invalid alpn="none,h2" for upstream "https://f.internal/", expected <protocol>,... or none`,
+		`invalid keep_alive="maybe" for upstream "https://g.internal/", expected true or false`,
+		`keep_alive=false isn't supported for HTTP/2 upstreams: "https://h.internal/"`,
+	} {
+		assert.Equal(t, true, strings.Contains(err.Error(), msg))
+	}
+}
+
+func TestStaticUpstreamsInvalid(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"static://ok/",
+		"static://600/a/",
+		"static://200/b/?body=OK&type=json",
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	for _, msg := range []string{
+		`invalid status code "ok" for static upstream "static://ok/"`,
+		`invalid status code "600" for static upstream "static://600/a/"`,
+		`unknown parameter "type" for static upstream`,
+	} {
+		assert.Equal(t, true, strings.Contains(err.Error(), msg))
+	}
+}
+
+func TestUpstreamNames(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"http://10.0.0.5:8080/billing/?name=billing-api&x=1",
+		"http://127.0.0.1:8081/",
+	}
+	o.GuestRoutes = []string{"upstream:billing-api", "^/review/"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "x=1", o.proxyURLs[0].RawQuery)
+	assert.Equal(t, []string{"billing-api", ""}, o.upstreamNames)
+	assert.Equal(t, map[string]bool{"billing-api": true}, o.guestUpstreams)
+	assert.Equal(t, 1, len(o.guestRoutes))
+}
+
+func TestUpstreamTags(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"http://10.0.0.5:8080/billing/?name=billing-api",
+		"http://10.0.0.6:8080/search/?name=search",
+	}
+	o.UpstreamTags = []string{"billing-api=payments", "search=cc-1234"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, map[string]string{"billing-api": "payments", "search": "cc-1234"}, o.upstreamTags)
+
+	o = testOptions()
+	o.Upstreams = []string{"http://10.0.0.5:8080/billing/?name=billing-api"}
+	o.UpstreamTags = []string{"billing-api=payments", "billing-api=finance", "search=cc-1234", "payments", "billing-api=a b"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		`upstream "billing-api" is tagged more than once`,
+		`upstream-tag="search=cc-1234" names an unknown upstream`,
+		`invalid upstream-tag "payments", expected <upstream name>=<tag>`,
+		`invalid upstream-tag "billing-api=a b", expected <upstream name>=<tag>`,
+	}), err.Error())
+}
+
+func TestUpstreamNamesInvalid(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"http://10.0.0.5:8080/a/?name=api",
+		"http://10.0.0.6:8080/b/?name=api",
+		"http://10.0.0.7:8080/c/?name=../x",
+	}
+	o.GuestRoutes = []string{"upstream:billing-api"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	for _, msg := range []string{
+		`duplicate upstream name "api"`,
+		`invalid name="../x"`,
+		`guest-route="upstream:billing-api" names an unknown upstream`,
+	} {
+		assert.Equal(t, true, strings.Contains(err.Error(), msg))
+	}
+}
+
+func TestCognitoDomainRequired(t *testing.T) {
+	o := testOptions()
+	o.Provider = "cognito"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.Contains(err.Error(), "missing setting: cognito-domain"))
+}
+
+func TestAppleSettingsRequired(t *testing.T) {
+	o := testOptions()
+	o.Provider = "apple"
+	o.ClientSecret = ""
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"missing setting: apple-team-id",
+		"missing setting: apple-key-id",
+		"missing setting: apple-private-key-file",
+	})
+	assert.Equal(t, expected, err.Error())
+}
+
 func TestCompiledRegex(t *testing.T) {
 	o := testOptions()
 	regexps := []string{"/foo/.*", "/ba[rz]/quux"}
@@ -108,6 +305,23 @@ func TestCompiledRegex(t *testing.T) {
 	assert.Equal(t, regexps, actual)
 }
 
+func TestTrustedIPs(t *testing.T) {
+	o := testOptions()
+	o.TrustedIPs = []string{"10.0.0.0/8", "192.168.1.10", "fd00::/8"}
+	assert.Equal(t, nil, o.Validate())
+	actual := make([]string, 0)
+	for _, ipNet := range o.trustedNets {
+		actual = append(actual, ipNet.String())
+	}
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.1.10/32", "fd00::/8"}, actual)
+
+	o = testOptions()
+	o.TrustedIPs = []string{"10.0.0.0/33", "internal"}
+	assert.Equal(t, errorMsg([]string{
+		`invalid trusted_ip "10.0.0.0/33", expected an address or a CIDR`,
+		`invalid trusted_ip "internal", expected an address or a CIDR`}), o.Validate().Error())
+}
+
 func TestCompiledRegexError(t *testing.T) {
 	o := testOptions()
 	o.SkipAuthRegex = []string{"(foobaz", "barquux)"}
@@ -231,3 +445,181 @@ func TestValidateCookieBadName(t *testing.T) {
 	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
 		fmt.Sprintf("  invalid cookie name: %q", o.CookieName))
 }
+
+func TestProviderDomains(t *testing.T) {
+	o := testOptions()
+	o.ProviderDomains = []string{"Example.com=google", "@corp.com=GitHub"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, map[string]string{
+		"example.com": "google",
+		"corp.com":    "github",
+	}, o.providerDomains)
+}
+
+func TestProviderDomainsInvalidSpec(t *testing.T) {
+	o := testOptions()
+	o.ProviderDomains = []string{"example.com"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"invalid provider-domain domain=provider spec: example.com"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestGiteaURLRequired(t *testing.T) {
+	o := testOptions()
+	o.Provider = "gitea"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.Contains(err.Error(), "missing setting: gitea-url"))
+
+	o = testOptions()
+	o.Provider = "forgejo"
+	o.GiteaURL = "https://git.example.com"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "https://git.example.com/api/v1", o.provider.Data().ValidateURL.String())
+}
+
+func TestSignProviderRequests(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.SignProviderRequests = []string{
+		"validate=aws-sigv4:us-east-1:execute-api",
+		"https://auth.example.com/oauth2/=aws-sigv4:us-east-1:execute-api",
+	}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.signingRules))
+	assert.Equal(t, "https://api.github.com/", o.signingRules[0].Prefix)
+	assert.Equal(t, "https://auth.example.com/oauth2/", o.signingRules[1].Prefix)
+
+	for _, spec := range []string{
+		"validate",
+		"validate=unknown",
+		"profile=aws-sigv4:us-east-1:execute-api",
+		"/relative=aws-sigv4:us-east-1:execute-api",
+	} {
+		o := testOptions()
+		o.Provider = "github"
+		o.SignProviderRequests = []string{spec}
+		assert.NotEqual(t, nil, o.Validate())
+	}
+}
+
+func TestProviderResponsePolicy(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, api.RedirectNone, o.ProviderRedirects)
+	assert.Equal(t, api.DefaultContentTypes, o.providerContentTypes)
+
+	o = testOptions()
+	o.ProviderRedirects = "same-host"
+	o.ProviderContentTypes = []string{"application/json", "Text/XML; charset=utf-8"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, []string{"application/json", "text/xml"}, o.providerContentTypes)
+
+	o = testOptions()
+	o.ProviderRedirects = "all"
+	o.ProviderContentTypes = []string{"json"}
+	assert.Equal(t, errorMsg([]string{
+		`invalid provider_redirects "all", expected none, same-host or any`,
+		`invalid provider_content_type "json", expected <type>/<subtype>`}), o.Validate().Error())
+}
+
+func TestGitHubRepoOptions(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubRepo = "acme"
+	assert.NotEqual(t, nil, o.Validate())
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubToken = "token"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.Contains(err.Error(), "missing setting: github-repo"))
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubRepo = "acme/staging"
+	o.GitHubToken = "token"
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestUpstreamConnOptions(t *testing.T) {
+	o := testOptions()
+	o.UpstreamMaxIdleConnsPerHost = -1
+	o.UpstreamDialTimeout = -time.Second
+	o.UpstreamResponseHeaderTimeout = -time.Second
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"upstream_max_idle_conns_per_host must not be negative",
+		"upstream_dial_timeout must not be negative",
+		"upstream_response_header_timeout must not be negative",
+	}), err.Error())
+}
+
+func TestUpstreamSignatureRequiresKey(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:8080/?signature_header=X-Hub-Signature"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		`signature_header and signature_headers require signature-key: "http://127.0.0.1:8080/"`,
+	}), err.Error())
+}
+
+func TestTLSInsecureSkipVerifyAppliesToUpstreams(t *testing.T) {
+	client := http.DefaultClient
+	o := testOptions()
+	o.TLSInsecureSkipVerify = true
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, true, o.tlsclientconfig.InsecureSkipVerify)
+	// the provider client is left to newProviderClient
+	assert.Equal(t, client, http.DefaultClient)
+}
+
+func TestTLSACMEOptions(t *testing.T) {
+	o := testOptions()
+	o.TLSACME = true
+	o.TLSCertFile = []string{"/etc/ssl/cert.pem"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"tls_acme can't be used with tls_cert_file",
+		"tls_acme requires at least one tls_acme_domain",
+		"tls_acme requires tls_acme_cache_dir",
+	}), err.Error())
+
+	o = testOptions()
+	o.TLSACME = true
+	o.TLSACMEDomains = []string{"auth.example.com"}
+	o.TLSACMECacheDir = "/var/cache/oauth2_proxy"
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestTLSSessionOptions(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, true, o.TLSSessionTickets)
+	o.TLSSessionTickets = false
+	o.TLSSessionTicketSecret = "too short"
+	o.TLSSessionTicketRotation = 0
+	o.TLSOCSPStapling = true
+	o.TLSACME = true
+	o.TLSACMEDomains = []string{"auth.example.com"}
+	o.TLSACMECacheDir = "/var/cache/oauth2_proxy"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"tls_session_ticket_secret requires tls_session_tickets",
+		"tls_session_ticket_secret must be at least 32 bytes",
+		"tls_session_ticket_rotation must be positive",
+		"tls_ocsp_stapling can't be used with tls_acme",
+	}), err.Error())
+
+	o = testOptions()
+	o.TLSSessionTicketSecret = "0123456789abcdef0123456789abcdef"
+	o.TLSOCSPStapling = true
+	assert.Equal(t, nil, o.Validate())
+}
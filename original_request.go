@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Headers describing the request a client made, for upstreams and WAF
+// modules whose policies depend on it: the URL and method may be rewritten
+// on the way to them, ie. by upstream path prefixes
+const (
+	originalURLHeader    = "X-Original-URL"
+	originalMethodHeader = "X-Original-Method"
+	forwardedURIHeader   = "X-Forwarded-Uri"
+)
+
+// originalRequest is the URL, and its path and query as uri, and method of
+// the request a client made
+type originalRequest struct {
+	url    string
+	uri    string
+	method string
+}
+
+// proxiedOriginalRequest is the original request of req, a request being
+// proxied to an upstream
+func proxiedOriginalRequest(req *http.Request) originalRequest {
+	uri := req.URL.RequestURI()
+	return originalRequest{url: forwardedScheme(req) + "://" + req.Host + uri, uri: uri, method: req.Method}
+}
+
+// authOriginalRequest is the original request req, a request to the auth
+// endpoint, asks about, as given by the X-Forwarded-* headers of Traefik's
+// forward auth or the X-Original-* headers of an nginx auth_request. Those
+// it doesn't give are left empty.
+func authOriginalRequest(req *http.Request) originalRequest {
+	o := originalRequest{
+		uri:    firstHeader(req.Header, forwardedURIHeader, "X-Original-URI"),
+		method: firstHeader(req.Header, "X-Forwarded-Method", originalMethodHeader),
+	}
+	o.url = req.Header.Get(originalURLHeader)
+	if o.url == "" && o.uri != "" {
+		host := req.Header.Get("X-Forwarded-Host")
+		if host == "" {
+			host = req.Host
+		}
+		o.url = forwardedScheme(req) + "://" + host + o.uri
+	}
+	return o
+}
+
+// forwardedScheme is the scheme the client made req with, as given by the
+// X-Forwarded-Proto header of a load balancer, or else the one req was
+// received with
+func forwardedScheme(req *http.Request) string {
+	if scheme := req.Header.Get("X-Forwarded-Proto"); scheme != "" {
+		return scheme
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// firstHeader is the value of the first of names set in header
+func firstHeader(header http.Header, names ...string) string {
+	for _, name := range names {
+		if value := header.Get(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// setHeaders sets the headers describing o in header, replacing any a
+// client sent
+func (o originalRequest) setHeaders(header http.Header) {
+	for name, value := range map[string]string{
+		originalURLHeader:    o.url,
+		forwardedURIHeader:   o.uri,
+		originalMethodHeader: o.method,
+	} {
+		if value == "" {
+			header.Del(name)
+			continue
+		}
+		header.Set(name, value)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestPassOriginalRequest(t *testing.T) {
+	var seen http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+	}))
+	defer backend.Close()
+
+	newProxy := func(pass bool) *OAuthProxy {
+		opts := testOptions()
+		opts.Upstreams = []string{backend.URL + "/"}
+		opts.PassOriginalRequest = pass
+		opts.SkipAuthRegex = []string{"^/public"}
+		assert.Equal(t, nil, opts.Validate())
+		return NewOAuthProxy(opts, func(string) bool { return true })
+	}
+	proxy := newProxy(true)
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest("POST", "http://app.example.com/public/form?step=2", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set(originalMethodHeader, "GET")
+		return req
+	}
+	proxy.ServeHTTP(httptest.NewRecorder(), newRequest())
+	assert.Equal(t, "https://app.example.com/public/form?step=2", seen.Get(originalURLHeader))
+	assert.Equal(t, "/public/form?step=2", seen.Get(forwardedURIHeader))
+	assert.Equal(t, "POST", seen.Get(originalMethodHeader))
+
+	// without the option the client's headers go through untouched
+	proxy = newProxy(false)
+	proxy.ServeHTTP(httptest.NewRecorder(), newRequest())
+	assert.Equal(t, "", seen.Get(originalURLHeader))
+	assert.Equal(t, "GET", seen.Get(originalMethodHeader))
+}
+
+func TestAuthOriginalRequest(t *testing.T) {
+	// Traefik forward auth
+	req := httptest.NewRequest("GET", "http://proxy.internal/oauth2/auth", nil)
+	req.Header.Set("X-Forwarded-Method", "DELETE")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "app.example.com")
+	req.Header.Set(forwardedURIHeader, "/items/1")
+	rw := httptest.NewRecorder()
+	authOriginalRequest(req).setHeaders(rw.Header())
+	assert.Equal(t, "https://app.example.com/items/1", rw.Header().Get(originalURLHeader))
+	assert.Equal(t, "/items/1", rw.Header().Get(forwardedURIHeader))
+	assert.Equal(t, "DELETE", rw.Header().Get(originalMethodHeader))
+
+	// nginx auth_request, without the method
+	req = httptest.NewRequest("GET", "http://app.example.com/oauth2/auth", nil)
+	req.Header.Set("X-Original-URI", "/items/1")
+	rw = httptest.NewRecorder()
+	authOriginalRequest(req).setHeaders(rw.Header())
+	assert.Equal(t, "http://app.example.com/items/1", rw.Header().Get(originalURLHeader))
+	assert.Equal(t, "", rw.Header().Get(originalMethodHeader))
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/uber/jaeger-client-go"
+)
+
+const (
+	// otlpSpanQueueSize bounds the spans waiting to be exported; spans
+	// finished while it's full are dropped
+	otlpSpanQueueSize = 2048
+	// otlpSpanBatchSize spans are exported at once, at most
+	otlpSpanBatchSize = 512
+	// otlpSpanFlushInterval is how often pending spans are exported
+	otlpSpanFlushInterval = 5 * time.Second
+	otlpExportTimeout     = 10 * time.Second
+
+	// OTLP enum values
+	otlpSpanKindInternal      = 1
+	otlpSpanKindServer        = 2
+	otlpSpanKindClient        = 3
+	otlpStatusCodeError       = 2
+	otlpTemporalityCumulative = 2
+)
+
+var otlpExportCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "otlp_exports_total",
+	Help: "OTLP exports of spans and metrics.",
+}, []string{"signal", "result"})
+
+func init() {
+	prometheus.MustRegister(otlpExportCounter)
+}
+
+// otlpExporter sends traces and metrics to an OpenTelemetry collector with
+// OTLP over HTTP, encoded as JSON
+type otlpExporter struct {
+	endpoint string
+	headers  http.Header
+	resource otlpResource
+	client   *http.Client
+}
+
+func newOTLPExporter(opts *Options) *otlpExporter {
+	return &otlpExporter{
+		endpoint: strings.TrimSuffix(opts.OTLPEndpoint, "/"),
+		headers:  opts.otlpHeaders,
+		resource: otlpResource{Attributes: opts.otlpResource},
+		client:   &http.Client{Timeout: otlpExportTimeout},
+	}
+}
+
+// otlpResourceAttributes are the standard resource attributes of the proxy,
+// overridden by the configured ones
+func otlpResourceAttributes(configured []string) []otlpKeyValue {
+	hostname, _ := os.Hostname()
+	values := map[string]string{
+		"service.name":        "oauth2_proxy",
+		"service.version":     VERSION,
+		"service.instance.id": hostname,
+		"host.name":           hostname,
+	}
+	for _, attribute := range configured {
+		if kv := strings.SplitN(attribute, "=", 2); len(kv) == 2 {
+			values[kv[0]] = kv[1]
+		}
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var attributes []otlpKeyValue
+	for _, key := range keys {
+		attributes = append(attributes, otlpAttribute(key, values[key]))
+	}
+	return attributes
+}
+
+// export POSTs body to path, ie. /v1/traces, of the endpoint
+func (e *otlpExporter) export(path string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.endpoint+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for name, values := range e.headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %d", e.endpoint+path, resp.StatusCode)
+	}
+	return nil
+}
+
+// scope is the instrumentation scope of everything the proxy exports
+func (e *otlpExporter) scope() otlpScope {
+	return otlpScope{Name: "oauth2_proxy", Version: VERSION}
+}
+
+// The OTLP JSON encoding: 64 bit integers are strings, and trace and span ids
+// hex strings.
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    string   `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	var v otlpAnyValue
+	switch value := value.(type) {
+	case bool:
+		v.BoolValue = &value
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		v.IntValue = fmt.Sprintf("%d", value)
+	case float32:
+		f := float64(value)
+		v.DoubleValue = &f
+	case float64:
+		v.DoubleValue = &value
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+	return otlpKeyValue{Key: key, Value: v}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code,omitempty"`
+}
+
+// newOTLPSpan converts a finished Jaeger span. Its span.kind and error tags
+// become the kind and status of the OTLP span, and its logs events.
+func newOTLPSpan(span *jaeger.Span) otlpSpan {
+	sc := span.SpanContext()
+	traceID := sc.TraceID()
+	s := otlpSpan{
+		TraceID:           fmt.Sprintf("%016x%016x", traceID.High, traceID.Low),
+		SpanID:            fmt.Sprintf("%016x", uint64(sc.SpanID())),
+		Name:              span.OperationName(),
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: otlpTime(span.StartTime()),
+		EndTimeUnixNano:   otlpTime(span.StartTime().Add(span.Duration())),
+	}
+	if parent := sc.ParentID(); parent != 0 {
+		s.ParentSpanID = fmt.Sprintf("%016x", uint64(parent))
+	}
+	tags := span.Tags()
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch value := tags[key]; key {
+		case "span.kind":
+			switch fmt.Sprint(value) {
+			case "server":
+				s.Kind = otlpSpanKindServer
+			case "client":
+				s.Kind = otlpSpanKindClient
+			}
+		case "error":
+			if value == true {
+				s.Status.Code = otlpStatusCodeError
+			}
+		default:
+			s.Attributes = append(s.Attributes, otlpAttribute(key, value))
+		}
+	}
+	for _, record := range span.Logs() {
+		e := otlpEvent{TimeUnixNano: otlpTime(record.Timestamp), Name: "log"}
+		for _, field := range record.Fields {
+			if field.Key() == "event" {
+				e.Name = fmt.Sprint(field.Value())
+				continue
+			}
+			e.Attributes = append(e.Attributes, otlpAttribute(field.Key(), field.Value()))
+		}
+		s.Events = append(s.Events, e)
+	}
+	return s
+}
+
+// otlpSpanReporter is the jaeger.Reporter exporting the sampled spans in
+// batches, in the background
+type otlpSpanReporter struct {
+	exporter *otlpExporter
+	spans    chan otlpSpan
+	done     chan struct{}
+	closed   chan struct{}
+}
+
+func newOTLPSpanReporter(exporter *otlpExporter) *otlpSpanReporter {
+	r := &otlpSpanReporter{
+		exporter: exporter,
+		spans:    make(chan otlpSpan, otlpSpanQueueSize),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *otlpSpanReporter) Report(span *jaeger.Span) {
+	select {
+	case r.spans <- newOTLPSpan(span):
+	default:
+		otlpExportCounter.WithLabelValues("spans", "dropped").Inc()
+	}
+}
+
+// Close exports the pending spans
+func (r *otlpSpanReporter) Close() {
+	close(r.done)
+	<-r.closed
+}
+
+func (r *otlpSpanReporter) run() {
+	defer close(r.closed)
+	ticker := time.NewTicker(otlpSpanFlushInterval)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	for {
+		select {
+		case span := <-r.spans:
+			batch = append(batch, span)
+			if len(batch) < otlpSpanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-r.done:
+			for len(r.spans) > 0 {
+				batch = append(batch, <-r.spans)
+			}
+			r.export(batch)
+			return
+		}
+		r.export(batch)
+		batch = nil
+	}
+}
+
+func (r *otlpSpanReporter) export(spans []otlpSpan) {
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > otlpSpanBatchSize {
+			n = otlpSpanBatchSize
+		}
+		err := r.exporter.export("/v1/traces", otlpTraces{ResourceSpans: []otlpResourceSpans{{
+			Resource:   r.exporter.resource,
+			ScopeSpans: []otlpScopeSpans{{Scope: r.exporter.scope(), Spans: spans[:n]}},
+		}}})
+		if err != nil {
+			log.Printf("ERROR: exporting %d spans with OTLP - %s", n, err)
+			otlpExportCounter.WithLabelValues("spans", "failed").Add(float64(n))
+		} else {
+			otlpExportCounter.WithLabelValues("spans", "sent").Add(float64(n))
+		}
+		spans = spans[n:]
+	}
+}
+
+type otlpMetrics struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	Summary     *otlpSummary   `json:"summary,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []otlpKeyValue      `json:"attributes,omitempty"`
+	StartTimeUnixNano string              `json:"startTimeUnixNano"`
+	TimeUnixNano      string              `json:"timeUnixNano"`
+	Count             string              `json:"count"`
+	Sum               float64             `json:"sum"`
+	QuantileValues    []otlpQuantileValue `json:"quantileValues"`
+}
+
+type otlpQuantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// newOTLPMetric converts a family of Prometheus metrics, whose values are
+// cumulative since start. Untyped metrics are exported as gauges.
+func newOTLPMetric(family *dto.MetricFamily, start, now time.Time) otlpMetric {
+	m := otlpMetric{Name: family.GetName(), Description: family.GetHelp()}
+	for _, metric := range family.GetMetric() {
+		var attributes []otlpKeyValue
+		for _, label := range metric.GetLabel() {
+			attributes = append(attributes, otlpAttribute(label.GetName(), label.GetValue()))
+		}
+		number := otlpNumberDataPoint{Attributes: attributes, StartTimeUnixNano: otlpTime(start), TimeUnixNano: otlpTime(now)}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			if m.Sum == nil {
+				m.Sum = &otlpSum{AggregationTemporality: otlpTemporalityCumulative, IsMonotonic: true}
+			}
+			number.AsDouble = metric.GetCounter().GetValue()
+			m.Sum.DataPoints = append(m.Sum.DataPoints, number)
+		case dto.MetricType_HISTOGRAM:
+			if m.Histogram == nil {
+				m.Histogram = &otlpHistogram{AggregationTemporality: otlpTemporalityCumulative}
+			}
+			m.Histogram.DataPoints = append(m.Histogram.DataPoints, newOTLPHistogramDataPoint(metric.GetHistogram(), number))
+		case dto.MetricType_SUMMARY:
+			if m.Summary == nil {
+				m.Summary = &otlpSummary{}
+			}
+			summary := metric.GetSummary()
+			point := otlpSummaryDataPoint{
+				Attributes:        attributes,
+				StartTimeUnixNano: number.StartTimeUnixNano,
+				TimeUnixNano:      number.TimeUnixNano,
+				Count:             strconv.FormatUint(summary.GetSampleCount(), 10),
+				Sum:               summary.GetSampleSum(),
+			}
+			for _, q := range summary.GetQuantile() {
+				point.QuantileValues = append(point.QuantileValues, otlpQuantileValue{Quantile: q.GetQuantile(), Value: q.GetValue()})
+			}
+			m.Summary.DataPoints = append(m.Summary.DataPoints, point)
+		default:
+			if m.Gauge == nil {
+				m.Gauge = &otlpGauge{}
+			}
+			number.AsDouble = metric.GetGauge().GetValue()
+			if family.GetType() == dto.MetricType_UNTYPED {
+				number.AsDouble = metric.GetUntyped().GetValue()
+			}
+			m.Gauge.DataPoints = append(m.Gauge.DataPoints, number)
+		}
+	}
+	return m
+}
+
+// newOTLPHistogramDataPoint converts the cumulative buckets of a Prometheus
+// histogram to the per bucket counts of OTLP, with the +Inf bucket last
+func newOTLPHistogramDataPoint(h *dto.Histogram, number otlpNumberDataPoint) otlpHistogramDataPoint {
+	point := otlpHistogramDataPoint{
+		Attributes:        number.Attributes,
+		StartTimeUnixNano: number.StartTimeUnixNano,
+		TimeUnixNano:      number.TimeUnixNano,
+		Count:             strconv.FormatUint(h.GetSampleCount(), 10),
+		Sum:               h.GetSampleSum(),
+		ExplicitBounds:    []float64{},
+	}
+	var previous uint64
+	for _, bucket := range h.GetBucket() {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			continue
+		}
+		point.ExplicitBounds = append(point.ExplicitBounds, bucket.GetUpperBound())
+		point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(bucket.GetCumulativeCount()-previous, 10))
+		previous = bucket.GetCumulativeCount()
+	}
+	point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(h.GetSampleCount()-previous, 10))
+	return point
+}
+
+// otlpMetricsExporter exports the metrics of a Prometheus gatherer every
+// interval, and once more when it's closed
+type otlpMetricsExporter struct {
+	exporter *otlpExporter
+	gatherer prometheus.Gatherer
+	start    time.Time
+	done     chan struct{}
+	closed   sync.WaitGroup
+}
+
+func newOTLPMetricsExporter(exporter *otlpExporter, gatherer prometheus.Gatherer, interval time.Duration) *otlpMetricsExporter {
+	e := &otlpMetricsExporter{
+		exporter: exporter,
+		gatherer: gatherer,
+		start:    time.Now(),
+		done:     make(chan struct{}),
+	}
+	e.closed.Add(1)
+	go e.run(interval)
+	return e
+}
+
+func (e *otlpMetricsExporter) run(interval time.Duration) {
+	defer e.closed.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-e.done:
+			e.export(time.Now())
+			return
+		}
+		e.export(time.Now())
+	}
+}
+
+func (e *otlpMetricsExporter) Close() {
+	close(e.done)
+	e.closed.Wait()
+}
+
+func (e *otlpMetricsExporter) export(now time.Time) {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		log.Printf("ERROR: gathering metrics to export with OTLP - %s", err)
+	}
+	var metrics []otlpMetric
+	for _, family := range families {
+		metrics = append(metrics, newOTLPMetric(family, e.start, now))
+	}
+	err = e.exporter.export("/v1/metrics", otlpMetrics{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     e.exporter.resource,
+		ScopeMetrics: []otlpScopeMetrics{{Scope: e.exporter.scope(), Metrics: metrics}},
+	}}})
+	if err != nil {
+		log.Printf("ERROR: exporting metrics with OTLP - %s", err)
+		otlpExportCounter.WithLabelValues("metrics", "failed").Inc()
+		return
+	}
+	otlpExportCounter.WithLabelValues("metrics", "sent").Inc()
+}
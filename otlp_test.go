@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uber/jaeger-client-go"
+)
+
+// otlpCollector records the bodies of the OTLP exports it receives by path
+func otlpCollector(t *testing.T) (*httptest.Server, chan map[string]interface{}) {
+	received := make(chan map[string]interface{}, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer collector-token", req.Header.Get("Authorization"))
+		b, _ := ioutil.ReadAll(req.Body)
+		var body map[string]interface{}
+		assert.Equal(t, nil, json.Unmarshal(b, &body))
+		body["path"] = req.URL.Path
+		received <- body
+	}))
+	return s, received
+}
+
+func testOTLPExporter(t *testing.T, endpoint string) *otlpExporter {
+	opts := testOptions()
+	opts.OTLPEndpoint = endpoint + "/"
+	opts.OTLPHeaders = []string{"Authorization=Bearer collector-token"}
+	opts.OTLPResourceAttributes = []string{"deployment.environment=staging", "service.name=edge-auth"}
+	assert.Equal(t, nil, opts.Validate())
+	return newOTLPExporter(opts)
+}
+
+func TestOTLPSpans(t *testing.T) {
+	collector, received := otlpCollector(t)
+	defer collector.Close()
+	spans := newOTLPSpanReporter(testOTLPExporter(t, collector.URL))
+	tracer, closer := jaeger.NewTracer("oauth2_proxy", jaeger.NewConstSampler(true), spans)
+
+	parent := tracer.StartSpan("HTTP GET", ext.SpanKindRPCServer)
+	ext.HTTPStatusCode.Set(parent, 502)
+	ext.Error.Set(parent, true)
+	child := tracer.StartSpan("callback.redeem", ext.RPCServerOption(nil))
+	child.Finish()
+	parent.LogKV("event", "retry", "attempt", 2)
+	parent.Finish()
+	closer.Close()
+
+	body := <-received
+	assert.Equal(t, "/v1/traces", body["path"])
+	resourceSpans := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	attributes := map[string]string{}
+	for _, a := range resourceSpans["resource"].(map[string]interface{})["attributes"].([]interface{}) {
+		kv := a.(map[string]interface{})
+		attributes[kv["key"].(string)] = kv["value"].(map[string]interface{})["stringValue"].(string)
+	}
+	assert.Equal(t, "edge-auth", attributes["service.name"])
+	assert.Equal(t, "staging", attributes["deployment.environment"])
+	assert.Equal(t, VERSION, attributes["service.version"])
+
+	exported := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	assert.Equal(t, 2, len(exported))
+	span := exported[1].(map[string]interface{})
+	assert.Equal(t, "HTTP GET", span["name"])
+	assert.Equal(t, 32, len(span["traceId"].(string)))
+	assert.Equal(t, 16, len(span["spanId"].(string)))
+	assert.Equal(t, float64(otlpSpanKindServer), span["kind"])
+	assert.Equal(t, float64(otlpStatusCodeError), span["status"].(map[string]interface{})["code"])
+	assert.Equal(t, "retry", span["events"].([]interface{})[0].(map[string]interface{})["name"])
+	attribute := span["attributes"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "http.status_code", attribute["key"])
+	assert.Equal(t, "502", attribute["value"].(map[string]interface{})["intValue"])
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	collector, received := otlpCollector(t)
+	defer collector.Close()
+
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "requests_total", Help: "Requests."}, []string{"code"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "request_seconds", Help: "Latency.", Buckets: []float64{0.1, 1}})
+	registry.MustRegister(counter, histogram)
+	counter.WithLabelValues("200").Add(3)
+	for _, v := range []float64{0.05, 0.5, 0.7, 5} {
+		histogram.Observe(v)
+	}
+
+	e := &otlpMetricsExporter{exporter: testOTLPExporter(t, collector.URL), gatherer: registry, start: time.Now()}
+	e.export(time.Now())
+	body := <-received
+	assert.Equal(t, "/v1/metrics", body["path"])
+	metrics := body["resourceMetrics"].([]interface{})[0].(map[string]interface{})["scopeMetrics"].([]interface{})[0].(map[string]interface{})["metrics"].([]interface{})
+	assert.Equal(t, 2, len(metrics))
+
+	latency := metrics[0].(map[string]interface{})
+	assert.Equal(t, "request_seconds", latency["name"])
+	point := latency["histogram"].(map[string]interface{})["dataPoints"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "4", point["count"])
+	assert.Equal(t, []interface{}{"1", "2", "1"}, point["bucketCounts"])
+	assert.Equal(t, []interface{}{0.1, 1.0}, point["explicitBounds"])
+
+	requests := metrics[1].(map[string]interface{})
+	assert.Equal(t, "requests_total", requests["name"])
+	sum := requests["sum"].(map[string]interface{})
+	assert.Equal(t, true, sum["isMonotonic"])
+	assert.Equal(t, float64(otlpTemporalityCumulative), sum["aggregationTemporality"])
+	assert.Equal(t, 3.0, sum["dataPoints"].([]interface{})[0].(map[string]interface{})["asDouble"])
+}
+
+func TestOTLPOptions(t *testing.T) {
+	o := testOptions()
+	o.OTLPHeaders = []string{"Authorization=Bearer token"}
+	assert.Equal(t, errorMsg([]string{
+		"otlp_headers and otlp_resource_attributes are only used with otlp_endpoint"}), o.Validate().Error())
+
+	o = testOptions()
+	o.OTLPEndpoint = "collector:4318"
+	o.OTLPHeaders = []string{"Authorization"}
+	o.OTLPResourceAttributes = []string{"=staging"}
+	o.OTLPMetricsInterval = 0
+	assert.Equal(t, errorMsg([]string{
+		`invalid otlp_endpoint "collector:4318", expected an http(s) url`,
+		"otlp_metrics_interval must be positive",
+		`invalid otlp-header="Authorization", expected <name>=<value>`,
+		`invalid otlp-resource-attribute="=staging", expected <key>=<value>`}), o.Validate().Error())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// maxErrorDescription caps the error_description of providers, which is
+// only logged
+const maxErrorDescription = 256
+
+// unknownProviderError stands in for error codes that aren't well formed
+const unknownProviderError = "unknown_error"
+
+var providerErrorCodeRegex = regexp.MustCompile(`^[a-z0-9_.-]{1,64}$`)
+
+// providerErrorMessages explain the errors RFC 6749 and OpenID Connect
+// providers redirect back with, instead of showing their raw code or
+// description. Custom error templates can localize them by .ErrorCode.
+var providerErrorMessages = map[string]string{
+	"access_denied":              "The sign in was cancelled, or the provider refused it.",
+	"login_required":             "Sign in with the provider again to continue.",
+	"consent_required":           "This application needs your consent at the provider to sign you in.",
+	"interaction_required":       "The provider needs you to complete the sign in.",
+	"account_selection_required": "Choose the account to sign in with at the provider.",
+	"temporarily_unavailable":    "The provider is temporarily unavailable. Try again in a few minutes.",
+	"server_error":               "The provider ran into an error. Try again in a few minutes.",
+	"invalid_request":            "Sign in isn't set up correctly with the provider. Contact your administrator.",
+	"invalid_scope":              "Sign in isn't set up correctly with the provider. Contact your administrator.",
+	"unauthorized_client":        "Sign in isn't set up correctly with the provider. Contact your administrator.",
+	"unsupported_response_type":  "Sign in isn't set up correctly with the provider. Contact your administrator.",
+}
+
+// providerError is the error a provider redirected back with. Both fields
+// come from the query string, so anyone can craft them.
+type providerError struct {
+	// Code is the error, or unknownProviderError when it isn't well formed
+	Code string
+	// Description is the error_description, stripped of control characters
+	// and capped to maxErrorDescription
+	Description string
+}
+
+func newProviderError(form url.Values) providerError {
+	code := strings.ToLower(form.Get("error"))
+	if !providerErrorCodeRegex.MatchString(code) {
+		code = unknownProviderError
+	}
+	return providerError{
+		Code:        code,
+		Description: sanitizeErrorDescription(form.Get("error_description")),
+	}
+}
+
+// Message is the explanation of the error shown to users
+func (e providerError) Message() string {
+	if message, ok := providerErrorMessages[e.Code]; ok {
+		return message
+	}
+	return "The provider couldn't sign you in."
+}
+
+func sanitizeErrorDescription(description string) string {
+	description = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, description)
+	description = strings.Join(strings.Fields(description), " ")
+	if runes := []rune(description); len(runes) > maxErrorDescription {
+		description = string(runes[:maxErrorDescription]) + "…"
+	}
+	return description
+}
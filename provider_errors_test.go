@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestNewProviderError(t *testing.T) {
+	e := newProviderError(url.Values{
+		"error":             {"ACCESS_DENIED"},
+		"error_description": {"The user\r\ndenied\x00 access\t "},
+	})
+	assert.Equal(t, "access_denied", e.Code)
+	assert.Equal(t, "The user denied access", e.Description)
+	assert.Equal(t, "The sign in was cancelled, or the provider refused it.", e.Message())
+
+	e = newProviderError(url.Values{
+		"error":             {"<script>alert(1)</script>"},
+		"error_description": {strings.Repeat("é", 300)},
+	})
+	assert.Equal(t, unknownProviderError, e.Code)
+	assert.Equal(t, strings.Repeat("é", maxErrorDescription)+"…", e.Description)
+	assert.Equal(t, "The provider couldn't sign you in.", e.Message())
+
+	e = newProviderError(url.Values{"error": {"vendor_specific.error"}})
+	assert.Equal(t, "vendor_specific.error", e.Code)
+	assert.Equal(t, "The provider couldn't sign you in.", e.Message())
+}
+
+func TestProviderErrorPage(t *testing.T) {
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	callback := func(query url.Values, accept string) *httptest.ResponseRecorder {
+		query.Set("state", "nonce:/")
+		req, _ := http.NewRequest("GET", "/oauth2/callback?"+query.Encode(), nil)
+		req.Header.Set("Accept", accept)
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := callback(url.Values{
+		"error":             {"temporarily_unavailable"},
+		"error_description": {"Call +1 555 0100 to restore your account"},
+	}, "text/html")
+	assert.Equal(t, 403, rw.Code)
+	body := rw.Body.String()
+	assert.Equal(t, true, strings.Contains(body, "The provider is temporarily unavailable. Try again in a few minutes."))
+	assert.Equal(t, false, strings.Contains(body, "555 0100"))
+
+	rw = callback(url.Values{"error": {`"><script>alert(1)</script>`}}, "text/html")
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, false, strings.Contains(rw.Body.String(), "<script>"))
+
+	rw = callback(url.Values{"error": {"access_denied"}}, "application/json")
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, `{"code":403,"title":"Permission Denied","message":"The sign in was cancelled, or the provider refused it.","error":"access_denied"}`+"\n", rw.Body.String())
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var providerTimeoutCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "provider_timeouts_total",
+	Help: "Sign ins that failed because a call to the provider timed out, by callback stage.",
+}, []string{"stage"})
+
+func init() {
+	prometheus.MustRegister(providerTimeoutCounter)
+}
+
+// providerTimeoutRetry is how long the provider timeout page waits before
+// starting the sign in again
+const providerTimeoutRetry = 5 * time.Second
+
+// isTimeout reports whether err is a call that ran out of time
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// callbackError answers a callback whose call to the provider failed at
+// stage. A timeout gets its own page, which starts the sign in to redirect
+// again after providerTimeoutRetry, as the provider is likely to answer on a
+// second try; other errors are internal errors.
+func (p *OAuthProxy) callbackError(rw http.ResponseWriter, req *http.Request, stage string, redirect string, err error) {
+	if !isTimeout(err) {
+		p.ErrorPage(rw, req, 500, "Internal Error", "Internal Error")
+		return
+	}
+	providerTimeoutCounter.WithLabelValues(stage).Inc()
+	retry := fmt.Sprintf("%s?%s", p.OAuthStartPath, url.Values{"rd": {redirect}}.Encode())
+	seconds := int(providerTimeoutRetry.Seconds())
+	rw.Header().Set("Refresh", fmt.Sprintf("%d; url=%s", seconds, retry))
+	rw.Header().Set("Retry-After", fmt.Sprintf("%d", seconds))
+	p.errorPage(rw, req, http.StatusGatewayTimeout, "Identity Provider Timeout",
+		fmt.Sprintf("The identity provider took too long to answer. Signing in again in %d seconds.", seconds), "provider_timeout")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestCallbackProviderTimeout(t *testing.T) {
+	release := make(chan bool)
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fast") == "" {
+			<-release
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer idp.Close()
+	defer close(release)
+	defer func(timeout time.Duration) { http.DefaultClient.Timeout = timeout }(http.DefaultClient.Timeout)
+	http.DefaultClient.Timeout = 50 * time.Millisecond
+	idpURL, _ := url.Parse(idp.URL)
+
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	opts.provider = NewTestProvider(idpURL, "user@example.com")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	callback := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/reports?id=1", nil)
+		req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := callback()
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+	assert.Equal(t, "5; url=/oauth2/start?rd=%2Freports%3Fid%3D1", rw.Header().Get("Refresh"))
+	assert.Equal(t, "5", rw.Header().Get("Retry-After"))
+
+	// other provider errors are still internal errors
+	proxy.provider.Data().RedeemURL.RawQuery = "fast=1"
+	rw = callback()
+	assert.Equal(t, http.StatusInternalServerError, rw.Code)
+	assert.Equal(t, "", rw.Header().Get("Refresh"))
+}
+
+func TestProviderTimeoutOption(t *testing.T) {
+	o := testOptions()
+	o.ProviderTimeout = 0
+	assert.Equal(t, errorMsg([]string{"provider_timeout must be positive"}), o.Validate().Error())
+}
+
+func TestNewProviderClient(t *testing.T) {
+	idp := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/redirect":
+			http.Redirect(w, r, "/", http.StatusFound)
+		case "/html":
+			w.Header().Set("Content-Type", "text/html")
+		default:
+			w.Header().Set("Content-Type", "application/json")
+		}
+	}))
+	defer idp.Close()
+
+	o := testOptions()
+	o.TLSInsecureSkipVerify = true
+	o.ProviderTimeout = 5 * time.Second
+	assert.Equal(t, nil, o.Validate())
+	client := newProviderClient(o)
+	assert.Equal(t, 5*time.Second, client.Timeout)
+
+	// skipping verification keeps the redirect and content type checks
+	resp, err := client.Get(idp.URL)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+	_, err = client.Get(idp.URL + "/redirect")
+	assert.NotEqual(t, nil, err)
+	_, err = client.Get(idp.URL + "/html")
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,259 @@
+package providers
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// appleAudience is the audience of the client secret JWT
+const appleAudience = "https://appleid.apple.com"
+
+// appleClientSecretTTL is how long each generated client secret is valid
+const appleClientSecretTTL = 5 * time.Minute
+
+type AppleProvider struct {
+	*ProviderData
+	TeamID string
+	KeyID  string
+	key    *ecdsa.PrivateKey
+}
+
+func NewAppleProvider(p *ProviderData) *AppleProvider {
+	p.ProviderName = "Apple"
+	if p.LoginURL == nil || p.LoginURL.String() == "" {
+		p.LoginURL = &url.URL{
+			Scheme: "https",
+			Host:   "appleid.apple.com",
+			Path:   "/auth/authorize",
+		}
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		p.RedeemURL = &url.URL{
+			Scheme: "https",
+			Host:   "appleid.apple.com",
+			Path:   "/auth/token",
+		}
+	}
+	if p.Scope == "" {
+		p.Scope = "name email"
+	}
+	return &AppleProvider{ProviderData: p}
+}
+
+// SetClientSecretKey configures the key the client secret JWTs are signed
+// with: the team ID, and the ID and PEM encoded contents of a .p8 key
+// created for Sign in with Apple.
+func (p *AppleProvider) SetClientSecretKey(teamID, keyID string, keyPEM []byte) error {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return errors.New("no PEM data found in apple private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid apple private key: %s", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return errors.New("apple private key is not an ECDSA key")
+	}
+	p.TeamID = teamID
+	p.KeyID = keyID
+	p.key = ecKey
+	return nil
+}
+
+// clientSecret generates the ES256 signed JWT Apple expects as the client
+// secret
+// https://developer.apple.com/documentation/sign_in_with_apple/generate_and_validate_tokens
+func (p *AppleProvider) clientSecret(now time.Time) (string, error) {
+	if p.key == nil {
+		return "", errors.New("apple private key not configured")
+	}
+	enc := base64.RawURLEncoding
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": p.KeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": p.TeamID,
+		"iat": now.Unix(),
+		"exp": now.Add(appleClientSecretTTL).Unix(),
+		"aud": appleAudience,
+		"sub": p.Credentials().ClientID,
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, p.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS ES256 signatures are r and s as fixed size big endian integers
+	size := (p.key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[size-len(rb):size], rb)
+	copy(sig[2*size-len(sb):], sb)
+	return signingInput + "." + enc.EncodeToString(sig), nil
+}
+
+// GetLoginURL asks for the response to be posted back, which Apple requires
+// when requesting the name or email scopes
+func (p *AppleProvider) GetLoginURL(redirectURI, state string) string {
+	a := *p.LoginURL
+	params, _ := url.ParseQuery(a.RawQuery)
+	params.Set("redirect_uri", redirectURI)
+	params.Set("scope", p.Scope)
+	params.Set("client_id", p.Credentials().ClientID)
+	params.Set("response_type", "code")
+	params.Set("response_mode", "form_post")
+	params.Set("state", state)
+	a.RawQuery = params.Encode()
+	return a.String()
+}
+
+type appleTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	IdToken      string `json:"id_token"`
+}
+
+func (p *AppleProvider) requestToken(params url.Values) (*appleTokenResponse, error) {
+	secret, err := p.clientSecret(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	params.Set("client_id", p.Credentials().ClientID)
+	params.Set("client_secret", secret)
+
+	req, err := http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, statusError(resp.StatusCode, p.RedeemURL.String(), body)
+	}
+
+	var token appleTokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// appleEmailFromIdToken reads the verified email of an ID token. The token
+// was just received from Apple over TLS so its signature isn't checked.
+func appleEmailFromIdToken(idToken string) (string, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("id_token is not a JWT")
+	}
+	b, err := jwtDecodeSegment(parts[1])
+	if err != nil {
+		return "", err
+	}
+	var claims struct {
+		Email         string      `json:"email"`
+		EmailVerified interface{} `json:"email_verified"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return "", err
+	}
+	if claims.Email == "" {
+		return "", errors.New("missing email")
+	}
+	if !jsonBool(claims.EmailVerified) {
+		return "", fmt.Errorf("email %s not listed as verified", claims.Email)
+	}
+	return claims.Email, nil
+}
+
+func (p *AppleProvider) Redeem(redirectURL, code string) (*SessionState, error) {
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+	token, err := p.requestToken(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURL},
+	})
+	if err != nil {
+		return nil, err
+	}
+	email, err := appleEmailFromIdToken(token.IdToken)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionState{
+		AccessToken:  token.AccessToken,
+		ExpiresOn:    Now().Add(time.Duration(token.ExpiresIn) * time.Second).Truncate(time.Second),
+		RefreshToken: token.RefreshToken,
+		Email:        email,
+	}, nil
+}
+
+// ValidateSessionState checks the refresh token is still valid, as Apple
+// has no endpoint to validate access tokens against
+func (p *AppleProvider) ValidateSessionState(s *SessionState) (bool, error) {
+	if s.RefreshToken == "" {
+		return !s.IsExpired(), nil
+	}
+	if _, err := p.requestToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.RefreshToken},
+	}); err != nil {
+		log.Printf("apple refresh token validation failed: %s", err)
+		if Unavailable(err) {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+func (p *AppleProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
+	if s == nil || s.ExpiresOn.After(Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+	token, err := p.requestToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.RefreshToken},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	origExpiration := s.ExpiresOn
+	s.AccessToken = token.AccessToken
+	s.ExpiresOn = Now().Add(time.Duration(token.ExpiresIn) * time.Second).Truncate(time.Second)
+	log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
+	return true, nil
+}
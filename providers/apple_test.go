@@ -0,0 +1,148 @@
+package providers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func testAppleKey(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Equal(t, nil, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Equal(t, nil, err)
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func testAppleProvider(t *testing.T, hostname string) (*AppleProvider, *ecdsa.PrivateKey) {
+	p := NewAppleProvider(
+		&ProviderData{
+			ClientID:  "com.example.web",
+			LoginURL:  &url.URL{},
+			RedeemURL: &url.URL{},
+			Scope:     ""})
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+	}
+	key, keyPEM := testAppleKey(t)
+	assert.Equal(t, nil, p.SetClientSecretKey("TEAMID", "KEYID", keyPEM))
+	return p, key
+}
+
+// verifyES256 checks the signature of a JWS ES256 signed JWT
+func verifyES256(pub *ecdsa.PublicKey, jwt string) bool {
+	i := strings.LastIndex(jwt, ".")
+	sig, err := base64.RawURLEncoding.DecodeString(jwt[i+1:])
+	if err != nil || len(sig) != 64 {
+		return false
+	}
+	digest := sha256.Sum256([]byte(jwt[:i]))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	return ecdsa.Verify(pub, digest[:], r, s)
+}
+
+func TestAppleProviderDefaults(t *testing.T) {
+	p, _ := testAppleProvider(t, "")
+	assert.Equal(t, "Apple", p.Data().ProviderName)
+	assert.Equal(t, "https://appleid.apple.com/auth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://appleid.apple.com/auth/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "name email", p.Data().Scope)
+}
+
+func TestAppleProviderInvalidKey(t *testing.T) {
+	p := NewAppleProvider(&ProviderData{})
+	assert.NotEqual(t, nil, p.SetClientSecretKey("TEAMID", "KEYID", []byte("not a key")))
+}
+
+func TestAppleProviderClientSecret(t *testing.T) {
+	p, key := testAppleProvider(t, "")
+	now := time.Now()
+	secret, err := p.clientSecret(now)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, verifyES256(&key.PublicKey, secret))
+
+	parts := strings.Split(secret, ".")
+	header, _ := jwtDecodeSegment(parts[0])
+	assert.Equal(t, `{"alg":"ES256","kid":"KEYID"}`, string(header))
+
+	b, _ := jwtDecodeSegment(parts[1])
+	var claims struct {
+		Iss string `json:"iss"`
+		Sub string `json:"sub"`
+		Aud string `json:"aud"`
+		Iat int64  `json:"iat"`
+		Exp int64  `json:"exp"`
+	}
+	assert.Equal(t, nil, json.Unmarshal(b, &claims))
+	assert.Equal(t, "TEAMID", claims.Iss)
+	assert.Equal(t, "com.example.web", claims.Sub)
+	assert.Equal(t, "https://appleid.apple.com", claims.Aud)
+	assert.Equal(t, now.Unix(), claims.Iat)
+	assert.Equal(t, now.Add(appleClientSecretTTL).Unix(), claims.Exp)
+}
+
+func TestAppleProviderGetLoginURL(t *testing.T) {
+	p, _ := testAppleProvider(t, "")
+	loginURL, _ := url.Parse(p.GetLoginURL("https://example.com/oauth2/callback", "state"))
+	params := loginURL.Query()
+	assert.Equal(t, "form_post", params.Get("response_mode"))
+	assert.Equal(t, "code", params.Get("response_type"))
+	assert.Equal(t, "name email", params.Get("scope"))
+	assert.Equal(t, "", params.Get("approval_prompt"))
+}
+
+func TestAppleProviderRedeem(t *testing.T) {
+	var key *ecdsa.PrivateKey
+	idToken := testJWT(`{"email": "user@privaterelay.appleid.com", "email_verified": "true"}`)
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/auth/token" || r.FormValue("code") != "code1234" ||
+			r.FormValue("client_id") != "com.example.web" ||
+			!verifyES256(&key.PublicKey, r.FormValue("client_secret")) {
+			w.WriteHeader(400)
+			return
+		}
+		w.Write([]byte(`{"access_token": "a", "refresh_token": "r", "expires_in": 3600, "id_token": "` + idToken + `"}`))
+	}))
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p, k := testAppleProvider(t, bURL.Host)
+	key = k
+
+	session, err := p.Redeem("https://example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@privaterelay.appleid.com", session.Email)
+	assert.Equal(t, "a", session.AccessToken)
+	assert.Equal(t, "r", session.RefreshToken)
+}
+
+func TestAppleProviderRedeemUnverifiedEmail(t *testing.T) {
+	idToken := testJWT(`{"email": "user@example.com", "email_verified": "false"}`)
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "a", "id_token": "` + idToken + `"}`))
+	}))
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p, _ := testAppleProvider(t, bURL.Host)
+	_, err := p.Redeem("https://example.com/oauth2/callback", "code1234")
+	assert.NotEqual(t, nil, err)
+}
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/bitly/go-simplejson"
@@ -8,11 +9,14 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 type AzureProvider struct {
 	*ProviderData
 	Tenant string
+	// Groups are the object IDs of the AAD groups logins are restricted to
+	Groups []string
 }
 
 func NewAzureProvider(p *ProviderData) *AzureProvider {
@@ -60,6 +64,12 @@ func (p *AzureProvider) Configure(tenant string) {
 	}
 }
 
+// SetGroupRestriction restricts logins to members of any of the given AAD
+// group object IDs
+func (p *AzureProvider) SetGroupRestriction(groups []string) {
+	p.Groups = groups
+}
+
 func getAzureHeader(access_token string) http.Header {
 	header := make(http.Header)
 	header.Set("Authorization", fmt.Sprintf("Bearer %s", access_token))
@@ -90,6 +100,19 @@ func (p *AzureProvider) GetEmailAddress(s *SessionState) (string, error) {
 	if s.AccessToken == "" {
 		return "", errors.New("missing access token")
 	}
+
+	// if we require a group, check that first
+	if len(p.Groups) > 0 {
+		groups, err := p.userGroups(s.AccessToken)
+		if err != nil {
+			return "", err
+		}
+		if len(groups) == 0 {
+			log.Printf("Missing Group:%v", p.Groups)
+			return "", nil
+		}
+	}
+
 	req, err := http.NewRequest("GET", p.ProfileURL.String(), nil)
 	if err != nil {
 		return "", err
@@ -122,3 +145,127 @@ func (p *AzureProvider) GetEmailAddress(s *SessionState) (string, error) {
 
 	return email, err
 }
+
+// azureTokenGroups reads the group object IDs carried by an access token.
+// ok is false when the token can't be read or when AAD left the groups out
+// because there were too many of them (the "overage" claim), in which case
+// the groups have to be fetched from the Graph API.
+func azureTokenGroups(accessToken string) (groups []string, ok bool) {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	b, err := jwtDecodeSegment(parts[1])
+	if err != nil {
+		return nil, false
+	}
+	var claims struct {
+		Groups     []string          `json:"groups"`
+		HasGroups  bool              `json:"hasgroups"`
+		ClaimNames map[string]string `json:"_claim_names"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, false
+	}
+	if _, overage := claims.ClaimNames["groups"]; overage || claims.HasGroups {
+		return nil, false
+	}
+	return claims.Groups, claims.Groups != nil
+}
+
+// memberOfURL is the Graph API endpoint listing the signed in user's
+// memberships on the protected resource, which is either Microsoft Graph or
+// the legacy Azure AD Graph
+func (p *AzureProvider) memberOfURL() *url.URL {
+	u := *p.ProtectedResource
+	if u.Host == "graph.microsoft.com" {
+		u.Path = "/v1.0/me/memberOf"
+		return &u
+	}
+	u.Path = "/me/memberOf"
+	u.RawQuery = "api-version=1.6"
+	return &u
+}
+
+// nextLinkURL resolves a Graph API paging link. Microsoft Graph returns
+// absolute links while Azure AD Graph returns links relative to the tenant
+// that lack the api-version.
+func (p *AzureProvider) nextLinkURL(link string) string {
+	if strings.HasPrefix(link, "https://") || strings.HasPrefix(link, "http://") {
+		return link
+	}
+	u := *p.ProtectedResource
+	return fmt.Sprintf("%s://%s/myorganization/%s&api-version=1.6", u.Scheme, u.Host, link)
+}
+
+func (p *AzureProvider) fetchMemberOf(accessToken string) ([]string, error) {
+	var groups []string
+	endpoint := p.memberOfURL().String()
+	for endpoint != "" {
+		req, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header = getAzureHeader(accessToken)
+
+		var page struct {
+			Value []struct {
+				ODataType  string `json:"@odata.type"`
+				ObjectType string `json:"objectType"`
+				ID         string `json:"id"`
+				ObjectID   string `json:"objectId"`
+			} `json:"value"`
+			NextLink       string `json:"@odata.nextLink"`
+			LegacyNextLink string `json:"odata.nextLink"`
+		}
+		if err := api.RequestJson(req, &page); err != nil {
+			return nil, err
+		}
+		for _, v := range page.Value {
+			switch {
+			case v.ODataType == "#microsoft.graph.group":
+				groups = append(groups, v.ID)
+			case v.ObjectType == "Group":
+				groups = append(groups, v.ObjectID)
+			}
+		}
+
+		endpoint = ""
+		if page.NextLink != "" {
+			endpoint = page.NextLink
+		} else if page.LegacyNextLink != "" {
+			endpoint = p.nextLinkURL(page.LegacyNextLink)
+		}
+	}
+	return groups, nil
+}
+
+// userGroups returns the configured groups the user is a member of
+func (p *AzureProvider) userGroups(accessToken string) ([]string, error) {
+	memberOf, ok := azureTokenGroups(accessToken)
+	if !ok {
+		var err error
+		memberOf, err = p.fetchMemberOf(accessToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var groups []string
+	for _, id := range memberOf {
+		for _, g := range p.Groups {
+			if strings.EqualFold(id, g) {
+				groups = append(groups, g)
+			}
+		}
+	}
+	return groups, nil
+}
+
+// GetGroups returns the configured groups the user is a member of
+func (p *AzureProvider) GetGroups(s *SessionState) ([]string, error) {
+	if len(p.Groups) == 0 {
+		return nil, nil
+	}
+	return p.userGroups(s.AccessToken)
+}
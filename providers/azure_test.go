@@ -198,3 +198,102 @@ func TestAzureProviderGetEmailAddressIncorrectOtherMails(t *testing.T) {
 	assert.Equal(t, "type assertion to string failed", err.Error())
 	assert.Equal(t, "", email)
 }
+
+func testAzureMemberOfBackend(accessToken string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer "+accessToken {
+				w.WriteHeader(403)
+				return
+			}
+			switch {
+			case r.URL.Path == "/me" && r.URL.RawQuery == "api-version=1.6":
+				w.Write([]byte(`{ "mail": "user@windows.net" }`))
+			case r.URL.Path == "/me/memberOf" && r.URL.RawQuery == "api-version=1.6":
+				w.Write([]byte(`{"value": [
+					{"objectType": "Group", "objectId": "group-a"},
+					{"objectType": "Role", "objectId": "role-a"}
+				], "odata.nextLink": "directoryObjects/$/Microsoft.DirectoryServices.User/u/memberOf?$skiptoken=X"}`))
+			case r.URL.Path == "/myorganization/directoryObjects/$/Microsoft.DirectoryServices.User/u/memberOf" &&
+				r.URL.Query().Get("$skiptoken") == "X" && r.URL.Query().Get("api-version") == "1.6":
+				w.Write([]byte(`{"value": [{"objectType": "Group", "objectId": "group-b"}]}`))
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+}
+
+func TestAzureProviderGroupsFromToken(t *testing.T) {
+	p := testAzureProvider("")
+	p.SetGroupRestriction([]string{"group-b", "group-c"})
+
+	token := testJWT(`{"groups": ["group-a", "GROUP-B"]}`)
+	groups, err := p.GetGroups(&SessionState{AccessToken: token})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"group-b"}, groups)
+}
+
+func TestAzureProviderGroupsOverageUsesMemberOf(t *testing.T) {
+	token := testJWT(`{"_claim_names": {"groups": "src1"}}`)
+	b := testAzureMemberOfBackend(token)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testAzureProvider(bURL.Host)
+	p.SetGroupRestriction([]string{"group-b"})
+
+	session := &SessionState{AccessToken: token}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@windows.net", email)
+
+	groups, err := p.GetGroups(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"group-b"}, groups)
+}
+
+func TestAzureProviderMicrosoftGraphMemberOfURL(t *testing.T) {
+	p := testAzureProvider("")
+	p.ProtectedResource, _ = url.Parse("https://graph.microsoft.com")
+	assert.Equal(t, "https://graph.microsoft.com/v1.0/me/memberOf",
+		p.memberOfURL().String())
+}
+
+func TestAzureProviderGroupsMicrosoftGraphPaging(t *testing.T) {
+	var b *httptest.Server
+	b = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/me/memberOf":
+				w.Write([]byte(`{"value": [{"@odata.type": "#microsoft.graph.directoryRole", "id": "group-a"}],
+					"@odata.nextLink": "` + b.URL + `/v1.0/me/memberOf?$skiptoken=X"}`))
+			case r.URL.Path == "/v1.0/me/memberOf" && r.URL.Query().Get("$skiptoken") == "X":
+				w.Write([]byte(`{"value": [{"@odata.type": "#microsoft.graph.group", "id": "group-b"}]}`))
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testAzureProvider(bURL.Host)
+	p.SetGroupRestriction([]string{"group-a", "group-b"})
+
+	groups, err := p.fetchMemberOf("imaginary_access_token")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"group-b"}, groups)
+}
+
+func TestAzureProviderGetEmailAddressNotInGroup(t *testing.T) {
+	token := testJWT(`{"hasgroups": true}`)
+	b := testAzureMemberOfBackend(token)
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testAzureProvider(bURL.Host)
+	p.SetGroupRestriction([]string{"group-c"})
+
+	email, err := p.GetEmailAddress(&SessionState{AccessToken: token})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
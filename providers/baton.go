@@ -7,9 +7,12 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/oauth2/jws"
 
@@ -52,6 +55,19 @@ func NewBatonProvider(p *ProviderData) *BatonProvider {
 	return &BatonProvider{ProviderData: p, certCache: cc}
 }
 
+// Redeem redeems code, and expires the session when its access token does
+func (p *BatonProvider) Redeem(redirectURL, code string) (*SessionState, error) {
+	s, err := p.ProviderData.Redeem(redirectURL, code)
+	if err != nil {
+		return nil, err
+	}
+	// a token that can't be decoded is refused by GetEmailAddress
+	if cs, err := batonClaims(s.AccessToken); err == nil && cs.Exp != 0 {
+		s.ExpiresOn = time.Unix(cs.Exp, 0)
+	}
+	return s, nil
+}
+
 func (p *BatonProvider) GetEmailAddress(s *SessionState) (string, error) {
 	if s.AccessToken == "" {
 		return "", errors.New("no access token set")
@@ -61,18 +77,10 @@ func (p *BatonProvider) GetEmailAddress(s *SessionState) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("could not fetch jws signing keys, %w", err)
 	}
-
-	var verified bool
-	for _, k := range keys {
-		if err := jws.Verify(s.AccessToken, k); err == nil {
-			verified = true
-			break
-		}
-	}
-	if !verified {
+	if !verifyJWS(s.AccessToken, keys) {
 		return "", errors.New("could not verify jws token against any keys")
 	}
-	cs, err := jws.Decode("Bearer " + s.AccessToken)
+	cs, err := batonClaims(s.AccessToken)
 	if err != nil {
 		return "", fmt.Errorf("could not decode jws, %w", err)
 	}
@@ -83,6 +91,105 @@ func (p *BatonProvider) GetEmailAddress(s *SessionState) (string, error) {
 	return cs.Sub, nil
 }
 
+// ValidateSessionState checks the access token's signature and expiry
+// locally, and only asks the whoami endpoint when that's inconclusive: the
+// signing keys can't be fetched, none of them verifies the token, as when
+// they were rotated, or the token doesn't expire.
+func (p *BatonProvider) ValidateSessionState(s *SessionState) (bool, error) {
+	valid, conclusive := p.validateLocally(s.AccessToken)
+	if conclusive {
+		return valid, nil
+	}
+	return validateToken(p, s.AccessToken, nil)
+}
+
+// validateLocally reports whether token is valid, without network calls
+// once the signing keys are cached, and whether that's conclusive
+func (p *BatonProvider) validateLocally(token string) (valid bool, conclusive bool) {
+	if token == "" {
+		return false, true
+	}
+	cs, err := batonClaims(token)
+	if err != nil {
+		log.Printf("could not decode jws, %s", err)
+		return false, true
+	}
+	if cs.Exp != 0 && !Now().Before(time.Unix(cs.Exp, 0)) {
+		return false, true
+	}
+	keys, err := p.certCache.getKeys()
+	if err != nil {
+		log.Printf("could not fetch jws signing keys, %s", err)
+		return false, false
+	}
+	if !verifyJWS(token, keys) {
+		return false, false
+	}
+	return true, cs.Exp != 0
+}
+
+// batonJWS is token without the "Bearer " prefix Baton may give it with
+func batonJWS(token string) string {
+	return strings.TrimPrefix(token, "Bearer ")
+}
+
+// batonClaims decodes the claims of an access token. Every method decodes
+// tokens with it, so that they all accept the same ones, with or without the
+// "Bearer " prefix and the base64 padding.
+func batonClaims(token string) (*jws.ClaimSet, error) {
+	parts := strings.Split(batonJWS(token), ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jws token must have three segments")
+	}
+	b, err := jwtDecodeSegment(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	cs := &jws.ClaimSet{}
+	if err := json.Unmarshal(b, cs); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// verifyJWS reports whether any of keys signed token
+func verifyJWS(token string, keys map[string]*rsa.PublicKey) bool {
+	token = batonJWS(token)
+	for _, k := range keys {
+		if err := jws.Verify(token, k); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// GetGroups returns the OIDC "groups" claim of the access token. The token
+// signature is checked by GetEmailAddress before a session is established.
+func (p *BatonProvider) GetGroups(s *SessionState) ([]string, error) {
+	if s.AccessToken == "" {
+		return nil, errors.New("no access token set")
+	}
+	return groupsFromJWT(batonJWS(s.AccessToken))
+}
+
+func groupsFromJWT(token string) ([]string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("jws token must have three segments")
+	}
+	b, err := jwtDecodeSegment(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("could not decode jws claims, %w", err)
+	}
+	var claims struct {
+		Groups []string `json:"groups"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, fmt.Errorf("could not unmarshal jws claims, %w", err)
+	}
+	return claims.Groups, nil
+}
+
 type certCache struct {
 	u *url.URL
 
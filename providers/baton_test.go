@@ -0,0 +1,146 @@
+package providers
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+// testBatonToken builds a JWT carrying claims, signed with key
+func testBatonToken(t *testing.T, key *rsa.PrivateKey, claims string) string {
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+	h := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	assert.Equal(t, nil, err)
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+// testBatonBackend serves the signing keys, counting the whoami calls
+func testBatonBackend(t *testing.T, key *rsa.PrivateKey, token string, whoami *int) *httptest.Server {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Equal(t, nil, err)
+	keys, _ := json.Marshal(map[string]string{
+		"key-1": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	})
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/keys":
+			w.Write(keys)
+		case "/oauth2/token":
+			fmt.Fprintf(w, `{"access_token":%q}`, token)
+		case "/oauth2/whoami":
+			*whoami++
+			w.Write([]byte(`{"sub":"user@example.com"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+}
+
+func testBatonProvider(backend *httptest.Server) *BatonProvider {
+	u, _ := url.Parse(backend.URL)
+	return NewBatonProvider(&ProviderData{
+		RedeemURL:   &url.URL{Scheme: "http", Host: u.Host, Path: "/oauth2/token"},
+		ValidateURL: &url.URL{Scheme: "http", Host: u.Host, Path: "/oauth2/whoami"},
+		JWTKeysURL:  &url.URL{Scheme: "http", Host: u.Host, Path: "/keys"},
+	})
+}
+
+func TestBatonProviderRedeemExpiry(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	token := testBatonToken(t, key, fmt.Sprintf(`{"sub":"user@example.com","exp":%d}`, exp.Unix()))
+	var whoami int
+	backend := testBatonBackend(t, key, token, &whoami)
+	defer backend.Close()
+	p := testBatonProvider(backend)
+
+	s, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, token, s.AccessToken)
+	assert.Equal(t, exp, s.ExpiresOn)
+	email, err := p.GetEmailAddress(s)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@example.com", email)
+}
+
+func TestBatonProviderTokenForms(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	claims := fmt.Sprintf(`{"sub":"user@example.com","exp":%d,"groups":["admins"]}`, exp.Unix())
+	// the claims segment needs padding, which some issuers keep
+	padded := claims + strings.Repeat(" ", (3-len(claims)%3)%3+1)
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + base64.URLEncoding.EncodeToString([]byte(padded))
+	h := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	assert.Equal(t, nil, err)
+	paddedToken := signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	assert.Equal(t, true, strings.Contains(paddedToken, "="))
+	token := testBatonToken(t, key, claims)
+
+	for _, form := range []string{token, "Bearer " + token, paddedToken, "Bearer " + paddedToken} {
+		var whoami int
+		backend := testBatonBackend(t, key, form, &whoami)
+		p := testBatonProvider(backend)
+
+		// every method accepts the token Redeem got
+		s, err := p.Redeem("https://proxy.example.com/oauth2/callback", "code")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, exp, s.ExpiresOn)
+		email, err := p.GetEmailAddress(s)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "user@example.com", email)
+		groups, err := p.GetGroups(s)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, []string{"admins"}, groups)
+		valid, err := p.ValidateSessionState(s)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, valid)
+		assert.Equal(t, 0, whoami)
+		backend.Close()
+	}
+}
+
+func TestBatonProviderValidateSessionState(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var whoami int
+	backend := testBatonBackend(t, key, "", &whoami)
+	defer backend.Close()
+	p := testBatonProvider(backend)
+	validate := func(token string) bool {
+		valid, err := p.ValidateSessionState(&SessionState{AccessToken: token})
+		assert.Equal(t, nil, err)
+		return valid
+	}
+
+	// signed and unexpired, or expired, tokens are checked locally
+	exp := time.Now().Add(time.Hour).Unix()
+	assert.Equal(t, true, validate(testBatonToken(t, key, fmt.Sprintf(`{"sub":"user@example.com","exp":%d}`, exp))))
+	exp = time.Now().Add(-time.Minute).Unix()
+	assert.Equal(t, false, validate(testBatonToken(t, key, fmt.Sprintf(`{"sub":"user@example.com","exp":%d}`, exp))))
+	assert.Equal(t, false, validate("opaque"))
+	assert.Equal(t, 0, whoami)
+
+	// tokens without an expiry, or signed with another key, ask whoami
+	assert.Equal(t, true, validate(testBatonToken(t, key, `{"sub":"user@example.com"}`)))
+	assert.Equal(t, 1, whoami)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	exp = time.Now().Add(time.Hour).Unix()
+	assert.Equal(t, true, validate(testBatonToken(t, other, fmt.Sprintf(`{"sub":"user@example.com","exp":%d}`, exp))))
+	assert.Equal(t, 2, whoami)
+}
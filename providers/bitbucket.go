@@ -0,0 +1,177 @@
+package providers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/bitly/oauth2_proxy/api"
+)
+
+type BitbucketProvider struct {
+	*ProviderData
+	Team       string
+	Repository string
+}
+
+func NewBitbucketProvider(p *ProviderData) *BitbucketProvider {
+	p.ProviderName = "Bitbucket"
+	if p.LoginURL == nil || p.LoginURL.String() == "" {
+		p.LoginURL = &url.URL{
+			Scheme: "https",
+			Host:   "bitbucket.org",
+			Path:   "/site/oauth2/authorize",
+		}
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		p.RedeemURL = &url.URL{
+			Scheme: "https",
+			Host:   "bitbucket.org",
+			Path:   "/site/oauth2/access_token",
+		}
+	}
+	// ValidateURL is the user emails endpoint; the API base is derived from it
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		p.ValidateURL = &url.URL{
+			Scheme: "https",
+			Host:   "api.bitbucket.org",
+			Path:   "/2.0/user/emails",
+		}
+	}
+	if p.Scope == "" {
+		p.Scope = "email"
+	}
+	return &BitbucketProvider{ProviderData: p}
+}
+
+// SetTeam restricts logins to members of the given team (workspace)
+func (p *BitbucketProvider) SetTeam(team string) {
+	p.Team = team
+	if team != "" {
+		p.Scope += " account"
+	}
+}
+
+// SetRepository restricts logins to users with access to the given
+// repository, in "team/repository" form
+func (p *BitbucketProvider) SetRepository(repository string) {
+	p.Repository = repository
+	if repository != "" {
+		p.Scope += " repository"
+	}
+}
+
+// apiURL builds an endpoint relative to the 2.0 API root
+func (p *BitbucketProvider) apiURL(endpoint string, params url.Values) *url.URL {
+	return &url.URL{
+		Scheme:   p.ValidateURL.Scheme,
+		Host:     p.ValidateURL.Host,
+		Path:     path.Join(path.Dir(path.Dir(p.ValidateURL.Path)), endpoint),
+		RawQuery: params.Encode(),
+	}
+}
+
+func (p *BitbucketProvider) getJSON(endpoint *url.URL, accessToken string, v interface{}) error {
+	req, err := http.NewRequest("GET", endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	return api.RequestJson(req, v)
+}
+
+func (p *BitbucketProvider) hasTeam(accessToken string) (bool, error) {
+	// https://developer.atlassian.com/bitbucket/api/2/reference/resource/workspaces
+	var workspaces struct {
+		Values []struct {
+			Slug string `json:"slug"`
+		} `json:"values"`
+	}
+	endpoint := p.apiURL("/workspaces", url.Values{
+		"role":    {"member"},
+		"pagelen": {"100"},
+	})
+	if err := p.getJSON(endpoint, accessToken, &workspaces); err != nil {
+		return false, err
+	}
+
+	var presentTeams []string
+	for _, w := range workspaces.Values {
+		if w.Slug == p.Team {
+			log.Printf("Found Bitbucket Team: %q", w.Slug)
+			return true, nil
+		}
+		presentTeams = append(presentTeams, w.Slug)
+	}
+	log.Printf("Missing Team:%q in %v", p.Team, presentTeams)
+	return false, nil
+}
+
+func (p *BitbucketProvider) hasRepository(accessToken string) (bool, error) {
+	// https://developer.atlassian.com/bitbucket/api/2/reference/resource/user/permissions/repositories
+	var permissions struct {
+		Values []struct {
+			Repository struct {
+				FullName string `json:"full_name"`
+			} `json:"repository"`
+		} `json:"values"`
+	}
+	endpoint := p.apiURL("/user/permissions/repositories", url.Values{
+		"q": {fmt.Sprintf("repository.full_name=%q", p.Repository)},
+	})
+	if err := p.getJSON(endpoint, accessToken, &permissions); err != nil {
+		return false, err
+	}
+
+	for _, perm := range permissions.Values {
+		if perm.Repository.FullName == p.Repository {
+			log.Printf("Found Bitbucket Repository: %q", p.Repository)
+			return true, nil
+		}
+	}
+	log.Printf("Missing Repository:%q", p.Repository)
+	return false, nil
+}
+
+func (p *BitbucketProvider) GetEmailAddress(s *SessionState) (string, error) {
+	// if we require a team or repository, check that first
+	if p.Team != "" {
+		if ok, err := p.hasTeam(s.AccessToken); err != nil || !ok {
+			return "", err
+		}
+	}
+	if p.Repository != "" {
+		if ok, err := p.hasRepository(s.AccessToken); err != nil || !ok {
+			return "", err
+		}
+	}
+
+	var emails struct {
+		Values []struct {
+			Email       string `json:"email"`
+			IsPrimary   bool   `json:"is_primary"`
+			IsConfirmed bool   `json:"is_confirmed"`
+		} `json:"values"`
+	}
+	if err := p.getJSON(p.ValidateURL, s.AccessToken, &emails); err != nil {
+		log.Printf("failed making request %s", err)
+		return "", err
+	}
+
+	for _, email := range emails.Values {
+		if email.IsPrimary && email.IsConfirmed {
+			return email.Email, nil
+		}
+	}
+	return "", nil
+}
+
+// ValidateSessionState checks the token against the emails endpoint, which
+// requires the token to be passed as a header
+func (p *BitbucketProvider) ValidateSessionState(s *SessionState) (bool, error) {
+	header := make(http.Header)
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", s.AccessToken))
+	return validateToken(p, s.AccessToken, header)
+}
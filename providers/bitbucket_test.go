@@ -0,0 +1,135 @@
+package providers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func testBitbucketProvider(hostname string) *BitbucketProvider {
+	p := NewBitbucketProvider(
+		&ProviderData{
+			ProviderName: "",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+func testBitbucketBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.WriteHeader(401)
+				return
+			}
+			switch r.URL.Path {
+			case "/2.0/user/emails":
+				w.WriteHeader(200)
+				w.Write([]byte(`{"values": [
+					{"email": "old@gsa.gov", "is_primary": false, "is_confirmed": true},
+					{"email": "michael.bland@gsa.gov", "is_primary": true, "is_confirmed": true}]}`))
+			case "/2.0/workspaces":
+				w.WriteHeader(200)
+				w.Write([]byte(`{"values": [{"slug": "gsa"}]}`))
+			case "/2.0/user/permissions/repositories":
+				w.WriteHeader(200)
+				if r.URL.Query().Get("q") == `repository.full_name="gsa/app"` {
+					w.Write([]byte(`{"values": [{"repository": {"full_name": "gsa/app"}}]}`))
+				} else {
+					w.Write([]byte(`{"values": []}`))
+				}
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+}
+
+func TestBitbucketProviderDefaults(t *testing.T) {
+	p := testBitbucketProvider("")
+	assert.NotEqual(t, nil, p)
+	p.SetTeam("gsa")
+	assert.Equal(t, "Bitbucket", p.Data().ProviderName)
+	assert.Equal(t, "https://bitbucket.org/site/oauth2/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://bitbucket.org/site/oauth2/access_token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://api.bitbucket.org/2.0/user/emails",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "email account", p.Data().Scope)
+}
+
+func TestBitbucketProviderGetEmailAddress(t *testing.T) {
+	b := testBitbucketBackend()
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(b_url.Host)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+}
+
+func TestBitbucketProviderGetEmailAddressWithTeam(t *testing.T) {
+	b := testBitbucketBackend()
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(b_url.Host)
+	p.SetTeam("gsa")
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+
+	p.Team = "other"
+	email, err = p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestBitbucketProviderGetEmailAddressWithRepository(t *testing.T) {
+	b := testBitbucketBackend()
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(b_url.Host)
+	p.SetRepository("gsa/app")
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+
+	p.Repository = "gsa/other"
+	email, err = p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestBitbucketProviderGetEmailAddressFailedRequest(t *testing.T) {
+	b := testBitbucketBackend()
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(b_url.Host)
+
+	session := &SessionState{AccessToken: "unexpected_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "", email)
+}
@@ -0,0 +1,27 @@
+package providers
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// clockOffset moves the clock sessions expire and refresh against, in
+// nanoseconds. Only the proxy's test mode sets it.
+var clockOffset int64
+
+// Now is the time sessions expire and refresh against
+func Now() time.Time {
+	return time.Now().Add(ClockOffset())
+}
+
+// ClockOffset is how far the clock sessions are checked against is ahead of
+// the system clock
+func ClockOffset() time.Duration {
+	return time.Duration(atomic.LoadInt64(&clockOffset))
+}
+
+// SetClockOffset moves the clock sessions are checked against d ahead of the
+// system clock, so tests can expire sessions without waiting
+func SetClockOffset(d time.Duration) {
+	atomic.StoreInt64(&clockOffset, int64(d))
+}
@@ -0,0 +1,224 @@
+package providers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type CognitoProvider struct {
+	*ProviderData
+	// Domain is the user pool's hosted UI domain, ie.
+	// https://<prefix>.auth.<region>.amazoncognito.com
+	Domain *url.URL
+}
+
+func NewCognitoProvider(p *ProviderData) *CognitoProvider {
+	p.ProviderName = "Cognito"
+	if p.Scope == "" {
+		p.Scope = "openid email profile"
+	}
+	return &CognitoProvider{ProviderData: p}
+}
+
+// Configure points the endpoints that weren't overridden at the user pool's
+// hosted UI domain
+func (p *CognitoProvider) Configure(domain *url.URL) {
+	p.Domain = domain
+	endpoint := func(u *url.URL, path string) *url.URL {
+		if u != nil && u.String() != "" {
+			return u
+		}
+		return &url.URL{Scheme: domain.Scheme, Host: domain.Host, Path: path}
+	}
+	p.LoginURL = endpoint(p.LoginURL, "/oauth2/authorize")
+	p.RedeemURL = endpoint(p.RedeemURL, "/oauth2/token")
+	p.ValidateURL = endpoint(p.ValidateURL, "/oauth2/userInfo")
+}
+
+// GetLoginURL drops approval_prompt, which Cognito rejects as an unknown
+// parameter
+func (p *CognitoProvider) GetLoginURL(redirectURI, state string) string {
+	a := *p.LoginURL
+	params, _ := url.ParseQuery(a.RawQuery)
+	params.Set("redirect_uri", redirectURI)
+	params.Set("scope", p.Scope)
+	params.Set("client_id", p.Credentials().ClientID)
+	params.Set("response_type", "code")
+	params.Set("state", state)
+	a.RawQuery = params.Encode()
+	return a.String()
+}
+
+type cognitoTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	IdToken      string `json:"id_token"`
+}
+
+// requestToken calls the token endpoint. Cognito requires app clients with
+// a secret to authenticate with HTTP Basic auth rather than form parameters.
+func (p *CognitoProvider) requestToken(params url.Values) (*cognitoTokenResponse, error) {
+	credentials := p.Credentials()
+	params.Set("client_id", credentials.ClientID)
+	req, err := http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if credentials.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(credentials.ClientID), url.QueryEscape(credentials.ClientSecret))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, statusError(resp.StatusCode, p.RedeemURL.String(), body)
+	}
+
+	var token cognitoTokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+type cognitoClaims struct {
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+	Groups        []string    `json:"cognito:groups"`
+}
+
+func cognitoClaimsFromToken(token string) (*cognitoClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a JWT")
+	}
+	b, err := jwtDecodeSegment(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims cognitoClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// jsonBool reads a boolean claim that some providers send as the string
+// "true" rather than a boolean, such as email_verified
+func jsonBool(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+func (p *CognitoProvider) Redeem(redirectURL, code string) (*SessionState, error) {
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+	token, err := p.requestToken(url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURL},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := cognitoClaimsFromToken(token.IdToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Email == "" {
+		return nil, errors.New("missing email")
+	}
+	if !jsonBool(claims.EmailVerified) {
+		return nil, fmt.Errorf("email %s not listed as verified", claims.Email)
+	}
+
+	return &SessionState{
+		AccessToken:  token.AccessToken,
+		ExpiresOn:    Now().Add(time.Duration(token.ExpiresIn) * time.Second).Truncate(time.Second),
+		RefreshToken: token.RefreshToken,
+		Email:        claims.Email,
+	}, nil
+}
+
+// GetGroups returns the cognito:groups claim of the access token
+func (p *CognitoProvider) GetGroups(s *SessionState) ([]string, error) {
+	claims, err := cognitoClaimsFromToken(s.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	return claims.Groups, nil
+}
+
+func (p *CognitoProvider) ValidateSessionState(s *SessionState) (bool, error) {
+	header := make(http.Header)
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", s.AccessToken))
+	return validateToken(p, s.AccessToken, header)
+}
+
+// RefreshSessionIfNeeded redeems the refresh token once the access token has
+// expired. Cognito doesn't rotate refresh tokens, so the original is kept.
+func (p *CognitoProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
+	if s == nil || s.ExpiresOn.After(Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+
+	token, err := p.requestToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.RefreshToken},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	origExpiration := s.ExpiresOn
+	s.AccessToken = token.AccessToken
+	s.ExpiresOn = Now().Add(time.Duration(token.ExpiresIn) * time.Second).Truncate(time.Second)
+	if groups, err := p.GetGroups(s); err == nil {
+		s.Groups = groups
+	}
+	log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
+	return true, nil
+}
+
+// GetLogoutURL returns the hosted UI logout endpoint, which ends the user's
+// Cognito session before sending them on to redirectURI. redirectURI must
+// be one of the app client's allowed sign out URLs.
+func (p *CognitoProvider) GetLogoutURL(redirectURI string) string {
+	if p.Domain == nil {
+		return ""
+	}
+	u := url.URL{
+		Scheme: p.Domain.Scheme,
+		Host:   p.Domain.Host,
+		Path:   "/logout",
+		RawQuery: url.Values{
+			"client_id":  {p.Credentials().ClientID},
+			"logout_uri": {redirectURI},
+		}.Encode(),
+	}
+	return u.String()
+}
@@ -0,0 +1,139 @@
+package providers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func testCognitoProvider(domain string) *CognitoProvider {
+	p := NewCognitoProvider(
+		&ProviderData{
+			ClientID:     "client id",
+			ClientSecret: "client secret",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	u, _ := url.Parse(domain)
+	p.Configure(u)
+	return p
+}
+
+func TestCognitoProviderDefaults(t *testing.T) {
+	p := testCognitoProvider("https://app.auth.us-east-1.amazoncognito.com")
+	assert.Equal(t, "Cognito", p.Data().ProviderName)
+	assert.Equal(t, "https://app.auth.us-east-1.amazoncognito.com/oauth2/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://app.auth.us-east-1.amazoncognito.com/oauth2/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://app.auth.us-east-1.amazoncognito.com/oauth2/userInfo",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "openid email profile", p.Data().Scope)
+}
+
+func TestCognitoProviderOverrides(t *testing.T) {
+	p := NewCognitoProvider(
+		&ProviderData{
+			LoginURL: &url.URL{
+				Scheme: "https",
+				Host:   "example.com",
+				Path:   "/oauth/auth"},
+			RedeemURL:   &url.URL{},
+			ValidateURL: &url.URL{},
+			Scope:       "openid"})
+	p.Configure(&url.URL{Scheme: "https", Host: "app.auth.eu-west-1.amazoncognito.com"})
+	assert.Equal(t, "https://example.com/oauth/auth",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://app.auth.eu-west-1.amazoncognito.com/oauth2/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "openid", p.Data().Scope)
+}
+
+func TestCognitoProviderGetLoginURL(t *testing.T) {
+	p := testCognitoProvider("https://app.auth.us-east-1.amazoncognito.com")
+	loginURL, _ := url.Parse(p.GetLoginURL("https://example.com/oauth2/callback", "state"))
+	params := loginURL.Query()
+	assert.Equal(t, "", params.Get("approval_prompt"))
+	assert.Equal(t, "code", params.Get("response_type"))
+	assert.Equal(t, "client id", params.Get("client_id"))
+	assert.Equal(t, "openid email profile", params.Get("scope"))
+}
+
+func TestCognitoProviderGetLogoutURL(t *testing.T) {
+	p := testCognitoProvider("https://app.auth.us-east-1.amazoncognito.com")
+	assert.Equal(t, "https://app.auth.us-east-1.amazoncognito.com/logout?"+
+		"client_id=client+id&logout_uri=https%3A%2F%2Fexample.com%2F",
+		p.GetLogoutURL("https://example.com/"))
+}
+
+func TestCognitoProviderRedeem(t *testing.T) {
+	idToken := testJWT(`{"email": "michael.bland@gsa.gov", "email_verified": "true"}`)
+	accessToken := testJWT(`{"cognito:groups": ["admins", "users"]}`)
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if r.URL.Path != "/oauth2/token" || !ok ||
+			user != "client+id" || password != "client+secret" ||
+			r.FormValue("code") != "code1234" || r.FormValue("client_secret") != "" {
+			w.WriteHeader(400)
+			return
+		}
+		w.Write([]byte(`{"access_token": "` + accessToken + `", "id_token": "` + idToken +
+			`", "refresh_token": "refresh", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	defer b.Close()
+
+	p := testCognitoProvider(b.URL)
+	session, err := p.Redeem("https://example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", session.Email)
+	assert.Equal(t, accessToken, session.AccessToken)
+	assert.Equal(t, "refresh", session.RefreshToken)
+	assert.Equal(t, true, session.ExpiresOn.After(time.Now()))
+
+	groups, err := p.GetGroups(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"admins", "users"}, groups)
+}
+
+func TestCognitoProviderRedeemUnverifiedEmail(t *testing.T) {
+	idToken := testJWT(`{"email": "michael.bland@gsa.gov", "email_verified": false}`)
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token": "a", "id_token": "` + idToken + `"}`))
+	}))
+	defer b.Close()
+
+	p := testCognitoProvider(b.URL)
+	_, err := p.Redeem("https://example.com/oauth2/callback", "code1234")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestCognitoProviderRefreshKeepsRefreshToken(t *testing.T) {
+	accessToken := testJWT(`{"cognito:groups": ["admins"]}`)
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh" {
+			w.WriteHeader(400)
+			return
+		}
+		w.Write([]byte(`{"access_token": "` + accessToken + `", "expires_in": 3600}`))
+	}))
+	defer b.Close()
+
+	p := testCognitoProvider(b.URL)
+	session := &SessionState{
+		Email:        "michael.bland@gsa.gov",
+		AccessToken:  "expired",
+		RefreshToken: "refresh",
+		ExpiresOn:    time.Now().Add(-time.Minute),
+	}
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, accessToken, session.AccessToken)
+	assert.Equal(t, "refresh", session.RefreshToken)
+	assert.Equal(t, []string{"admins"}, session.Groups)
+}
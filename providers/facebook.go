@@ -75,6 +75,6 @@ func (p *FacebookProvider) GetEmailAddress(s *SessionState) (string, error) {
 	return r.Email, nil
 }
 
-func (p *FacebookProvider) ValidateSessionState(s *SessionState) bool {
+func (p *FacebookProvider) ValidateSessionState(s *SessionState) (bool, error) {
 	return validateToken(p, s.AccessToken, getFacebookHeader(s.AccessToken))
 }
@@ -0,0 +1,238 @@
+package providers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/bitly/oauth2_proxy/api"
+)
+
+// giteaPageSize is the number of items requested per page, which is the
+// default maximum of a Gitea instance
+const giteaPageSize = 50
+
+// GiteaProvider authenticates against a self-hosted Gitea or Forgejo
+// instance, which share the same OAuth2 and API endpoints
+type GiteaProvider struct {
+	*ProviderData
+	Org  string
+	Team string
+}
+
+func NewGiteaProvider(p *ProviderData) *GiteaProvider {
+	p.ProviderName = "Gitea"
+	if p.Scope == "" {
+		p.Scope = "read:user"
+	}
+	return &GiteaProvider{ProviderData: p}
+}
+
+// Configure points the endpoints that weren't overridden at the instance
+// at base. The validate URL is the root of the API.
+func (p *GiteaProvider) Configure(base *url.URL) {
+	endpoint := func(u *url.URL, suffix string) *url.URL {
+		if u != nil && u.String() != "" {
+			return u
+		}
+		return &url.URL{Scheme: base.Scheme, Host: base.Host, Path: path.Join("/", base.Path, suffix)}
+	}
+	p.LoginURL = endpoint(p.LoginURL, "/login/oauth/authorize")
+	p.RedeemURL = endpoint(p.RedeemURL, "/login/oauth/access_token")
+	p.ValidateURL = endpoint(p.ValidateURL, "/api/v1")
+}
+
+// SetOrgTeam restricts logins to members of org, or of any of the comma
+// separated teams of org
+func (p *GiteaProvider) SetOrgTeam(org, team string) {
+	p.Org = org
+	p.Team = team
+	if org != "" || team != "" {
+		p.Scope += " read:organization"
+	}
+}
+
+func (p *GiteaProvider) apiRequest(accessToken, endpoint string, params url.Values, v interface{}) error {
+	u := &url.URL{
+		Scheme:   p.ValidateURL.Scheme,
+		Host:     p.ValidateURL.Host,
+		Path:     path.Join(p.ValidateURL.Path, endpoint),
+		RawQuery: params.Encode(),
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
+	return api.RequestJson(req, v)
+}
+
+// giteaOrg is an organization as returned by the API. Older releases only
+// fill in username, newer ones deprecate it in favour of name.
+type giteaOrg struct {
+	Name     string `json:"name"`
+	Username string `json:"username"`
+}
+
+func (o giteaOrg) login() string {
+	if o.Name != "" {
+		return o.Name
+	}
+	return o.Username
+}
+
+type giteaTeam struct {
+	Name string   `json:"name"`
+	Org  giteaOrg `json:"organization"`
+}
+
+func (p *GiteaProvider) getOrgs(accessToken string) ([]string, error) {
+	// https://try.gitea.io/api/swagger#/organization/orgListCurrentUserOrgs
+	var orgs []string
+	for page := 1; ; page++ {
+		var data []giteaOrg
+		err := p.apiRequest(accessToken, "/user/orgs", url.Values{
+			"limit": {strconv.Itoa(giteaPageSize)},
+			"page":  {strconv.Itoa(page)},
+		}, &data)
+		if err != nil {
+			return nil, err
+		}
+		for _, org := range data {
+			orgs = append(orgs, org.login())
+		}
+		if len(data) < giteaPageSize {
+			return orgs, nil
+		}
+	}
+}
+
+func (p *GiteaProvider) getTeams(accessToken string) ([]giteaTeam, error) {
+	// https://try.gitea.io/api/swagger#/user/userListTeams
+	var teams []giteaTeam
+	for page := 1; ; page++ {
+		var data []giteaTeam
+		err := p.apiRequest(accessToken, "/user/teams", url.Values{
+			"limit": {strconv.Itoa(giteaPageSize)},
+			"page":  {strconv.Itoa(page)},
+		}, &data)
+		if err != nil {
+			return nil, err
+		}
+		teams = append(teams, data...)
+		if len(data) < giteaPageSize {
+			return teams, nil
+		}
+	}
+}
+
+func (p *GiteaProvider) hasOrg(accessToken string) (bool, error) {
+	orgs, err := p.getOrgs(accessToken)
+	if err != nil {
+		return false, err
+	}
+	for _, org := range orgs {
+		if strings.EqualFold(p.Org, org) {
+			log.Printf("Found Gitea Organization: %q", org)
+			return true, nil
+		}
+	}
+	log.Printf("Missing Organization:%q in %v", p.Org, orgs)
+	return false, nil
+}
+
+func (p *GiteaProvider) hasOrgAndTeam(accessToken string) (bool, error) {
+	teams, err := p.getTeams(accessToken)
+	if err != nil {
+		return false, err
+	}
+	var presentTeams []string
+	for _, team := range teams {
+		if !strings.EqualFold(p.Org, team.Org.login()) {
+			continue
+		}
+		for _, t := range strings.Split(p.Team, ",") {
+			if strings.EqualFold(t, team.Name) {
+				log.Printf("Found Gitea Organization:%q Team:%q", team.Org.login(), team.Name)
+				return true, nil
+			}
+		}
+		presentTeams = append(presentTeams, team.Name)
+	}
+	log.Printf("Missing Team:%q from Org:%q in teams: %v", p.Team, p.Org, presentTeams)
+	return false, nil
+}
+
+// GetGroups returns the user's teams as "org/team" pairs when an org is set
+func (p *GiteaProvider) GetGroups(s *SessionState) ([]string, error) {
+	if p.Org == "" {
+		return nil, nil
+	}
+	teams, err := p.getTeams(s.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, team := range teams {
+		groups = append(groups, fmt.Sprintf("%s/%s", team.Org.login(), team.Name))
+	}
+	return groups, nil
+}
+
+func (p *GiteaProvider) GetEmailAddress(s *SessionState) (string, error) {
+	// if we require an Org or Team, check that first
+	if p.Org != "" {
+		if p.Team != "" {
+			if ok, err := p.hasOrgAndTeam(s.AccessToken); err != nil || !ok {
+				return "", err
+			}
+		} else {
+			if ok, err := p.hasOrg(s.AccessToken); err != nil || !ok {
+				return "", err
+			}
+		}
+	}
+
+	// https://try.gitea.io/api/swagger#/user/userListEmails
+	var emails []struct {
+		Email    string `json:"email"`
+		Verified bool   `json:"verified"`
+		Primary  bool   `json:"primary"`
+	}
+	if err := p.apiRequest(s.AccessToken, "/user/emails", nil, &emails); err != nil {
+		return "", err
+	}
+	for _, email := range emails {
+		if email.Primary {
+			if !email.Verified {
+				return "", fmt.Errorf("email %s not listed as verified", email.Email)
+			}
+			return email.Email, nil
+		}
+	}
+	return "", nil
+}
+
+// ValidateSessionState fetches the user with the token in a header, as
+// newer releases reject tokens in the query string
+func (p *GiteaProvider) ValidateSessionState(s *SessionState) (bool, error) {
+	if s.AccessToken == "" {
+		return false, nil
+	}
+	var user struct {
+		ID int64 `json:"id"`
+	}
+	if err := p.apiRequest(s.AccessToken, "/user", nil, &user); err != nil {
+		log.Printf("token validation request failed: %s", err)
+		if Unavailable(err) {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
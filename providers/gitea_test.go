@@ -0,0 +1,165 @@
+package providers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func testGiteaProvider(backendURL string) *GiteaProvider {
+	p := NewGiteaProvider(&ProviderData{})
+	base, _ := url.Parse(backendURL)
+	p.Configure(base)
+	return p
+}
+
+func testGiteaBackend(responses map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "token imaginary_access_token" {
+				w.WriteHeader(401)
+				return
+			}
+			key := r.URL.Path
+			if page := r.URL.Query().Get("page"); page != "" {
+				key += "?page=" + page
+			}
+			response, ok := responses[key]
+			if !ok {
+				w.Write([]byte("[]"))
+				return
+			}
+			json.NewEncoder(w).Encode(response)
+		}))
+}
+
+func TestGiteaProviderDefaults(t *testing.T) {
+	p := testGiteaProvider("https://git.example.com/gitea")
+	assert.Equal(t, "Gitea", p.Data().ProviderName)
+	assert.Equal(t, "https://git.example.com/gitea/login/oauth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://git.example.com/gitea/login/oauth/access_token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://git.example.com/gitea/api/v1",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "read:user", p.Data().Scope)
+
+	p.SetOrgTeam("infra", "")
+	assert.Equal(t, "read:user read:organization", p.Data().Scope)
+
+	assert.Equal(t, "Forgejo", New("forgejo", &ProviderData{}).Data().ProviderName)
+}
+
+func TestGiteaProviderOverrides(t *testing.T) {
+	p := NewGiteaProvider(&ProviderData{
+		ValidateURL: &url.URL{Scheme: "https", Host: "api.example.com", Path: "/v1"},
+	})
+	base, _ := url.Parse("https://git.example.com")
+	p.Configure(base)
+	assert.Equal(t, "https://git.example.com/login/oauth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://api.example.com/v1", p.Data().ValidateURL.String())
+}
+
+func TestGiteaProviderGetEmailAddress(t *testing.T) {
+	b := testGiteaBackend(map[string]interface{}{
+		"/api/v1/user/emails": []map[string]interface{}{
+			{"email": "other@example.com", "verified": true, "primary": false},
+			{"email": "user@example.com", "verified": true, "primary": true},
+		},
+	})
+	defer b.Close()
+
+	p := testGiteaProvider(b.URL)
+	email, err := p.GetEmailAddress(&SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@example.com", email)
+}
+
+func TestGiteaProviderUnverifiedEmail(t *testing.T) {
+	b := testGiteaBackend(map[string]interface{}{
+		"/api/v1/user/emails": []map[string]interface{}{
+			{"email": "user@example.com", "verified": false, "primary": true},
+		},
+	})
+	defer b.Close()
+
+	p := testGiteaProvider(b.URL)
+	_, err := p.GetEmailAddress(&SessionState{AccessToken: "imaginary_access_token"})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestGiteaProviderOrgRestriction(t *testing.T) {
+	// the second page of orgs is only requested when the first one is full
+	firstPage := make([]map[string]string, giteaPageSize)
+	for i := range firstPage {
+		firstPage[i] = map[string]string{"username": "other"}
+	}
+	b := testGiteaBackend(map[string]interface{}{
+		"/api/v1/user/orgs?page=1": firstPage,
+		"/api/v1/user/orgs?page=2": []map[string]string{{"name": "Infra"}},
+		"/api/v1/user/emails": []map[string]interface{}{
+			{"email": "user@example.com", "verified": true, "primary": true},
+		},
+	})
+	defer b.Close()
+
+	p := testGiteaProvider(b.URL)
+	p.SetOrgTeam("infra", "")
+	email, err := p.GetEmailAddress(&SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@example.com", email)
+
+	p.SetOrgTeam("payments", "")
+	email, err = p.GetEmailAddress(&SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestGiteaProviderTeamRestriction(t *testing.T) {
+	b := testGiteaBackend(map[string]interface{}{
+		"/api/v1/user/teams?page=1": []map[string]interface{}{
+			{"name": "Owners", "organization": map[string]string{"username": "infra"}},
+			{"name": "oncall", "organization": map[string]string{"name": "infra"}},
+		},
+		"/api/v1/user/emails": []map[string]interface{}{
+			{"email": "user@example.com", "verified": true, "primary": true},
+		},
+	})
+	defer b.Close()
+
+	p := testGiteaProvider(b.URL)
+	p.SetOrgTeam("infra", "sre,oncall")
+	s := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(s)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@example.com", email)
+
+	groups, err := p.GetGroups(s)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"infra/Owners", "infra/oncall"}, groups)
+
+	p.SetOrgTeam("infra", "sre")
+	email, err = p.GetEmailAddress(s)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestGiteaProviderValidateSessionState(t *testing.T) {
+	b := testGiteaBackend(map[string]interface{}{
+		"/api/v1/user": map[string]interface{}{"id": 1},
+	})
+	defer b.Close()
+
+	p := testGiteaProvider(b.URL)
+	valid, err := p.ValidateSessionState(&SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, true, valid)
+	assert.Equal(t, nil, err)
+	valid, err = p.ValidateSessionState(&SessionState{AccessToken: "expired"})
+	assert.Equal(t, false, valid)
+	assert.Equal(t, nil, err)
+}
@@ -9,12 +9,29 @@ import (
 	"net/url"
 	"path"
 	"strings"
+
+	"github.com/bitly/oauth2_proxy/api"
 )
 
 type GitHubProvider struct {
 	*ProviderData
+	// Orgs admit all of their members
+	Orgs []string
+	// Teams admit their members
+	Teams []GitHubTeam
+	// Repo admits collaborators of the "owner/name" repository
+	Repo string
+	// Token, when set, is used to look up the collaborators of Repo, so
+	// private repositories can be checked without access to them
+	Token string
+	// Users admit these logins regardless of the other restrictions
+	Users []string
+}
+
+// GitHubTeam is a team of an organization, identified by its slug
+type GitHubTeam struct {
 	Org  string
-	Team string
+	Slug string
 }
 
 func NewGitHubProvider(p *ProviderData) *GitHubProvider {
@@ -46,12 +63,184 @@ func NewGitHubProvider(p *ProviderData) *GitHubProvider {
 	}
 	return &GitHubProvider{ProviderData: p}
 }
-func (p *GitHubProvider) SetOrgTeam(org, team string) {
-	p.Org = org
-	p.Team = team
-	if org != "" || team != "" {
+
+// SetEnterpriseURL points the endpoints that were left at their github.com
+// defaults at a GitHub Enterprise instance, whose API is served under
+// /api/v3
+func (p *GitHubProvider) SetEnterpriseURL(base *url.URL) {
+	endpoint := func(suffix string) *url.URL {
+		return &url.URL{
+			Scheme: base.Scheme,
+			Host:   base.Host,
+			Path:   path.Join("/", base.Path, suffix),
+		}
+	}
+	if p.LoginURL.Host == "github.com" {
+		p.LoginURL = endpoint("/login/oauth/authorize")
+	}
+	if p.RedeemURL.Host == "github.com" {
+		p.RedeemURL = endpoint("/login/oauth/access_token")
+	}
+	if p.ValidateURL.Host == "api.github.com" {
+		p.ValidateURL = endpoint("/api/v3")
+	}
+}
+
+// SetOrgsTeams restricts logins to members of any of orgs or teams. Teams
+// are given as "org:team" slugs, or as a bare team slug that applies to
+// each of orgs. An org with teams listed only admits members of those teams.
+func (p *GitHubProvider) SetOrgsTeams(orgs, teams []string) error {
+	p.Orgs = nil
+	p.Teams = nil
+	teamOrgs := make(map[string]bool)
+	for _, spec := range teams {
+		for _, team := range strings.Split(spec, ",") {
+			team = strings.TrimSpace(team)
+			if team == "" {
+				continue
+			}
+			if parts := strings.SplitN(team, ":", 2); len(parts) == 2 {
+				if parts[0] == "" || parts[1] == "" {
+					return fmt.Errorf("invalid github team %q", team)
+				}
+				p.Teams = append(p.Teams, GitHubTeam{Org: parts[0], Slug: parts[1]})
+				teamOrgs[strings.ToLower(parts[0])] = true
+				continue
+			}
+			if len(orgs) == 0 {
+				return fmt.Errorf("github team %q has no org, use <org>:<team>", team)
+			}
+			for _, org := range orgs {
+				p.Teams = append(p.Teams, GitHubTeam{Org: org, Slug: team})
+				teamOrgs[strings.ToLower(org)] = true
+			}
+		}
+	}
+	for _, org := range orgs {
+		if !teamOrgs[strings.ToLower(org)] {
+			p.Orgs = append(p.Orgs, org)
+		}
+	}
+	if len(p.Orgs) > 0 || len(p.Teams) > 0 {
 		p.Scope += " read:org"
 	}
+	return nil
+}
+
+// SetRepo restricts logins to collaborators of the "owner/name" repo.
+// token, when set, must have push access to it.
+func (p *GitHubProvider) SetRepo(repo, token string) {
+	p.Repo = repo
+	p.Token = token
+}
+
+// SetUsers admits the listed logins without checking orgs, teams or repo,
+// ie. for bots and contractors that aren't members
+func (p *GitHubProvider) SetUsers(users []string) {
+	p.Users = users
+}
+
+func (p *GitHubProvider) apiEndpoint(endpoint string) *url.URL {
+	return &url.URL{
+		Scheme: p.ValidateURL.Scheme,
+		Host:   p.ValidateURL.Host,
+		Path:   path.Join(p.ValidateURL.Path, endpoint),
+	}
+}
+
+// hasRepo checks the user's own permissions on the repo. Everyone can pull
+// a public repo, so push access is required for those.
+func (p *GitHubProvider) hasRepo(accessToken string) (bool, error) {
+	// https://developer.github.com/v3/repos/#get
+
+	endpoint := p.apiEndpoint("/repos/" + p.Repo)
+	req, _ := http.NewRequest("GET", endpoint.String(), nil)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
+
+	var repo struct {
+		Private     bool `json:"private"`
+		Permissions struct {
+			Pull bool `json:"pull"`
+			Push bool `json:"push"`
+		} `json:"permissions"`
+	}
+	if err := api.RequestJson(req, &repo); err != nil {
+		return false, err
+	}
+	if repo.Permissions.Push || (repo.Private && repo.Permissions.Pull) {
+		log.Printf("Found Github Repository access: %q", p.Repo)
+		return true, nil
+	}
+	log.Printf("Missing Repository access: %q", p.Repo)
+	return false, nil
+}
+
+func (p *GitHubProvider) getLogin(accessToken string) (string, error) {
+	// https://developer.github.com/v3/users/#get-the-authenticated-user
+
+	req, _ := http.NewRequest("GET", p.apiEndpoint("/user").String(), nil)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := api.RequestJson(req, &user); err != nil {
+		return "", err
+	}
+	return user.Login, nil
+}
+
+// isUser checks the user's login is one of the allowed users
+func (p *GitHubProvider) isUser(accessToken string) (bool, error) {
+	login, err := p.getLogin(accessToken)
+	if err != nil {
+		return false, err
+	}
+	for _, u := range p.Users {
+		if strings.EqualFold(u, login) {
+			log.Printf("Found Github User: %q", login)
+			return true, nil
+		}
+	}
+	log.Printf("Missing User:%q in %v", login, p.Users)
+	return false, nil
+}
+
+// isCollaborator looks the user up in the repo's collaborators with the
+// configured token
+func (p *GitHubProvider) isCollaborator(accessToken string) (bool, error) {
+	// https://developer.github.com/v3/repos/collaborators/#check-if-a-user-is-a-collaborator
+
+	login, err := p.getLogin(accessToken)
+	if err != nil {
+		return false, err
+	}
+
+	endpoint := p.apiEndpoint("/repos/" + p.Repo + "/collaborators/" + login)
+	req, _ := http.NewRequest("GET", endpoint.String(), nil)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", p.Token))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	switch resp.StatusCode {
+	case 204:
+		log.Printf("Found Github Repository collaborator: %q in %q", login, p.Repo)
+		return true, nil
+	case 404:
+		log.Printf("Missing Repository collaborator: %q in %q", login, p.Repo)
+		return false, nil
+	default:
+		return false, fmt.Errorf(
+			"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	}
 }
 
 func (p *GitHubProvider) hasOrg(accessToken string) (bool, error) {
@@ -95,27 +284,31 @@ func (p *GitHubProvider) hasOrg(accessToken string) (bool, error) {
 
 	var presentOrgs []string
 	for _, org := range orgs {
-		if p.Org == org.Login {
-			log.Printf("Found Github Organization: %q", org.Login)
-			return true, nil
+		for _, o := range p.Orgs {
+			if strings.EqualFold(o, org.Login) {
+				log.Printf("Found Github Organization: %q", org.Login)
+				return true, nil
+			}
 		}
 		presentOrgs = append(presentOrgs, org.Login)
 	}
 
-	log.Printf("Missing Organization:%q in %v", p.Org, presentOrgs)
+	log.Printf("Missing Organization:%q in %v", p.Orgs, presentOrgs)
 	return false, nil
 }
 
-func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
+type githubTeam struct {
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+	Org  struct {
+		Login string `json:"login"`
+	} `json:"organization"`
+}
+
+func (p *GitHubProvider) getTeams(accessToken string) ([]githubTeam, error) {
 	// https://developer.github.com/v3/orgs/teams/#list-user-teams
 
-	var teams []struct {
-		Name string `json:"name"`
-		Slug string `json:"slug"`
-		Org  struct {
-			Login string `json:"login"`
-		} `json:"organization"`
-	}
+	var teams []githubTeam
 
 	params := url.Values{
 		"limit": {"100"},
@@ -132,52 +325,94 @@ func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
 	req.Header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		return false, fmt.Errorf(
+		return nil, fmt.Errorf(
 			"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
 	}
 
 	if err := json.Unmarshal(body, &teams); err != nil {
-		return false, fmt.Errorf("%s unmarshaling %s", err, body)
+		return nil, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	return teams, nil
+}
+
+func (p *GitHubProvider) hasTeam(accessToken string) (bool, error) {
+	teams, err := p.getTeams(accessToken)
+	if err != nil {
+		return false, err
 	}
 
-	var hasOrg bool
-	presentOrgs := make(map[string]bool)
 	var presentTeams []string
 	for _, team := range teams {
-		presentOrgs[team.Org.Login] = true
-		if p.Org == team.Org.Login {
-			hasOrg = true
-			ts := strings.Split(p.Team, ",")
-			for _, t := range ts {
-				if t == team.Slug {
-					log.Printf("Found Github Organization:%q Team:%q (Name:%q)", team.Org.Login, team.Slug, team.Name)
-					return true, nil
-				}
+		for _, t := range p.Teams {
+			if strings.EqualFold(t.Org, team.Org.Login) && strings.EqualFold(t.Slug, team.Slug) {
+				log.Printf("Found Github Organization:%q Team:%q (Name:%q)", team.Org.Login, team.Slug, team.Name)
+				return true, nil
 			}
-			presentTeams = append(presentTeams, team.Slug)
 		}
+		presentTeams = append(presentTeams, fmt.Sprintf("%s:%s", team.Org.Login, team.Slug))
 	}
-	if hasOrg {
-		log.Printf("Missing Team:%q from Org:%q in teams: %v", p.Team, p.Org, presentTeams)
-	} else {
-		var allOrgs []string
-		for org, _ := range presentOrgs {
-			allOrgs = append(allOrgs, org)
+	log.Printf("Missing Team:%v in teams: %v", p.Teams, presentTeams)
+	return false, nil
+}
+
+// isAuthorized checks the user is one of the allowed users, a member of one
+// of the orgs or teams, or a collaborator of the repo, when a restriction
+// is configured
+func (p *GitHubProvider) isAuthorized(accessToken string) (bool, error) {
+	if len(p.Users) == 0 && len(p.Orgs) == 0 && len(p.Teams) == 0 && p.Repo == "" {
+		return true, nil
+	}
+	if len(p.Users) > 0 {
+		if ok, err := p.isUser(accessToken); err != nil || ok {
+			return ok, err
 		}
-		log.Printf("Missing Organization:%q in %#v", p.Org, allOrgs)
+	}
+	if len(p.Orgs) > 0 {
+		if ok, err := p.hasOrg(accessToken); err != nil || ok {
+			return ok, err
+		}
+	}
+	if len(p.Teams) > 0 {
+		if ok, err := p.hasTeam(accessToken); err != nil || ok {
+			return ok, err
+		}
+	}
+	if p.Repo != "" {
+		if p.Token != "" {
+			return p.isCollaborator(accessToken)
+		}
+		return p.hasRepo(accessToken)
 	}
 	return false, nil
 }
 
+// GetGroups returns the user's teams as "org/team" pairs. Teams are only
+// visible with the read:org scope, which is requested when an org or team
+// is set.
+func (p *GitHubProvider) GetGroups(s *SessionState) ([]string, error) {
+	if len(p.Orgs) == 0 && len(p.Teams) == 0 {
+		return nil, nil
+	}
+	teams, err := p.getTeams(s.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, team := range teams {
+		groups = append(groups, fmt.Sprintf("%s/%s", team.Org.Login, team.Slug))
+	}
+	return groups, nil
+}
+
 func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
 
 	var emails []struct {
@@ -185,17 +420,9 @@ func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
 		Primary bool   `json:"primary"`
 	}
 
-	// if we require an Org or Team, check that first
-	if p.Org != "" {
-		if p.Team != "" {
-			if ok, err := p.hasOrgAndTeam(s.AccessToken); err != nil || !ok {
-				return "", err
-			}
-		} else {
-			if ok, err := p.hasOrg(s.AccessToken); err != nil || !ok {
-				return "", err
-			}
-		}
+	// if we require a User, Org, Team or Repo, check that first
+	if ok, err := p.isAuthorized(s.AccessToken); err != nil || !ok {
+		return "", err
 	}
 
 	endpoint := &url.URL{
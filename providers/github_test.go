@@ -0,0 +1,213 @@
+package providers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestGitHubProviderDefaults(t *testing.T) {
+	p := NewGitHubProvider(&ProviderData{})
+	assert.Equal(t, "GitHub", p.Data().ProviderName)
+	assert.Equal(t, "https://github.com/login/oauth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://github.com/login/oauth/access_token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://api.github.com/",
+		p.Data().ValidateURL.String())
+}
+
+func TestGitHubProviderEnterpriseURL(t *testing.T) {
+	p := NewGitHubProvider(&ProviderData{})
+	base, _ := url.Parse("https://github.example.com")
+	p.SetEnterpriseURL(base)
+	assert.Equal(t, "https://github.example.com/login/oauth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://github.example.com/login/oauth/access_token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://github.example.com/api/v3",
+		p.Data().ValidateURL.String())
+
+	// explicitly set endpoints are kept
+	p = NewGitHubProvider(&ProviderData{
+		ValidateURL: &url.URL{Scheme: "https", Host: "api.example.com", Path: "/"},
+	})
+	p.SetEnterpriseURL(base)
+	assert.Equal(t, "https://api.example.com/", p.Data().ValidateURL.String())
+}
+
+func TestGitHubProviderEnterpriseOrg(t *testing.T) {
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v3/user/orgs":
+			w.Write([]byte(`[{"login":"infra"}]`))
+		case "/api/v3/user/emails":
+			w.Write([]byte(`[{"email":"user@example.com","primary":true}]`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer b.Close()
+
+	p := NewGitHubProvider(&ProviderData{})
+	base, _ := url.Parse(b.URL)
+	p.SetEnterpriseURL(base)
+	p.SetOrgsTeams([]string{"infra"}, nil)
+	email, err := p.GetEmailAddress(&SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@example.com", email)
+}
+
+func TestGitHubProviderSetOrgsTeams(t *testing.T) {
+	p := NewGitHubProvider(&ProviderData{})
+	assert.Equal(t, nil, p.SetOrgsTeams([]string{"acme", "partner"}, []string{"sre,oncall", "other:admins"}))
+	assert.Equal(t, 0, len(p.Orgs))
+	assert.Equal(t, []GitHubTeam{
+		{Org: "acme", Slug: "sre"},
+		{Org: "partner", Slug: "sre"},
+		{Org: "acme", Slug: "oncall"},
+		{Org: "partner", Slug: "oncall"},
+		{Org: "other", Slug: "admins"},
+	}, p.Teams)
+	assert.Equal(t, "user:email read:org", p.Data().Scope)
+
+	p = NewGitHubProvider(&ProviderData{})
+	assert.Equal(t, nil, p.SetOrgsTeams([]string{"acme", "Partner"}, []string{"partner:sre"}))
+	assert.Equal(t, []string{"acme"}, p.Orgs)
+	assert.Equal(t, []GitHubTeam{{Org: "partner", Slug: "sre"}}, p.Teams)
+
+	p = NewGitHubProvider(&ProviderData{})
+	assert.NotEqual(t, nil, p.SetOrgsTeams(nil, []string{"sre"}))
+	assert.NotEqual(t, nil, p.SetOrgsTeams(nil, []string{"acme:"}))
+}
+
+func testGitHubRestrictionBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/user/orgs":
+			w.Write([]byte(`[{"login":"acme"},{"login":"partner"}]`))
+		case "/user/teams":
+			w.Write([]byte(`[{"slug":"sre","organization":{"login":"partner"}}]`))
+		case "/user/emails":
+			w.Write([]byte(`[{"email":"user@example.com","primary":true}]`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+}
+
+func TestGitHubProviderOrgsTeamsRestriction(t *testing.T) {
+	b := testGitHubRestrictionBackend()
+	defer b.Close()
+
+	for _, c := range []struct {
+		orgs, teams []string
+		email       string
+	}{
+		{nil, nil, "user@example.com"},
+		{[]string{"other", "Partner"}, nil, "user@example.com"},
+		{[]string{"other"}, nil, ""},
+		{[]string{"partner"}, []string{"sre"}, "user@example.com"},
+		{[]string{"partner"}, []string{"admins"}, ""},
+		{[]string{"other"}, []string{"acme:admins", "partner:sre"}, "user@example.com"},
+		{nil, []string{"acme:admins"}, ""},
+	} {
+		p := NewGitHubProvider(&ProviderData{
+			ValidateURL: &url.URL{Scheme: "http", Host: b.Listener.Addr().String(), Path: "/"},
+		})
+		assert.Equal(t, nil, p.SetOrgsTeams(c.orgs, c.teams))
+		email, err := p.GetEmailAddress(&SessionState{AccessToken: "imaginary_access_token"})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, c.email, email)
+	}
+}
+
+func testGitHubRepoBackend(private, pull, push bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		switch r.URL.Path {
+		case "/repos/acme/staging":
+			fmt.Fprintf(w, `{"private":%t,"permissions":{"pull":%t,"push":%t}}`, private, pull, push)
+		case "/user":
+			w.Write([]byte(`{"login":"octocat"}`))
+		case "/repos/acme/staging/collaborators/octocat":
+			if auth != "token repo-token" {
+				w.WriteHeader(401)
+			} else if push {
+				w.WriteHeader(204)
+			} else {
+				w.WriteHeader(404)
+			}
+		case "/user/emails":
+			w.Write([]byte(`[{"email":"user@example.com","primary":true}]`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+}
+
+func TestGitHubProviderRepoRestriction(t *testing.T) {
+	for _, c := range []struct {
+		private, pull, push bool
+		token               string
+		email               string
+	}{
+		{false, true, false, "", ""},
+		{false, true, true, "", "user@example.com"},
+		{true, true, false, "", "user@example.com"},
+		{true, false, false, "", ""},
+		{true, false, false, "repo-token", ""},
+		{true, false, true, "repo-token", "user@example.com"},
+	} {
+		b := testGitHubRepoBackend(c.private, c.pull, c.push)
+		p := NewGitHubProvider(&ProviderData{
+			ValidateURL: &url.URL{Scheme: "http", Host: b.Listener.Addr().String(), Path: "/"},
+		})
+		p.SetRepo("acme/staging", c.token)
+		email, err := p.GetEmailAddress(&SessionState{AccessToken: "imaginary_access_token"})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, c.email, email)
+		b.Close()
+	}
+}
+
+func TestGitHubProviderRepoTokenErrors(t *testing.T) {
+	b := testGitHubRepoBackend(true, false, true)
+	defer b.Close()
+
+	p := NewGitHubProvider(&ProviderData{
+		ValidateURL: &url.URL{Scheme: "http", Host: b.Listener.Addr().String(), Path: "/"},
+	})
+	p.SetRepo("acme/staging", "wrong-token")
+	_, err := p.GetEmailAddress(&SessionState{AccessToken: "imaginary_access_token"})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestGitHubProviderUserAllowlist(t *testing.T) {
+	b := testGitHubRepoBackend(false, true, false)
+	defer b.Close()
+
+	for _, c := range []struct {
+		users []string
+		repo  string
+		email string
+	}{
+		{[]string{"OctoCat"}, "", "user@example.com"},
+		{[]string{"hubot"}, "", ""},
+		{[]string{"hubot", "octocat"}, "acme/staging", "user@example.com"},
+		{[]string{"hubot"}, "acme/staging", ""},
+	} {
+		p := NewGitHubProvider(&ProviderData{
+			ValidateURL: &url.URL{Scheme: "http", Host: b.Listener.Addr().String(), Path: "/"},
+		})
+		p.SetRepo(c.repo, "")
+		p.SetUsers(c.users)
+		email, err := p.GetEmailAddress(&SessionState{AccessToken: "imaginary_access_token"})
+		assert.Equal(t, nil, err)
+		assert.Equal(t, c.email, email)
+	}
+}
@@ -1,15 +1,52 @@
 package providers
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/bitly/oauth2_proxy/api"
 )
 
+// defaultGitLabProjectAccessLevel is the Reporter access level
+// https://docs.gitlab.com/ee/api/members.html#valid-access-levels
+const defaultGitLabProjectAccessLevel = 20
+
 type GitLabProvider struct {
 	*ProviderData
+	Groups   []string
+	Projects []*GitLabProject
+}
+
+// GitLabProject is a project path and the minimum access level a user
+// needs on it
+type GitLabProject struct {
+	Name        string
+	AccessLevel int
+}
+
+// NewGitLabProject parses a "group/project" or "group/project=<level>"
+// specification
+func NewGitLabProject(spec string) (*GitLabProject, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	project := &GitLabProject{Name: parts[0], AccessLevel: defaultGitLabProjectAccessLevel}
+	if project.Name == "" {
+		return nil, fmt.Errorf("invalid gitlab project %q", spec)
+	}
+	if len(parts) == 2 {
+		level, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid gitlab project access level %q", spec)
+		}
+		project.AccessLevel = level
+	}
+	return project, nil
 }
 
 func NewGitLabProvider(p *ProviderData) *GitLabProvider {
@@ -32,7 +69,7 @@ func NewGitLabProvider(p *ProviderData) *GitLabProvider {
 		p.ValidateURL = &url.URL{
 			Scheme: "https",
 			Host:   "gitlab.com",
-			Path:   "/api/v3/user",
+			Path:   "/api/v4/user",
 		}
 	}
 	if p.Scope == "" {
@@ -41,8 +78,162 @@ func NewGitLabProvider(p *ProviderData) *GitLabProvider {
 	return &GitLabProvider{ProviderData: p}
 }
 
+// SetBaseURL points the endpoints that were left at their gitlab.com
+// defaults at a self-hosted GitLab instance
+func (p *GitLabProvider) SetBaseURL(base *url.URL) {
+	for _, u := range []*url.URL{p.LoginURL, p.RedeemURL, p.ValidateURL} {
+		if u.Host != "gitlab.com" {
+			continue
+		}
+		u.Scheme = base.Scheme
+		u.Host = base.Host
+		u.Path = path.Join("/", base.Path, u.Path)
+	}
+}
+
+// SetGroupsProjects restricts logins to members of any of the given groups
+// or projects
+func (p *GitLabProvider) SetGroupsProjects(groups []string, projects []*GitLabProject) {
+	p.Groups = groups
+	p.Projects = projects
+}
+
+// apiURL builds an API endpoint relative to the user endpoint, which is the
+// root of the API plus "/user"
+func (p *GitLabProvider) apiURL(endpoint string, params url.Values) *url.URL {
+	return &url.URL{
+		Scheme:   p.ValidateURL.Scheme,
+		Host:     p.ValidateURL.Host,
+		Path:     path.Join(path.Dir(p.ValidateURL.Path), endpoint),
+		RawQuery: params.Encode(),
+	}
+}
+
+func (p *GitLabProvider) getUserGroups(accessToken string) ([]string, error) {
+	// https://docs.gitlab.com/ee/api/groups.html#list-groups
+
+	var groups []string
+	page := "1"
+	for page != "" {
+		endpoint := p.apiURL("/groups", url.Values{
+			"access_token": {accessToken},
+			"per_page":     {"100"},
+			"page":         {page},
+		})
+		resp, err := http.DefaultClient.Get(endpoint.String())
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf(
+				"got %d from %q %s", resp.StatusCode, stripToken(endpoint.String()), body)
+		}
+
+		var data []struct {
+			FullPath string `json:"full_path"`
+		}
+		if err := json.Unmarshal(body, &data); err != nil {
+			return nil, fmt.Errorf("%s unmarshaling %s", err, body)
+		}
+		for _, group := range data {
+			groups = append(groups, group.FullPath)
+		}
+		page = resp.Header.Get("X-Next-Page")
+	}
+	return groups, nil
+}
+
+func (p *GitLabProvider) hasProjectAccess(accessToken string, project *GitLabProject) (bool, error) {
+	// https://docs.gitlab.com/ee/api/projects.html#get-single-project
+
+	// the project path is passed URL encoded as a single path segment
+	endpoint := p.apiURL("/projects/"+project.Name, url.Values{
+		"access_token": {accessToken},
+	})
+	endpoint.RawPath = path.Join(path.Dir(p.ValidateURL.Path), "/projects/"+url.PathEscape(project.Name))
+	req, err := http.NewRequest("GET", endpoint.String(), nil)
+	if err != nil {
+		return false, err
+	}
+
+	var data struct {
+		Permissions struct {
+			ProjectAccess *struct {
+				AccessLevel int `json:"access_level"`
+			} `json:"project_access"`
+			GroupAccess *struct {
+				AccessLevel int `json:"access_level"`
+			} `json:"group_access"`
+		} `json:"permissions"`
+	}
+	if err := api.RequestJson(req, &data); err != nil {
+		return false, err
+	}
+
+	level := 0
+	if a := data.Permissions.ProjectAccess; a != nil && a.AccessLevel > level {
+		level = a.AccessLevel
+	}
+	if a := data.Permissions.GroupAccess; a != nil && a.AccessLevel > level {
+		level = a.AccessLevel
+	}
+	return level >= project.AccessLevel, nil
+}
+
+func (p *GitLabProvider) isAuthorized(accessToken string) (bool, error) {
+	if len(p.Groups) == 0 && len(p.Projects) == 0 {
+		return true, nil
+	}
+
+	if len(p.Groups) > 0 {
+		groups, err := p.getUserGroups(accessToken)
+		if err != nil {
+			return false, err
+		}
+		for _, group := range groups {
+			for _, g := range p.Groups {
+				if g == group {
+					log.Printf("Found GitLab Group: %q", group)
+					return true, nil
+				}
+			}
+		}
+		log.Printf("Missing Group:%v in %v", p.Groups, groups)
+	}
+
+	for _, project := range p.Projects {
+		ok, err := p.hasProjectAccess(accessToken, project)
+		if err != nil {
+			log.Printf("error checking access to project %q: %s", project.Name, err)
+			continue
+		}
+		if ok {
+			log.Printf("Found GitLab Project: %q", project.Name)
+			return true, nil
+		}
+	}
+	if len(p.Projects) > 0 {
+		var names []string
+		for _, project := range p.Projects {
+			names = append(names, project.Name)
+		}
+		log.Printf("Missing Project access:%v", names)
+	}
+	return false, nil
+}
+
 func (p *GitLabProvider) GetEmailAddress(s *SessionState) (string, error) {
 
+	// if we require a group or project, check that first
+	if ok, err := p.isAuthorized(s.AccessToken); err != nil || !ok {
+		return "", err
+	}
+
 	req, err := http.NewRequest("GET",
 		p.ValidateURL.String()+"?access_token="+s.AccessToken, nil)
 	if err != nil {
@@ -56,3 +247,12 @@ func (p *GitLabProvider) GetEmailAddress(s *SessionState) (string, error) {
 	}
 	return json.Get("email").String()
 }
+
+// GetGroups returns the full paths of the groups the user is a member of
+// when a group restriction is configured
+func (p *GitLabProvider) GetGroups(s *SessionState) ([]string, error) {
+	if len(p.Groups) == 0 {
+		return nil, nil
+	}
+	return p.getUserGroups(s.AccessToken)
+}
@@ -28,7 +28,7 @@ func testGitLabProvider(hostname string) *GitLabProvider {
 }
 
 func testGitLabBackend(payload string) *httptest.Server {
-	path := "/api/v3/user"
+	path := "/api/v4/user"
 	query := "access_token=imaginary_access_token"
 
 	return httptest.NewServer(http.HandlerFunc(
@@ -51,7 +51,7 @@ func TestGitLabProviderDefaults(t *testing.T) {
 		p.Data().LoginURL.String())
 	assert.Equal(t, "https://gitlab.com/oauth/token",
 		p.Data().RedeemURL.String())
-	assert.Equal(t, "https://gitlab.com/api/v3/user",
+	assert.Equal(t, "https://gitlab.com/api/v4/user",
 		p.Data().ValidateURL.String())
 	assert.Equal(t, "api", p.Data().Scope)
 }
@@ -70,7 +70,7 @@ func TestGitLabProviderOverrides(t *testing.T) {
 			ValidateURL: &url.URL{
 				Scheme: "https",
 				Host:   "example.com",
-				Path:   "/api/v3/user"},
+				Path:   "/api/v4/user"},
 			Scope: "profile"})
 	assert.NotEqual(t, nil, p)
 	assert.Equal(t, "GitLab", p.Data().ProviderName)
@@ -78,7 +78,7 @@ func TestGitLabProviderOverrides(t *testing.T) {
 		p.Data().LoginURL.String())
 	assert.Equal(t, "https://example.com/oauth/token",
 		p.Data().RedeemURL.String())
-	assert.Equal(t, "https://example.com/api/v3/user",
+	assert.Equal(t, "https://example.com/api/v4/user",
 		p.Data().ValidateURL.String())
 	assert.Equal(t, "profile", p.Data().Scope)
 }
@@ -126,3 +126,96 @@ func TestGitLabProviderGetEmailAddressEmailNotPresentInPayload(t *testing.T) {
 	assert.NotEqual(t, nil, err)
 	assert.Equal(t, "", email)
 }
+
+func testGitLabGroupsBackend(payload string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/api/v4/user":
+				w.WriteHeader(200)
+				w.Write([]byte(payload))
+			case r.URL.Path == "/api/v4/groups" && r.URL.Query().Get("page") == "1":
+				w.Header().Set("X-Next-Page", "2")
+				w.WriteHeader(200)
+				w.Write([]byte(`[{"full_path": "group1"}]`))
+			case r.URL.Path == "/api/v4/groups" && r.URL.Query().Get("page") == "2":
+				w.WriteHeader(200)
+				w.Write([]byte(`[{"full_path": "group2/subgroup"}]`))
+			case r.URL.EscapedPath() == "/api/v4/projects/group1%2Fproject":
+				w.WriteHeader(200)
+				w.Write([]byte(`{"permissions": {"project_access": {"access_level": 30}}}`))
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+}
+
+func TestGitLabProviderSetBaseURL(t *testing.T) {
+	p := testGitLabProvider("")
+	p.ValidateURL = &url.URL{Scheme: "https", Host: "example.com", Path: "/api/v4/user"}
+	base, _ := url.Parse("http://gitlab.example.com/prefix")
+	p.SetBaseURL(base)
+	assert.Equal(t, "http://gitlab.example.com/prefix/oauth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "http://gitlab.example.com/prefix/oauth/token",
+		p.Data().RedeemURL.String())
+	// explicitly configured endpoints are left alone
+	assert.Equal(t, "https://example.com/api/v4/user",
+		p.Data().ValidateURL.String())
+}
+
+func TestNewGitLabProject(t *testing.T) {
+	project, err := NewGitLabProject("group/project")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "group/project", project.Name)
+	assert.Equal(t, 20, project.AccessLevel)
+
+	project, err = NewGitLabProject("group/project=40")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 40, project.AccessLevel)
+
+	_, err = NewGitLabProject("group/project=owner")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestGitLabProviderGetEmailAddressWithGroup(t *testing.T) {
+	b := testGitLabGroupsBackend("{\"email\": \"michael.bland@gsa.gov\"}")
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testGitLabProvider(b_url.Host)
+	p.SetGroupsProjects([]string{"group2/subgroup"}, nil)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+
+	groups, err := p.GetGroups(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"group1", "group2/subgroup"}, groups)
+
+	p.SetGroupsProjects([]string{"group3"}, nil)
+	email, err = p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestGitLabProviderGetEmailAddressWithProject(t *testing.T) {
+	b := testGitLabGroupsBackend("{\"email\": \"michael.bland@gsa.gov\"}")
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testGitLabProvider(b_url.Host)
+	p.SetGroupsProjects(nil, []*GitLabProject{{Name: "group1/project", AccessLevel: 30}})
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+
+	p.SetGroupsProjects(nil, []*GitLabProject{{Name: "group1/project", AccessLevel: 40}})
+	email, err = p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
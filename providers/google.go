@@ -2,6 +2,7 @@ package providers
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -14,6 +15,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/bitly/oauth2_proxy/api"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/admin/directory/v1"
@@ -26,6 +28,18 @@ type GoogleProvider struct {
 	// GroupValidator is a function that determines if the passed email is in
 	// the configured Google group.
 	GroupValidator func(string) bool
+	// GroupLister is a function that returns the configured Google groups the
+	// passed email is a member of.
+	GroupLister func(string) []string
+	// groupCache, when set, caches the group memberships looked up by the
+	// group restriction
+	groupCache *groupCache
+	// serveStaleGroups, when set and returning true, lets failed lookups
+	// fall back to expired cache entries
+	serveStaleGroups func() bool
+	// HostedDomains, when set, restricts logins to accounts of these Google
+	// Workspace domains, as stated by the ID token's hd claim
+	HostedDomains []string
 }
 
 func NewGoogleProvider(p *ProviderData) *GoogleProvider {
@@ -59,34 +73,70 @@ func NewGoogleProvider(p *ProviderData) *GoogleProvider {
 		GroupValidator: func(email string) bool {
 			return true
 		},
+		GroupLister: func(email string) []string {
+			return nil
+		},
 	}
 }
 
-func emailFromIdToken(idToken string) (string, error) {
+type googleIdTokenClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	HostedDomain  string `json:"hd"`
+}
+
+func claimsFromIdToken(idToken string) (*googleIdTokenClaims, error) {
 
 	// id_token is a base64 encode ID token payload
 	// https://developers.google.com/accounts/docs/OAuth2Login#obtainuserinfo
 	jwt := strings.Split(idToken, ".")
+	if len(jwt) < 2 {
+		return nil, errors.New("malformed id_token")
+	}
 	b, err := jwtDecodeSegment(jwt[1])
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var email struct {
-		Email         string `json:"email"`
-		EmailVerified bool   `json:"email_verified"`
-	}
-	err = json.Unmarshal(b, &email)
+	var claims googleIdTokenClaims
+	err = json.Unmarshal(b, &claims)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if claims.Email == "" {
+		return nil, errors.New("missing email")
+	}
+	if !claims.EmailVerified {
+		return nil, fmt.Errorf("email %s not listed as verified", claims.Email)
 	}
-	if email.Email == "" {
-		return "", errors.New("missing email")
+	return &claims, nil
+}
+
+// SetHostedDomains restricts logins to accounts of the given Google
+// Workspace domains, where "*.example.com" allows any subdomain of
+// example.com. Tokens without an hd claim, such as those of consumer
+// accounts, are rejected.
+func (p *GoogleProvider) SetHostedDomains(domains []string) {
+	p.HostedDomains = domains
+}
+
+func (p *GoogleProvider) checkHostedDomain(claims *googleIdTokenClaims) error {
+	if len(p.HostedDomains) == 0 {
+		return nil
 	}
-	if !email.EmailVerified {
-		return "", fmt.Errorf("email %s not listed as verified", email.Email)
+	if claims.HostedDomain == "" {
+		return fmt.Errorf("%s is not a Google Workspace account", claims.Email)
+	}
+	hd := strings.ToLower(claims.HostedDomain)
+	for _, domain := range p.HostedDomains {
+		if strings.HasPrefix(domain, "*.") && strings.HasSuffix(hd, strings.ToLower(domain[1:])) {
+			return nil
+		}
+		if strings.EqualFold(hd, domain) {
+			return nil
+		}
 	}
-	return email.Email, nil
+	return fmt.Errorf("hosted domain %q of %s is not allowed", claims.HostedDomain, claims.Email)
 }
 
 func jwtDecodeSegment(seg string) ([]byte, error) {
@@ -105,8 +155,9 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 
 	params := url.Values{}
 	params.Add("redirect_uri", redirectURL)
-	params.Add("client_id", p.ClientID)
-	params.Add("client_secret", p.ClientSecret)
+	credentials := p.Credentials()
+	params.Add("client_id", credentials.ClientID)
+	params.Add("client_secret", credentials.ClientSecret)
 	params.Add("code", code)
 	params.Add("grant_type", "authorization_code")
 	var req *http.Request
@@ -142,16 +193,20 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 	if err != nil {
 		return
 	}
-	var email string
-	email, err = emailFromIdToken(jsonResponse.IdToken)
+	var claims *googleIdTokenClaims
+	claims, err = claimsFromIdToken(jsonResponse.IdToken)
+	if err != nil {
+		return
+	}
+	err = p.checkHostedDomain(claims)
 	if err != nil {
 		return
 	}
 	s = &SessionState{
 		AccessToken:  jsonResponse.AccessToken,
-		ExpiresOn:    time.Now().Add(time.Duration(jsonResponse.ExpiresIn) * time.Second).Truncate(time.Second),
+		ExpiresOn:    Now().Add(time.Duration(jsonResponse.ExpiresIn) * time.Second).Truncate(time.Second),
 		RefreshToken: jsonResponse.RefreshToken,
-		Email:        email,
+		Email:        claims.Email,
 	}
 	return
 }
@@ -162,11 +217,64 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 // account credentials.
 func (p *GoogleProvider) SetGroupRestriction(groups []string, adminEmail string, credentialsReader io.Reader) {
 	adminService := getAdminService(adminEmail, credentialsReader)
+	fetch := func(email string) ([]string, error) {
+		return userGroups(adminService, groups, email, false)
+	}
 	p.GroupValidator = func(email string) bool {
-		return userInGroup(adminService, groups, email)
+		var found []string
+		var err error
+		if p.groupCache == nil {
+			// nothing is cached for GroupLister, so any one group will do
+			found, err = userGroups(adminService, groups, email, true)
+		} else {
+			found, err = p.lookupGroups(email, fetch)
+		}
+		if err != nil {
+			log.Printf("error fetching groups of %s: %v", email, err)
+			return false
+		}
+		return len(found) > 0
+	}
+	p.GroupLister = func(email string) []string {
+		found, err := p.lookupGroups(email, fetch)
+		if err != nil {
+			log.Printf("error fetching groups of %s: %v", email, err)
+		}
+		return found
 	}
 }
 
+// SetGroupCache caches group memberships for ttl, and users that are in
+// none of the groups for negativeTTL. A zero ttl disables the cache.
+func (p *GoogleProvider) SetGroupCache(ttl, negativeTTL time.Duration) {
+	if ttl <= 0 {
+		p.groupCache = nil
+		return
+	}
+	p.groupCache = newGroupCache(ttl, negativeTTL)
+}
+
+// SetStaleGroups serves expired group memberships from the cache when
+// looking them up fails while serveStale returns true, ie. during an outage
+func (p *GoogleProvider) SetStaleGroups(serveStale func() bool) {
+	p.serveStaleGroups = serveStale
+}
+
+func (p *GoogleProvider) lookupGroups(email string, fetch func(string) ([]string, error)) ([]string, error) {
+	if p.groupCache == nil {
+		return fetch(email)
+	}
+	groups, err := p.groupCache.Lookup(email, time.Now(), fetch)
+	if err != nil && p.serveStaleGroups != nil && p.serveStaleGroups() {
+		if stale, ok := p.groupCache.Stale(email); ok {
+			log.Printf("degraded mode: using cached groups of %s after error: %v", email, err)
+			groupCacheCounter.WithLabelValues("stale_hit").Inc()
+			return stale, nil
+		}
+	}
+	return groups, err
+}
+
 func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Service {
 	data, err := ioutil.ReadAll(credentialsReader)
 	if err != nil {
@@ -178,7 +286,11 @@ func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Serv
 	}
 	conf.Subject = adminEmail
 
-	client := conf.Client(oauth2.NoContext)
+	// the Admin SDK quota is easily used up by group checks, so back off
+	// from it as it asks
+	ctx := context.WithValue(oauth2.NoContext, oauth2.HTTPClient,
+		&http.Client{Transport: api.NewRateLimitTransport(http.DefaultTransport)})
+	client := conf.Client(ctx)
 	adminService, err := admin.New(client)
 	if err != nil {
 		log.Fatal(err)
@@ -186,36 +298,105 @@ func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Serv
 	return adminService
 }
 
-func userInGroup(service *admin.Service, groups []string, email string) bool {
+// groupCheckConcurrency bounds the group membership checks of a user that
+// are in flight at once
+const groupCheckConcurrency = 8
+
+// userGroups returns the subset of groups that email is a member of, or only
+// the first one found when first is set. Groups that don't exist are skipped,
+// as are users that don't exist.
+func userGroups(service *admin.Service, groups []string, email string, first bool) ([]string, error) {
 	user, err := fetchUser(service, email)
 	if err != nil {
-		log.Printf("error fetching user: %v", err)
-		return false
+		if err, ok := err.(*googleapi.Error); ok && err.Code == 404 {
+			log.Printf("error fetching user %s: user does not exist", email)
+			return nil, nil
+		}
+		return nil, err
 	}
-	id := user.Id
-	custID := user.CustomerId
 
-	for _, group := range groups {
+	return memberGroups(groups, first, func(group string) (bool, error) {
 		members, err := fetchGroupMembers(service, group)
 		if err != nil {
 			if err, ok := err.(*googleapi.Error); ok && err.Code == 404 {
 				log.Printf("error fetching members for group %s: group does not exist", group)
-			} else {
-				log.Printf("error fetching group members: %v", err)
-				return false
+				return false, nil
 			}
+			return false, err
 		}
+		return isGroupMember(members, user.Id, user.CustomerId), nil
+	})
+}
 
-		for _, member := range members {
-			switch member.Type {
-			case "CUSTOMER":
-				if member.Id == custID {
-					return true
-				}
-			case "USER":
-				if member.Id == id {
-					return true
+// memberGroups checks the groups with isMember in parallel, at most
+// groupCheckConcurrency at a time, and returns those it's true for in their
+// configured order. When first is set it returns as soon as one is found,
+// without starting further checks; so does the first error.
+func memberGroups(groups []string, first bool, isMember func(string) (bool, error)) ([]string, error) {
+	type result struct {
+		i      int
+		member bool
+		err    error
+	}
+	work := make(chan int, len(groups))
+	for i := range groups {
+		work <- i
+	}
+	close(work)
+	// buffered so that checks still in flight when returning early don't
+	// block their worker
+	results := make(chan result, len(groups))
+	stop := make(chan struct{})
+	defer close(stop)
+
+	workers := groupCheckConcurrency
+	if len(groups) < workers {
+		workers = len(groups)
+	}
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range work {
+				select {
+				case <-stop:
+					return
+				default:
 				}
+				member, err := isMember(groups[i])
+				results <- result{i, member, err}
+			}
+		}()
+	}
+
+	member := make([]bool, len(groups))
+	for range groups {
+		r := <-results
+		if r.err != nil {
+			return nil, r.err
+		}
+		if r.member && first {
+			return []string{groups[r.i]}, nil
+		}
+		member[r.i] = r.member
+	}
+	var found []string
+	for i, group := range groups {
+		if member[i] {
+			found = append(found, group)
+		}
+	}
+	return found, nil
+}
+
+func isGroupMember(members []*admin.Member, id, custID string) bool {
+	for _, member := range members {
+		switch member.Type {
+		case "CUSTOMER":
+			if member.Id == custID {
+				return true
+			}
+		case "USER":
+			if member.Id == id {
+				return true
 			}
 		}
 	}
@@ -250,6 +431,12 @@ func fetchGroupMembers(service *admin.Service, group string) ([]*admin.Member, e
 	return members, nil
 }
 
+// GetGroups returns the configured Google groups the session's user is a
+// member of.
+func (p *GoogleProvider) GetGroups(s *SessionState) ([]string, error) {
+	return p.GroupLister(s.Email), nil
+}
+
 // ValidateGroup validates that the provided email exists in the configured Google
 // group(s).
 func (p *GoogleProvider) ValidateGroup(email string) bool {
@@ -257,7 +444,7 @@ func (p *GoogleProvider) ValidateGroup(email string) bool {
 }
 
 func (p *GoogleProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
-	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+	if s == nil || s.ExpiresOn.After(Now()) || s.RefreshToken == "" {
 		return false, nil
 	}
 
@@ -272,8 +459,9 @@ func (p *GoogleProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 	}
 
 	origExpiration := s.ExpiresOn
+	s.Groups = p.GroupLister(s.Email)
 	s.AccessToken = newToken
-	s.ExpiresOn = time.Now().Add(duration).Truncate(time.Second)
+	s.ExpiresOn = Now().Add(duration).Truncate(time.Second)
 	log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
 	return true, nil
 }
@@ -281,8 +469,9 @@ func (p *GoogleProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 func (p *GoogleProvider) redeemRefreshToken(refreshToken string) (token string, expires time.Duration, err error) {
 	// https://developers.google.com/identity/protocols/OAuth2WebServer#refresh
 	params := url.Values{}
-	params.Add("client_id", p.ClientID)
-	params.Add("client_secret", p.ClientSecret)
+	credentials := p.Credentials()
+	params.Add("client_id", credentials.ClientID)
+	params.Add("client_secret", credentials.ClientSecret)
 	params.Add("refresh_token", refreshToken)
 	params.Add("grant_type", "refresh_token")
 	var req *http.Request
@@ -304,7 +493,7 @@ func (p *GoogleProvider) redeemRefreshToken(refreshToken string) (token string,
 	}
 
 	if resp.StatusCode != 200 {
-		err = fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+		err = statusError(resp.StatusCode, p.RedeemURL.String(), body)
 		return
 	}
 
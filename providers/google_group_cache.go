@@ -0,0 +1,102 @@
+package providers
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// groupCacheMaxEntries bounds the memory used by the group membership cache
+const groupCacheMaxEntries = 10000
+
+var groupCacheCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "google_group_cache_total",
+	Help: "Google group membership cache lookups by result.",
+}, []string{"result"})
+
+func init() {
+	prometheus.MustRegister(groupCacheCounter)
+}
+
+type groupCacheEntry struct {
+	groups  []string
+	expires time.Time
+}
+
+// groupCache remembers the groups a user is a member of, so that sessions
+// can be validated without a round trip to the Admin SDK each time. Users
+// that are in none of the groups are cached for negativeTTL, which may be
+// zero to always look them up again.
+type groupCache struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	negativeTTL time.Duration
+	entries     map[string]groupCacheEntry
+}
+
+func newGroupCache(ttl, negativeTTL time.Duration) *groupCache {
+	return &groupCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     make(map[string]groupCacheEntry),
+	}
+}
+
+// Lookup returns the cached groups of email, or calls fetch and caches its
+// result. Errors aren't cached.
+func (c *groupCache) Lookup(email string, now time.Time, fetch func(string) ([]string, error)) ([]string, error) {
+	key := strings.ToLower(email)
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		if len(e.groups) == 0 {
+			groupCacheCounter.WithLabelValues("negative_hit").Inc()
+		} else {
+			groupCacheCounter.WithLabelValues("hit").Inc()
+		}
+		return e.groups, nil
+	}
+	groupCacheCounter.WithLabelValues("miss").Inc()
+
+	groups, err := fetch(email)
+	if err != nil {
+		return nil, err
+	}
+	ttl := c.ttl
+	if len(groups) == 0 {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return groups, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= groupCacheMaxEntries {
+		c.gc(now)
+	}
+	c.entries[key] = groupCacheEntry{groups: groups, expires: now.Add(ttl)}
+	return groups, nil
+}
+
+// Stale returns the cached groups of email even when they have expired
+func (c *groupCache) Stale(email string) ([]string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[strings.ToLower(email)]
+	return e.groups, ok
+}
+
+// gc drops the expired entries, or everything when that doesn't make room
+func (c *groupCache) gc(now time.Time) {
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) >= groupCacheMaxEntries {
+		c.entries = make(map[string]groupCacheEntry)
+	}
+}
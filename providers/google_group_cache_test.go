@@ -0,0 +1,105 @@
+package providers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestGroupCacheLookup(t *testing.T) {
+	var fetches int
+	members := map[string][]string{"user@example.com": {"admins@example.com"}}
+	fetch := func(email string) ([]string, error) {
+		fetches++
+		return members[email], nil
+	}
+	c := newGroupCache(time.Minute, 10*time.Second)
+	now := time.Now()
+
+	groups, err := c.Lookup("user@example.com", now, fetch)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"admins@example.com"}, groups)
+	groups, _ = c.Lookup("USER@example.com", now.Add(59*time.Second), fetch)
+	assert.Equal(t, []string{"admins@example.com"}, groups)
+	assert.Equal(t, 1, fetches)
+
+	delete(members, "user@example.com")
+	groups, _ = c.Lookup("user@example.com", now.Add(time.Minute), fetch)
+	assert.Equal(t, 0, len(groups))
+	assert.Equal(t, 2, fetches)
+
+	// negative results expire after the negative ttl
+	c.Lookup("user@example.com", now.Add(time.Minute+9*time.Second), fetch)
+	assert.Equal(t, 2, fetches)
+	c.Lookup("user@example.com", now.Add(time.Minute+10*time.Second), fetch)
+	assert.Equal(t, 3, fetches)
+}
+
+func TestGroupCacheNoNegativeCaching(t *testing.T) {
+	var fetches int
+	fetch := func(email string) ([]string, error) {
+		fetches++
+		return nil, nil
+	}
+	c := newGroupCache(time.Minute, 0)
+	now := time.Now()
+	c.Lookup("user@example.com", now, fetch)
+	c.Lookup("user@example.com", now, fetch)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestGroupCacheErrorsNotCached(t *testing.T) {
+	var fetches int
+	fetch := func(email string) ([]string, error) {
+		fetches++
+		if fetches == 1 {
+			return nil, errors.New("rate limited")
+		}
+		return []string{"admins@example.com"}, nil
+	}
+	c := newGroupCache(time.Minute, time.Minute)
+	now := time.Now()
+	_, err := c.Lookup("user@example.com", now, fetch)
+	assert.NotEqual(t, nil, err)
+	groups, err := c.Lookup("user@example.com", now, fetch)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"admins@example.com"}, groups)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestGoogleProviderGroupCacheDisabled(t *testing.T) {
+	p := newGoogleProvider()
+	p.SetGroupCache(0, time.Minute)
+	assert.Equal(t, (*groupCache)(nil), p.groupCache)
+	p.SetGroupCache(time.Minute, 0)
+	assert.NotEqual(t, (*groupCache)(nil), p.groupCache)
+}
+
+func TestGoogleProviderStaleGroups(t *testing.T) {
+	p := &GoogleProvider{}
+	p.SetGroupCache(time.Minute, 0)
+	p.groupCache.entries["user@example.com"] = groupCacheEntry{
+		groups:  []string{"admins@example.com"},
+		expires: time.Now().Add(-time.Hour),
+	}
+	fetch := func(email string) ([]string, error) {
+		return nil, errors.New("backend error")
+	}
+
+	_, err := p.lookupGroups("user@example.com", fetch)
+	assert.NotEqual(t, nil, err)
+
+	degraded := false
+	p.SetStaleGroups(func() bool { return degraded })
+	_, err = p.lookupGroups("user@example.com", fetch)
+	assert.NotEqual(t, nil, err)
+
+	degraded = true
+	groups, err := p.lookupGroups("user@example.com", fetch)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"admins@example.com"}, groups)
+	_, err = p.lookupGroups("other@example.com", fetch)
+	assert.NotEqual(t, nil, err)
+}
@@ -3,10 +3,14 @@ package providers
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bmizerany/assert"
 )
@@ -105,6 +109,42 @@ func TestGoogleProviderGetEmailAddress(t *testing.T) {
 	assert.Equal(t, "refresh12345", session.RefreshToken)
 }
 
+func TestGoogleProviderHostedDomain(t *testing.T) {
+	redeem := func(claims string) (*SessionState, error) {
+		p := newGoogleProvider()
+		p.SetHostedDomains([]string{"example.com"})
+		body, err := json.Marshal(redeemResponse{
+			AccessToken: "a1234",
+			IdToken:     "ignored prefix." + base64.URLEncoding.EncodeToString([]byte(claims)),
+		})
+		assert.Equal(t, nil, err)
+		var server *httptest.Server
+		p.RedeemURL, server = newRedeemServer(body)
+		defer server.Close()
+		return p.Redeem("http://redirect/", "code1234")
+	}
+
+	session, err := redeem(`{"email": "user@example.com", "email_verified":true, "hd": "Example.com"}`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "user@example.com", session.Email)
+
+	session, err = redeem(`{"email": "user+x@example.com", "email_verified":true}`)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, (*SessionState)(nil), session)
+
+	session, err = redeem(`{"email": "user@example.com", "email_verified":true, "hd": "example.org"}`)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, (*SessionState)(nil), session)
+}
+
+func TestGoogleProviderWildcardHostedDomain(t *testing.T) {
+	p := newGoogleProvider()
+	p.SetHostedDomains([]string{"*.example.com"})
+	assert.Equal(t, nil, p.checkHostedDomain(&googleIdTokenClaims{Email: "user@eu.example.com", HostedDomain: "EU.example.com"}))
+	assert.NotEqual(t, nil, p.checkHostedDomain(&googleIdTokenClaims{Email: "user@example.com", HostedDomain: "example.com"}))
+	assert.NotEqual(t, nil, p.checkHostedDomain(&googleIdTokenClaims{Email: "user@notexample.com", HostedDomain: "notexample.com"}))
+}
+
 func TestGoogleProviderValidateGroup(t *testing.T) {
 	p := newGoogleProvider()
 	p.GroupValidator = func(email string) bool {
@@ -117,6 +157,58 @@ func TestGoogleProviderValidateGroup(t *testing.T) {
 	assert.Equal(t, false, p.ValidateGroup("michael.bland@gsa.gov"))
 }
 
+func TestMemberGroups(t *testing.T) {
+	var groups []string
+	for i := 0; i < 40; i++ {
+		groups = append(groups, fmt.Sprintf("group%d@example.com", i))
+	}
+	var mu sync.Mutex
+	var calls, inFlight, maxInFlight int
+	isMember := func(group string) (bool, error) {
+		mu.Lock()
+		calls++
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return group == "group3@example.com" || group == "group31@example.com", nil
+	}
+
+	found, err := memberGroups(groups, false, isMember)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"group3@example.com", "group31@example.com"}, found)
+	assert.Equal(t, 40, calls)
+	assert.Equal(t, true, maxInFlight > 1)
+	assert.Equal(t, true, maxInFlight <= groupCheckConcurrency)
+
+	// the first match is enough to validate a user
+	calls = 0
+	found, err = memberGroups(groups, true, isMember)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"group3@example.com"}, found)
+	mu.Lock()
+	assert.Equal(t, true, calls < 40)
+	mu.Unlock()
+
+	found, err = memberGroups(groups, false, func(group string) (bool, error) {
+		if group == "group7@example.com" {
+			return false, errors.New("quota exceeded")
+		}
+		return true, nil
+	})
+	assert.Equal(t, "quota exceeded", err.Error())
+	assert.Equal(t, []string(nil), found)
+
+	found, err = memberGroups(nil, true, isMember)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string(nil), found)
+}
+
 func TestGoogleProviderWithoutValidateGroup(t *testing.T) {
 	p := newGoogleProvider()
 	assert.Equal(t, true, p.ValidateGroup("michael.bland@gsa.gov"))
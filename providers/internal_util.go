@@ -1,6 +1,8 @@
 package providers
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -45,10 +47,32 @@ func stripParam(param, endpoint string) string {
 	return endpoint
 }
 
-// validateToken returns true if token is valid
-func validateToken(p Provider, access_token string, header http.Header) bool {
+// ErrProviderUnavailable is wrapped by the errors of calls the provider
+// failed with a 5xx, rather than refused
+var ErrProviderUnavailable = errors.New("provider unavailable")
+
+// Unavailable reports whether err means the provider couldn't answer a
+// call, as it was unreachable, timed out or failed with a 5xx. Any other
+// error is the provider refusing the call.
+func Unavailable(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) || errors.Is(err, ErrProviderUnavailable)
+}
+
+// statusError is the error of a call to endpoint answered with status
+func statusError(status int, endpoint string, body []byte) error {
+	if status >= 500 {
+		return fmt.Errorf("got %d from %q %s: %w", status, endpoint, body, ErrProviderUnavailable)
+	}
+	return fmt.Errorf("got %d from %q %s", status, endpoint, body)
+}
+
+// validateToken returns true if token is valid. It returns an error when
+// the validate endpoint couldn't be asked or failed with a 5xx, so the
+// token is neither valid nor rejected.
+func validateToken(p Provider, access_token string, header http.Header) (bool, error) {
 	if access_token == "" || p.Data().ValidateURL == nil {
-		return false
+		return false, nil
 	}
 	endpoint := p.Data().ValidateURL.String()
 	if len(header) == 0 {
@@ -57,9 +81,9 @@ func validateToken(p Provider, access_token string, header http.Header) bool {
 	}
 	resp, err := api.RequestUnparsedResponse(endpoint, header)
 	if err != nil {
-		log.Printf("GET %s", endpoint)
+		log.Printf("GET %s", stripToken(endpoint))
 		log.Printf("token validation request failed: %s", err)
-		return false
+		return false, err
 	}
 
 	body, _ := ioutil.ReadAll(resp.Body)
@@ -67,8 +91,11 @@ func validateToken(p Provider, access_token string, header http.Header) bool {
 	log.Printf("%d GET %s %s", resp.StatusCode, stripToken(endpoint), body)
 
 	if resp.StatusCode == 200 {
-		return true
+		return true, nil
 	}
 	log.Printf("token validation request failed: status %d - %s", resp.StatusCode, body)
-	return false
+	if resp.StatusCode >= 500 {
+		return false, statusError(resp.StatusCode, stripToken(endpoint), body)
+	}
+	return false, nil
 }
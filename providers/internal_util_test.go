@@ -20,8 +20,8 @@ func (tp *ValidateSessionStateTestProvider) GetEmailAddress(s *SessionState) (st
 
 // Note that we're testing the internal validateToken() used to implement
 // several Provider's ValidateSessionState() implementations
-func (tp *ValidateSessionStateTestProvider) ValidateSessionState(s *SessionState) bool {
-	return false
+func (tp *ValidateSessionStateTestProvider) ValidateSessionState(s *SessionState) (bool, error) {
+	return false, nil
 }
 
 type ValidateSessionStateTest struct {
@@ -81,7 +81,9 @@ func (vt_test *ValidateSessionStateTest) Close() {
 func TestValidateSessionStateValidToken(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	defer vt_test.Close()
-	assert.Equal(t, true, validateToken(vt_test.provider, "foobar", nil))
+	valid, err := validateToken(vt_test.provider, "foobar", nil)
+	assert.Equal(t, true, valid)
+	assert.Equal(t, nil, err)
 }
 
 func TestValidateSessionStateValidTokenWithHeaders(t *testing.T) {
@@ -89,35 +91,53 @@ func TestValidateSessionStateValidTokenWithHeaders(t *testing.T) {
 	defer vt_test.Close()
 	vt_test.header = make(http.Header)
 	vt_test.header.Set("Authorization", "Bearer foobar")
-	assert.Equal(t, true,
-		validateToken(vt_test.provider, "foobar", vt_test.header))
+	valid, err := validateToken(vt_test.provider, "foobar", vt_test.header)
+	assert.Equal(t, true, valid)
+	assert.Equal(t, nil, err)
 }
 
 func TestValidateSessionStateEmptyToken(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	defer vt_test.Close()
-	assert.Equal(t, false, validateToken(vt_test.provider, "", nil))
+	valid, err := validateToken(vt_test.provider, "", nil)
+	assert.Equal(t, false, valid)
+	assert.Equal(t, nil, err)
 }
 
 func TestValidateSessionStateEmptyValidateURL(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	defer vt_test.Close()
 	vt_test.provider.Data().ValidateURL = nil
-	assert.Equal(t, false, validateToken(vt_test.provider, "foobar", nil))
+	valid, err := validateToken(vt_test.provider, "foobar", nil)
+	assert.Equal(t, false, valid)
+	assert.Equal(t, nil, err)
 }
 
 func TestValidateSessionStateRequestNetworkFailure(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	// Close immediately to simulate a network failure
 	vt_test.Close()
-	assert.Equal(t, false, validateToken(vt_test.provider, "foobar", nil))
+	valid, err := validateToken(vt_test.provider, "foobar", nil)
+	assert.Equal(t, false, valid)
+	assert.Equal(t, true, Unavailable(err))
+}
+
+func TestValidateSessionStateServerError(t *testing.T) {
+	vt_test := NewValidateSessionStateTest()
+	defer vt_test.Close()
+	vt_test.response_code = 503
+	valid, err := validateToken(vt_test.provider, "foobar", nil)
+	assert.Equal(t, false, valid)
+	assert.Equal(t, true, Unavailable(err))
 }
 
 func TestValidateSessionStateExpiredToken(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	defer vt_test.Close()
 	vt_test.response_code = 401
-	assert.Equal(t, false, validateToken(vt_test.provider, "foobar", nil))
+	valid, err := validateToken(vt_test.provider, "foobar", nil)
+	assert.Equal(t, false, valid)
+	assert.Equal(t, nil, err)
 }
 
 func TestStripTokenNotPresent(t *testing.T) {
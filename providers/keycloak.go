@@ -0,0 +1,181 @@
+package providers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bitly/oauth2_proxy/api"
+)
+
+type KeycloakProvider struct {
+	*ProviderData
+	Groups     []string
+	RealmRoles []string
+}
+
+func NewKeycloakProvider(p *ProviderData) *KeycloakProvider {
+	p.ProviderName = "Keycloak"
+	if p.LoginURL == nil || p.LoginURL.String() == "" {
+		p.LoginURL = &url.URL{
+			Scheme: "https",
+			Host:   "keycloak.org",
+			Path:   "/oauth/authorize",
+		}
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		p.RedeemURL = &url.URL{
+			Scheme: "https",
+			Host:   "keycloak.org",
+			Path:   "/oauth/token",
+		}
+	}
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		p.ValidateURL = &url.URL{
+			Scheme: "https",
+			Host:   "keycloak.org",
+			Path:   "/api/v3/user",
+		}
+	}
+	if p.Scope == "" {
+		p.Scope = "openid"
+	}
+	return &KeycloakProvider{ProviderData: p}
+}
+
+// SetGroups restricts logins to members of any of the given groups, as
+// reported by the "groups" claim of the userinfo endpoint.
+func (p *KeycloakProvider) SetGroups(groups []string) {
+	p.Groups = groups
+}
+
+// SetRealmRoles restricts logins to tokens carrying any of the given realm
+// roles in their "realm_access" claim.
+func (p *KeycloakProvider) SetRealmRoles(roles []string) {
+	p.RealmRoles = roles
+}
+
+func getKeycloakHeader(accessToken string) http.Header {
+	header := make(http.Header)
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	return header
+}
+
+type keycloakUserInfo struct {
+	Email  string   `json:"email"`
+	Groups []string `json:"groups"`
+}
+
+func (p *KeycloakProvider) getUserInfo(accessToken string) (*keycloakUserInfo, error) {
+	req, err := http.NewRequest("GET", p.ValidateURL.String(), nil)
+	if err != nil {
+		log.Printf("failed building request %s", err)
+		return nil, err
+	}
+	req.Header = getKeycloakHeader(accessToken)
+
+	var info keycloakUserInfo
+	if err := api.RequestJson(req, &info); err != nil {
+		log.Printf("failed making request %s", err)
+		return nil, err
+	}
+	return &info, nil
+}
+
+// realmRolesFromToken reads the realm roles granted to an access token.
+// Keycloak access tokens are JWTs; the signature is not checked here as the
+// token was either just redeemed or accepted by the userinfo endpoint.
+func realmRolesFromToken(accessToken string) ([]string, error) {
+	parts := strings.Split(accessToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("access token is not a JWT")
+	}
+	b, err := jwtDecodeSegment(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims struct {
+		RealmAccess struct {
+			Roles []string `json:"roles"`
+		} `json:"realm_access"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, err
+	}
+	return claims.RealmAccess.Roles, nil
+}
+
+func containsAny(have []string, want []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if w == h {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *KeycloakProvider) hasRealmRole(accessToken string) (bool, error) {
+	if len(p.RealmRoles) == 0 {
+		return true, nil
+	}
+	roles, err := realmRolesFromToken(accessToken)
+	if err != nil {
+		return false, err
+	}
+	if containsAny(roles, p.RealmRoles) {
+		return true, nil
+	}
+	log.Printf("Missing realm role:%v in %v", p.RealmRoles, roles)
+	return false, nil
+}
+
+func (p *KeycloakProvider) GetEmailAddress(s *SessionState) (string, error) {
+	if ok, err := p.hasRealmRole(s.AccessToken); err != nil || !ok {
+		return "", err
+	}
+
+	info, err := p.getUserInfo(s.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	if len(p.Groups) > 0 && !containsAny(info.Groups, p.Groups) {
+		log.Printf("Missing group:%v in %v", p.Groups, info.Groups)
+		return "", nil
+	}
+	if info.Email == "" {
+		return "", errors.New("missing email")
+	}
+	return info.Email, nil
+}
+
+// GetGroups returns the groups reported by the userinfo endpoint
+func (p *KeycloakProvider) GetGroups(s *SessionState) ([]string, error) {
+	info, err := p.getUserInfo(s.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	return info.Groups, nil
+}
+
+// ValidateSessionState checks the token against the userinfo endpoint and
+// that it still carries one of the required realm roles.
+func (p *KeycloakProvider) ValidateSessionState(s *SessionState) (bool, error) {
+	if valid, err := validateToken(p, s.AccessToken, getKeycloakHeader(s.AccessToken)); !valid {
+		return false, err
+	}
+	ok, err := p.hasRealmRole(s.AccessToken)
+	if err != nil {
+		log.Printf("error checking realm roles %s", err)
+		if Unavailable(err) {
+			return false, err
+		}
+		return false, nil
+	}
+	return ok, nil
+}
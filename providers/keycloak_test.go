@@ -0,0 +1,129 @@
+package providers
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func testKeycloakProvider(hostname string) *KeycloakProvider {
+	p := NewKeycloakProvider(
+		&ProviderData{
+			ProviderName: "",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+func testKeycloakBackend(payload string) *httptest.Server {
+	path := "/api/v3/user"
+
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			url := r.URL
+			if url.Path != path || r.Header.Get("Authorization") == "" {
+				w.WriteHeader(404)
+			} else {
+				w.WriteHeader(200)
+				w.Write([]byte(payload))
+			}
+		}))
+}
+
+// testJWT builds an unsigned JWT carrying claims
+func testJWT(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		enc.EncodeToString([]byte(claims)) + ".sig"
+}
+
+func TestKeycloakProviderDefaults(t *testing.T) {
+	p := testKeycloakProvider("")
+	assert.NotEqual(t, nil, p)
+	assert.Equal(t, "Keycloak", p.Data().ProviderName)
+	assert.Equal(t, "https://keycloak.org/oauth/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://keycloak.org/oauth/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://keycloak.org/api/v3/user",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "openid", p.Data().Scope)
+}
+
+func TestKeycloakProviderGetEmailAddress(t *testing.T) {
+	b := testKeycloakBackend(`{"email": "michael.bland@gsa.gov"}`)
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testKeycloakProvider(b_url.Host)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+}
+
+func TestKeycloakProviderGetEmailAddressWithGroup(t *testing.T) {
+	b := testKeycloakBackend(`{"email": "michael.bland@gsa.gov", "groups": ["test-grp1", "test-grp2"]}`)
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testKeycloakProvider(b_url.Host)
+	p.SetGroups([]string{"test-grp2"})
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+
+	p.SetGroups([]string{"other-grp"})
+	email, err = p.GetEmailAddress(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestKeycloakProviderGetEmailAddressWithRealmRole(t *testing.T) {
+	b := testKeycloakBackend(`{"email": "michael.bland@gsa.gov"}`)
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testKeycloakProvider(b_url.Host)
+	p.SetRealmRoles([]string{"admin"})
+
+	token := testJWT(`{"realm_access": {"roles": ["user", "admin"]}}`)
+	email, err := p.GetEmailAddress(&SessionState{AccessToken: token})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+
+	token = testJWT(`{"realm_access": {"roles": ["user"]}}`)
+	email, err = p.GetEmailAddress(&SessionState{AccessToken: token})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestKeycloakProviderGetEmailAddressFailedRequest(t *testing.T) {
+	b := testKeycloakBackend("unused payload")
+	defer b.Close()
+
+	b_url, _ := url.Parse(b.URL)
+	p := testKeycloakProvider(b_url.Host)
+	p.ValidateURL.Path = "/unexpected"
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(session)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "", email)
+}
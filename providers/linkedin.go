@@ -69,6 +69,6 @@ func (p *LinkedInProvider) GetEmailAddress(s *SessionState) (string, error) {
 	return email, nil
 }
 
-func (p *LinkedInProvider) ValidateSessionState(s *SessionState) bool {
+func (p *LinkedInProvider) ValidateSessionState(s *SessionState) (bool, error) {
 	return validateToken(p, s.AccessToken, getLinkedInHeader(s.AccessToken))
 }
@@ -2,6 +2,7 @@ package providers
 
 import (
 	"net/url"
+	"sync/atomic"
 )
 
 type ProviderData struct {
@@ -16,6 +17,33 @@ type ProviderData struct {
 	Scope             string
 	ApprovalPrompt    string
 	JWTKeysURL        *url.URL
+
+	// rotated holds the Credentials set by SetCredentials, which replace
+	// ClientID and ClientSecret while requests are being served
+	rotated atomic.Value
+}
+
+// Credentials are the client ID and secret the proxy is registered with at
+// the provider
+type Credentials struct {
+	ClientID     string
+	ClientSecret string
 }
 
 func (p *ProviderData) Data() *ProviderData { return p }
+
+// Credentials returns the client ID and secret to make requests with: the
+// last ones set by SetCredentials, or ClientID and ClientSecret
+func (p *ProviderData) Credentials() Credentials {
+	if c, ok := p.rotated.Load().(Credentials); ok {
+		return c
+	}
+	return Credentials{ClientID: p.ClientID, ClientSecret: p.ClientSecret}
+}
+
+// SetCredentials rotates the client ID and secret. Unlike ClientID and
+// ClientSecret, which are only set up before the provider is used, it may be
+// called while requests are being served.
+func (p *ProviderData) SetCredentials(c Credentials) {
+	p.rotated.Store(c)
+}
@@ -20,8 +20,9 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err er
 
 	params := url.Values{}
 	params.Add("redirect_uri", redirectURL)
-	params.Add("client_id", p.ClientID)
-	params.Add("client_secret", p.ClientSecret)
+	credentials := p.Credentials()
+	params.Add("client_id", credentials.ClientID)
+	params.Add("client_secret", credentials.ClientSecret)
 	params.Add("code", code)
 	params.Add("grant_type", "authorization_code")
 	if p.ProtectedResource != nil && p.ProtectedResource.String() != "" {
@@ -85,13 +86,19 @@ func (p *ProviderData) GetLoginURL(redirectURI, state string) string {
 	params.Set("redirect_uri", redirectURI)
 	params.Set("approval_prompt", p.ApprovalPrompt)
 	params.Add("scope", p.Scope)
-	params.Set("client_id", p.ClientID)
+	params.Set("client_id", p.Credentials().ClientID)
 	params.Set("response_type", "code")
 	params.Add("state", state)
 	a.RawQuery = params.Encode()
 	return a.String()
 }
 
+// GetLogoutURL returns the provider URL that ends the user's session with
+// the provider. Providers without one return "".
+func (p *ProviderData) GetLogoutURL(redirectURI string) string {
+	return ""
+}
+
 // CookieForSession serializes a session state for storage in a cookie
 func (p *ProviderData) CookieForSession(s *SessionState, c *cookie.Cipher) (string, error) {
 	return s.EncodeSessionState(c)
@@ -106,13 +113,19 @@ func (p *ProviderData) GetEmailAddress(s *SessionState) (string, error) {
 	return "", errors.New("not implemented")
 }
 
+// GetGroups returns the groups the session's user is a member of. Providers
+// without a notion of groups return none.
+func (p *ProviderData) GetGroups(s *SessionState) ([]string, error) {
+	return nil, nil
+}
+
 // ValidateGroup validates that the provided email exists in the configured provider
 // email group(s).
 func (p *ProviderData) ValidateGroup(email string) bool {
 	return true
 }
 
-func (p *ProviderData) ValidateSessionState(s *SessionState) bool {
+func (p *ProviderData) ValidateSessionState(s *SessionState) (bool, error) {
 	return validateToken(p, s.AccessToken, nil)
 }
 
@@ -1,6 +1,9 @@
 package providers
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -15,3 +18,26 @@ func TestRefresh(t *testing.T) {
 	assert.Equal(t, false, refreshed)
 	assert.Equal(t, nil, err)
 }
+
+func TestRotatedCredentials(t *testing.T) {
+	var clientID, clientSecret string
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret = r.FormValue("client_id"), r.FormValue("client_secret")
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"access_token":"token"}`))
+	}))
+	defer s.Close()
+	redeemURL, _ := url.Parse(s.URL)
+	p := &ProviderData{ClientID: "id", ClientSecret: "secret", RedeemURL: redeemURL}
+
+	_, err := p.Redeem("https://example.com/oauth2/callback", "code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "id", clientID)
+	assert.Equal(t, "secret", clientSecret)
+
+	p.SetCredentials(Credentials{ClientID: "id", ClientSecret: "rotated"})
+	_, err = p.Redeem("https://example.com/oauth2/callback", "code")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "rotated", clientSecret)
+	assert.Equal(t, "secret", p.ClientSecret)
+}
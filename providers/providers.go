@@ -7,13 +7,18 @@ import (
 type Provider interface {
 	Data() *ProviderData
 	GetEmailAddress(*SessionState) (string, error)
+	GetGroups(*SessionState) ([]string, error)
 	Redeem(string, string) (*SessionState, error)
 	ValidateGroup(string) bool
-	ValidateSessionState(*SessionState) bool
+	// ValidateSessionState reports whether the session's token is still
+	// valid. It returns an error only when the provider couldn't answer,
+	// which Unavailable reports.
+	ValidateSessionState(*SessionState) (bool, error)
 	GetLoginURL(redirectURI, finalRedirect string) string
 	RefreshSessionIfNeeded(*SessionState) (bool, error)
 	SessionFromCookie(string, *cookie.Cipher) (*SessionState, error)
 	CookieForSession(*SessionState, *cookie.Cipher) (string, error)
+	GetLogoutURL(redirectURI string) string
 }
 
 func New(provider string, p *ProviderData) Provider {
@@ -26,10 +31,24 @@ func New(provider string, p *ProviderData) Provider {
 		return NewFacebookProvider(p)
 	case "github":
 		return NewGitHubProvider(p)
+	case "apple":
+		return NewAppleProvider(p)
 	case "azure":
 		return NewAzureProvider(p)
+	case "cognito":
+		return NewCognitoProvider(p)
+	case "bitbucket":
+		return NewBitbucketProvider(p)
+	case "gitea":
+		return NewGiteaProvider(p)
+	case "forgejo":
+		gitea := NewGiteaProvider(p)
+		gitea.ProviderName = "Forgejo"
+		return gitea
 	case "gitlab":
 		return NewGitLabProvider(p)
+	case "keycloak":
+		return NewKeycloakProvider(p)
 	case "baton":
 		return NewBatonProvider(p)
 	default:
@@ -15,10 +15,17 @@ type SessionState struct {
 	RefreshToken string
 	Email        string
 	User         string
+	Groups       []string
+	// Provider tags sessions with the provider that issued them when a
+	// failover provider is configured
+	Provider string
+	// Scopes are the scopes granted on top of the base scope by incremental
+	// authorization
+	Scopes []string
 }
 
 func (s *SessionState) IsExpired() bool {
-	if !s.ExpiresOn.IsZero() && s.ExpiresOn.Before(time.Now()) {
+	if !s.ExpiresOn.IsZero() && s.ExpiresOn.Before(Now()) {
 		return true
 	}
 	return false
@@ -35,10 +42,25 @@ func (s *SessionState) String() string {
 	if s.RefreshToken != "" {
 		o += " refresh_token:true"
 	}
+	if len(s.Groups) > 0 {
+		o += fmt.Sprintf(" groups:%s", strings.Join(s.Groups, ","))
+	}
+	if s.Provider != "" {
+		o += fmt.Sprintf(" provider:%s", s.Provider)
+	}
+	if len(s.Scopes) > 0 {
+		o += fmt.Sprintf(" scopes:%s", strings.Join(s.Scopes, " "))
+	}
 	return o + "}"
 }
 
 func (s *SessionState) EncodeSessionState(c *cookie.Cipher) (string, error) {
+	if s.AccessToken == "" && !s.ExpiresOn.IsZero() {
+		// sessions without a token can still carry their own expiry,
+		// which needs no encryption
+		v := fmt.Sprintf("%s||%d|", s.userOrEmail(), s.ExpiresOn.Unix())
+		return v + s.optionalFields(), nil
+	}
 	if c == nil || s.AccessToken == "" {
 		return s.userOrEmail(), nil
 	}
@@ -72,7 +94,25 @@ func (s *SessionState) EncryptedString(c *cookie.Cipher) (string, error) {
 			return "", err
 		}
 	}
-	return fmt.Sprintf("%s|%s|%d|%s", s.userOrEmail(), a, s.ExpiresOn.Unix(), r), nil
+	v := fmt.Sprintf("%s|%s|%d|%s", s.userOrEmail(), a, s.ExpiresOn.Unix(), r)
+	return v + s.optionalFields(), nil
+}
+
+// optionalFields encodes the groups, provider and scopes as optional fifth,
+// sixth and seventh fields, so that cookies written before they were tracked
+// still decode
+func (s *SessionState) optionalFields() string {
+	var v string
+	if len(s.Groups) > 0 || s.Provider != "" || len(s.Scopes) > 0 {
+		v += "|" + strings.Join(s.Groups, ",")
+	}
+	if s.Provider != "" || len(s.Scopes) > 0 {
+		v += "|" + s.Provider
+	}
+	if len(s.Scopes) > 0 {
+		v += "|" + strings.Join(s.Scopes, " ")
+	}
+	return v
 }
 
 func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error) {
@@ -85,8 +125,8 @@ func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error)
 		return &SessionState{User: v}, nil
 	}
 
-	if len(chunks) != 4 {
-		err = fmt.Errorf("invalid number of fields (got %d expected 4)", len(chunks))
+	if len(chunks) < 4 || len(chunks) > 7 {
+		err = fmt.Errorf("invalid number of fields (got %d expected 4 to 7)", len(chunks))
 		return
 	}
 
@@ -111,5 +151,14 @@ func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error)
 	}
 	ts, _ := strconv.Atoi(chunks[2])
 	s.ExpiresOn = time.Unix(int64(ts), 0)
+	if len(chunks) >= 5 && chunks[4] != "" {
+		s.Groups = strings.Split(chunks[4], ",")
+	}
+	if len(chunks) >= 6 {
+		s.Provider = chunks[5]
+	}
+	if len(chunks) == 7 && chunks[6] != "" {
+		s.Scopes = strings.Split(chunks[6], " ")
+	}
 	return
 }
@@ -45,6 +45,75 @@ func TestSessionStateSerialization(t *testing.T) {
 	assert.NotEqual(t, s.RefreshToken, ss.RefreshToken)
 }
 
+func TestSessionStateSerializationWithGroups(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		ExpiresOn:   time.Now().Add(time.Duration(1) * time.Hour),
+		Groups:      []string{"admins", "org/team"},
+	}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, strings.Count(encoded, "|"))
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Email, ss.Email)
+	assert.Equal(t, s.AccessToken, ss.AccessToken)
+	assert.Equal(t, s.Groups, ss.Groups)
+}
+
+func TestSessionStateSerializationWithProvider(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		ExpiresOn:   time.Now().Add(time.Duration(1) * time.Hour),
+		Provider:    "secondary",
+	}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 5, strings.Count(encoded, "|"))
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.AccessToken, ss.AccessToken)
+	assert.Equal(t, []string(nil), ss.Groups)
+	assert.Equal(t, "secondary", ss.Provider)
+
+	s.Groups = []string{"admins"}
+	encoded, err = s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	ss, err = DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Groups, ss.Groups)
+	assert.Equal(t, "secondary", ss.Provider)
+}
+
+func TestSessionStateSerializationWithScopes(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		ExpiresOn:   time.Now().Add(time.Duration(1) * time.Hour),
+		Scopes:      []string{"https://www.googleapis.com/auth/calendar", "drive"},
+	}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 6, strings.Count(encoded, "|"))
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.AccessToken, ss.AccessToken)
+	assert.Equal(t, []string(nil), ss.Groups)
+	assert.Equal(t, "", ss.Provider)
+	assert.Equal(t, s.Scopes, ss.Scopes)
+}
+
 func TestSessionStateSerializationNoCipher(t *testing.T) {
 
 	s := &SessionState{
@@ -65,6 +134,21 @@ func TestSessionStateSerializationNoCipher(t *testing.T) {
 	assert.Equal(t, "", ss.RefreshToken)
 }
 
+func TestSessionStateSerializationExpiryWithoutToken(t *testing.T) {
+	s := &SessionState{
+		User:      "guest:acme",
+		ExpiresOn: time.Now().Add(time.Duration(1) * time.Hour),
+	}
+	encoded, err := s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+
+	ss, err := DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.User, ss.User)
+	assert.Equal(t, "", ss.AccessToken)
+	assert.Equal(t, s.ExpiresOn.Unix(), ss.ExpiresOn.Unix())
+}
+
 func TestSessionStateUserOrEmail(t *testing.T) {
 
 	s := &SessionState{
@@ -0,0 +1,41 @@
+package providers
+
+import (
+	"errors"
+	"time"
+)
+
+// TestModeRefreshFail is the refresh token of test mode sessions that fail
+// to refresh
+const TestModeRefreshFail = "fail"
+
+// TestModeProvider refreshes and validates the sessions minted by the
+// proxy's test mode, so integration tests exercise expiry and refresh
+// without an identity provider. Expired sessions with a refresh token are
+// refreshed for Lifetime, unless the token is TestModeRefreshFail.
+type TestModeProvider struct {
+	*ProviderData
+	Lifetime time.Duration
+}
+
+func NewTestModeProvider(p *ProviderData, lifetime time.Duration) *TestModeProvider {
+	p.ProviderName = "Test Mode"
+	return &TestModeProvider{ProviderData: p, Lifetime: lifetime}
+}
+
+// ValidateSessionState accepts the sessions with an access token
+func (p *TestModeProvider) ValidateSessionState(s *SessionState) (bool, error) {
+	return s.AccessToken != "", nil
+}
+
+// RefreshSessionIfNeeded extends the expired sessions with a refresh token
+func (p *TestModeProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
+	if s == nil || s.ExpiresOn.After(Now()) || s.RefreshToken == "" {
+		return false, nil
+	}
+	if s.RefreshToken == TestModeRefreshFail {
+		return false, errors.New("test mode refresh token rejected")
+	}
+	s.ExpiresOn = Now().Add(p.Lifetime).Truncate(time.Second)
+	return true, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// proxyConfiguration describes how the proxy forwards identity to upstreams,
+// so they can configure their verification of it from the document served at
+// ConfigurationPath
+type proxyConfiguration struct {
+	SignInEndpoint  string `json:"sign_in_endpoint"`
+	SignOutEndpoint string `json:"sign_out_endpoint"`
+	StartEndpoint   string `json:"start_endpoint"`
+	AuthEndpoint    string `json:"auth_endpoint"`
+	// IdentityHeaders maps the identity claims to the request headers
+	// upstreams receive them in
+	IdentityHeaders map[string]string `json:"identity_headers,omitempty"`
+	// AuthResponseHeaders maps them to the response headers of AuthEndpoint
+	AuthResponseHeaders map[string]string `json:"auth_response_headers,omitempty"`
+	// BasicAuth tells whether the user is also passed as basic auth
+	BasicAuth bool                    `json:"basic_auth"`
+	Signature *signatureConfiguration `json:"signature,omitempty"`
+}
+
+// signatureConfiguration describes the HMAC signature of upstream requests.
+// The key is shared out of band, and upstreams with their own signature
+// header or headers aren't described.
+type signatureConfiguration struct {
+	Header        string   `json:"header"`
+	Algorithm     string   `json:"algorithm"`
+	SignedHeaders []string `json:"signed_headers"`
+}
+
+func newSignatureConfiguration(opts *Options) *signatureConfiguration {
+	if opts.signatureData == nil {
+		return nil
+	}
+	return &signatureConfiguration{
+		Header:        SignatureHeader,
+		Algorithm:     strings.SplitN(opts.SignatureKey, ":", 2)[0],
+		SignedHeaders: SignatureHeaders,
+	}
+}
+
+// configuration describes the headers Authenticate sets, with endpoints on
+// host unless the redirect URL has one
+func (p *OAuthProxy) configuration(host string) proxyConfiguration {
+	c := proxyConfiguration{
+		SignInEndpoint:  p.absoluteURL(host, p.SignInPath),
+		SignOutEndpoint: p.absoluteURL(host, p.SignOutPath),
+		StartEndpoint:   p.absoluteURL(host, p.OAuthStartPath),
+		AuthEndpoint:    p.absoluteURL(host, p.AuthOnlyPath),
+		BasicAuth:       p.PassBasicAuth,
+		Signature:       p.signature,
+	}
+	if p.PassUserHeaders || p.PassBasicAuth {
+		c.IdentityHeaders = p.identityHeaders("X-Forwarded-")
+		if p.PassAccessToken {
+			c.IdentityHeaders["access_token"] = "X-Forwarded-Access-Token"
+		}
+	}
+	if p.SetXAuthRequest {
+		c.AuthResponseHeaders = p.identityHeaders("X-Auth-Request-")
+	}
+	if p.experiments != nil {
+		if c.IdentityHeaders == nil {
+			c.IdentityHeaders = make(map[string]string)
+		}
+		c.IdentityHeaders["experiment_bucket"] = "X-Experiment-Bucket"
+		if c.AuthResponseHeaders != nil {
+			c.AuthResponseHeaders["experiment_bucket"] = "X-Auth-Request-Experiment-Bucket"
+		}
+	}
+	return c
+}
+
+func (p *OAuthProxy) identityHeaders(prefix string) map[string]string {
+	headers := map[string]string{
+		"user":   prefix + "User",
+		"email":  prefix + "Email",
+		"groups": prefix + "Groups",
+	}
+	if p.roleMap != nil {
+		headers["roles"] = prefix + "Roles"
+	}
+	return headers
+}
+
+// ConfigurationPage serves the proxy configuration as JSON
+func (p *OAuthProxy) ConfigurationPage(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(rw).Encode(p.configuration(req.Host))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestConfigurationPage(t *testing.T) {
+	opts := testOptions()
+	opts.SetXAuthRequest = true
+	opts.PassAccessToken = true
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.SignatureKey = "sha256:secret"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	req, _ := http.NewRequest("GET", "/oauth2/.well-known/proxy-configuration", nil)
+	req.Host = "auth.example.com"
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "application/json", rw.HeaderMap.Get("Content-Type"))
+	assert.Equal(t, false, strings.Contains(rw.Body.String(), "secret"))
+
+	var c proxyConfiguration
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &c))
+	assert.Equal(t, "https://auth.example.com/oauth2/sign_in", c.SignInEndpoint)
+	assert.Equal(t, "https://auth.example.com/oauth2/auth", c.AuthEndpoint)
+	assert.Equal(t, map[string]string{
+		"user":         "X-Forwarded-User",
+		"email":        "X-Forwarded-Email",
+		"groups":       "X-Forwarded-Groups",
+		"access_token": "X-Forwarded-Access-Token",
+	}, c.IdentityHeaders)
+	assert.Equal(t, "X-Auth-Request-Email", c.AuthResponseHeaders["email"])
+	assert.Equal(t, true, c.BasicAuth)
+	assert.Equal(t, &signatureConfiguration{
+		Header:        "GAP-Signature",
+		Algorithm:     "sha256",
+		SignedHeaders: SignatureHeaders,
+	}, c.Signature)
+
+	opts = testOptions()
+	opts.PassUserHeaders = false
+	opts.PassBasicAuth = false
+	assert.Equal(t, nil, opts.Validate())
+	proxy = NewOAuthProxy(opts, func(string) bool { return true })
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, `{"sign_in_endpoint":"https://auth.example.com/oauth2/sign_in","sign_out_endpoint":"https://auth.example.com/oauth2/sign_out","start_endpoint":"https://auth.example.com/oauth2/start","auth_endpoint":"https://auth.example.com/oauth2/auth","basic_auth":false}`+"\n", rw.Body.String())
+}
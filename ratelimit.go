@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket per key, refilled at a fixed rate up to a
+// burst of the same size as the per-minute rate
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*tokenBucket
+	lastGC  time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token from key's bucket. When none is left it returns false
+// and how long until one is available.
+func (l *rateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.gc(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// gc drops the buckets that have refilled completely, which are the same as
+// a new bucket, once a minute
+func (l *rateLimiter) gc(now time.Time) {
+	if now.Sub(l.lastGC) < time.Minute {
+		return
+	}
+	l.lastGC = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// proxyRateLimit limits the proxied requests of each user to the paths
+// starting with prefix, or to any path when it's empty. A nil limiter leaves
+// them unlimited.
+type proxyRateLimit struct {
+	prefix  string
+	limiter *rateLimiter
+}
+
+// proxyRateLimits picks the limit of the longest prefix a path starts with,
+// or the default limit
+type proxyRateLimits []proxyRateLimit
+
+func newProxyRateLimits(perMinute int, routes []rateLimitRoute) proxyRateLimits {
+	limits := proxyRateLimits{{}}
+	if perMinute > 0 {
+		limits[0].limiter = newRateLimiter(perMinute)
+	}
+	for _, r := range routes {
+		l := proxyRateLimit{prefix: r.prefix}
+		if r.perMinute > 0 {
+			l.limiter = newRateLimiter(r.perMinute)
+		}
+		limits = append(limits, l)
+	}
+	return limits
+}
+
+// Allow takes a token from key's bucket for path, like rateLimiter.Allow,
+// and also returns the prefix of the limit it was taken against
+func (limits proxyRateLimits) Allow(path, key string, now time.Time) (bool, time.Duration, string) {
+	limit := limits[0]
+	for _, l := range limits[1:] {
+		if strings.HasPrefix(path, l.prefix) && len(l.prefix) > len(limit.prefix) {
+			limit = l
+		}
+	}
+	if limit.limiter == nil {
+		return true, 0, limit.prefix
+	}
+	ok, wait := limit.limiter.Allow(key, now)
+	return ok, wait, limit.prefix
+}
+
+// concurrencyLimiter caps the number of requests handled at once
+type concurrencyLimiter chan struct{}
+
+func newConcurrencyLimiter(n int) concurrencyLimiter {
+	return make(concurrencyLimiter, n)
+}
+
+// TryAcquire takes a slot without waiting, reporting whether one was free
+func (c concurrencyLimiter) TryAcquire() bool {
+	select {
+	case c <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c concurrencyLimiter) Release() {
+	<-c
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestRateLimiterPerKey(t *testing.T) {
+	l := newRateLimiter(2)
+	now := time.Now()
+
+	ok, _ := l.Allow("10.0.0.1", now)
+	assert.Equal(t, true, ok)
+	ok, _ = l.Allow("10.0.0.1", now)
+	assert.Equal(t, true, ok)
+	ok, wait := l.Allow("10.0.0.1", now)
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 30*time.Second, wait)
+
+	// other clients have their own bucket
+	ok, _ = l.Allow("10.0.0.2", now)
+	assert.Equal(t, true, ok)
+
+	// a token is refilled every 30 seconds
+	ok, _ = l.Allow("10.0.0.1", now.Add(30*time.Second))
+	assert.Equal(t, true, ok)
+	ok, _ = l.Allow("10.0.0.1", now.Add(30*time.Second))
+	assert.Equal(t, false, ok)
+}
+
+func TestRateLimiterDropsRefilledBuckets(t *testing.T) {
+	l := newRateLimiter(2)
+	now := time.Now()
+	l.Allow("10.0.0.1", now)
+	l.Allow("10.0.0.2", now)
+	l.Allow("10.0.0.2", now)
+
+	l.Allow("10.0.0.3", now.Add(61*time.Second))
+	assert.Equal(t, 1, len(l.buckets))
+}
+
+func TestConcurrencyLimiter(t *testing.T) {
+	c := newConcurrencyLimiter(1)
+	assert.Equal(t, true, c.TryAcquire())
+	assert.Equal(t, false, c.TryAcquire())
+	c.Release()
+	assert.Equal(t, true, c.TryAcquire())
+}
+
+func TestOAuthStartRateLimited(t *testing.T) {
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, "http://127.0.0.1:8080/")
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.AuthRateLimit = 1
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	codes := make([]int, 0)
+	for _, addr := range []string{"10.0.0.1:1234", "10.0.0.1:5678", "10.0.0.2:1234"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/start", nil)
+		req.RemoteAddr = addr
+		proxy.ServeHTTP(rw, req)
+		codes = append(codes, rw.Code)
+		if rw.Code == http.StatusTooManyRequests {
+			assert.Equal(t, "60", rw.HeaderMap.Get("Retry-After"))
+		}
+	}
+	assert.Equal(t, []int{302, 429, 302}, codes)
+}
+
+func TestOAuthCallbackConcurrencyLimited(t *testing.T) {
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, "http://127.0.0.1:8080/")
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.AuthMaxConcurrent = 1
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	// hold the only slot
+	assert.Equal(t, true, proxy.authConcurrency.TryAcquire())
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?token=code&state=nonce:/", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 503, rw.Code)
+	proxy.authConcurrency.Release()
+}
+
+func TestProxyRateLimits(t *testing.T) {
+	limits := newProxyRateLimits(2, []rateLimitRoute{{"/api/", 1}, {"/api/bulk/", 0}})
+	now := time.Now()
+	allow := func(path, key string) bool {
+		ok, _, _ := limits.Allow(path, key, now)
+		return ok
+	}
+
+	assert.Equal(t, true, allow("/", "user:a"))
+	assert.Equal(t, true, allow("/app", "user:a"))
+	assert.Equal(t, false, allow("/", "user:a"))
+	assert.Equal(t, true, allow("/", "user:b"))
+
+	// routes have their own buckets
+	assert.Equal(t, true, allow("/api/users", "user:a"))
+	ok, wait, route := limits.Allow("/api/users", "user:a", now)
+	assert.Equal(t, false, ok)
+	assert.Equal(t, time.Minute, wait)
+	assert.Equal(t, "/api/", route)
+
+	// the longest prefix wins, and 0 is no limit
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, true, allow("/api/bulk/export", "user:a"))
+	}
+
+	// without a default limit only the routes are limited
+	limits = newProxyRateLimits(0, []rateLimitRoute{{"/api/", 1}})
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, true, allow("/", "user:a"))
+	}
+}
+
+func TestProxyRateLimited(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{backend.URL}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.PassAccessToken = true
+	opts.RateLimit = 1
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	codes := make([]int, 0)
+	for _, r := range []struct{ email, addr string }{
+		{"a@example.com", "10.0.0.1:1234"},
+		// users are limited wherever they connect from
+		{"a@example.com", "10.0.0.2:1234"},
+		{"b@example.com", "10.0.0.1:1234"},
+	} {
+		session := &providers.SessionState{Email: r.email, AccessToken: "token"}
+		value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+		assert.Equal(t, nil, err)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = r.addr
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		codes = append(codes, rw.Code)
+		if rw.Code == http.StatusTooManyRequests {
+			assert.Equal(t, "60", rw.HeaderMap.Get("Retry-After"))
+		}
+	}
+	assert.Equal(t, []int{200, 429, 200}, codes)
+}
+
+func TestRateLimitRoutesInvalid(t *testing.T) {
+	o := testOptions()
+	o.RateLimit = -1
+	o.RateLimitRoutes = []string{"/api/=10", "api=1", "/api/=fast"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	expected := errorMsg([]string{
+		"rate_limit must not be negative",
+		`invalid rate-limit-route="api=1", expected <path prefix>=<requests per minute>`,
+		`invalid rate-limit-route="/api/=fast", the rate must be a number of requests per minute, or 0 for none`,
+	})
+	assert.Equal(t, expected, err.Error())
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// reloadableHandler serves requests with the handler of the current
+// configuration, which is swapped atomically when it's reloaded
+type reloadableHandler struct {
+	handler atomic.Value
+}
+
+func (h *reloadableHandler) Store(handler http.Handler) {
+	h.handler.Store(handler)
+}
+
+func (h *reloadableHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.handler.Load().(http.Handler).ServeHTTP(rw, req)
+}
+
+// restartOnlyOptions are the options only read at start, which a reload
+// would silently ignore: the listeners and their TLS settings, the client
+// calls to the provider are made with, the client IP header, the logs, and
+// the admin and metrics listeners. The labels of the handler metrics are
+// shared by the running handlers too.
+var restartOnlyOptions = []string{
+	"HttpAddress", "HttpsAddress", "ReusePort", "ShutdownTimeout",
+	"TLSCertFile", "TLSKeyFile", "TLSClientCAFile", "TLSACME", "TLSACMEDomains", "TLSACMECacheDir",
+	"HTTP2MaxConcurrentStreams", "TLSSessionTickets", "TLSSessionTicketSecret", "TLSSessionTicketRotation",
+	"TLSOCSPStapling",
+	"TLSInsecureSkipVerify", "SignProviderRequests", "ProviderRedirects", "ProviderContentTypes", "ProviderTimeout",
+	"RealClientIPHeader",
+	"AccessLogFile", "AccessLogMaxSize", "AccessLogMaxBackups", "AuditLogFile",
+	"LoggingFilename", "LoggingMaxSize", "LoggingMaxBackups", "LoggingMaxAge",
+	"LoggingSyslog", "LoggingSyslogFacility", "LoggingSyslogTag",
+	"AdminAddress", "AdminToken", "MetricsAddress", "MetricsLabels",
+}
+
+// checkReloadable refuses reloads that change restartOnlyOptions, naming
+// them by their config file names
+func checkReloadable(current, next *Options) error {
+	cv, nv := reflect.ValueOf(current).Elem(), reflect.ValueOf(next).Elem()
+	var changed []string
+	for _, name := range restartOnlyOptions {
+		if !reflect.DeepEqual(cv.FieldByName(name).Interface(), nv.FieldByName(name).Interface()) {
+			field, _ := cv.Type().FieldByName(name)
+			changed = append(changed, field.Tag.Get("cfg"))
+		}
+	}
+	if len(changed) > 0 {
+		return fmt.Errorf("%s can only be changed by a restart", strings.Join(changed, ", "))
+	}
+	return nil
+}
+
+// reloadSignals are the signals that reload the configuration
+func reloadSignals() <-chan os.Signal {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	return reload
+}
+
+// reloadOn calls reload for each signal received from signals. The current
+// configuration is kept when reload fails.
+func reloadOn(signals <-chan os.Signal, reload func() error) {
+	for sig := range signals {
+		log.Printf("received %s, reloading the configuration", sig)
+		if err := reload(); err != nil {
+			log.Printf("ERROR: reloading the configuration failed, keeping the current one - %s", err)
+			continue
+		}
+		log.Printf("configuration reloaded")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestReloadOn(t *testing.T) {
+	handler := &reloadableHandler{}
+	serve := func(body string) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(body))
+		})
+	}
+	handler.Store(serve("first"))
+	get := func() string {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+		return rw.Body.String()
+	}
+	assert.Equal(t, "first", get())
+
+	// a failed reload keeps the current handler
+	signals := make(chan os.Signal, 2)
+	signals <- syscall.SIGHUP
+	signals <- syscall.SIGHUP
+	close(signals)
+	reloads := 0
+	reloadOn(signals, func() error {
+		reloads++
+		if reloads == 1 {
+			return errors.New("invalid configuration")
+		}
+		handler.Store(serve("second"))
+		return nil
+	})
+	assert.Equal(t, 2, reloads)
+	assert.Equal(t, "second", get())
+}
+
+func TestCheckReloadable(t *testing.T) {
+	current := testOptions()
+	current.MetricsLabels = []string{"team=header:X-Team"}
+	next := testOptions()
+	next.MetricsLabels = []string{"team=header:X-Team"}
+	next.SkipAuthRegex = []string{"^/public/"}
+	assert.Equal(t, nil, checkReloadable(current, next))
+
+	next.MetricsLabels = nil
+	assert.Equal(t, "metrics_labels can only be changed by a restart", checkReloadable(current, next).Error())
+
+	next.MetricsLabels = current.MetricsLabels
+	next.MetricsAddress = "127.0.0.1:9100"
+	assert.NotEqual(t, nil, checkReloadable(current, next))
+
+	next = testOptions()
+	next.MetricsLabels = current.MetricsLabels
+	next.HttpAddress = "127.0.0.1:4181"
+	next.TLSCertFile = []string{"/etc/ssl/next.pem"}
+	next.ProviderTimeout = time.Minute
+	next.RealClientIPHeader = "X-Forwarded-For"
+	next.AccessLogFile = "/var/log/oauth2_proxy/access.log"
+	assert.Equal(t, "http_address, tls_cert_file, provider_timeout, real_client_ip_header, access_log_file can only be changed by a restart",
+		checkReloadable(current, next).Error())
+}
+
+func TestRestartOnlyOptions(t *testing.T) {
+	// a renamed option must not drop out of the check
+	typ := reflect.TypeOf(Options{})
+	for _, name := range restartOnlyOptions {
+		field, ok := typ.FieldByName(name)
+		assert.Equal(t, true, ok)
+		assert.NotEqual(t, "", field.Tag.Get("cfg"))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// framingHeaders are kept by an allowlist whether or not they are listed, as
+// the response body can't be read without them
+var framingHeaders = []string{"Content-Length", "Content-Encoding"}
+
+// responseHeaderFilter removes the headers of an upstream's responses that
+// shouldn't reach clients, ie. Server or debug headers: all but those
+// allowed, when set, or else those denied. Patterns are header names, or
+// name prefixes ending with *.
+type responseHeaderFilter struct {
+	allow []string
+	deny  []string
+}
+
+// parseResponseHeaderFilter reads and strips the allow_response_headers and
+// deny_response_headers query parameters of an upstream URL
+func parseResponseHeaderFilter(u *url.URL, msgs []string) (responseHeaderFilter, []string) {
+	var f responseHeaderFilter
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "h2c" && u.Scheme != "srv" {
+		return f, msgs
+	}
+	params := u.Query()
+	allow, deny := params.Get("allow_response_headers"), params.Get("deny_response_headers")
+	params.Del("allow_response_headers")
+	params.Del("deny_response_headers")
+	u.RawQuery = params.Encode()
+
+	if allow != "" && deny != "" {
+		msgs = append(msgs, fmt.Sprintf(
+			"allow_response_headers and deny_response_headers can't be combined: %q", u))
+	}
+	f.allow, msgs = parseHeaderPatterns(u, allow, msgs)
+	f.deny, msgs = parseHeaderPatterns(u, deny, msgs)
+	return f, msgs
+}
+
+// parseHeaderPatterns reads a comma separated list of header patterns
+func parseHeaderPatterns(u *url.URL, list string, msgs []string) ([]string, []string) {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		name := strings.TrimSuffix(pattern, "*")
+		if name == "" || strings.ContainsAny(name, " \t\r\n:*") {
+			msgs = append(msgs, fmt.Sprintf(
+				"invalid response header %q for upstream %q", pattern, u))
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, msgs
+}
+
+func (f responseHeaderFilter) enabled() bool {
+	return f.allow != nil || f.deny != nil
+}
+
+// Filter removes the headers of h that aren't allowed, or are denied
+func (f responseHeaderFilter) Filter(h http.Header) {
+	for name := range h {
+		if f.allow != nil {
+			if !matchesHeader(f.allow, name) && !matchesHeader(framingHeaders, name) {
+				h.Del(name)
+			}
+		} else if matchesHeader(f.deny, name) {
+			h.Del(name)
+		}
+	}
+}
+
+// modifyResponse filters the responses, after the ModifyResponse next
+func (f responseHeaderFilter) modifyResponse(next func(*http.Response) error) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if next != nil {
+			if err := next(resp); err != nil {
+				return err
+			}
+		}
+		f.Filter(resp.Header)
+		return nil
+	}
+}
+
+// matchesHeader reports whether the header name matches one of patterns
+func matchesHeader(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestResponseHeaderFilter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "legacy/1.0")
+		w.Header().Set("X-Backend-Node", "app-3")
+		w.Header().Set("X-Debug-Sql", "select 1")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	// serve proxies a request through the upstream with the query params
+	serve := func(params string) http.Header {
+		opts := testOptions()
+		opts.Upstreams = []string{backend.URL + "/?" + params}
+		assert.Equal(t, nil, opts.Validate())
+		proxy := NewOAuthProxy(opts, func(string) bool { return true })
+		rw := httptest.NewRecorder()
+		proxy.upstreamFor("/").ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+		assert.Equal(t, "ok", rw.Body.String())
+		return rw.Header()
+	}
+
+	header := serve("deny_response_headers=Server,x-backend-node,X-Debug-*")
+	assert.Equal(t, "", header.Get("Server"))
+	assert.Equal(t, "", header.Get("X-Backend-Node"))
+	assert.Equal(t, "", header.Get("X-Debug-Sql"))
+	assert.Equal(t, "no-store", header.Get("Cache-Control"))
+
+	header = serve("allow_response_headers=Content-Type")
+	assert.Equal(t, "text/plain", header.Get("Content-Type"))
+	assert.Equal(t, "2", header.Get("Content-Length"))
+	assert.Equal(t, "", header.Get("Server"))
+	assert.Equal(t, "", header.Get("Cache-Control"))
+	// set by the proxy, not the upstream
+	assert.NotEqual(t, "", header.Get("GAP-Upstream-Address"))
+
+	header = serve("")
+	assert.Equal(t, "legacy/1.0", header.Get("Server"))
+}
+
+func TestResponseHeaderFilterOptions(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{
+		"http://127.0.0.1:8080/?allow_response_headers=Content-Type&deny_response_headers=Server",
+		"http://127.0.0.1:8081/api/?deny_response_headers=X-Debug:Sql,*",
+	}
+	assert.Equal(t, errorMsg([]string{
+		`allow_response_headers and deny_response_headers can't be combined: "http://127.0.0.1:8080/"`,
+		`invalid response header "X-Debug:Sql" for upstream "http://127.0.0.1:8081/api/"`,
+		`invalid response header "*" for upstream "http://127.0.0.1:8081/api/"`}), o.Validate().Error())
+}
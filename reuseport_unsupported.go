@@ -0,0 +1,12 @@
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("reuse_port is not supported on this platform")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+)
+
+// RoleMap translates the group names or IDs providers report into roles,
+// as listed in a role mapping file. Each line maps a group to one or more
+// roles:
+//
+//	gcp-group-12345,admins
+//	engineering@example.com,developers,on-call
+type RoleMap struct {
+	file string
+	m    unsafe.Pointer
+}
+
+// NewRoleMap reads the role mapping file
+func NewRoleMap(file string) (*RoleMap, error) {
+	rm := &RoleMap{file: file}
+	if err := rm.load(); err != nil {
+		return nil, err
+	}
+	return rm, nil
+}
+
+// Watch reloads the role mapping file whenever it changes. A file that
+// can't be read leaves the previous mapping in place.
+func (rm *RoleMap) Watch(done <-chan bool) {
+	log.Printf("using role mapping file %s", rm.file)
+	WatchForUpdates(rm.file, done, func() {
+		if err := rm.load(); err != nil {
+			log.Printf("error reloading role-mapping-file=%q, keeping the previous roles: %s", rm.file, err)
+		}
+	})
+}
+
+func (rm *RoleMap) load() error {
+	r, err := os.Open(rm.file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	csvReader := csv.NewReader(r)
+	csvReader.Comma = ','
+	csvReader.Comment = '#'
+	csvReader.TrimLeadingSpace = true
+	csvReader.FieldsPerRecord = -1
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return err
+	}
+	updated := make(map[string][]string)
+	for _, r := range records {
+		group := strings.TrimSpace(r[0])
+		if len(r) < 2 {
+			return fmt.Errorf("group %q isn't mapped to any role", group)
+		}
+		for _, role := range r[1:] {
+			if role = strings.TrimSpace(role); role != "" {
+				updated[group] = append(updated[group], role)
+			}
+		}
+	}
+	atomic.StorePointer(&rm.m, unsafe.Pointer(&updated))
+	return nil
+}
+
+// Roles returns the sorted roles of groups. Groups that aren't mapped have
+// no role.
+func (rm *RoleMap) Roles(groups []string) []string {
+	if rm == nil {
+		return nil
+	}
+	m := *(*map[string][]string)(atomic.LoadPointer(&rm.m))
+	seen := make(map[string]bool)
+	var roles []string
+	for _, group := range groups {
+		for _, role := range m[group] {
+			if !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func writeRoleMapping(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "test_role_mapping_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString(content)
+	return f.Name()
+}
+
+func TestRoleMap(t *testing.T) {
+	file := writeRoleMapping(t, `# group,roles
+gcp-group-12345,admins
+engineering@example.com, developers, on-call
+gcp-group-67890,developers
+`)
+	defer os.Remove(file)
+	rm, err := NewRoleMap(file)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"admins", "developers", "on-call"},
+		rm.Roles([]string{"gcp-group-67890", "engineering@example.com", "gcp-group-12345", "unmapped"}))
+	assert.Equal(t, []string(nil), rm.Roles([]string{"unmapped"}))
+	assert.Equal(t, []string(nil), (*RoleMap)(nil).Roles([]string{"gcp-group-12345"}))
+
+	ioutil.WriteFile(file, []byte("gcp-group-12345,viewers\n"), 0600)
+	assert.Equal(t, nil, rm.load())
+	assert.Equal(t, []string{"viewers"}, rm.Roles([]string{"gcp-group-12345"}))
+
+	// a broken file keeps the previous roles
+	ioutil.WriteFile(file, []byte("gcp-group-12345\n"), 0600)
+	assert.Equal(t, `group "gcp-group-12345" isn't mapped to any role`, rm.load().Error())
+	assert.Equal(t, []string{"viewers"}, rm.Roles([]string{"gcp-group-12345"}))
+}
+
+func TestRoleMappingOptions(t *testing.T) {
+	o := testOptions()
+	o.RoleMappingFile = "/nonexistent/roles.csv"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, true, strings.Contains(err.Error(),
+		`error reading role-mapping-file="/nonexistent/roles.csv": open /nonexistent/roles.csv: no such file or directory`))
+}
+
+func TestRoleHeaders(t *testing.T) {
+	file := writeRoleMapping(t, "gcp-group-12345,admins\n")
+	defer os.Remove(file)
+
+	opts := testOptions()
+	opts.RoleMappingFile = file
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.PassAccessToken = true
+	opts.SetXAuthRequest = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	authenticate := func(groups []string) (*http.Request, *httptest.ResponseRecorder) {
+		session := &providers.SessionState{Email: "user@example.com", User: "user", AccessToken: "token", Groups: groups}
+		value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+		assert.Equal(t, nil, err)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Forwarded-Roles", "admins")
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+		rw := httptest.NewRecorder()
+		assert.Equal(t, http.StatusAccepted, proxy.Authenticate(rw, req))
+		return req, rw
+	}
+
+	req, rw := authenticate([]string{"gcp-group-12345", "other"})
+	assert.Equal(t, "gcp-group-12345,other", req.Header.Get("X-Forwarded-Groups"))
+	assert.Equal(t, "admins", req.Header.Get("X-Forwarded-Roles"))
+	assert.Equal(t, "admins", rw.HeaderMap.Get("X-Auth-Request-Roles"))
+
+	// clients can't claim roles their groups don't map to
+	req, rw = authenticate([]string{"other"})
+	assert.Equal(t, "", req.Header.Get("X-Forwarded-Roles"))
+	assert.Equal(t, "", rw.HeaderMap.Get("X-Auth-Request-Roles"))
+
+	// nor any roles without a role mapping
+	opts = testOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.PassAccessToken = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy = NewOAuthProxy(opts, func(string) bool { return true })
+	req, _ = authenticate([]string{"gcp-group-12345"})
+	assert.Equal(t, "", req.Header.Get("X-Forwarded-Roles"))
+}
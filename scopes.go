@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// scopeRoute is a route that needs scopes beyond the base scope, requested
+// by incremental authorization when a user first reaches it
+type scopeRoute struct {
+	path   *regexp.Regexp
+	scopes []string
+}
+
+// routeScopes returns the additional scopes path needs
+func (p *OAuthProxy) routeScopes(path string) []string {
+	var scopes []string
+	for _, r := range p.scopeRoutes {
+		if r.path.MatchString(path) {
+			scopes = mergeScopes(scopes, r.scopes)
+		}
+	}
+	return scopes
+}
+
+// missingScopes returns the additional scopes path needs that s wasn't
+// granted. Requests authenticated without a session miss none.
+func (p *OAuthProxy) missingScopes(s *providers.SessionState, path string) []string {
+	if s == nil {
+		return nil
+	}
+	granted := make(map[string]bool, len(s.Scopes))
+	for _, scope := range s.Scopes {
+		granted[scope] = true
+	}
+	var missing []string
+	for _, scope := range p.routeScopes(path) {
+		if !granted[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+// requestedScopes returns the additional scopes a sign in redirecting to
+// redirect asks for: those the current session was granted, so they aren't
+// lost, and those the redirect path needs
+func (p *OAuthProxy) requestedScopes(req *http.Request, redirect string) []string {
+	if len(p.scopeRoutes) == 0 {
+		return nil
+	}
+	var scopes []string
+	if session, _, err := p.LoadCookiedSession(req); err == nil {
+		scopes = session.Scopes
+	}
+	if u, err := url.Parse(redirect); err == nil {
+		scopes = mergeScopes(scopes, p.routeScopes(u.Path))
+	}
+	return scopes
+}
+
+// requestScopes sends a user who reached a route needing scopes they weren't
+// granted to sign in again, asking for them on top of the granted ones.
+// Requests other than page navigations are denied instead.
+func (p *OAuthProxy) requestScopes(rw http.ResponseWriter, req *http.Request, missing []string) {
+	log.Printf("%s %s needs additional scopes %s", getRemoteAddr(req), req.URL.Path, strings.Join(missing, " "))
+	switch {
+	case p.Headless || !isPageNavigation(req):
+		p.ErrorPage(rw, req, http.StatusForbidden, "Permission Denied", "Additional consent required")
+	case p.SkipProviderButton:
+		p.OAuthStart(rw, req)
+	default:
+		http.Redirect(rw, req, p.OAuthStartPath+"?rd="+url.QueryEscape(req.URL.RequestURI()), 302)
+	}
+}
+
+// mergeScopes appends the scopes of b missing from a
+func mergeScopes(a, b []string) []string {
+	for _, scope := range b {
+		found := false
+		for _, s := range a {
+			found = found || s == scope
+		}
+		if !found {
+			a = append(a, scope)
+		}
+	}
+	return a
+}
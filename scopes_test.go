@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestIncrementalScopes(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"my_auth_token"}`))
+	}))
+	defer idp.Close()
+	idpURL, _ := url.Parse(idp.URL)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{backend.URL}
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.CookieSecure = false
+	opts.PassAccessToken = true
+	opts.ScopeRoutes = []string{"^/calendar/=calendar.readonly", "^/calendar/edit=calendar"}
+	assert.Equal(t, nil, opts.Validate())
+	opts.provider = NewTestProvider(idpURL, "user@example.com")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	var cookies []*http.Cookie
+	serve := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Accept", "text/html")
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	signIn := func(rd string) {
+		rw := serve("GET", "/oauth2/start?rd="+url.QueryEscape(rd), nil)
+		assert.Equal(t, 302, rw.Code)
+		loginURL, _ := url.Parse(rw.HeaderMap.Get("Location"))
+		state := loginURL.Query().Get("state")
+		nonce := strings.SplitN(state, ":", 2)[0]
+		req := httptest.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+url.QueryEscape(state), nil)
+		req.AddCookie(proxy.MakeCSRFCookie(req, nonce, proxy.CookieExpire, time.Now()))
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rw = httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 302, rw.Code)
+		assert.Equal(t, rd, rw.HeaderMap.Get("Location"))
+		for _, c := range rw.Result().Cookies() {
+			if c.Name == proxy.CookieName {
+				cookies = []*http.Cookie{c}
+			}
+		}
+	}
+	loginScope := func(rd string) string {
+		rw := serve("GET", "/oauth2/start?rd="+url.QueryEscape(rd), nil)
+		loginURL, _ := url.Parse(rw.HeaderMap.Get("Location"))
+		return loginURL.Query().Get("scope")
+	}
+
+	// the base scope is requested at sign in
+	assert.Equal(t, "profile.email", loginScope("/"))
+	signIn("/")
+	assert.Equal(t, 200, serve("GET", "/", nil).Code)
+
+	// reaching a route that needs more starts incremental authorization
+	rw := serve("GET", "/calendar/today?week=1", nil)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "/oauth2/start?rd="+url.QueryEscape("/calendar/today?week=1"), rw.HeaderMap.Get("Location"))
+	assert.Equal(t, 403, serve("POST", "/calendar/today", nil).Code)
+	assert.Equal(t, 403, serve("GET", "/calendar/today", http.Header{"Accept": {"application/json"}}).Code)
+	assert.Equal(t, "profile.email calendar.readonly", loginScope("/calendar/today"))
+
+	signIn("/calendar/today")
+	assert.Equal(t, 200, serve("GET", "/calendar/today", nil).Code)
+	assert.Equal(t, 302, serve("GET", "/calendar/edit", nil).Code)
+
+	// the granted scopes are asked for again with the new ones
+	assert.Equal(t, "profile.email calendar.readonly calendar", loginScope("/calendar/edit"))
+	signIn("/calendar/edit")
+	assert.Equal(t, 200, serve("GET", "/calendar/edit", nil).Code)
+	assert.Equal(t, 200, serve("GET", "/calendar/today", nil).Code)
+}
+
+func TestScopeRouteOptions(t *testing.T) {
+	o := testOptions()
+	o.ScopeRoutes = []string{"^/calendar/", "^/drive/= ", "(=drive"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	expected := errorMsg([]string{
+		"scope_routes requires pass_access_token",
+		`invalid scope-route="^/calendar/", expected <path regex>=<scope>`,
+		`invalid scope-route="^/drive/= ", expected <path regex>=<scope>`,
+		"error compiling scope-route=\"(=drive\" error parsing regexp: missing closing ): `(`",
+	})
+	assert.Equal(t, expected, err.Error())
+}
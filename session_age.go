@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// statusSessionTooOld is the status of requests whose session is too old
+// for their route and can't be refreshed. Unlike http.StatusForbidden, it
+// starts a sign in without removing the session, which other routes still
+// accept.
+const statusSessionTooOld = http.StatusPreconditionRequired
+
+// sessionAgeRoute is a route that only accepts sessions issued, refreshed
+// or revalidated within maxAge
+type sessionAgeRoute struct {
+	path   *regexp.Regexp
+	maxAge time.Duration
+}
+
+// routeMaxSessionAge returns the oldest session path accepts, the shortest
+// of the matching routes, and whether any matches
+func (p *OAuthProxy) routeMaxSessionAge(path string) (time.Duration, bool) {
+	var maxAge time.Duration
+	var found bool
+	for _, r := range p.sessionAgeRoutes {
+		if r.path.MatchString(path) && (!found || r.maxAge < maxAge) {
+			maxAge, found = r.maxAge, true
+		}
+	}
+	return maxAge, found
+}
+
+// sessionAgePath is the path whose maximum session age applies to req: the
+// path of the request the auth endpoint is asked about, as forwarded by the
+// ingress, or else req's own
+func (p *OAuthProxy) sessionAgePath(req *http.Request) string {
+	if req.URL.Path == p.AuthOnlyPath {
+		if uri := authOriginalRequest(req).uri; uri != "" {
+			if u, err := url.ParseRequestURI(uri); err == nil {
+				return u.Path
+			}
+		}
+	}
+	return req.URL.Path
+}
+
+// reauthenticate starts a sign in for a request whose session is too old for
+// its route, like requestScopes. The sign in page would remove the session,
+// logging the user out of every route if they don't sign in again.
+func (p *OAuthProxy) reauthenticate(rw http.ResponseWriter, req *http.Request) {
+	switch {
+	case p.Headless || !isPageNavigation(req):
+		p.ErrorPage(rw, req, http.StatusForbidden, "Permission Denied", "Sign in again to access this page")
+	case p.SkipProviderButton:
+		p.OAuthStart(rw, req)
+	default:
+		http.Redirect(rw, req, p.OAuthStartPath+"?rd="+url.QueryEscape(req.URL.RequestURI()), 302)
+	}
+}
+
+// refreshStaleSession refreshes s with its provider before it expires, for a
+// route that needs a younger session. It returns the refreshed session, or
+// nil when s can't be refreshed and the user has to sign in again.
+func (p *OAuthProxy) refreshStaleSession(s *providers.SessionState) *providers.SessionState {
+	refreshed := *s
+	refreshed.ExpiresOn = providers.Now().Add(-time.Second)
+	ok, err := p.sessionProvider(s).RefreshSessionIfNeeded(&refreshed)
+	if unavailable := providers.Unavailable(err); ok || unavailable {
+		p.recordProviderCall(unavailable)
+	}
+	if !ok || err != nil {
+		return nil
+	}
+	return &refreshed
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestSessionAgeRoutes(t *testing.T) {
+	o := testOptions()
+	o.SessionAgeRoutes = []string{"^/payments/=1h", "^/payments/refunds=5m"}
+	assert.Equal(t, nil, o.Validate())
+	proxy := NewOAuthProxy(o, func(string) bool { return true })
+
+	maxAge, ok := proxy.routeMaxSessionAge("/payments/")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, time.Hour, maxAge)
+	maxAge, ok = proxy.routeMaxSessionAge("/payments/refunds")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 5*time.Minute, maxAge)
+	_, ok = proxy.routeMaxSessionAge("/reports")
+	assert.Equal(t, false, ok)
+
+	o = testOptions()
+	o.SessionAgeRoutes = []string{"/payments", "(=1h", "/payments=0s"}
+	assert.Equal(t, errorMsg([]string{
+		`invalid max-session-age-route="/payments", expected <path regex>=<duration>`,
+		"error compiling max-session-age-route=\"(=1h\" error parsing regexp: missing closing ): `(`",
+		`invalid max-session-age-route="/payments=0s", the duration must be positive`}), o.Validate().Error())
+
+	o = testOptions()
+	o.SessionAgeRoutes = []string{"^/payments/=1h"}
+	o.AuthOnlyCacheTTL = 2 * time.Second
+	assert.Equal(t, errorMsg([]string{
+		"auth_only_cache_ttl can't be used with max_session_age_routes"}), o.Validate().Error())
+}
+
+func TestMaxSessionAge(t *testing.T) {
+	opts := testOptions()
+	opts.SessionAgeRoutes = []string{"^/payments/=1h"}
+	opts.UnsafeTestMode = true
+	opts.TestModeSecret = testModeTestSecret
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.PassAccessToken = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	// builds a request for path with a session issued age ago
+	request := func(path, refreshToken string, age time.Duration) *http.Request {
+		session := &providers.SessionState{
+			Email:        "user@example.com",
+			AccessToken:  testModeAccessToken,
+			RefreshToken: refreshToken,
+			ExpiresOn:    time.Now().Add(time.Hour),
+			Provider:     sessionProviderTestMode,
+		}
+		value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+		assert.Equal(t, nil, err)
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now().Add(-age)))
+		return req
+	}
+	authenticate := func(path, refreshToken string, age time.Duration) (int, http.Header) {
+		rw := httptest.NewRecorder()
+		return proxy.Authenticate(rw, request(path, refreshToken, age)), rw.Header()
+	}
+
+	status, header := authenticate("/reports", "", 2*time.Hour)
+	assert.Equal(t, http.StatusAccepted, status)
+	status, header = authenticate("/payments/", "", 30*time.Minute)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, "", header.Get("Set-Cookie"))
+
+	// an older session is refreshed, and re-issued
+	status, header = authenticate("/payments/", "refresh", 2*time.Hour)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.NotEqual(t, "", header.Get("Set-Cookie"))
+
+	// or has to sign in again when it can't be, without being removed
+	status, header = authenticate("/payments/", "", 2*time.Hour)
+	assert.Equal(t, statusSessionTooOld, status)
+	assert.Equal(t, "", header.Get("Set-Cookie"))
+	status, _ = authenticate("/payments/", providers.TestModeRefreshFail, 2*time.Hour)
+	assert.Equal(t, statusSessionTooOld, status)
+
+	// page navigations are sent to sign in again, other requests are denied,
+	// and neither removes the session
+	req := request("/payments/", "", 2*time.Hour)
+	req.Header.Set("Accept", "text/html")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/oauth2/start?rd=%2Fpayments%2F", rw.Header().Get("Location"))
+	assert.Equal(t, 0, len(rw.Result().Cookies()))
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, request("/payments/", "", 2*time.Hour))
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, 0, len(rw.Result().Cookies()))
+
+	// the auth endpoint checks the path of the request it's asked about
+	req = request("/oauth2/auth", "", 2*time.Hour)
+	req.Header.Set("X-Original-URI", "/payments/?page=2")
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Equal(t, 0, len(rw.Result().Cookies()))
+	req = request("/oauth2/auth", "", 2*time.Hour)
+	req.Header.Set("X-Original-URI", "/reports")
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// sessionEventBuffer bounds the events waiting for each stream client.
+	// Events are dropped for clients that fall further behind.
+	sessionEventBuffer = 1000
+	// sessionEventKeepAlive is how often idle streams get a comment, so
+	// load balancers in between don't close them
+	sessionEventKeepAlive = 30 * time.Second
+)
+
+var sessionEventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "session_events_dropped_total",
+	Help: "Session events not streamed to a client that fell behind.",
+})
+
+func init() {
+	prometheus.MustRegister(sessionEventsDropped)
+}
+
+// sessionEvents streams the session lifecycle events of every proxy built by
+// configuration reloads
+var sessionEvents = newSessionEventBus()
+
+// sessionEventBus fans session lifecycle events out to the clients of the
+// event stream as server-sent events
+type sessionEventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan auditEvent]bool
+}
+
+func newSessionEventBus() *sessionEventBus {
+	return &sessionEventBus{subscribers: make(map[chan auditEvent]bool)}
+}
+
+// Publish sends e to the subscribers, dropping it for those that fell behind
+func (b *sessionEventBus) Publish(e auditEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for events := range b.subscribers {
+		select {
+		case events <- e:
+		default:
+			sessionEventsDropped.Inc()
+		}
+	}
+}
+
+// Subscribe returns the events published from now on, until unsubscribe is
+// called
+func (b *sessionEventBus) Subscribe() (events <-chan auditEvent, unsubscribe func()) {
+	ch := make(chan auditEvent, sessionEventBuffer)
+	b.mu.Lock()
+	b.subscribers[ch] = true
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+}
+
+// ServeHTTP streams the events as server-sent events named by their type,
+// with the JSON audit event as data. The type query parameter restricts the
+// stream to a comma separated list of event types.
+func (b *sessionEventBus) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	var types map[string]bool
+	if t := req.URL.Query().Get("type"); t != "" {
+		types = make(map[string]bool)
+		for _, eventType := range strings.Split(t, ",") {
+			types[strings.TrimSpace(eventType)] = true
+		}
+	}
+
+	events, unsubscribe := b.Subscribe()
+	defer unsubscribe()
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sessionEventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-events:
+			if types != nil && !types[e.Type] {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", e.Type, data)
+		case <-keepAlive.C:
+			fmt.Fprint(rw, ": keep-alive\n\n")
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// serveAdmin serves the session event stream at /events on addr, which
+// should only be reachable by monitoring systems, and the credential
+// rotation at /credentials when it is enabled
+func serveAdmin(addr string, rotation *credentialRotation) {
+	mux := http.NewServeMux()
+	mux.Handle("/events", sessionEvents)
+	if rotation != nil {
+		mux.Handle("/credentials", rotation)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("FATAL: listen (tcp, %s) failed - %s", addr, err)
+	}
+	log.Printf("admin: listening on %s", listener.Addr())
+	if err := http.Serve(listener, mux); err != nil {
+		log.Printf("ERROR: admin http.Serve() - %s", err)
+	}
+}
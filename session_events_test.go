@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestSessionEventBus(t *testing.T) {
+	b := newSessionEventBus()
+	events, unsubscribe := b.Subscribe()
+	b.Publish(auditEvent{Type: "sign_in"})
+	assert.Equal(t, "sign_in", (<-events).Type)
+
+	// clients that fall behind miss events rather than blocking the proxy
+	for i := 0; i < sessionEventBuffer+1; i++ {
+		b.Publish(auditEvent{Type: "sign_in"})
+	}
+	assert.Equal(t, sessionEventBuffer, len(events))
+
+	unsubscribe()
+	assert.Equal(t, 0, len(b.subscribers))
+}
+
+func TestSessionEventStream(t *testing.T) {
+	b := newSessionEventBus()
+	server := httptest.NewServer(b)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events?type=sign_in_denied,session_refreshed")
+	assert.Equal(t, nil, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	for len(b.subscribers) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	b.Publish(auditEvent{Type: "sign_in", Email: "user@example.com"})
+	b.Publish(auditEvent{Type: "sign_in_denied", Email: "user@example.com", Reason: "blocked"})
+	r := bufio.NewReader(resp.Body)
+	event, _ := r.ReadString('\n')
+	data, _ := r.ReadString('\n')
+	assert.Equal(t, "event: sign_in_denied\n", event)
+	assert.Equal(t, true, strings.HasPrefix(data, `data: {"time":"0001-01-01T00:00:00Z","type":"sign_in_denied","email":"user@example.com",`))
+	assert.Equal(t, true, strings.HasSuffix(data, `"reason":"blocked"}`+"\n"))
+}
+
+func TestAuditStreamsSessionEvents(t *testing.T) {
+	events, unsubscribe := sessionEvents.Subscribe()
+	defer unsubscribe()
+
+	// events are streamed without an audit webhook
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	req := httptest.NewRequest("GET", "/", nil)
+	proxy.audit(req, "sign_out", &providers.SessionState{Email: "user@example.com"}, "")
+	proxy.streamSessionEvent(req, "session_refreshed", &providers.SessionState{Email: "user@example.com"}, "")
+	e := <-events
+	assert.Equal(t, "sign_out", e.Type)
+	assert.Equal(t, "user@example.com", e.Email)
+	assert.Equal(t, "session_refreshed", (<-events).Type)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+// sessionExpiry is when a session whose cookie was issued at issued ends:
+// when the cookie expires, or when the token does if it can't be refreshed
+func (p *OAuthProxy) sessionExpiry(s *providers.SessionState, issued time.Time) time.Time {
+	expires := issued.Add(p.CookieExpire)
+	if !s.ExpiresOn.IsZero() && s.RefreshToken == "" && s.ExpiresOn.Before(expires) {
+		expires = s.ExpiresOn
+	}
+	return expires
+}
+
+// sessionRefreshURL is where applications send users to renew their
+// session, which is the silent renewal endpoint when it is enabled
+func (p *OAuthProxy) sessionRefreshURL() string {
+	if p.SilentReauth {
+		return p.SilentPath
+	}
+	return p.OAuthStartPath
+}
+
+// setSessionExpiryHeaders tells applications how many seconds the session
+// has left, and where to renew it
+func (p *OAuthProxy) setSessionExpiryHeaders(rw http.ResponseWriter, s *providers.SessionState, issued time.Time) {
+	left := p.sessionExpiry(s, issued).Sub(time.Now())
+	if left < 0 {
+		left = 0
+	}
+	rw.Header().Set("GAP-Session-Expires-In", strconv.Itoa(int(left.Seconds())))
+	rw.Header().Set("GAP-Session-Refresh-URL", p.sessionRefreshURL())
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestSessionExpiryHeaders(t *testing.T) {
+	opts := testOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.PassAccessToken = true
+	opts.CookieExpire = 2 * time.Hour
+	opts.SessionExpiryHeaders = true
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	authenticate := func(s *providers.SessionState) *httptest.ResponseRecorder {
+		value, err := proxy.provider.CookieForSession(s, proxy.CookieCipher)
+		assert.Equal(t, nil, err)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now().Add(-time.Hour)))
+		rw := httptest.NewRecorder()
+		assert.Equal(t, 202, proxy.Authenticate(rw, req))
+		return rw
+	}
+	expiresIn := func(rw *httptest.ResponseRecorder) time.Duration {
+		seconds, err := strconv.Atoi(rw.HeaderMap.Get("GAP-Session-Expires-In"))
+		assert.Equal(t, nil, err)
+		return time.Duration(seconds) * time.Second
+	}
+
+	// the cookie was issued an hour ago
+	rw := authenticate(&providers.SessionState{Email: "user@example.com"})
+	assert.Equal(t, true, expiresIn(rw) > 59*time.Minute && expiresIn(rw) <= time.Hour)
+	assert.Equal(t, "/oauth2/start", rw.HeaderMap.Get("GAP-Session-Refresh-URL"))
+
+	// tokens that can't be refreshed end the session when they expire
+	rw = authenticate(&providers.SessionState{Email: "user@example.com", AccessToken: "token",
+		ExpiresOn: time.Now().Add(10 * time.Minute)})
+	assert.Equal(t, true, expiresIn(rw) > 9*time.Minute && expiresIn(rw) <= 10*time.Minute)
+	rw = authenticate(&providers.SessionState{Email: "user@example.com", AccessToken: "token",
+		RefreshToken: "refresh", ExpiresOn: time.Now().Add(10 * time.Minute)})
+	assert.Equal(t, true, expiresIn(rw) > 59*time.Minute)
+
+	proxy.SilentReauth = true
+	rw = authenticate(&providers.SessionState{Email: "user@example.com"})
+	assert.Equal(t, "/oauth2/silent", rw.HeaderMap.Get("GAP-Session-Refresh-URL"))
+}
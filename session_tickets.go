@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"log"
+	"time"
+)
+
+// minSessionTicketSecret is the shortest tls_session_ticket_secret accepted
+const minSessionTicketSecret = 32
+
+// sessionTicketKeys derives the session ticket keys of the rotation period
+// now falls in from secret, so replicas sharing it agree on them without
+// coordinating. The key of the current period encrypts new tickets; those of
+// the previous and the next period are also accepted, for tickets issued
+// before the last rotation and by replicas whose clocks run ahead.
+func sessionTicketKeys(secret string, rotation time.Duration, now time.Time) [][32]byte {
+	period := now.UnixNano() / int64(rotation)
+	return [][32]byte{
+		sessionTicketKey(secret, period),
+		sessionTicketKey(secret, period-1),
+		sessionTicketKey(secret, period+1),
+	}
+}
+
+func sessionTicketKey(secret string, period int64) (key [32]byte) {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte("oauth2_proxy session ticket key"))
+	binary.Write(h, binary.BigEndian, period)
+	copy(key[:], h.Sum(nil))
+	return
+}
+
+// rotateSessionTicketKeys sets the session ticket keys of config derived from
+// secret, and rotates them at the start of every period
+func rotateSessionTicketKeys(config *tls.Config, secret string, rotation time.Duration) {
+	config.SetSessionTicketKeys(sessionTicketKeys(secret, rotation, time.Now()))
+	log.Printf("HTTPS: rotating session ticket keys every %s", rotation)
+	go func() {
+		for {
+			now := time.Now()
+			time.Sleep(rotation - time.Duration(now.UnixNano()%int64(rotation)))
+			config.SetSessionTicketKeys(sessionTicketKeys(secret, rotation, time.Now()))
+		}
+	}()
+}
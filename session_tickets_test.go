@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSessionTicketKeys(t *testing.T) {
+	secret := "0123456789abcdef0123456789abcdef"
+	now := time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC)
+	keys := sessionTicketKeys(secret, time.Hour, now)
+	assert.Equal(t, 3, len(keys))
+
+	// replicas agree on the keys within a period
+	assert.Equal(t, keys, sessionTicketKeys(secret, time.Hour, now.Add(59*time.Minute)))
+	assert.NotEqual(t, keys, sessionTicketKeys("fedcba9876543210fedcba9876543210", time.Hour, now))
+
+	// after a rotation the current key is still accepted, and the next one
+	// encrypts new tickets
+	rotated := sessionTicketKeys(secret, time.Hour, now.Add(time.Hour))
+	assert.Equal(t, keys[2], rotated[0])
+	assert.Equal(t, keys[0], rotated[1])
+}
+
+func TestSessionTicketsAcrossReplicas(t *testing.T) {
+	// borrow the test certificate of httptest
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := ts.TLS.Certificates[0]
+	ts.Close()
+
+	replica := func() net.Listener {
+		config := &tls.Config{Certificates: []tls.Certificate{cert}}
+		rotateSessionTicketKeys(config, "0123456789abcdef0123456789abcdef", time.Hour)
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+		assert.Equal(t, nil, err)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+		return ln
+	}
+
+	client := &tls.Config{
+		InsecureSkipVerify: true,
+		// tickets are part of the TLS 1.2 handshake
+		MaxVersion:         tls.VersionTLS12,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		ServerName:         "example.com",
+	}
+	dial := func(addr string) bool {
+		conn, err := tls.Dial("tcp", addr, client)
+		assert.Equal(t, nil, err)
+		defer conn.Close()
+		return conn.ConnectionState().DidResume
+	}
+
+	first, second := replica(), replica()
+	defer first.Close()
+	defer second.Close()
+	assert.Equal(t, false, dial(first.Addr().String()))
+	assert.Equal(t, true, dial(second.Addr().String()))
+}
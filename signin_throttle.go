@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// signInBackoffStart is the wait imposed by the first failed sign in over
+// the allowed attempts, which doubles with each further failure
+const signInBackoffStart = time.Second
+
+// signInThrottle slows down password guessing on the htpasswd sign in form.
+// Each key, a client IP or a username, may fail attempts times, after which
+// every failure doubles the wait before the next attempt, up to lockout.
+// Failures are forgotten lockout after the last one.
+type signInThrottle struct {
+	mu       sync.Mutex
+	attempts int
+	lockout  time.Duration
+	failures map[string]*signInFailures
+	lastGC   time.Time
+}
+
+type signInFailures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+func newSignInThrottle(attempts int, lockout time.Duration) *signInThrottle {
+	return &signInThrottle{
+		attempts: attempts,
+		lockout:  lockout,
+		failures: make(map[string]*signInFailures),
+	}
+}
+
+// Wait returns how long until all of keys may attempt to sign in again
+func (t *signInThrottle) Wait(now time.Time, keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var wait time.Duration
+	for _, key := range keys {
+		if f := t.current(key, now); f != nil && f.until.Sub(now) > wait {
+			wait = f.until.Sub(now)
+		}
+	}
+	return wait
+}
+
+// Fail records a failed sign in for keys, and returns whether it locked any
+// of them out for the longest wait
+func (t *signInThrottle) Fail(now time.Time, keys ...string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.gc(now)
+	locked := false
+	for _, key := range keys {
+		f := t.current(key, now)
+		if f == nil {
+			f = &signInFailures{}
+			t.failures[key] = f
+		}
+		f.count++
+		f.last = now
+		if over := f.count - t.attempts; over > 0 {
+			wait := t.lockout
+			if over <= 32 && signInBackoffStart<<uint(over-1) < t.lockout {
+				wait = signInBackoffStart << uint(over-1)
+			} else {
+				locked = true
+			}
+			f.until = now.Add(wait)
+		}
+	}
+	return locked
+}
+
+// Reset forgets the failures of key
+func (t *signInThrottle) Reset(key string) {
+	t.mu.Lock()
+	delete(t.failures, key)
+	t.mu.Unlock()
+}
+
+// current returns the failures of key that aren't forgotten yet
+func (t *signInThrottle) current(key string, now time.Time) *signInFailures {
+	f, ok := t.failures[key]
+	if !ok || now.Sub(f.last) >= t.lockout {
+		return nil
+	}
+	return f
+}
+
+// gc drops the forgotten failures once a minute
+func (t *signInThrottle) gc(now time.Time) {
+	if now.Sub(t.lastGC) < time.Minute {
+		return
+	}
+	t.lastGC = now
+	for key, f := range t.failures {
+		if now.Sub(f.last) >= t.lockout {
+			delete(t.failures, key)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSignInThrottle(t *testing.T) {
+	throttle := newSignInThrottle(2, time.Minute)
+	now := time.Now()
+
+	assert.Equal(t, false, throttle.Fail(now, "ip:10.0.0.1", "user:alice"))
+	assert.Equal(t, false, throttle.Fail(now, "ip:10.0.0.1", "user:alice"))
+	assert.Equal(t, time.Duration(0), throttle.Wait(now, "ip:10.0.0.1", "user:alice"))
+
+	// each failure over the allowed attempts doubles the wait
+	throttle.Fail(now, "ip:10.0.0.1", "user:alice")
+	assert.Equal(t, time.Second, throttle.Wait(now, "ip:10.0.0.1"))
+	throttle.Fail(now, "ip:10.0.0.1", "user:alice")
+	assert.Equal(t, 2*time.Second, throttle.Wait(now, "ip:10.0.0.2", "user:alice"))
+	assert.Equal(t, time.Duration(0), throttle.Wait(now, "ip:10.0.0.2", "user:bob"))
+
+	// up to the lockout
+	for i := 0; i < 5; i++ {
+		throttle.Fail(now, "ip:10.0.0.1", "user:alice")
+	}
+	assert.Equal(t, true, throttle.Fail(now, "ip:10.0.0.1", "user:alice"))
+	assert.Equal(t, time.Minute, throttle.Wait(now, "user:alice"))
+
+	// a successful sign in only resets the user
+	throttle.Reset("user:alice")
+	assert.Equal(t, time.Duration(0), throttle.Wait(now, "user:alice"))
+	assert.Equal(t, time.Minute, throttle.Wait(now, "ip:10.0.0.1"))
+
+	// and forgets the failures once the lockout is over
+	assert.Equal(t, time.Duration(0), throttle.Wait(now.Add(time.Minute), "ip:10.0.0.1"))
+	assert.Equal(t, false, throttle.Fail(now.Add(time.Minute), "ip:10.0.0.1"))
+	assert.Equal(t, 1, len(throttle.failures))
+}
+
+func TestManualSignInThrottled(t *testing.T) {
+	opts := testOptions()
+	opts.SignInAttempts = 1
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	proxy.HtpasswdFile, _ = NewHtpasswd(bytes.NewBufferString("testuser:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=\n"))
+
+	signIn := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"testuser"}, "password": {password}}
+		req, _ := http.NewRequest("POST", "/oauth2/sign_in", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = "10.0.0.1:1234"
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, 200, signIn("wrong").Code)
+	assert.Equal(t, 200, signIn("wrong").Code)
+	// the right password isn't even checked while backing off
+	rw := signIn("asdf")
+	assert.Equal(t, 429, rw.Code)
+	assert.Equal(t, "1", rw.HeaderMap.Get("Retry-After"))
+
+	proxy.signInThrottle = newSignInThrottle(1, time.Minute)
+	assert.Equal(t, 302, signIn("asdf").Code)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes sockets in
+const sdListenFDsStart = 3
+
+// systemdListeners returns the sockets systemd passed to the process by
+// socket activation, from file descriptor firstFD on, or none when it wasn't
+// socket activated. Like sd_listen_fds, it unsets the LISTEN_* variables so
+// child processes don't take the sockets for theirs.
+func systemdListeners(firstFD int) ([]net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		f := os.NewFile(uintptr(firstFD+i), fmt.Sprintf("LISTEN_FD_%d", firstFD+i))
+		listeners[i], err = net.FileListener(f)
+		// FileListener dups the socket
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d passed by systemd isn't a listener - %s", firstFD+i, err)
+		}
+	}
+	return listeners, nil
+}
+
+// listen returns the socket systemd passed in when socket activated, and
+// listens on addr otherwise, with SO_REUSEPORT when reusePort is set
+func listen(network, addr string, reusePort bool) (net.Listener, error) {
+	listeners, err := systemdListeners(sdListenFDsStart)
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) == 0 {
+		var lc net.ListenConfig
+		if reusePort && network != "unix" {
+			lc.Control = reusePortControl
+		}
+		return lc.Listen(context.Background(), network, addr)
+	}
+	for _, ln := range listeners[1:] {
+		log.Printf("ignoring socket %s passed by systemd, only one listener is used", ln.Addr())
+		ln.Close()
+	}
+	log.Printf("using socket %s passed by systemd instead of %s", listeners[0].Addr(), addr)
+	return listeners[0], nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSystemdListeners(t *testing.T) {
+	listeners, err := systemdListeners(sdListenFDsStart)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(listeners))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	assert.Equal(t, nil, err)
+	defer f.Close()
+
+	// sockets passed to another process are left alone
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	listeners, err = systemdListeners(int(f.Fd()))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(listeners))
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "http")
+	listeners, err = systemdListeners(int(f.Fd()))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(listeners))
+	defer listeners[0].Close()
+	assert.Equal(t, ln.Addr().String(), listeners[0].Addr().String())
+	assert.Equal(t, "", os.Getenv("LISTEN_PID"))
+	assert.Equal(t, "", os.Getenv("LISTEN_FDNAMES"))
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "many")
+	_, err = systemdListeners(int(f.Fd()))
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,46 @@
+// +build !windows,!plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+)
+
+// syslogFacilities are the facilities logging_syslog_facility may name
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+func checkSyslogFacility(facility string) error {
+	if _, ok := syslogFacilities[facility]; !ok {
+		return fmt.Errorf("invalid logging_syslog_facility %q, expected daemon, auth, authpriv, local0 to local7 or another syslog facility", facility)
+	}
+	return nil
+}
+
+// openSyslog connects to the local syslog daemon, which the lines written
+// are sent to at the info level of facility, tagged with tag
+func openSyslog(facility, tag string) (io.Writer, error) {
+	return syslog.New(syslogFacilities[facility]|syslog.LOG_INFO, tag)
+}
@@ -0,0 +1,16 @@
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+func checkSyslogFacility(facility string) error {
+	return errors.New("logging_syslog is not supported on this platform")
+}
+
+func openSyslog(facility, tag string) (io.Writer, error) {
+	return nil, errors.New("logging_syslog is not supported on this platform")
+}
@@ -3,7 +3,13 @@ package main
 import (
 	"html/template"
 	"log"
+	"net/http"
 	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 func loadTemplates(dir string) *template.Template {
@@ -15,9 +21,148 @@ func loadTemplates(dir string) *template.Template {
 	if err != nil {
 		log.Fatalf("failed parsing template %s", err)
 	}
+	// optional variants, ie. error.fr.mobile.html
+	for _, pattern := range []string{"sign_in.*.html", "error.*.html"} {
+		variants, _ := filepath.Glob(path.Join(dir, pattern))
+		if len(variants) == 0 {
+			continue
+		}
+		log.Printf("using template variants %v", variants)
+		if t, err = t.ParseFiles(variants...); err != nil {
+			log.Fatalf("failed parsing template %s", err)
+		}
+	}
 	return t
 }
 
+// maxTemplateLocales bounds the Accept-Language entries tried
+const maxTemplateLocales = 3
+
+var (
+	localeRegex = regexp.MustCompile(`^[a-z]{1,8}(-[a-z0-9]{1,8})*$`)
+
+	// webviewRegex matches in-app browsers: Android WebViews and common
+	// social apps
+	webviewRegex = regexp.MustCompile(`; wv\)|FBAN|FBAV|Instagram|Line/|Twitter`)
+	mobileRegex  = regexp.MustCompile(`Mobi|Android|iPhone|iPad|iPod`)
+	iosRegex     = regexp.MustCompile(`iPhone|iPad|iPod`)
+)
+
+// requestLocales are the languages of the Accept-Language header, most
+// preferred first, each followed by its primary language, ie. "fr-ca",
+// "fr"
+func requestLocales(req *http.Request) []string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	var langs []lang
+	for _, part := range strings.Split(req.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if !localeRegex.MatchString(tag) {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			if v := strings.TrimSpace(f); strings.HasPrefix(v, "q=") {
+				q, _ = strconv.ParseFloat(v[2:], 64)
+			}
+		}
+		if q > 0 {
+			langs = append(langs, lang{tag, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	var locales []string
+	seen := make(map[string]bool)
+	add := func(tag string) {
+		if !seen[tag] {
+			seen[tag] = true
+			locales = append(locales, tag)
+		}
+	}
+	for i, l := range langs {
+		if i == maxTemplateLocales {
+			break
+		}
+		add(l.tag)
+		if i := strings.Index(l.tag, "-"); i > 0 {
+			add(l.tag[:i])
+		}
+	}
+	return locales
+}
+
+// requestDevices are the device classes of the User-Agent, most specific
+// first: "webview" falls back to "mobile"
+func requestDevices(req *http.Request) []string {
+	ua := req.Header.Get("User-Agent")
+	// iOS apps embed WebKit without identifying as Safari
+	iosWebview := iosRegex.MatchString(ua) && strings.Contains(ua, "AppleWebKit") &&
+		!strings.Contains(ua, "Safari")
+	switch {
+	case webviewRegex.MatchString(ua) || iosWebview:
+		return []string{"webview", "mobile"}
+	case mobileRegex.MatchString(ua):
+		return []string{"mobile"}
+	}
+	return nil
+}
+
+// wantsJSON reports whether the client prefers JSON over HTML, as API
+// clients and XHRs ask for
+func wantsJSON(req *http.Request) bool {
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+		switch strings.TrimSpace(strings.Split(part, ";")[0]) {
+		case "application/json":
+			return true
+		case "text/html", "application/xhtml+xml", "*/*":
+			return false
+		}
+	}
+	return false
+}
+
+// isPageNavigation reports whether req is a browser loading a page, rather
+// than an API client or a script fetching data
+func isPageNavigation(req *http.Request) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	if req.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return false
+	}
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "text/html") || strings.Contains(accept, "application/xhtml+xml")
+}
+
+// templateVariant picks the most specific defined variant of the base.html
+// template for req. Variants are named base.<locale>.<device>.html,
+// base.<locale>.html and base.<device>.html, and are tried in that order
+// for each locale, then without one.
+func templateVariant(t *template.Template, req *http.Request, base string) string {
+	locales := append(requestLocales(req), "")
+	devices := append(requestDevices(req), "")
+	for _, locale := range locales {
+		for _, device := range devices {
+			name := base
+			if locale != "" {
+				name += "." + locale
+			}
+			if device != "" {
+				name += "." + device
+			}
+			name += ".html"
+			if t.Lookup(name) != nil {
+				return name
+			}
+		}
+	}
+	return base + ".html"
+}
+
 func getTemplates() *template.Template {
 	t, err := template.New("foo").Parse(`{{define "sign_in.html"}}
 <!DOCTYPE html>
@@ -110,13 +255,16 @@ func getTemplates() *template.Template {
 </head>
 <body>
 	<div class="signin center">
-	<form method="GET" action="{{.ProxyPrefix}}/start">
-	<input type="hidden" name="rd" value="{{.Redirect}}">
 	{{ if .SignInMessage }}
 	<p>{{.SignInMessage}}</p>
 	{{ end}}
-	<button type="submit" class="btn">Sign in with a {{.ProviderName}} Account</button><br/>
+	{{ range .Providers }}
+	<form method="GET" action="{{$.ProxyPrefix}}/start">
+	<input type="hidden" name="rd" value="{{$.Redirect}}">
+	{{ if .ID }}<input type="hidden" name="provider" value="{{.ID}}">{{ end }}
+	<button type="submit" class="btn">Sign in with a {{.Name}} Account</button><br/>
 	</form>
+	{{ end }}
 	</div>
 
 	{{ if .CustomLogin }}
@@ -1,11 +1,139 @@
 package main
 
 import (
-	"github.com/bmizerany/assert"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
 	"testing"
+
+	"github.com/bmizerany/assert"
 )
 
 func TestTemplatesCompile(t *testing.T) {
 	templates := getTemplates()
 	assert.NotEqual(t, templates, nil)
 }
+
+func TestRequestLocales(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	assert.Equal(t, []string(nil), requestLocales(req))
+
+	req.Header.Set("Accept-Language", "de;q=0.5, fr-CA, en;q=0.8, *;q=0.1, ../x")
+	assert.Equal(t, []string{"fr-ca", "fr", "en", "de"}, requestLocales(req))
+
+	req.Header.Set("Accept-Language", "fr;q=0, en")
+	assert.Equal(t, []string{"en"}, requestLocales(req))
+}
+
+func TestRequestDevices(t *testing.T) {
+	for ua, devices := range map[string][]string{
+		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/80.0 Safari/537.36":                                            nil,
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 13_3 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/13.0 Mobile/15E148 Safari/604.1":     {"mobile"},
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 13_3 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148":                               {"webview", "mobile"},
+		"Mozilla/5.0 (Linux; Android 10; Pixel 3 Build/QQ1A; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/80.0 Mobile Safari/537.36": {"webview", "mobile"},
+		"Mozilla/5.0 (Linux; Android 10; Pixel 3) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/80.0 Mobile Safari/537.36":                            {"mobile"},
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("User-Agent", ua)
+		assert.Equal(t, devices, requestDevices(req))
+	}
+}
+
+func TestWantsJSON(t *testing.T) {
+	for accept, expected := range map[string]bool{
+		"":                                  false,
+		"text/html,application/xhtml+xml":   false,
+		"application/json":                  true,
+		"application/json, text/plain, */*": true,
+		"*/*":                               false,
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", accept)
+		assert.Equal(t, expected, wantsJSON(req))
+	}
+}
+
+func TestIsPageNavigation(t *testing.T) {
+	for _, c := range []struct {
+		method, accept, requestedWith string
+		expected                      bool
+	}{
+		{"GET", "text/html,application/xhtml+xml,*/*;q=0.8", "", true},
+		{"HEAD", "application/xhtml+xml", "", true},
+		{"GET", "text/html", "XMLHttpRequest", false},
+		{"POST", "text/html", "", false},
+		{"GET", "*/*", "", false},
+		{"GET", "application/json", "", false},
+	} {
+		req, _ := http.NewRequest(c.method, "/", nil)
+		req.Header.Set("Accept", c.accept)
+		req.Header.Set("X-Requested-With", c.requestedWith)
+		assert.Equal(t, c.expected, isPageNavigation(req))
+	}
+}
+
+func TestTemplateVariant(t *testing.T) {
+	templates := template.Must(getTemplates().Parse(`
+{{define "error.mobile.html"}}mobile{{end}}
+{{define "error.fr.html"}}fr{{end}}
+{{define "error.fr.webview.html"}}fr webview{{end}}`))
+
+	for _, c := range []struct {
+		lang, ua, expected string
+	}{
+		{"", "", "error.html"},
+		{"de", "", "error.html"},
+		{"", "Android; wv)", "error.mobile.html"},
+		{"fr-CA", "", "error.fr.html"},
+		{"fr-CA", "iPhone", "error.fr.html"},
+		{"fr", "Android; wv)", "error.fr.webview.html"},
+		{"de, fr;q=0.5", "iPhone", "error.fr.html"},
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", c.lang)
+		req.Header.Set("User-Agent", c.ua)
+		assert.Equal(t, c.expected, templateVariant(templates, req, "error"))
+	}
+	req, _ := http.NewRequest("GET", "/", nil)
+	assert.Equal(t, "sign_in.html", templateVariant(templates, req, "sign_in"))
+}
+
+func TestLoadTemplateVariants(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "templates")
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		"sign_in.html":       `{{define "sign_in.html"}}sign in{{end}}`,
+		"error.html":         `{{define "error.html"}}error{{end}}`,
+		"error.webview.html": `{{define "error.webview.html"}}webview error{{end}}`,
+		"sign_in.es.html":    `{{define "sign_in.es.html"}}iniciar sesión{{end}}`,
+		"unrelated.html":     `{{define "unrelated.html"}}{{end}}`,
+	} {
+		ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644)
+	}
+	templates := loadTemplates(dir)
+	assert.NotEqual(t, nil, templates.Lookup("error.webview.html"))
+	assert.NotEqual(t, nil, templates.Lookup("sign_in.es.html"))
+	assert.Equal(t, (*template.Template)(nil), templates.Lookup("unrelated.html"))
+}
+
+func TestErrorPageJSON(t *testing.T) {
+	proxy := &OAuthProxy{templates: getTemplates(), ProxyPrefix: "/oauth2"}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	rw := httptest.NewRecorder()
+	proxy.ErrorPage(rw, req, 403, "Permission Denied", "Invalid Account")
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, "application/json", rw.HeaderMap.Get("Content-Type"))
+	assert.Equal(t, `{"code":403,"title":"Permission Denied","message":"Invalid Account"}`,
+		strings.TrimSpace(rw.Body.String()))
+
+	req.Header.Set("Accept", "text/html")
+	rw = httptest.NewRecorder()
+	proxy.ErrorPage(rw, req, 403, "Permission Denied", "Invalid Account")
+	assert.Equal(t, true, strings.Contains(rw.Body.String(), "<h2>403 Permission Denied</h2>"))
+}
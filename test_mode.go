@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/providers"
+)
+
+const (
+	// testIdentityHeader carries the identity test mode mints a session
+	// for, and testClockHeader the clock offset a request to the test clock
+	// endpoint sets, both signed with the test mode secret like a cookie
+	testIdentityHeader = "X-Test-Identity"
+	testClockHeader    = "X-Test-Clock"
+
+	// testModeSignatureMaxAge is how long a signed header is accepted after
+	// it was signed
+	testModeSignatureMaxAge = 5 * time.Minute
+
+	// testModeLifetime is how long the sessions test mode mints and
+	// refreshes last, unless the identity gives another expiry
+	testModeLifetime = time.Hour
+
+	// sessionProviderTestMode tags the sessions minted by test mode, which
+	// the test mode provider refreshes and validates
+	sessionProviderTestMode = "test-mode"
+	testModeAccessToken     = "test-mode"
+)
+
+// testIdentity is the JSON payload of the X-Test-Identity header
+type testIdentity struct {
+	Email        string   `json:"email"`
+	User         string   `json:"user,omitempty"`
+	Groups       []string `json:"groups,omitempty"`
+	ExpiresIn    int64    `json:"expires_in,omitempty"`
+	RefreshToken string   `json:"refresh_token,omitempty"`
+}
+
+// testMode mints sessions without an identity provider for integration
+// tests, when enabled with --unsafe-test-mode
+type testMode struct {
+	secret   string
+	provider providers.Provider
+}
+
+func newTestMode(secret string) *testMode {
+	return &testMode{
+		secret:   secret,
+		provider: providers.NewTestModeProvider(&providers.ProviderData{}, testModeLifetime),
+	}
+}
+
+// verify returns the value of the signed header name of req, or "" when it
+// is missing
+func (t *testMode) verify(req *http.Request, name string) (string, error) {
+	signed := req.Header.Get(name)
+	if signed == "" {
+		return "", nil
+	}
+	value, _, ok := cookie.Validate(&http.Cookie{Name: name, Value: signed}, t.secret, testModeSignatureMaxAge)
+	if !ok {
+		return "", fmt.Errorf("invalid or expired %s signature", name)
+	}
+	return value, nil
+}
+
+// session mints the session of the X-Test-Identity header of req, or
+// returns nil without one
+func (t *testMode) session(req *http.Request) (*providers.SessionState, error) {
+	value, err := t.verify(req, testIdentityHeader)
+	if value == "" || err != nil {
+		return nil, err
+	}
+	var id testIdentity
+	if err := json.Unmarshal([]byte(value), &id); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", testIdentityHeader, err)
+	}
+	if id.Email == "" && id.User == "" {
+		return nil, fmt.Errorf("invalid %s: missing email or user", testIdentityHeader)
+	}
+	expiresIn := testModeLifetime
+	if id.ExpiresIn != 0 {
+		expiresIn = time.Duration(id.ExpiresIn) * time.Second
+	}
+	return &providers.SessionState{
+		AccessToken:  testModeAccessToken,
+		ExpiresOn:    providers.Now().Add(expiresIn).Truncate(time.Second),
+		RefreshToken: id.RefreshToken,
+		Email:        id.Email,
+		User:         id.User,
+		Groups:       id.Groups,
+		Provider:     sessionProviderTestMode,
+	}, nil
+}
+
+// testModeSession is the session minted from the request's X-Test-Identity
+// header in test mode, or nil. The header isn't passed upstream.
+func (p *OAuthProxy) testModeSession(req *http.Request) *providers.SessionState {
+	if p.testMode == nil {
+		return nil
+	}
+	session, err := p.testMode.session(req)
+	req.Header.Del(testIdentityHeader)
+	if err != nil {
+		log.Printf("%s test mode: %s", getRemoteAddr(req), err)
+		return nil
+	}
+	if session != nil {
+		log.Printf("%s test mode: minted session for %s", getRemoteAddr(req), session)
+	}
+	return session
+}
+
+// TestClock reports the clock sessions expire and refresh against on GET,
+// and moves it on POST to the offset from the system clock given by the
+// signed X-Test-Clock header, ie. "2h", or "0" to reset it
+func (p *OAuthProxy) TestClock(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST":
+		value, err := p.testMode.verify(req, testClockHeader)
+		if value == "" && err == nil {
+			err = errors.New("missing " + testClockHeader)
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusForbidden)
+			return
+		}
+		offset, err := time.ParseDuration(value)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("invalid %s: %s", testClockHeader, err), http.StatusBadRequest)
+			return
+		}
+		providers.SetClockOffset(offset)
+		log.Printf("%s test mode: session clock moved %s ahead", getRemoteAddr(req), offset)
+	default:
+		rw.Header().Set("Allow", "GET, POST")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(struct {
+		Now    time.Time `json:"now"`
+		Offset string    `json:"offset"`
+	}{providers.Now().UTC(), providers.ClockOffset().String()})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/cookie"
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+const testModeTestSecret = "0123456789abcdef"
+
+func testModeProxy(t *testing.T) *OAuthProxy {
+	opts := testOptions()
+	opts.UnsafeTestMode = true
+	opts.TestModeSecret = testModeTestSecret
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.PassAccessToken = true
+	assert.Equal(t, nil, opts.Validate())
+	return NewOAuthProxy(opts, func(string) bool { return true })
+}
+
+func testIdentityRequest(t *testing.T, secret string, id testIdentity) *http.Request {
+	b, err := json.Marshal(id)
+	assert.Equal(t, nil, err)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(testIdentityHeader, cookie.SignedValue(secret, testIdentityHeader, string(b), time.Now()))
+	return req
+}
+
+func moveTestClock(t *testing.T, proxy *OAuthProxy, offset string) {
+	req := httptest.NewRequest("POST", "/oauth2/test/clock", nil)
+	req.Header.Set(testClockHeader, cookie.SignedValue(testModeTestSecret, testClockHeader, offset, time.Now()))
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+}
+
+func TestTestModeOptions(t *testing.T) {
+	o := testOptions()
+	o.UnsafeTestMode = true
+	o.TestModeSecret = "short"
+	assert.Equal(t, errorMsg([]string{"unsafe_test_mode requires a test_mode_secret of at least 16 bytes"}), o.Validate().Error())
+
+	o = testOptions()
+	o.TestModeSecret = testModeTestSecret
+	assert.Equal(t, errorMsg([]string{"test_mode_secret is only used with unsafe_test_mode"}), o.Validate().Error())
+}
+
+func TestTestModeMintsSessions(t *testing.T) {
+	proxy := testModeProxy(t)
+
+	req := testIdentityRequest(t, testModeTestSecret, testIdentity{Email: "tester@example.com", Groups: []string{"qa"}})
+	rw := httptest.NewRecorder()
+	status, session := proxy.authenticate(rw, req)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, "tester@example.com", session.Email)
+	assert.Equal(t, []string{"qa"}, session.Groups)
+	assert.Equal(t, "", req.Header.Get(testIdentityHeader))
+	assert.NotEqual(t, "", rw.Header().Get("Set-Cookie"))
+
+	// identities signed with another secret are ignored
+	req = testIdentityRequest(t, "another secret!!", testIdentity{Email: "tester@example.com"})
+	assert.Equal(t, http.StatusForbidden, proxy.Authenticate(httptest.NewRecorder(), req))
+
+	// and so are all identities without test mode
+	opts := testOptions()
+	assert.Equal(t, nil, opts.Validate())
+	proxy = NewOAuthProxy(opts, func(string) bool { return true })
+	req = testIdentityRequest(t, testModeTestSecret, testIdentity{Email: "tester@example.com"})
+	assert.Equal(t, http.StatusForbidden, proxy.Authenticate(httptest.NewRecorder(), req))
+	assert.Equal(t, "/oauth2/test/clock", proxy.TestClockPath)
+}
+
+func TestTestModeClock(t *testing.T) {
+	defer providers.SetClockOffset(0)
+	proxy := testModeProxy(t)
+
+	// mints a session, and returns a request carrying its cookie
+	signIn := func(refreshToken string) *http.Request {
+		req := testIdentityRequest(t, testModeTestSecret, testIdentity{Email: "tester@example.com", ExpiresIn: 60, RefreshToken: refreshToken})
+		rw := httptest.NewRecorder()
+		assert.Equal(t, http.StatusAccepted, proxy.Authenticate(rw, req))
+		req = httptest.NewRequest("GET", "/", nil)
+		for _, c := range rw.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		return req
+	}
+	expiring, refreshing, failing := signIn(""), signIn("refresh"), signIn(providers.TestModeRefreshFail)
+	assert.Equal(t, http.StatusAccepted, proxy.Authenticate(httptest.NewRecorder(), expiring))
+
+	moveTestClock(t, proxy, "2m")
+	assert.Equal(t, 2*time.Minute, providers.ClockOffset())
+	assert.Equal(t, http.StatusForbidden, proxy.Authenticate(httptest.NewRecorder(), expiring))
+	assert.Equal(t, http.StatusForbidden, proxy.Authenticate(httptest.NewRecorder(), failing))
+	status, session := proxy.authenticate(httptest.NewRecorder(), refreshing)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, true, session.ExpiresOn.After(providers.Now().Add(59*time.Minute)))
+
+	// the clock only moves with a valid signature
+	req := httptest.NewRequest("POST", "/oauth2/test/clock", nil)
+	req.Header.Set(testClockHeader, cookie.SignedValue("another secret!!", testClockHeader, "0", time.Now()))
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, 2*time.Minute, providers.ClockOffset())
+
+	moveTestClock(t, proxy, "0")
+	assert.Equal(t, http.StatusAccepted, proxy.Authenticate(httptest.NewRecorder(), expiring))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/uber/jaeger-client-go"
+	jaegercfg "github.com/uber/jaeger-client-go/config"
+	jaegerlog "github.com/uber/jaeger-client-go/log"
+	"github.com/uber/jaeger-lib/metrics"
+)
+
+// initTracer sets up the global tracer, which reports the sampled spans to
+// the Jaeger agent at JAEGER_AGENT_HOST and JAEGER_AGENT_PORT. With an OTLP
+// endpoint they are exported with OTLP too, along with the metrics.
+func initTracer(opts *Options) (io.Closer, error) {
+	traceHost := "localhost"
+	tracePort := "6831"
+	if jhost := os.Getenv("JAEGER_AGENT_HOST"); jhost != "" {
+		traceHost = jhost
+	}
+	if jport := os.Getenv("JAEGER_AGENT_PORT"); jport != "" {
+		tracePort = jport
+	}
+	jcfg := jaegercfg.Configuration{
+		Sampler: &jaegercfg.SamplerConfig{
+			Type:  jaeger.SamplerTypeProbabilistic,
+			Param: 1.0 / 100.0,
+		},
+		Reporter: &jaegercfg.ReporterConfig{
+			LogSpans:           false,
+			LocalAgentHostPort: traceHost + ":" + tracePort,
+		},
+	}
+
+	jLogger := jaegerlog.StdLogger
+	jMetricsFactory := metrics.NullFactory
+	options := []jaegercfg.Option{
+		jaegercfg.Logger(jLogger),
+		jaegercfg.Metrics(jMetricsFactory),
+		// requests are sampled by newTraceHandler, which forces sampling
+		// without marking traces as debug traces
+		jaegercfg.NoDebugFlagOnForcedSampling(true),
+	}
+	if opts.OTLPEndpoint == "" {
+		return jcfg.InitGlobalTracer("oauth2_proxy", options...)
+	}
+
+	exporter := newOTLPExporter(opts)
+	agent, err := jcfg.Reporter.NewReporter("oauth2_proxy", jaeger.NewMetrics(jMetricsFactory, nil), jLogger)
+	if err != nil {
+		return nil, err
+	}
+	spans := newOTLPSpanReporter(exporter)
+	options = append(options, jaegercfg.Reporter(jaeger.NewCompositeReporter(agent, spans)))
+	closer, err := jcfg.InitGlobalTracer("oauth2_proxy", options...)
+	if err != nil {
+		spans.Close()
+		return nil, err
+	}
+	return otlpCloser{
+		tracer:  closer,
+		metrics: newOTLPMetricsExporter(exporter, prometheus.DefaultGatherer, opts.OTLPMetricsInterval),
+	}, nil
+}
+
+// otlpCloser closes the tracer, which exports its pending spans, and
+// exports the metrics a last time
+type otlpCloser struct {
+	tracer  io.Closer
+	metrics *otlpMetricsExporter
+}
+
+func (c otlpCloser) Close() error {
+	err := c.tracer.Close()
+	c.metrics.Close()
+	return err
+}
+
+// traceRoute is the sampling rate of the requests whose path matches
+type traceRoute struct {
+	path *regexp.Regexp
+	rate float64
+}
+
+// traceSampler decides which requests are traced before their span starts:
+// those matching a route at its rate, then the sign in and auth endpoints,
+// then the rest at the default rate. Requests continuing a trace follow its
+// decision, and responses with a server error are always traced.
+type traceSampler struct {
+	routes    []traceRoute
+	rate      float64
+	authPaths []string
+	// random is overridden in tests
+	random func() float64
+}
+
+func newTraceSampler(opts *Options) *traceSampler {
+	s := &traceSampler{
+		routes: opts.traceRoutes,
+		rate:   opts.TraceSampleRate,
+		random: rand.Float64,
+	}
+	for _, endpoint := range []string{"sign_in", "sign_out", "start", "callback", "auth", "silent", "guest"} {
+		s.authPaths = append(s.authPaths, opts.ProxyPrefix+"/"+endpoint)
+	}
+	return s
+}
+
+// rateFor returns the sampling rate of the requests for path
+func (s *traceSampler) rateFor(path string) float64 {
+	for _, r := range s.routes {
+		if r.path.MatchString(path) {
+			return r.rate
+		}
+	}
+	for _, authPath := range s.authPaths {
+		if path == authPath || strings.HasPrefix(path, authPath+"/") {
+			return 1
+		}
+	}
+	return s.rate
+}
+
+func (s *traceSampler) sample(path string) bool {
+	rate := s.rateFor(path)
+	return rate >= 1 || (rate > 0 && s.random() < rate)
+}
+
+// traceHandler starts a server span for each request, with the sampling
+// decision of sampler, like nethttp.Middleware does with the tracer's
+type traceHandler struct {
+	tracer  opentracing.Tracer
+	sampler *traceSampler
+	handler http.Handler
+}
+
+func newTraceHandler(tracer opentracing.Tracer, sampler *traceSampler, h http.Handler) http.Handler {
+	return traceHandler{tracer: tracer, sampler: sampler, handler: h}
+}
+
+func (h traceHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	parent, _ := h.tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+	options := []opentracing.StartSpanOption{ext.RPCServerOption(parent)}
+	if parent == nil {
+		priority := uint16(0)
+		if h.sampler.sample(req.URL.Path) {
+			priority = 1
+		}
+		options = append(options, opentracing.Tag{Key: string(ext.SamplingPriority), Value: priority})
+	}
+	span := h.tracer.StartSpan("HTTP "+req.Method, options...)
+	defer span.Finish()
+	ext.HTTPMethod.Set(span, req.Method)
+	ext.HTTPUrl.Set(span, req.URL.String())
+	ext.Component.Set(span, "net/http")
+
+	w := &traceResponseWriter{ResponseWriter: rw, status: http.StatusOK}
+	h.handler.ServeHTTP(w, req.WithContext(opentracing.ContextWithSpan(req.Context(), span)))
+	ext.HTTPStatusCode.Set(span, uint16(w.status))
+	if w.status >= http.StatusInternalServerError {
+		ext.Error.Set(span, true)
+		// keeps the request's span, though spans it started that already
+		// finished unsampled are lost
+		ext.SamplingPriority.Set(span, 1)
+	}
+}
+
+// traceResponseWriter records the status of a response
+type traceResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *traceResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *traceResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *traceResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *traceResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("webserver doesn't support hijacking")
+	}
+	return hijacker.Hijack()
+}
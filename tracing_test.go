@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/uber/jaeger-client-go"
+)
+
+func TestTraceSampler(t *testing.T) {
+	opts := testOptions()
+	opts.TraceSampleRoutes = []string{"^/reports/=0.5", "^/oauth2/auth$=0"}
+	assert.Equal(t, nil, opts.Validate())
+	s := newTraceSampler(opts)
+
+	assert.Equal(t, 0.01, s.rateFor("/app"))
+	assert.Equal(t, 0.5, s.rateFor("/reports/daily"))
+	assert.Equal(t, 1.0, s.rateFor("/oauth2/callback"))
+	assert.Equal(t, 1.0, s.rateFor("/oauth2/sign_in"))
+	assert.Equal(t, 0.0, s.rateFor("/oauth2/auth"))
+	assert.Equal(t, 0.01, s.rateFor("/oauth2/metrics"))
+	assert.Equal(t, 0.01, s.rateFor("/oauth2/starter"))
+
+	s.random = func() float64 { return 0.3 }
+	assert.Equal(t, true, s.sample("/reports/daily"))
+	assert.Equal(t, false, s.sample("/app"))
+	assert.Equal(t, false, s.sample("/oauth2/auth"))
+}
+
+func TestTraceHandler(t *testing.T) {
+	reporter := jaeger.NewInMemoryReporter()
+	tracer, closer := jaeger.NewTracer("oauth2_proxy", jaeger.NewConstSampler(false), reporter,
+		jaeger.TracerOptions.NoDebugFlagOnForcedSampling(true))
+	defer closer.Close()
+
+	opts := testOptions()
+	opts.TraceSampleRate = 0
+	assert.Equal(t, nil, opts.Validate())
+	var childSampled bool
+	h := newTraceHandler(tracer, newTraceSampler(opts), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		child := tracer.StartSpan("child", opentracing.ChildOf(opentracing.SpanFromContext(req.Context()).Context()))
+		childSampled = child.Context().(jaeger.SpanContext).IsSampled()
+		child.Finish()
+		if req.URL.Path == "/broken" {
+			rw.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	var parent opentracing.Span
+	traced := func(path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		if parent != nil {
+			tracer.Inject(parent.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+		}
+		reporter.Reset()
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		return len(reporter.GetSpans())
+	}
+
+	assert.Equal(t, 0, traced("/app"))
+	assert.Equal(t, false, childSampled)
+	assert.Equal(t, 2, traced("/oauth2/callback"))
+	assert.Equal(t, true, childSampled)
+	// the request span of a server error is kept
+	assert.Equal(t, 1, traced("/broken"))
+	span := reporter.GetSpans()[0].(*jaeger.Span)
+	assert.Equal(t, false, span.SpanContext().IsDebug())
+	assert.Equal(t, "HTTP GET", span.OperationName())
+
+	// requests continuing a trace follow its sampling decision
+	parent = tracer.StartSpan("client", opentracing.Tag{Key: "sampling.priority", Value: uint16(1)})
+	assert.Equal(t, 2, traced("/app"))
+	parent = tracer.StartSpan("client")
+	assert.Equal(t, 0, traced("/oauth2/callback"))
+}
+
+func TestTraceSamplingOptions(t *testing.T) {
+	o := testOptions()
+	o.TraceSampleRate = 2
+	o.TraceSampleRoutes = []string{"^/app/", "^/app/=1.5", "(=0.5"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	expected := errorMsg([]string{
+		"trace_sample_rate must be between 0 and 1",
+		`invalid trace-sample-route="^/app/", expected <path regex>=<rate>`,
+		`invalid trace-sample-route="^/app/=1.5", the rate must be between 0 and 1`,
+		"error compiling trace-sample-route=\"(=0.5\" error parsing regexp: missing closing ): `(`",
+	})
+	assert.Equal(t, expected, err.Error())
+}
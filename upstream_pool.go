@@ -0,0 +1,448 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	upstreamBalanceRoundRobin = "round-robin"
+	upstreamBalanceLeastConn  = "least-conn"
+	upstreamBalanceSticky     = "sticky"
+
+	// upstreamHealthMaxTimeout bounds how long an active health check waits
+	// for an upstream, when the interval is longer
+	upstreamHealthMaxTimeout = 5 * time.Second
+)
+
+var upstreamHealthyGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "upstream_healthy",
+	Help: "Whether an upstream sharing its path with others is in rotation.",
+}, []string{"backend"})
+
+func init() {
+	prometheus.MustRegister(upstreamHealthyGauge)
+}
+
+// upstreamHealth configures how the upstreams of a pool are health checked
+type upstreamHealth struct {
+	// path is requested from every upstream each interval when set
+	path     string
+	interval time.Duration
+	// maxFails consecutive failed requests take an upstream out of rotation
+	// until it passes a health check, or for interval without them
+	maxFails int
+}
+
+// poolBackend is an upstream of a pool, with its requests in flight and
+// health
+type poolBackend struct {
+	*UpstreamProxy
+	active int64
+
+	mu        sync.Mutex
+	fails     int
+	down      bool
+	downUntil time.Time
+}
+
+func (b *poolBackend) healthy(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down && !b.downUntil.IsZero() && !now.Before(b.downUntil) {
+		b.setDown(false, "ejection period over")
+	}
+	return !b.down
+}
+
+// setDown moves the backend in or out of rotation, and must be called with
+// mu held
+func (b *poolBackend) setDown(down bool, reason string) {
+	if b.down == down {
+		return
+	}
+	b.down = down
+	b.fails = 0
+	if down {
+		log.Printf("taking upstream %q out of rotation: %s", b.upstream.Host, reason)
+		upstreamHealthyGauge.WithLabelValues(b.upstream.Host).Set(0)
+	} else {
+		log.Printf("putting upstream %q back in rotation: %s", b.upstream.Host, reason)
+		b.downUntil = time.Time{}
+		upstreamHealthyGauge.WithLabelValues(b.upstream.Host).Set(1)
+	}
+}
+
+// upstreamPool spreads the requests for a path across several upstreams,
+// either in turn, to the one with the fewest requests in flight, or to the
+// one each user is pinned to, skipping the unhealthy ones. When none is
+// healthy, all of them are tried.
+type upstreamPool struct {
+	next      uint64
+	leastConn bool
+	sticky    bool
+	health    upstreamHealth
+	timeout   time.Duration
+
+	// mu guards backends, which change when they are discovered
+	mu       sync.RWMutex
+	backends []*poolBackend
+}
+
+func newUpstreamPool(upstreams []*UpstreamProxy, balance string, health upstreamHealth) *upstreamPool {
+	p := &upstreamPool{
+		leastConn: balance == upstreamBalanceLeastConn,
+		sticky:    balance == upstreamBalanceSticky,
+		health:    health,
+		timeout:   health.interval,
+	}
+	if p.timeout > upstreamHealthMaxTimeout {
+		p.timeout = upstreamHealthMaxTimeout
+	}
+	p.setBackends(upstreams)
+	return p
+}
+
+// setBackends replaces the upstreams of the pool. Upstreams it already has
+// keep their health and requests in flight.
+func (p *upstreamPool) setBackends(upstreams []*UpstreamProxy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	existing := make(map[string]*poolBackend, len(p.backends))
+	for _, b := range p.backends {
+		existing[b.upstream.Host] = b
+	}
+	backends := make([]*poolBackend, 0, len(upstreams))
+	for _, u := range upstreams {
+		if b, ok := existing[u.upstream.Host]; ok {
+			backends = append(backends, b)
+			delete(existing, u.upstream.Host)
+			continue
+		}
+		backends = append(backends, &poolBackend{UpstreamProxy: u})
+		upstreamHealthyGauge.WithLabelValues(u.upstream.Host).Set(1)
+	}
+	for host := range existing {
+		upstreamHealthyGauge.DeleteLabelValues(host)
+	}
+	p.backends = backends
+}
+
+func (p *upstreamPool) snapshot() []*poolBackend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.backends
+}
+
+// pick chooses the backend for a request, or returns nil when the pool has
+// none. Least connections breaks ties in turn, so idle backends share the
+// load too.
+func (p *upstreamPool) pick() *poolBackend {
+	candidates := p.candidates()
+	if len(candidates) == 0 {
+		return nil
+	}
+	start := int(atomic.AddUint64(&p.next, 1)-1) % len(candidates)
+	if !p.leastConn {
+		return candidates[start]
+	}
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		b := candidates[(start+i)%len(candidates)]
+		if atomic.LoadInt64(&b.active) < atomic.LoadInt64(&best.active) {
+			best = b
+		}
+	}
+	return best
+}
+
+// candidates are the healthy backends, or all of them when none is
+func (p *upstreamPool) candidates() []*poolBackend {
+	now := time.Now()
+	backends := p.snapshot()
+	candidates := make([]*poolBackend, 0, len(backends))
+	for _, b := range backends {
+		if b.healthy(now) {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		return backends
+	}
+	return candidates
+}
+
+// pickFor chooses the backend for a request with the affinity key, which
+// sticky pools pin to the candidate with the highest rendezvous hash of it.
+// When that backend goes out of rotation only its users are pinned to
+// others, and they return once it's back.
+func (p *upstreamPool) pickFor(key string) *poolBackend {
+	if !p.sticky {
+		return p.pick()
+	}
+	var best *poolBackend
+	var bestScore uint64
+	for _, b := range p.candidates() {
+		if score := rendezvousScore(key, b.upstream.Host); best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+func rendezvousScore(key, host string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(host))
+	// fnv spreads similar keys poorly, so finish with the splitmix64 mixer
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+type affinityKeyType struct{}
+
+// withAffinityKey carries the key sticky pools pin the request's user by
+func withAffinityKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, affinityKeyType{}, key)
+}
+
+// affinityKey is the key set by withAffinityKey, or the client IP for
+// requests without a session
+func affinityKey(r *http.Request) string {
+	if key, ok := r.Context().Value(affinityKeyType{}).(string); ok && key != "" {
+		return key
+	}
+	return clientIP(r)
+}
+
+func (p *upstreamPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b := p.pickFor(affinityKey(r))
+	if b == nil {
+		log.Printf("no upstreams to proxy %s to", r.URL.Path)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	atomic.AddInt64(&b.active, 1)
+	defer atomic.AddInt64(&b.active, -1)
+	rw := &poolResponseWriter{ResponseWriter: w}
+	b.ServeHTTP(rw, r)
+	p.record(b, rw.status)
+}
+
+// record counts a gateway error from an upstream, or resets its count.
+// Upstreams are taken out of rotation after health.maxFails in a row.
+func (p *upstreamPool) record(b *poolBackend, status int) {
+	if p.health.maxFails <= 0 {
+		return
+	}
+	failed := status == http.StatusBadGateway || status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.fails = 0
+		return
+	}
+	b.fails++
+	if b.fails < p.health.maxFails || b.down {
+		return
+	}
+	b.setDown(true, fmt.Sprintf("%d failed requests in a row", b.fails))
+	if p.health.path == "" {
+		b.downUntil = time.Now().Add(p.health.interval)
+	}
+}
+
+// checkHealth requests the health check path from every backend, putting
+// those that answer with a success or redirect in rotation, and taking the
+// others out
+func (p *upstreamPool) checkHealth() {
+	var wg sync.WaitGroup
+	for _, b := range p.snapshot() {
+		wg.Add(1)
+		go func(b *poolBackend) {
+			defer wg.Done()
+			err := p.probe(b)
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if err != nil {
+				b.setDown(true, fmt.Sprintf("health check failed: %s", err))
+			} else {
+				b.setDown(false, "health check passed")
+			}
+		}(b)
+	}
+	wg.Wait()
+}
+
+// probe requests the health check path from a backend, through its own
+// transport so its TLS and dial settings apply
+func (p *upstreamPool) probe(b *poolBackend) error {
+	u := b.upstream
+	u.Path = p.health.path
+	u.RawQuery = ""
+	client := &http.Client{Timeout: p.timeout}
+	if rp, ok := b.handler.(*httputil.ReverseProxy); ok {
+		client.Transport = rp.Transport
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// startHealthChecks checks the backends every interval, until done is closed
+func (p *upstreamPool) startHealthChecks(done <-chan bool) {
+	go func() {
+		for {
+			p.checkHealth()
+			select {
+			case <-done:
+				return
+			case <-time.After(p.health.interval):
+			}
+		}
+	}()
+}
+
+// poolResponseWriter records the status of a response, so gateway errors
+// count against the upstream
+type poolResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *poolResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *poolResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *poolResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *poolResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("webserver doesn't support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// upstreamPools collects the http and https upstreams by path, so that
+// paths served by several of them are balanced across them, and the srv
+// upstreams whose backends are discovered. Health checks and lookups stop
+// once done is closed.
+type upstreamPools struct {
+	balance  string
+	health   upstreamHealth
+	paths    []string
+	backends map[string][]*UpstreamProxy
+	srv      map[string]*srvUpstream
+	done     <-chan bool
+}
+
+func newUpstreamPools(balance string, health upstreamHealth, done <-chan bool) *upstreamPools {
+	return &upstreamPools{
+		balance:  balance,
+		health:   health,
+		backends: make(map[string][]*UpstreamProxy),
+		srv:      make(map[string]*srvUpstream),
+		done:     done,
+	}
+}
+
+func (p *upstreamPools) Add(path string, u *UpstreamProxy) {
+	if _, ok := p.backends[path]; !ok {
+		p.paths = append(p.paths, path)
+	}
+	p.backends[path] = append(p.backends[path], u)
+}
+
+// AddSRV serves path from the backends of an srv upstream, which must be
+// the only upstream of the path
+func (p *upstreamPools) AddSRV(path string, s *srvUpstream) {
+	p.paths = append(p.paths, path)
+	p.srv[path] = s
+}
+
+// Register maps each path to its upstream, or to a pool of them. A pool
+// takes the name and tag given to one of its upstreams, which all of them
+// report.
+func (p *upstreamPools) Register(mux *http.ServeMux) {
+	for _, path := range p.paths {
+		if s, ok := p.srv[path]; ok {
+			pool := newUpstreamPool(nil, p.balance, p.health)
+			s.start(pool, p.done)
+			p.startHealthChecks(path, pool)
+			mux.Handle(path, &UpstreamProxy{
+				upstream: url.URL{Scheme: "srv", Host: s.record},
+				name:     s.name,
+				pool:     pool,
+			})
+			continue
+		}
+		backends := p.backends[path]
+		if len(backends) == 1 {
+			mux.Handle(path, backends[0])
+			continue
+		}
+		var name, tag string
+		for _, b := range backends {
+			if b.name != "" {
+				name, tag = b.name, b.tag
+			}
+		}
+		for _, b := range backends {
+			b.name, b.tag = name, tag
+		}
+		log.Printf("balancing path %q across %d upstreams (%s)", path, len(backends), p.balance)
+		pool := newUpstreamPool(backends, p.balance, p.health)
+		p.startHealthChecks(path, pool)
+		mux.Handle(path, &UpstreamProxy{
+			upstream: backends[0].upstream,
+			name:     name,
+			pool:     pool,
+		})
+	}
+}
+
+func (p *upstreamPools) startHealthChecks(path string, pool *upstreamPool) {
+	if p.health.path == "" {
+		return
+	}
+	log.Printf("health checking the upstreams of path %q at %q every %s", path, p.health.path, p.health.interval)
+	pool.startHealthChecks(p.done)
+}
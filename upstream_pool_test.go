@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitly/oauth2_proxy/providers"
+	"github.com/bmizerany/assert"
+)
+
+func TestUpstreamPoolOptions(t *testing.T) {
+	o := testOptions()
+	o.UpstreamBalance = "random"
+	o.UpstreamHealthPath = "healthz"
+	o.UpstreamHealthInterval = 0
+	o.UpstreamMaxFails = -1
+	o.Upstreams = []string{
+		"http://10.0.0.5:8080/api/?name=api",
+		"http://10.0.0.6:8080/api/?name=api-2",
+		"http://10.0.0.7:8080/static/",
+		"file:///var/www/#/static/",
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	for _, msg := range []string{
+		`upstream_balance must be "round-robin", "least-conn" or "sticky"`,
+		`only one of the upstreams for path "/api/" may be named`,
+		`path "/static/" has several upstreams, which is only supported for http, https and h2c upstreams`,
+		`upstream_health_path "healthz" must start with /`,
+		"upstream_health_interval must be at least 1s",
+		"upstream_max_fails must not be negative",
+	} {
+		assert.Equal(t, true, strings.Contains(err.Error(), msg))
+	}
+}
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+	var hits []string
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits = append(hits, name)
+		}))
+	}
+	a, b := backend("a"), backend("b")
+	defer a.Close()
+	defer b.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{a.URL + "/api/?name=api", b.URL + "/api/"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest("GET", "/api/items", nil)
+		rw := httptest.NewRecorder()
+		proxy.serveMux.ServeHTTP(rw, req)
+		assert.Equal(t, 200, rw.Code)
+		assert.Equal(t, "api", rw.HeaderMap.Get("GAP-Upstream-Address"))
+	}
+	assert.Equal(t, []string{"a", "b", "a", "b"}, hits)
+	assert.Equal(t, "api", proxy.upstreamFor("/api/items").name)
+}
+
+func testPoolBackends(n int) []*UpstreamProxy {
+	var backends []*UpstreamProxy
+	for i := 0; i < n; i++ {
+		u, _ := url.Parse(fmt.Sprintf("http://10.0.0.%d:8080", i+1))
+		backends = append(backends, &UpstreamProxy{upstream: *u})
+	}
+	return backends
+}
+
+func TestUpstreamPoolLeastConn(t *testing.T) {
+	pool := newUpstreamPool(testPoolBackends(3), upstreamBalanceLeastConn, upstreamHealth{})
+	b := pool.backends
+	b[0].active, b[1].active, b[2].active = 2, 0, 1
+	assert.Equal(t, b[1], pool.pick())
+	assert.Equal(t, b[1], pool.pick())
+	b[0].active, b[1].active, b[2].active = 1, 1, 1
+	// ties are broken in turn
+	assert.Equal(t, b[2], pool.pick())
+	assert.Equal(t, b[0], pool.pick())
+}
+
+func TestUpstreamPoolSticky(t *testing.T) {
+	pool := newUpstreamPool(testPoolBackends(3), upstreamBalanceSticky,
+		upstreamHealth{interval: time.Minute, maxFails: 1})
+	b := pool.backends
+
+	pinned := make(map[string]*poolBackend)
+	used := make(map[*poolBackend]int)
+	for i := 0; i < 300; i++ {
+		user := fmt.Sprintf("user%d@example.com", i)
+		pinned[user] = pool.pickFor(user)
+		used[pinned[user]]++
+		assert.Equal(t, pinned[user], pool.pickFor(user))
+	}
+	// users are spread across the backends
+	for _, backend := range b {
+		assert.Equal(t, true, used[backend] > 50)
+	}
+
+	// only the users of a backend taken out of rotation move, until it's back
+	pool.record(b[0], http.StatusBadGateway)
+	for user, backend := range pinned {
+		if backend == b[0] {
+			assert.NotEqual(t, b[0], pool.pickFor(user))
+		} else {
+			assert.Equal(t, backend, pool.pickFor(user))
+		}
+	}
+	b[0].mu.Lock()
+	b[0].setDown(false, "health check passed")
+	b[0].mu.Unlock()
+	for user, backend := range pinned {
+		assert.Equal(t, backend, pool.pickFor(user))
+	}
+}
+
+func TestUpstreamPoolStickyProxy(t *testing.T) {
+	var hits []string
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits = append(hits, name)
+		}))
+	}
+	a, b := backend("a"), backend("b")
+	defer a.Close()
+	defer b.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{a.URL + "/api/", b.URL + "/api/"}
+	opts.UpstreamBalance = upstreamBalanceSticky
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	for i := 0; i < 4; i++ {
+		// each refresh of the session gets a new cookie
+		session := &providers.SessionState{Email: "user@example.com", AccessToken: fmt.Sprint(i)}
+		value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+		assert.Equal(t, nil, err)
+		req := httptest.NewRequest("GET", "/api/items", nil)
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 200, rw.Code)
+	}
+	assert.Equal(t, 4, len(hits))
+	for _, hit := range hits {
+		assert.Equal(t, hits[0], hit)
+	}
+}
+
+func TestUpstreamPoolPassiveHealth(t *testing.T) {
+	pool := newUpstreamPool(testPoolBackends(2), upstreamBalanceRoundRobin,
+		upstreamHealth{interval: time.Minute, maxFails: 2})
+	b := pool.backends
+
+	pool.record(b[0], http.StatusBadGateway)
+	pool.record(b[0], http.StatusOK)
+	pool.record(b[0], http.StatusBadGateway)
+	assert.Equal(t, true, b[0].healthy(time.Now()))
+	pool.record(b[0], http.StatusGatewayTimeout)
+	assert.Equal(t, false, b[0].healthy(time.Now()))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, b[1], pool.pick())
+	}
+	// without active health checks it is back after the interval
+	assert.Equal(t, true, b[0].healthy(time.Now().Add(time.Minute)))
+
+	// all of them are tried when none is healthy
+	for _, backend := range b {
+		pool.record(backend, http.StatusServiceUnavailable)
+		pool.record(backend, http.StatusServiceUnavailable)
+	}
+	assert.Equal(t, b[1], pool.pick())
+	assert.Equal(t, b[0], pool.pick())
+}
+
+func TestUpstreamPoolActiveHealth(t *testing.T) {
+	healthy := true
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/healthz", r.URL.Path)
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer up.Close()
+
+	backends := testPoolBackends(1)
+	u, _ := url.Parse(up.URL)
+	backends = append(backends, &UpstreamProxy{upstream: *u})
+	// nothing listens on the first backend
+	backends[0].upstream.Host = "127.0.0.1:1"
+	pool := newUpstreamPool(backends, upstreamBalanceRoundRobin,
+		upstreamHealth{path: "/healthz", interval: time.Second, maxFails: 3})
+
+	pool.checkHealth()
+	assert.Equal(t, false, pool.backends[0].healthy(time.Now()))
+	assert.Equal(t, true, pool.backends[1].healthy(time.Now()))
+
+	// ejected upstreams only come back by passing a health check
+	healthy = false
+	pool.checkHealth()
+	assert.Equal(t, false, pool.backends[1].healthy(time.Now().Add(time.Hour)))
+	healthy = true
+	pool.checkHealth()
+	assert.Equal(t, true, pool.backends[1].healthy(time.Now()))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// srvLookupTimeout bounds how long a lookup of the SRV records of an
+// upstream may take
+const srvLookupTimeout = 5 * time.Second
+
+var (
+	srvBackendsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "upstream_srv_backends",
+		Help: "Upstreams discovered from the SRV records of an srv upstream.",
+	}, []string{"record"})
+	srvLookupErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "upstream_srv_lookup_errors_total",
+		Help: "Failed or empty lookups of the SRV records of an srv upstream.",
+	}, []string{"record"})
+)
+
+func init() {
+	prometheus.MustRegister(srvBackendsGauge)
+	prometheus.MustRegister(srvLookupErrorsCounter)
+}
+
+// srvUpstream discovers the upstreams of a path from the SRV records of a
+// name, ie. a Consul service, and keeps the pool serving the path up to
+// date as they change. Only the records of the lowest priority are used.
+// When a lookup fails or finds no records, the upstreams already discovered
+// are kept.
+type srvUpstream struct {
+	// record is the name whose SRV records are looked up
+	record string
+	// name is the name given to the upstream, if any
+	name string
+	// template is the URL of the upstreams, without their host
+	template url.URL
+	interval time.Duration
+	build    func(*url.URL) *UpstreamProxy
+	// lookup is overridden in tests
+	lookup func(ctx context.Context, record string) ([]*net.SRV, error)
+
+	pool  *upstreamPool
+	hosts []string
+}
+
+// newSRVUpstream returns the srv upstream for u. Upstreams are requested
+// over http, or the scheme given as u's scheme query parameter, and built
+// with build.
+func newSRVUpstream(u *url.URL, name string, interval time.Duration, build func(*url.URL) *UpstreamProxy) *srvUpstream {
+	template := *u
+	params := template.Query()
+	template.Scheme = params.Get("scheme")
+	if template.Scheme == "" {
+		template.Scheme = "http"
+	}
+	params.Del("scheme")
+	template.RawQuery = params.Encode()
+	template.Host = ""
+	return &srvUpstream{
+		record:   u.Hostname(),
+		name:     name,
+		template: template,
+		interval: interval,
+		build:    build,
+		lookup:   lookupSRV,
+	}
+}
+
+func lookupSRV(ctx context.Context, record string) ([]*net.SRV, error) {
+	_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", record)
+	return addrs, err
+}
+
+// start looks the upstreams of pool up, and then again every interval until
+// done is closed
+func (s *srvUpstream) start(pool *upstreamPool, done <-chan bool) {
+	s.pool = pool
+	s.refresh()
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(s.interval):
+			}
+			s.refresh()
+		}
+	}()
+}
+
+// refresh looks the SRV records up, and updates the upstreams of the pool
+// when they changed
+func (s *srvUpstream) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), srvLookupTimeout)
+	defer cancel()
+	records, err := s.lookup(ctx, s.record)
+	if err == nil && len(records) == 0 {
+		err = errors.New("no records")
+	}
+	if err != nil {
+		srvLookupErrorsCounter.WithLabelValues(s.record).Inc()
+		log.Printf("looking up SRV records of %q: %s, keeping %d upstreams", s.record, err, len(s.hosts))
+		return
+	}
+
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, r := range records {
+		if r.Priority != records[0].Priority {
+			continue
+		}
+		host := net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	if equalStrings(hosts, s.hosts) {
+		return
+	}
+
+	log.Printf("SRV records of %q point to upstreams %s", s.record, strings.Join(hosts, ", "))
+	upstreams := make([]*UpstreamProxy, 0, len(hosts))
+	for _, host := range hosts {
+		u := s.template
+		u.Host = host
+		upstreams = append(upstreams, s.build(&u))
+	}
+	s.pool.setBackends(upstreams)
+	s.hosts = hosts
+	srvBackendsGauge.WithLabelValues(s.record).Set(float64(len(hosts)))
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSRVUpstreamOptions(t *testing.T) {
+	o := testOptions()
+	o.UpstreamSRVInterval = 0
+	o.Upstreams = []string{
+		"srv://app.service.consul:8080/app/",
+		"srv://app.service.consul/api/?scheme=ftp",
+		"srv://app.service.consul/web/?dial_address=10.0.0.5:80&tls_server_name=app.example.com",
+		"srv://app.service.consul/shared/",
+		"http://10.0.0.5:8080/shared/",
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	for _, msg := range []string{
+		`srv upstream "srv://app.service.consul:8080/app/" can't have a port, it comes from the SRV records`,
+		`invalid scheme "ftp" for srv upstream "srv://app.service.consul/api/?scheme=ftp"`,
+		`tls_server_name is only supported for https upstreams: "srv://app.service.consul/web/"`,
+		`dial_address isn't supported for srv upstreams: "srv://app.service.consul/web/"`,
+		`path "/shared/" has several upstreams, which is only supported for http, https and h2c upstreams`,
+		"upstream_srv_interval must be at least 1s",
+	} {
+		assert.Equal(t, true, strings.Contains(err.Error(), msg))
+	}
+
+	o = testOptions()
+	o.Upstreams = []string{"srv://app.service.consul/?scheme=https&tls_server_name=app.example.com"}
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestSRVUpstreamDiscovery(t *testing.T) {
+	var hits []string
+	backend := func(name string) (*httptest.Server, *net.SRV) {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits = append(hits, name+" "+r.URL.Path)
+		}))
+		_, port, _ := net.SplitHostPort(strings.TrimPrefix(s.URL, "http://"))
+		p, _ := strconv.Atoi(port)
+		return s, &net.SRV{Target: "127.0.0.1.", Port: uint16(p), Priority: 1}
+	}
+	a, recordA := backend("a")
+	b, recordB := backend("b")
+	defer a.Close()
+	defer b.Close()
+	backup := &net.SRV{Target: "10.0.0.9.", Port: 80, Priority: 2}
+
+	records := []*net.SRV{recordA, recordB, backup}
+	var lookupErr error
+	u, _ := url.Parse("srv://app.service.consul")
+	s := newSRVUpstream(u, "app", time.Hour, func(u *url.URL) *UpstreamProxy {
+		return &UpstreamProxy{upstream: *u, handler: NewReverseProxy(u, nil)}
+	})
+	s.lookup = func(_ context.Context, record string) ([]*net.SRV, error) {
+		assert.Equal(t, "app.service.consul", record)
+		return records, lookupErr
+	}
+	assert.Equal(t, "app.service.consul", s.record)
+	assert.Equal(t, "http", s.template.Scheme)
+
+	pool := newUpstreamPool(nil, upstreamBalanceRoundRobin, upstreamHealth{})
+	rw := httptest.NewRecorder()
+	pool.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+
+	s.pool = pool
+	s.refresh()
+	// records of a lower priority are only used when the others are gone
+	assert.Equal(t, 2, len(pool.snapshot()))
+	for i := 0; i < 4; i++ {
+		pool.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/items", nil))
+	}
+	sort.Strings(hits)
+	assert.Equal(t, []string{"a /items", "a /items", "b /items", "b /items"}, hits)
+
+	records = []*net.SRV{recordB}
+	var kept *poolBackend
+	for _, backend := range pool.snapshot() {
+		if backend.upstream.Host == strings.TrimPrefix(b.URL, "http://") {
+			kept = backend
+		}
+	}
+	s.refresh()
+	assert.Equal(t, 1, len(pool.snapshot()))
+	// upstreams still listed keep their state
+	assert.Equal(t, kept, pool.snapshot()[0])
+
+	lookupErr = errors.New("no such host")
+	s.refresh()
+	records, lookupErr = nil, nil
+	s.refresh()
+	assert.Equal(t, 1, len(pool.snapshot()))
+	hits = nil
+	pool.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/items", nil))
+	assert.Equal(t, []string{"b /items"}, hits)
+}
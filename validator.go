@@ -7,9 +7,14 @@ import (
 	"os"
 	"strings"
 	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
+// UserMap holds the addresses of the authenticated emails file. An entry may
+// be time-boxed with an expires field, ie. "contractor@example.com,
+// expires=2024-12-31", which is valid through that day in UTC, or through an
+// RFC 3339 time.
 type UserMap struct {
 	usersFile string
 	m         unsafe.Pointer
@@ -17,7 +22,7 @@ type UserMap struct {
 
 func NewUserMap(usersFile string, done <-chan bool, onUpdate func()) *UserMap {
 	um := &UserMap{usersFile: usersFile}
-	m := make(map[string]bool)
+	m := make(map[string]time.Time)
 	atomic.StorePointer(&um.m, unsafe.Pointer(&m))
 	if usersFile != "" {
 		log.Printf("using authenticated emails file %s", usersFile)
@@ -30,10 +35,21 @@ func NewUserMap(usersFile string, done <-chan bool, onUpdate func()) *UserMap {
 	return um
 }
 
-func (um *UserMap) IsValid(email string) (result bool) {
-	m := *(*map[string]bool)(atomic.LoadPointer(&um.m))
-	_, result = m[email]
-	return
+func (um *UserMap) IsValid(email string) bool {
+	expires, ok := um.lookup(email)
+	return ok && (expires.IsZero() || time.Now().Before(expires))
+}
+
+// IsExpired tells whether email is only denied because its entry expired
+func (um *UserMap) IsExpired(email string) bool {
+	expires, ok := um.lookup(email)
+	return ok && !expires.IsZero() && !time.Now().Before(expires)
+}
+
+func (um *UserMap) lookup(email string) (time.Time, bool) {
+	m := *(*map[string]time.Time)(atomic.LoadPointer(&um.m))
+	expires, ok := m[strings.ToLower(email)]
+	return expires, ok
 }
 
 func (um *UserMap) LoadAuthenticatedEmailsFile() {
@@ -46,21 +62,48 @@ func (um *UserMap) LoadAuthenticatedEmailsFile() {
 	csv_reader.Comma = ','
 	csv_reader.Comment = '#'
 	csv_reader.TrimLeadingSpace = true
+	csv_reader.FieldsPerRecord = -1
 	records, err := csv_reader.ReadAll()
 	if err != nil {
 		log.Printf("error reading authenticated-emails-file=%q, %s", um.usersFile, err)
 		return
 	}
-	updated := make(map[string]bool)
+	updated := make(map[string]time.Time)
 	for _, r := range records {
 		address := strings.ToLower(strings.TrimSpace(r[0]))
-		updated[address] = true
+		expires, err := parseEmailExpiry(r[1:])
+		if err != nil {
+			// a typo mustn't lock out, or keep in, the other entries
+			log.Printf("error reading authenticated-emails-file=%q, skipping %s: %s", um.usersFile, address, err)
+			continue
+		}
+		updated[address] = expires
 	}
 	atomic.StorePointer(&um.m, unsafe.Pointer(&updated))
 }
 
+// parseEmailExpiry reads the expiry of an authenticated emails file entry
+// from its fields after the address, or the zero time when it doesn't expire
+func parseEmailExpiry(fields []string) (expires time.Time, err error) {
+	for _, field := range fields {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 || kv[0] != "expires" {
+			return expires, fmt.Errorf("unknown field %q", field)
+		}
+		if expires, err = time.Parse(time.RFC3339, kv[1]); err == nil {
+			continue
+		}
+		day, err := time.Parse("2006-01-02", kv[1])
+		if err != nil {
+			return expires, fmt.Errorf("invalid expires %q, expected a date or an RFC 3339 time", kv[1])
+		}
+		expires = day.AddDate(0, 0, 1)
+	}
+	return expires, nil
+}
+
 func newValidatorImpl(domains []string, usersFile string,
-	done <-chan bool, onUpdate func()) func(string) bool {
+	done <-chan bool, onUpdate func()) (func(string) bool, *UserMap) {
 	validUsers := NewUserMap(usersFile, done, onUpdate)
 
 	var allowAll bool
@@ -69,7 +112,7 @@ func newValidatorImpl(domains []string, usersFile string,
 			allowAll = true
 			continue
 		}
-		domains[i] = fmt.Sprintf("@%s", strings.ToLower(domain))
+		domains[i] = emailDomainSuffix(domain)
 	}
 
 	validator := func(email string) (valid bool) {
@@ -88,9 +131,27 @@ func newValidatorImpl(domains []string, usersFile string,
 		}
 		return valid
 	}
-	return validator
+	return validator, validUsers
+}
+
+// emailDomainSuffix is the suffix of the addresses of an email domain, which
+// matches any subdomain when given as "*.example.com", ie. "@eu.example.com"
+func emailDomainSuffix(domain string) string {
+	domain = strings.ToLower(domain)
+	if strings.HasPrefix(domain, "*.") {
+		return domain[1:]
+	}
+	return "@" + domain
 }
 
 func NewValidator(domains []string, usersFile string) func(string) bool {
+	validator, _ := newValidatorImpl(domains, usersFile, nil, func() {})
+	return validator
+}
+
+// NewValidatorWithUsers is NewValidator, also returning the users of
+// usersFile, ie. to tell whether an address was denied because its entry
+// expired
+func NewValidatorWithUsers(domains []string, usersFile string) (func(string) bool, *UserMap) {
 	return newValidatorImpl(domains, usersFile, nil, func() {})
 }
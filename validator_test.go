@@ -5,6 +5,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 type ValidatorTest struct {
@@ -31,13 +32,14 @@ func (vt *ValidatorTest) TearDown() {
 
 func (vt *ValidatorTest) NewValidator(domains []string,
 	updated chan<- bool) func(string) bool {
-	return newValidatorImpl(domains, vt.auth_email_file.Name(),
+	validator, _ := newValidatorImpl(domains, vt.auth_email_file.Name(),
 		vt.done, func() {
 			if vt.update_seen == false {
 				updated <- true
 				vt.update_seen = true
 			}
 		})
+	return validator
 }
 
 // This will close vt.auth_email_file.
@@ -97,6 +99,28 @@ func TestValidatorSingleDomain(t *testing.T) {
 	}
 }
 
+func TestValidatorWildcardDomain(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string(nil))
+	domains := []string{"*.example.com"}
+	validator := vt.NewValidator(domains, nil)
+
+	if !validator("foo.bar@eu.example.com") {
+		t.Error("email from a subdomain should validate")
+	}
+	if !validator("foo.bar@Dev.US.Example.com") {
+		t.Error("email from a nested subdomain should validate")
+	}
+	if validator("foo.bar@example.com") {
+		t.Error("email from the domain itself should not validate")
+	}
+	if validator("foo.bar@notexample.com") {
+		t.Error("email from a domain ending like the pattern should not validate")
+	}
+}
+
 func TestValidatorMultipleEmailsMultipleDomains(t *testing.T) {
 	vt := NewValidatorTest(t)
 	defer vt.TearDown()
@@ -160,3 +184,71 @@ func TestValidatorIgnoreSpacesInAuthEmails(t *testing.T) {
 		t.Error("email should validate")
 	}
 }
+
+func TestValidatorExpiringEmails(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string{
+		"permanent@example.com",
+		"expired@example.com,expires=2001-01-01",
+		"contractor@example.com, expires=2999-12-31",
+	})
+	domains := []string(nil)
+	validator := vt.NewValidator(domains, nil)
+
+	if !validator("permanent@example.com") {
+		t.Error("email without an expiry should validate")
+	}
+	if validator("expired@example.com") {
+		t.Error("expired email should not validate")
+	}
+	if !validator("contractor@example.com") {
+		t.Error("email should validate until it expires")
+	}
+}
+
+func TestValidatorSkipsInvalidEntries(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string{
+		"before@example.com",
+		"typo@example.com,expires=2999-13-01",
+		"group@example.com,group=admins",
+		"after@example.com, expires=2999-12-31",
+	})
+	domains := []string(nil)
+	validator := vt.NewValidator(domains, nil)
+
+	if !validator("before@example.com") || !validator("after@example.com") {
+		t.Error("valid entries around invalid ones should validate")
+	}
+	if validator("typo@example.com") || validator("group@example.com") {
+		t.Error("invalid entries should not validate")
+	}
+}
+
+func TestParseEmailExpiry(t *testing.T) {
+	expires, err := parseEmailExpiry(nil)
+	if err != nil || !expires.IsZero() {
+		t.Errorf("entry without fields should not expire, got %s, %v", expires, err)
+	}
+
+	// a date is valid through the end of that day
+	expires, err = parseEmailExpiry([]string{"expires=2024-12-31"})
+	if want := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC); err != nil || !expires.Equal(want) {
+		t.Errorf("expected %s, got %s, %v", want, expires, err)
+	}
+
+	expires, err = parseEmailExpiry([]string{" expires=2024-12-31T17:00:00-05:00"})
+	if want := time.Date(2024, 12, 31, 22, 0, 0, 0, time.UTC); err != nil || !expires.Equal(want) {
+		t.Errorf("expected %s, got %s, %v", want, expires, err)
+	}
+
+	for _, fields := range [][]string{{"expires=tomorrow"}, {"group=admins"}} {
+		if _, err := parseEmailExpiry(fields); err == nil {
+			t.Errorf("expected an error for %q", fields)
+		}
+	}
+}
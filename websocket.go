@@ -3,6 +3,7 @@ package main
 import (
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -38,7 +39,18 @@ func (u *UpstreamProxy) handleWebsocket(w http.ResponseWriter, r *http.Request)
 	for _, header := range HandshakeHeaders {
 		delete(upstreamHeader, header)
 	}
-	upstreamHeader.Set("Host", r.Host)
+	if u.hostHeader != "" {
+		upstreamHeader.Set("Host", u.hostHeader)
+	} else {
+		upstreamHeader.Set("Host", r.Host)
+	}
+	// Identify the client like the reverse proxy does for other requests
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior, ok := upstreamHeader["X-Forwarded-For"]; ok {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		upstreamHeader.Set("X-Forwarded-For", clientIP)
+	}
 
 	// Connect upstream
 	upstreamAddr := u.upstreamWSURL(*r.URL).String()
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"encoding/pem"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/bitly/oauth2_proxy/providers"
 	"github.com/bmizerany/assert"
+	"github.com/gorilla/websocket"
 )
 
 func TestCopyHeader(t *testing.T) {
@@ -45,3 +53,62 @@ func TestUpgrade(t *testing.T) {
 		assert.Equal(t, tt.upgrade, isWebsocketRequest(req))
 	}
 }
+
+func TestWebsocketTLSUpstream(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"v2.chat", "v1.chat"}}
+	var upgradeReq *http.Request
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgradeReq = r
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		messageType, message, err := conn.ReadMessage()
+		if err == nil {
+			conn.WriteMessage(messageType, message)
+		}
+	}))
+	defer upstream.Close()
+
+	ca, err := ioutil.TempFile("", "test_tls_ca_")
+	assert.Equal(t, nil, err)
+	defer os.Remove(ca.Name())
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+	ca.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.TLSCAFile = ca.Name()
+	opts.PassHostHeader = false
+	opts.CookieSecure = false
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	session := &providers.SessionState{Email: "user@example.com", User: "user"}
+	value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+	assert.Equal(t, nil, err)
+	req := httptest.NewRequest("GET", "/", nil)
+	cookie := proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now())
+
+	dialer := websocket.Dialer{Subprotocols: []string{"v1.chat", "v3.chat"}}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(frontend.URL, "http"), http.Header{
+		"Cookie": []string{cookie.String()},
+	})
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	assert.Equal(t, "v1.chat", conn.Subprotocol())
+	assert.Equal(t, upstream.Listener.Addr().String(), upgradeReq.Host)
+	assert.Equal(t, "user", upgradeReq.Header.Get("X-Forwarded-User"))
+	assert.Equal(t, "user@example.com", upgradeReq.Header.Get("X-Forwarded-Email"))
+	assert.Equal(t, "127.0.0.1", upgradeReq.Header.Get("X-Forwarded-For"))
+	assert.Equal(t, "v1.chat, v3.chat", upgradeReq.Header.Get("Sec-Websocket-Protocol"))
+	assert.Equal(t, "v1.chat", resp.Header.Get("Sec-Websocket-Protocol"))
+
+	assert.Equal(t, nil, conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+	_, message, err := conn.ReadMessage()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "hello", string(message))
+}